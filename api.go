@@ -1,12 +1,23 @@
 package vsh
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	iofs "io/fs"
+	"iter"
+	"log/slog"
 	"maps"
+	"math/rand/v2"
+	"net"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/wzshiming/vsh/fs"
 
@@ -19,8 +30,7 @@ import (
 //
 // Note that writes to Stdout and Stderr may be concurrent if background
 // commands are used. If you plan on using an [io.Writer] implementation that
-// isn't safe for concurrent use, consider a workaround like hiding writes
-// behind a mutex.
+// isn't safe for concurrent use, wrap it with [SafeWriter].
 //
 // Runner's exported fields are meant to be configured via [runnerOption];
 // once a Runner has been created, the fields should be treated as read-only.
@@ -30,7 +40,8 @@ type Runner struct {
 	//
 	// If it includes a TMPDIR variable describing an absolute directory,
 	// it is used as the directory in which to create temporary files needed
-	// for the interpreter's use, such as named pipes for process substitutions.
+	// for the interpreter's use, such as for process substitutions.
+	// See [WithTempDir].
 	Env expand.Environ
 
 	writeEnv expand.WriteEnviron
@@ -44,6 +55,11 @@ type Runner struct {
 	// It can only be set via [Params].
 	Params []string
 
+	// Vars and Funcs are the shell's variables and functions. Any which are
+	// set before the first call to Run or Reset are kept as part of the
+	// runner's initial state, so every Reset sets them again. After that,
+	// Vars reflects the variables set when the last Run returned, and
+	// changing it has no effect; use [WithVar] or a Reset instead.
 	Vars  map[string]expand.Variable
 	Funcs map[string]*syntax.Stmt
 
@@ -55,6 +71,14 @@ type Runner struct {
 
 	alias map[string]alias
 
+	// disabled holds the builtins and commands turned off via "enable -n".
+	disabled map[string]bool
+
+	// sharedMaps is true when Funcs, alias and disabled may also be used by
+	// another runner, such as a subshell, so they must be copied before
+	// they're modified; see [Runner.ownMaps].
+	sharedMaps bool
+
 	stdin  *os.File // e.g. the read end of a pipe
 	stdout io.Writer
 	stderr io.Writer
@@ -64,6 +88,10 @@ type Runner struct {
 
 	lastExpandExit int // used to surface exit codes while expanding fields
 
+	// noMatch is set when a pattern matched nothing with failglob set,
+	// so that the command using the fields isn't run; see [Runner.globFailed].
+	noMatch bool
+
 	// didReset remembers whether the runner has ever been reset. This is
 	// used so that Reset is automatically called when running any program
 	// or node for the first time on a Runner.
@@ -71,11 +99,16 @@ type Runner struct {
 
 	filename string // only if Node was a File
 
+	// argv0 is the value of $0 when not running a named file.
+	// It can only be set via [WithArgv0].
+	argv0 string
+
 	// >0 to break or continue out of N enclosing loops
 	breakEnclosing, contnEnclosing int
 
-	inLoop       bool
+	loopDepth    int // number of enclosing loops
 	inFunc       bool
+	funcDepth    int // number of nested function calls and sourced files being run
 	inSource     bool
 	handlingTrap bool // whether we're currently in a trap callback
 
@@ -101,6 +134,10 @@ type Runner struct {
 	exit     int
 	lastExit int
 
+	// lastArg is the last expanded argument of the previous simple command,
+	// exposed as $_.
+	lastArg string
+
 	// bgProcs holds all background shells spawned by this runner.
 	// Their PIDs are 1-indexed, from 1 to len(bgProcs), with a "g" prefix
 	// to distinguish them from real PIDs on the host operating system.
@@ -111,12 +148,116 @@ type Runner struct {
 
 	opts runnerOpts
 
-	origDir    string
-	origParams []string
-	origOpts   runnerOpts
-	origStdin  *os.File
-	origStdout io.Writer
-	origStderr io.Writer
+	// bashOpts holds the options set via "shopt", like in [bashOptsTable].
+	bashOpts [len(bashOptsTable)]bool
+
+	// extraOptsTable holds the shell options added via [WithShellOption],
+	// and extraOpts their values, which follow those in opts.
+	extraOptsTable []shellOpt
+	extraOpts      []bool
+
+	// maxFuncDepth limits how deeply function calls and sourced files can
+	// nest. It can only be set via [WithMaxFuncDepth].
+	maxFuncDepth int
+
+	// maxProcs limits how many subshells can run at once.
+	// It can only be set via [WithMaxProcs].
+	maxProcs int
+
+	// maxCommands limits how many commands can be run in total, and
+	// maxLoopIterations how many times each loop can go round.
+	// They can only be set via [WithMaxCommands] and [WithMaxLoopIterations].
+	maxCommands       int
+	maxLoopIterations int
+
+	// commandTimeout limits how long each command can run for.
+	// It can only be set via [WithCommandTimeout].
+	commandTimeout time.Duration
+
+	// panicHandler is told about panics in commands.
+	// It can only be set via [WithPanicHandler].
+	panicHandler func(name string, v any, stack []byte)
+
+	// preRun and postRun are called around each command.
+	// They can only be set via [WithPreRun] and [WithPostRun].
+	preRun  func(hc RunnerContext, args []string) error
+	postRun func(hc RunnerContext, args []string, exit int)
+
+	// presetVars are set by each Reset, in order, after the defaults.
+	// They can only be set via [WithVar] and similar options.
+	presetVars []presetVar
+
+	// fsAuditor is consulted before each change to the FileSystem.
+	// It can only be set via [WithFileSystemAuditor].
+	fsAuditor func(op, path string) error
+	// metrics receives metrics about commands and file operations.
+	// It can only be set via [WithMetrics].
+	metrics Recorder
+	// noPathLookup disables searching $PATH on the host for executables.
+	// It can only be set via [WithNoPathLookup].
+	noPathLookup bool
+	// network allows commands to make network requests.
+	// It can only be set via [WithNetwork].
+	network bool
+	// dialer makes the connections of commands, if network is set.
+	// It can only be set via [WithDialer].
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	// homeLookup finds the home directory of other users for "~user".
+	// It can only be set via [WithHomeLookup].
+	homeLookup func(user string) (string, bool)
+
+	// logger is the host's log sink. It can only be set via [WithLogger].
+	logger *slog.Logger
+	// debugLogger receives the interpreter's own diagnostics.
+	// It can only be set via [WithDebugLogger].
+	debugLogger *slog.Logger
+	// eventSink receives events for the host.
+	// It can only be set via [WithEventSink].
+	eventSink func(name string, fields map[string]string)
+
+	// rand is the source of randomness, shared with all subshells.
+	// It is set via [WithRandSource], and reseeded by assigning to RANDOM.
+	rand *rand.Rand
+
+	// regexps caches the regular expressions compiled for pattern matching,
+	// shared with all subshells.
+	regexps *regexpCache
+
+	// secondsStart is when SECONDS was last zero.
+	secondsStart time.Time
+	// lineNo is the line of the statement being run, for LINENO.
+	lineNo uint
+	// callStack holds the function calls being run, innermost last,
+	// for FUNCNAME and the caller builtin.
+	callStack []callFrame
+
+	// tempDir is the directory for temporary files, if set via [WithTempDir].
+	tempDir string
+	// procSubstFiles are the temporary files of the process substitutions
+	// in the statements being run.
+	procSubstFiles []procSubstFile
+
+	// clock and cronJobs are used by [Runner.StartCron].
+	// They can only be set via [WithClock] and [WithCron].
+	clock    Clock
+	cronJobs []*cronJob
+
+	// procs counts the running subshells, and is shared with all of them.
+	// It is nil if there is no limit.
+	procs *procLimit
+
+	// commands counts the commands run, and is shared with all subshells.
+	// It is nil if there is no limit.
+	commands *commandBudget
+
+	origDir       string
+	origParams    []string
+	origOpts      runnerOpts
+	origExtraOpts []bool
+	origStdin     *os.File
+	origStdout    io.Writer
+	origStderr    io.Writer
+	origFuncs     map[string]*syntax.Stmt
 
 	// Most scripts don't use pushd/popd, so make space for the initial PWD
 	// without requiring an extra allocation.
@@ -129,6 +270,14 @@ type Runner struct {
 	// apply to the current shell, and not just the command.
 	keepRedirs bool
 
+	// expandVars holds the values of the parameter expansions which the
+	// runner does itself; see [Runner.paramExps].
+	expandVars map[string]expand.Variable
+
+	// pendingLines holds the input given to [Runner.RunLine] so far
+	// which does not yet form complete statements.
+	pendingLines []byte
+
 	// Fake signal callbacks
 	callbackErr  string
 	callbackExit string
@@ -140,6 +289,15 @@ type bgProc struct {
 	done chan struct{}
 
 	exit *int
+
+	// node is what the process runs, as listed by "jobs".
+	node syntax.Node
+	// at is set for jobs scheduled via "at", as listed by "jobs".
+	at time.Time
+
+	// disowned is set via [RunnerContext.Disown], after which "wait" and
+	// "jobs" leave the process alone.
+	disowned bool
 }
 
 type alias struct {
@@ -148,9 +306,9 @@ type alias struct {
 }
 
 func (r *Runner) optByFlag(flag byte) *bool {
-	for i, opt := range &shellOptsTable {
+	for opt, status := range r.shellOpts() {
 		if opt.flag == flag {
-			return &r.opts[i]
+			return status
 		}
 	}
 	return nil
@@ -168,6 +326,12 @@ func NewRunner(opts ...runnerOption) (*Runner, error) {
 		Dir:        "/",
 		TTY:        true,
 		Commands:   map[string]func(RunnerContext, []string) error{},
+		stdout:     io.Discard,
+		stderr:     io.Discard,
+
+		maxFuncDepth: defaultMaxFuncDepth,
+		rand:         newLockedRand(rand.NewPCG(uint64(time.Now().UnixNano()), rand.Uint64())),
+		regexps:      &regexpCache{},
 	}
 	r.dirStack = r.dirBootstrap[:0]
 
@@ -176,6 +340,13 @@ func NewRunner(opts ...runnerOption) (*Runner, error) {
 			return nil, err
 		}
 	}
+	// Wrap the filesystem last, so that it doesn't matter which option set it.
+	if r.fsAuditor != nil {
+		r.FileSystem = fs.NewAuditFS(r.FileSystem, r.fsAuditor)
+	}
+	if r.metrics != nil {
+		r.FileSystem = &metricsFS{FileSystem: r.FileSystem, rec: r.metrics}
+	}
 	return r, nil
 }
 
@@ -194,6 +365,285 @@ func WithCommand(name string, fn func(RunnerContext, []string) error) runnerOpti
 	}
 }
 
+// defaultMaxFuncDepth is the default limit for [WithMaxFuncDepth],
+// matching the default FUNCNEST of other shells.
+const defaultMaxFuncDepth = 1000
+
+// ErrRecursionLimit is the fatal error returned when function calls and
+// sourced files nest more deeply than allowed by [WithMaxFuncDepth].
+var ErrRecursionLimit = errors.New("maximum function nesting level exceeded")
+
+// WithMaxFuncDepth limits how deeply shell function calls and "source" or "."
+// builtins can nest, counted together, so that runaway recursion like
+// "f() { f; }; f" or a script sourcing itself stops with [ErrRecursionLimit]
+// instead of exhausting the Go stack. The default is 1000; zero or less
+// removes the limit.
+func WithMaxFuncDepth(n int) runnerOption {
+	return func(r *Runner) error {
+		r.maxFuncDepth = n
+		return nil
+	}
+}
+
+// WithMaxRecursionDepth is an alias for [WithMaxFuncDepth].
+func WithMaxRecursionDepth(n int) runnerOption {
+	return WithMaxFuncDepth(n)
+}
+
+// ErrMaxProcs is the fatal error returned when a script tries to run more
+// subshells at once than allowed by [WithMaxProcs].
+var ErrMaxProcs = errors.New("maximum number of processes exceeded")
+
+// WithMaxProcs limits how many subshells can run at once, counting background
+// commands, pipeline stages, "( ... )" subshells and command substitutions.
+// Going over the limit is a fatal error which stops the shell along with all
+// of its subshells, so that a fork bomb like ":(){ :|:& };:" is contained
+// instead of exhausting memory. The default, zero or less, means no limit.
+//
+// Only the call to [Runner.Run] which went over the limit fails; the next one
+// starts afresh, so that an interactive shell can carry on.
+func WithMaxProcs(n int) runnerOption {
+	return func(r *Runner) error {
+		r.maxProcs = n
+		return nil
+	}
+}
+
+// ErrCommandBudgetExceeded is the fatal error returned when a script tries to
+// run more commands than allowed by [WithMaxCommands].
+var ErrCommandBudgetExceeded = errors.New("maximum number of commands exceeded")
+
+// WithMaxCommands limits how many simple commands a script can run in total,
+// counting those run by functions and subshells. Going over the limit is a
+// fatal error which stops the shell along with all of its subshells. Unlike
+// [WithCommandTimeout], it stops a runaway script like "while true; do true;
+// done" regardless of how fast the host is. The count starts again with each
+// [Runner.Reset]. The default, zero or less, means no limit.
+func WithMaxCommands(n int) runnerOption {
+	return func(r *Runner) error {
+		r.maxCommands = n
+		return nil
+	}
+}
+
+// ErrMaxLoopIterations is the fatal error returned when a loop goes round more
+// times than allowed by [WithMaxLoopIterations].
+var ErrMaxLoopIterations = errors.New("maximum number of loop iterations exceeded")
+
+// WithMaxLoopIterations limits how many times each while, until or for loop
+// can go round, which also catches loops which don't run any commands, such
+// as "while ((1)); do ((i++)); done". Going over the limit is a fatal error.
+// The default, zero or less, means no limit.
+func WithMaxLoopIterations(n int) runnerOption {
+	return func(r *Runner) error {
+		r.maxLoopIterations = n
+		return nil
+	}
+}
+
+// ErrCommandTimeout is the cause of the cancellation of a command's context
+// once the time allowed by [WithCommandTimeout] is up. It is also the error
+// from [Runner.Run] when the last command timed out.
+var ErrCommandTimeout = fmt.Errorf("command timed out: %w", context.DeadlineExceeded)
+
+// WithCommandTimeout limits how long each builtin or command set via
+// [WithCommand] can run for, so that a single runaway command cannot hold up
+// a server. Every command, including those in the background, gets its own
+// context which is cancelled once d has passed, with [ErrCommandTimeout] as
+// its cause. Commands which stop then have an exit status of 124, like with
+// the timeout program; those which ignore their context keep running.
+// The default, zero or less, means no limit.
+func WithCommandTimeout(d time.Duration) runnerOption {
+	return func(r *Runner) error {
+		r.commandTimeout = d
+		return nil
+	}
+}
+
+// WithPanicHandler sets a function to be told about panics in builtins and
+// in commands set via [WithCommand], such as to log them. Either way, such a
+// panic does not take down the host: it is printed to standard error, and the
+// command fails with an exit status of 2. The handler is given the command's
+// name, the value passed to panic, and the stack trace of the panic.
+func WithPanicHandler(fn func(name string, v any, stack []byte)) runnerOption {
+	return func(r *Runner) error {
+		r.panicHandler = fn
+		return nil
+	}
+}
+
+// WithFileSystemAuditor sets a function to be called before each change the
+// runner or its commands make to the FileSystem, with the operation and the
+// absolute path it is on; see [fs.NewAuditFS] for the operations. If it
+// returns an error, the change is not made, and the command trying to make it
+// fails. This can be used to preview what a script would do, or to only allow
+// writes to some paths.
+func WithFileSystemAuditor(fn func(op, path string) error) runnerOption {
+	return func(r *Runner) error {
+		r.fsAuditor = fn
+		return nil
+	}
+}
+
+// WithMetrics sets a [Recorder] to be told about each command the runner
+// runs and each operation on its FileSystem, such as to export metrics about
+// the scripts run by a service.
+func WithMetrics(rec Recorder) runnerOption {
+	return func(r *Runner) error {
+		r.metrics = rec
+		return nil
+	}
+}
+
+// WithPreRun sets a function to be called before each simple command is run,
+// be it a function, a builtin, or a command set via [WithCommand], with the
+// command's arguments after expansion, including its name. If it returns an
+// error, the command isn't run, and the error is handled like one returned by
+// a command set via [WithCommand]. This can be used to log, limit or approve
+// the commands run by a script.
+func WithPreRun(fn func(hc RunnerContext, args []string) error) runnerOption {
+	return func(r *Runner) error {
+		r.preRun = fn
+		return nil
+	}
+}
+
+// WithPostRun sets a function to be called after each simple command is run,
+// like with [WithPreRun], with the command's exit status.
+func WithPostRun(fn func(hc RunnerContext, args []string, exit int)) runnerOption {
+	return func(r *Runner) error {
+		r.postRun = fn
+		return nil
+	}
+}
+
+// WithNoPathLookup stops the interpreter from searching the host's $PATH for
+// executables, such as in "type", "command -v" or "source". Names which are
+// not functions, builtins nor in the command table are then not found, without
+// touching the host filesystem. This suits sandboxes with no real executables.
+func WithNoPathLookup() runnerOption {
+	return func(r *Runner) error {
+		r.noPathLookup = true
+		return nil
+	}
+}
+
+// ErrNetworkDisabled is the error for the connections of commands when the
+// runner doesn't allow them, as set via [WithNetwork].
+var ErrNetworkDisabled = errors.New("network access is disabled")
+
+// WithNetwork sets whether commands may make network requests, such as
+// fetching URLs, as reported to them via [RunnerContext.Network]. It is off by
+// default, so that sandboxed scripts cannot reach the network.
+//
+// Commands make their connections with [RunnerContext.Dial], which fails with
+// [ErrNetworkDisabled] unless the network is allowed. Once it is, connections
+// go through the dialer set via [WithDialer], which can restrict them further,
+// or else straight to the host's network. Note that this only holds for the
+// commands which use Dial, such as those in the builtin package; a command
+// registered via [WithCommand] is Go code which can do anything, and programs
+// run from the host are not sandboxed at all.
+func WithNetwork(enabled bool) runnerOption {
+	return func(r *Runner) error {
+		r.network = enabled
+		return nil
+	}
+}
+
+// WithDialer sets how commands connect to the network once it is allowed via
+// [WithNetwork], such as via a proxy for each tenant, or only to the addresses
+// in an allow-list. dial is called like [net.Dialer.DialContext], possibly
+// concurrently by background commands, and its errors are those of the
+// commands' connections. By default, a plain [net.Dialer] is used.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) runnerOption {
+	return func(r *Runner) error {
+		r.dialer = dial
+		return nil
+	}
+}
+
+// WithHomeLookup sets how "~user" finds the home directory of a user other
+// than the current one, whose home directory is always $HOME. Since the
+// interpreter has no user database of its own, "~user" is left as is unless
+// fn reports the user as found.
+func WithHomeLookup(fn func(user string) (home string, ok bool)) runnerOption {
+	return func(r *Runner) error {
+		r.homeLookup = fn
+		return nil
+	}
+}
+
+// WithLogger sets a log sink for commands to send messages to the host,
+// such as a logger command, via [RunnerContext.Logger].
+func WithLogger(l *slog.Logger) runnerOption {
+	return func(r *Runner) error {
+		r.logger = l
+		return nil
+	}
+}
+
+// WithDebugLogger sets a logger for the interpreter's own diagnostics, such
+// as which commands are run and how, redirections, subshells, and background
+// jobs, to help find out why a script misbehaves without "set -x". They are
+// logged at [slog.LevelDebug], and only prepared when the logger is enabled at
+// that level.
+//
+// Unlike [WithLogger], which is for messages from the script, nothing is
+// logged by default.
+func WithDebugLogger(l *slog.Logger) runnerOption {
+	return func(r *Runner) error {
+		r.debugLogger = l
+		return nil
+	}
+}
+
+// debugging reports whether diagnostics go to the logger set via
+// [WithDebugLogger], so that callers can skip preparing them otherwise.
+func (r *Runner) debugging(ctx context.Context) bool {
+	return r.debugLogger != nil && r.debugLogger.Enabled(ctx, slog.LevelDebug)
+}
+
+// WithRandSource sets the source of randomness, so that runs can be made
+// reproducible in tests. It is used for $RANDOM and for the names of temporary
+// files, and is available to commands via [RunnerContext.Rand], such as for
+// the names made by a mktemp command. The default source is seeded with the
+// current time. The source is only used by one goroutine at a time.
+func WithRandSource(src rand.Source) runnerOption {
+	return func(r *Runner) error {
+		r.rand = newLockedRand(src)
+		return nil
+	}
+}
+
+// newLockedRand returns a [rand.Rand] which is safe for concurrent use,
+// as background commands may use it at the same time.
+func newLockedRand(src rand.Source) *rand.Rand {
+	return rand.New(&lockedSource{src: src})
+}
+
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+// WithEventSink sets a function to receive structured events sent by scripts
+// to the host, such as via an emit command, to report progress or to trigger
+// actions in the embedding application. It is available to commands via
+// [RunnerContext.EventSink]. fn may be called concurrently by background
+// commands.
+func WithEventSink(fn func(name string, fields map[string]string)) runnerOption {
+	return func(r *Runner) error {
+		r.eventSink = fn
+		return nil
+	}
+}
+
 // WithEnv sets the interpreter's environment.
 func WithEnv(env expand.Environ) runnerOption {
 	return func(r *Runner) error {
@@ -202,13 +652,70 @@ func WithEnv(env expand.Environ) runnerOption {
 	}
 }
 
+// presetVar is a variable set via [WithVar] or similar options.
+type presetVar struct {
+	name string
+	vr   expand.Variable
+}
+
+// WithVar sets a shell variable, which is not exported to the environment
+// of the commands run. Unlike those set in the environment given via
+// [WithEnv], the variable is set again by every [Runner.Reset], as the
+// shell's variables are cleared then; so it's set when a script starts to
+// run, even if it was changed by a previous script.
+func WithVar(name, value string) runnerOption {
+	return withVar(name, value, false)
+}
+
+// WithExportedVar is like [WithVar], but the variable is exported to the
+// environment of the commands run, as if with "export".
+func WithExportedVar(name, value string) runnerOption {
+	return withVar(name, value, true)
+}
+
+// WithVars sets a number of shell variables, like [WithVar] does, in the
+// order of their names.
+func WithVars(vars map[string]string) runnerOption {
+	return func(r *Runner) error {
+		for _, name := range slices.Sorted(maps.Keys(vars)) {
+			if err := withVar(name, vars[name], false)(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func withVar(name, value string, exported bool) runnerOption {
+	return func(r *Runner) error {
+		if !syntax.ValidName(name) {
+			return fmt.Errorf("invalid variable name: %q", name)
+		}
+		r.presetVars = append(r.presetVars, presetVar{name: name, vr: expand.Variable{
+			Set:      true,
+			Kind:     expand.String,
+			Exported: exported,
+			Str:      value,
+		}})
+		return nil
+	}
+}
+
 // WithDir sets the interpreter's working directory.
+//
+// A leading "~" and any $VAR or ${VAR} references in path are expanded with
+// the environment given via [WithEnv], which must come first. Referencing an
+// unset variable is an error rather than expanding to an empty string.
 func WithDir(f fs.FileSystem, path string) runnerOption {
 	return func(r *Runner) error {
 		if path == "" {
 			return nil
 		}
-		path := r.absPath(path)
+		path, err := r.expandOptPath(path)
+		if err != nil {
+			return err
+		}
+		path = r.absPath(path)
 		r.FileSystem = f
 
 		info, err := iofs.Stat(r.FileSystem, path)
@@ -223,6 +730,81 @@ func WithDir(f fs.FileSystem, path string) runnerOption {
 	}
 }
 
+// expandOptPath expands a leading "~" and any variable references in a path
+// given to an option, using the environment set via [WithEnv].
+func (r *Runner) expandOptPath(path string) (string, error) {
+	lookup := func(name string) (string, bool) {
+		if r.Env == nil {
+			return "", false
+		}
+		vr := r.Env.Get(name)
+		return vr.String(), vr.IsSet()
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, ok := lookup("HOME")
+		if !ok {
+			home = "/" // the default set by Reset
+		}
+		path = home + path[1:]
+	}
+	var err error
+	path = os.Expand(path, func(name string) string {
+		val, ok := lookup(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("%s: unbound variable", name)
+		}
+		return val
+	})
+	return path, err
+}
+
+// WithShellOption adds a boolean shell option, which is unset at first.
+// Scripts can then use it like the built-in options, such as via
+// "set -o name" or "[[ -o name ]]", and commands can check it via
+// [RunnerContext.ShellOption]. If flag is not zero nor a space, the option
+// can also be set via "set -flag".
+func WithShellOption(name string, flag byte) runnerOption {
+	return func(r *Runner) error {
+		if !syntax.ValidName(name) {
+			return fmt.Errorf("invalid option name: %q", name)
+		}
+		if _, status := r.optByName(name); status != nil {
+			return fmt.Errorf("option %q already exists", name)
+		}
+		switch {
+		case flag == 0 || flag == ' ':
+			flag = ' '
+		case !('a' <= flag && flag <= 'z' || 'A' <= flag && flag <= 'Z'):
+			return fmt.Errorf("invalid option flag: %q", flag)
+		case r.optByFlag(flag) != nil:
+			return fmt.Errorf("option flag %q already exists", flag)
+		}
+		r.extraOptsTable = append(r.extraOptsTable, shellOpt{flag: flag, name: name})
+		r.extraOpts = append(r.extraOpts, false)
+		return nil
+	}
+}
+
+// WithNoClobber sets the "noclobber" shell option, like "set -C", so that
+// the ">" redirection refuses to overwrite existing files. The ">|"
+// redirection can still be used to overwrite them.
+func WithNoClobber() runnerOption {
+	return func(r *Runner) error {
+		r.opts[optNoClobber] = true
+		return nil
+	}
+}
+
+// WithArgv0 sets the value of $0 when running anything other than a
+// [syntax.File] with a name, such as a command string given to a "-c" flag.
+// When running a named file, $0 is always its name. The default is "sh".
+func WithArgv0(name string) runnerOption {
+	return func(r *Runner) error {
+		r.argv0 = name
+		return nil
+	}
+}
+
 // WithParams populates the shell options and parameters. For example, WithParams("-e",
 // "--", "foo") will set the "-e" option and the parameters ["foo"], and
 // WithParams("+e") will unset the "-e" option and leave the parameters untouched.
@@ -251,26 +833,35 @@ func WithParams(args ...string) runnerOption {
 			}
 			value := fp.value()
 			if value == "" && enable {
-				for i, opt := range &shellOptsTable {
-					r.printOptLine(opt.name, r.opts[i], true)
+				for opt, status := range r.shellOpts() {
+					r.printOptLine(opt.name, *status, true)
 				}
 				continue
 			}
 			if value == "" && !enable {
-				for i, opt := range &shellOptsTable {
+				for opt, status := range r.shellOpts() {
 					setFlag := "+o"
-					if r.opts[i] {
+					if *status {
 						setFlag = "-o"
 					}
 					r.outf("set %s %s\n", setFlag, opt.name)
 				}
 				continue
 			}
-			_, opt := r.optByName(value)
+			i, opt := r.optByName(value)
 			if opt == nil {
 				return fmt.Errorf("invalid option: %q", value)
 			}
 			*opt = enable
+			// The line editing modes are only recorded, as the
+			// interpreter does no line editing itself. Like in
+			// bash, turning one on turns the other off.
+			switch {
+			case i == optEmacs && enable:
+				r.opts[optVi] = false
+			case i == optVi && enable:
+				r.opts[optEmacs] = false
+			}
 		}
 		if args := fp.args(); args != nil {
 			// If "--" wasn't given and there were zero arguments,
@@ -318,6 +909,10 @@ func stdinFile(r io.Reader) (*os.File, error) {
 // When providing an [*os.File] as standard input, consider using an [os.Pipe]
 // as it has the best chance to support cancellable reads via [os.File.SetReadDeadline],
 // so that cancelling the runner's context can stop a blocked standard input read.
+//
+// Background commands may write to out and err concurrently. Unless they are
+// safe for concurrent use, such as an [*os.File], wrap them with [SafeWriter],
+// which also keeps the lines of background commands from being torn apart.
 func WithStdIO(in io.Reader, out, err io.Writer) runnerOption {
 	return func(r *Runner) error {
 		stdin, _err := stdinFile(in)
@@ -337,6 +932,110 @@ func WithStdIO(in io.Reader, out, err io.Writer) runnerOption {
 	}
 }
 
+// WithMergedOutput sends both standard output and standard error to w, like
+// running every script with "2>&1", keeping standard input as it is. The
+// writes to w go through [SafeWriter].
+//
+// The writes of each command keep their order, and those of a foreground
+// command come before those of the commands after it. The output of
+// concurrent background commands may interleave, but only line by line.
+// Redirections in scripts still apply, so "cmd 2>errors.log" keeps the
+// errors apart.
+func WithMergedOutput(w io.Writer) runnerOption {
+	return func(r *Runner) error {
+		if w == nil {
+			w = io.Discard
+		}
+		out := SafeWriter(w)
+		r.stdout = out
+		r.stderr = out
+		return nil
+	}
+}
+
+// SafeWriter returns a writer which passes writes on to w one at a time, so
+// that it can be used concurrently as standard output or error even if w
+// isn't safe for concurrent use, as when a script runs background commands.
+//
+// When a runner's standard output or error is a SafeWriter, the output of
+// each background command is also line-buffered, so that lines from
+// commands running at the same time never get torn apart. A background
+// command's last line is written once it is done, even without a newline.
+func SafeWriter(w io.Writer) io.Writer {
+	if sw, ok := w.(*safeWriter); ok {
+		return sw
+	}
+	return &safeWriter{w: w}
+}
+
+type safeWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *safeWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// maxLineBuffer is how much of a line a [lineWriter] holds on to at most,
+// so that output without newlines doesn't pile up.
+const maxLineBuffer = 64 << 10
+
+// lineWriter line-buffers the output of a background command which goes to a
+// [SafeWriter]. Like the latter, it can be written to concurrently, as by the
+// stages of a pipeline.
+type lineWriter struct {
+	mu  sync.Mutex
+	w   *safeWriter
+	buf []byte
+}
+
+// backgroundWriter returns the writer to use for w in a background command,
+// along with a func to flush it once the command is done.
+func backgroundWriter(w io.Writer) (io.Writer, func()) {
+	var sw *safeWriter
+	switch w := w.(type) {
+	case *safeWriter:
+		sw = w
+	case *lineWriter:
+		sw = w.w // a nested background command gets its own lines
+	default:
+		return w, func() {}
+	}
+	lw := &lineWriter{w: sw}
+	return lw, lw.flush
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if len(w.buf) > maxLineBuffer {
+		i = len(w.buf) - 1
+	}
+	if i < 0 {
+		return len(p), nil
+	}
+	_, err := w.w.Write(w.buf[:i+1])
+	w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.w.Write(w.buf)
+		w.buf = w.buf[:0]
+	}
+}
+
 // optByName returns the matching runner's option index and status
 func (r *Runner) optByName(name string) (index int, status *bool) {
 	for i, opt := range &shellOptsTable {
@@ -344,9 +1043,41 @@ func (r *Runner) optByName(name string) (index int, status *bool) {
 			return i, &r.opts[i]
 		}
 	}
+	for i, opt := range r.extraOptsTable {
+		if opt.name == name {
+			return len(shellOptsTable) + i, &r.extraOpts[i]
+		}
+	}
 	return 0, nil
 }
 
+// shellOpts iterates over the shell options, including those added via
+// [WithShellOption], along with their current status.
+func (r *Runner) shellOpts() iter.Seq2[shellOpt, *bool] {
+	return func(yield func(shellOpt, *bool) bool) {
+		for i, opt := range &shellOptsTable {
+			if !yield(opt, &r.opts[i]) {
+				return
+			}
+		}
+		for i, opt := range r.extraOptsTable {
+			if !yield(opt, &r.extraOpts[i]) {
+				return
+			}
+		}
+	}
+}
+
+// shellOption reports whether the shell option with the given name is set,
+// including those set via "shopt".
+func (r *Runner) shellOption(name string) bool {
+	if i := bashOptIndex(name); i >= 0 {
+		return r.bashOpts[i]
+	}
+	_, status := r.optByName(name)
+	return status != nil && *status
+}
+
 type runnerOpts [len(shellOptsTable)]bool
 
 type shellOpt struct {
@@ -359,11 +1090,39 @@ var shellOptsTable = [...]shellOpt{
 	// that have no flag form
 	{'a', "allexport"},
 	{'e', "errexit"},
+	{'C', "noclobber"},
 	{'n', "noexec"},
 	{'f', "noglob"},
 	{'u', "nounset"},
 	{'x', "xtrace"},
+	{' ', "emacs"},
 	{' ', "pipefail"},
+	{' ', "vi"},
+}
+
+// bashOpt is an option set via "shopt", which bash keeps apart from the
+// options of "set -o".
+type bashOpt struct {
+	name string
+	// supported is false for the options which can't be turned on,
+	// but which are known so that scripts can check them.
+	supported bool
+}
+
+var bashOptsTable = [...]bashOpt{
+	// sorted alphabetically by name
+	{"dotglob", false},
+	{"extglob", true},
+	{"failglob", true},
+	{"globstar", true},
+	{"nocaseglob", true},
+	{"nullglob", true},
+}
+
+// bashOptIndex returns the index of the "shopt" option with the given name
+// in [bashOptsTable], or -1 if there's no such option.
+func bashOptIndex(name string) int {
+	return slices.IndexFunc(bashOptsTable[:], func(opt bashOpt) bool { return opt.name == name })
 }
 
 // To access the shell options arrays without a linear search when we
@@ -372,15 +1131,31 @@ const (
 	// These correspond to indexes in [shellOptsTable]
 	optAllExport = iota
 	optErrExit
+	optNoClobber
 	optNoExec
 	optNoGlob
 	optNoUnset
 	optXTrace
+	optEmacs
 	optPipeFail
+	optVi
+)
+
+const (
+	// These correspond to indexes in [bashOptsTable]
+	optDotGlob = iota
+	optExtGlob
+	optFailGlob
+	optGlobStar
+	optNoCaseGlob
+	optNullGlob
 )
 
 // Reset returns a runner to its initial state, right before the first call to
-// Run or Reset.
+// Run or Reset. That state includes the variables set via options like
+// [WithVar], and those in Vars and Funcs at the time of the first call, which
+// Run makes on its own if needed; the rest of the shell's variables and
+// functions are dropped.
 //
 // Typically, this function only needs to be called if a runner is reused to run
 // multiple programs non-incrementally. Not calling Reset between each run will
@@ -391,9 +1166,14 @@ func (r *Runner) Reset() {
 		r.origDir = r.Dir
 		r.origParams = r.Params
 		r.origOpts = r.opts
+		r.origExtraOpts = slices.Clone(r.extraOpts)
 		r.origStdin = r.stdin
 		r.origStdout = r.stdout
 		r.origStderr = r.stderr
+		for _, name := range slices.Sorted(maps.Keys(r.Vars)) {
+			r.presetVars = append(r.presetVars, presetVar{name: name, vr: r.Vars[name]})
+		}
+		r.origFuncs = maps.Clone(r.Funcs)
 	}
 	// reset the internal state
 	*r = Runner{
@@ -409,12 +1189,20 @@ func (r *Runner) Reset() {
 		stdout: r.origStdout,
 		stderr: r.origStderr,
 
-		origDir:    r.origDir,
-		origParams: r.origParams,
-		origOpts:   r.origOpts,
-		origStdin:  r.origStdin,
-		origStdout: r.origStdout,
-		origStderr: r.origStderr,
+		extraOptsTable: r.extraOptsTable,
+		extraOpts:      slices.Clone(r.origExtraOpts),
+
+		origDir:       r.origDir,
+		origParams:    r.origParams,
+		origOpts:      r.origOpts,
+		origExtraOpts: r.origExtraOpts,
+		origStdin:     r.origStdin,
+		origStdout:    r.origStdout,
+		origStderr:    r.origStderr,
+		origFuncs:     r.origFuncs,
+
+		// Funcs are copied, since they might be modified.
+		Funcs: maps.Clone(r.origFuncs),
 
 		// emptied below, to reuse the space
 		Vars: r.Vars,
@@ -424,6 +1212,37 @@ func (r *Runner) Reset() {
 		TTY:        r.TTY,
 		FileSystem: r.FileSystem,
 		Commands:   r.Commands,
+
+		maxFuncDepth:      r.maxFuncDepth,
+		maxProcs:          r.maxProcs,
+		maxCommands:       r.maxCommands,
+		maxLoopIterations: r.maxLoopIterations,
+		commandTimeout:    r.commandTimeout,
+		panicHandler:      r.panicHandler,
+		preRun:            r.preRun,
+		postRun:           r.postRun,
+		presetVars:        r.presetVars,
+		noPathLookup:      r.noPathLookup,
+		network:           r.network,
+		dialer:            r.dialer,
+		homeLookup:        r.homeLookup,
+		argv0:             r.argv0,
+		logger:            r.logger,
+		debugLogger:       r.debugLogger,
+		rand:              r.rand,
+		regexps:           r.regexps,
+		eventSink:         r.eventSink,
+		metrics:           r.metrics,
+		tempDir:           r.tempDir,
+		clock:             r.clock,
+		cronJobs:          r.cronJobs,
+	}
+	r.secondsStart = r.getClock().Now()
+	if r.maxProcs > 0 {
+		r.procs = &procLimit{max: int64(r.maxProcs)}
+	}
+	if r.maxCommands > 0 {
+		r.commands = &commandBudget{max: int64(r.maxCommands)}
 	}
 	// Ensure we stop referencing any pointers before we reuse bgProcs.
 	clear(r.bgProcs)
@@ -463,9 +1282,20 @@ func (r *Runner) Reset() {
 			Str:      "0",
 		})
 	}
+	if r.tempDir != "" {
+		r.setVar("TMPDIR", expand.Variable{
+			Set:      true,
+			Kind:     expand.String,
+			Exported: true,
+			Str:      r.tempDir,
+		})
+	}
 	r.setVarString("PWD", r.Dir)
 	r.setVarString("IFS", " \t\n")
 	r.setVarString("OPTIND", "1")
+	for _, pv := range r.presetVars {
+		r.setVar(pv.name, pv.vr)
+	}
 
 	r.dirStack = append(r.dirStack, r.Dir)
 
@@ -496,9 +1326,14 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 	r.returning = false
 	r.exiting = false
 	r.filename = ""
+	if r.procs != nil {
+		// Going over the limit only stops the call which did.
+		r.procs.exceeded.Store(false)
+	}
 	switch node := node.(type) {
 	case *syntax.File:
 		r.filename = node.Name
+		r.lastArg = node.Name
 		r.stmts(ctx, node.Stmts)
 		if !r.exiting {
 			r.exitShell(ctx, r.exit)
@@ -510,6 +1345,11 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 	default:
 		return fmt.Errorf("node can only be File, Stmt, or Command: %T", node)
 	}
+	if r.fatalErr == nil && r.procs != nil && r.procs.exceeded.Load() {
+		// Hit by a background subshell after the shell's last check.
+		r.fatalErr = ErrMaxProcs
+		r.exit = 1
+	}
 	maps.Insert(r.Vars, r.writeEnv.Each)
 	// Return the first of: a fatal error, a non-fatal handler error, or the exit code.
 	if r.fatalErr != nil {
@@ -524,6 +1364,122 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 	return nil
 }
 
+// RunString parses src as a shell program and runs it, like [Runner.RunReader].
+func (r *Runner) RunString(ctx context.Context, src string) error {
+	return r.RunReader(ctx, strings.NewReader(src), "")
+}
+
+// RunReader parses the shell program read from src and runs it, as a [syntax.File]
+// with the given name; see [Runner.Run]. If the program cannot be parsed, the
+// parse error is returned, and nothing is run.
+//
+// Like Run, it only resets the runner on its first call, so the state of the
+// shell carries over from one call to the next. To run each program afresh,
+// call [Runner.Reset] before it.
+func (r *Runner) RunReader(ctx context.Context, src io.Reader, name string) error {
+	file, err := syntax.NewParser().Parse(src, name)
+	if err != nil {
+		return err
+	}
+	return r.Run(ctx, file)
+}
+
+// RunLine adds a line of input to any incomplete input given in previous calls,
+// and runs it once it forms complete statements. If more input is needed, such
+// as when a quote or an if statement is left open, nothing is run and complete
+// is false, much like [syntax.Parser.Incomplete].
+//
+// Like [Runner.Run], the state of the shell carries over from one call to the
+// next, which is what a REPL needs. The exit status of the statements is
+// returned via err as usual. If the input cannot be parsed, the parse error is
+// returned with complete set to true, and the input is discarded.
+//
+// Each statement is run on its own, as with an interactive shell, so the EXIT
+// trap only runs once the shell exits, such as via the exit builtin; check
+// [Runner.Exited] after each call. The rest of the line is not run after the
+// shell exits or a fatal error.
+//
+// Calling [Runner.Reset] discards any incomplete input.
+func (r *Runner) RunLine(ctx context.Context, line string) (complete bool, err error) {
+	r.pendingLines = append(r.pendingLines, line...)
+	if !strings.HasSuffix(line, "\n") {
+		r.pendingLines = append(r.pendingLines, '\n')
+	}
+	parser := syntax.NewParser()
+	var stmts []*syntax.Stmt
+	incomplete := false
+	err = parser.Interactive(bytes.NewReader(r.pendingLines), func(more []*syntax.Stmt) bool {
+		incomplete = parser.Incomplete()
+		if !incomplete {
+			stmts = append(stmts, more...)
+		}
+		return true
+	})
+	if incomplete || syntax.IsIncomplete(err) {
+		return false, nil
+	}
+	r.pendingLines = r.pendingLines[:0]
+	if err != nil {
+		return true, err
+	}
+	for _, stmt := range stmts {
+		err = r.Run(ctx, stmt)
+		if r.Exited() || r.FatalErr() != nil {
+			break
+		}
+	}
+	return true, err
+}
+
+// ParseAndRun parses src as a shell program and runs it on a new [Runner]
+// built with opts, returning its standard output and exit status. It is a
+// shortcut for embedders which only need to run a snippet of code.
+//
+// Standard output is always captured, replacing any writer set via
+// [WithStdIO]. A non-zero exit status is not an error; err is only set if
+// src cannot be parsed, in which case the exit status is 2 like in other
+// shells, or if building the runner or running the program fails fatally.
+func ParseAndRun(ctx context.Context, src string, opts ...runnerOption) (stdout string, exit int, err error) {
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		return "", 2, err
+	}
+	r, err := NewRunner(opts...)
+	if err != nil {
+		return "", 1, err
+	}
+	var out syncBuffer
+	r.stdout = &out
+	err = r.Run(ctx, file)
+	var status ExitStatus
+	if errors.As(err, &status) {
+		return out.String(), int(status), nil
+	}
+	if err != nil {
+		return out.String(), max(r.exit, 1), err
+	}
+	return out.String(), 0, nil
+}
+
+// syncBuffer is a [bytes.Buffer] which can be written to concurrently,
+// such as by background commands.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 // Exited reports whether the last Run call should exit an entire shell. This
 // can be triggered by the "exit" built-in command, for example.
 //
@@ -533,6 +1489,16 @@ func (r *Runner) Exited() bool {
 	return r.exiting
 }
 
+// ExitCode returns the exit status of the last Run call, as seen by the
+// script via "$?"; it is zero on success. Unlike the error returned by Run,
+// which may be a fatal error or that from a handler, it's always a number.
+//
+// Like with [Runner.Exited], this state is overwritten at every Run call, so
+// it's only meaningful immediately after Run returns.
+func (r *Runner) ExitCode() int {
+	return r.exit
+}
+
 func (r *Runner) FatalErr() error {
 	return r.fatalErr
 }
@@ -548,7 +1514,10 @@ func (r *Runner) FatalErr() error {
 // To replace e.g. stdin/out/err, do [WithStdIO](r.stdin, r.stdout, r.stderr)(r) on
 // the copy.
 func (r *Runner) Subshell() *Runner {
-	return r.subshell(true)
+	r2 := r.subshell(true)
+	// The caller may modify Funcs directly.
+	r2.ownMaps()
+	return r2
 }
 
 // subshell is like [Runner.subshell], but allows skipping some allocations and copies
@@ -568,23 +1537,76 @@ func (r *Runner) subshell(background bool) *Runner {
 		stderr:   r.stderr,
 		filename: r.filename,
 		opts:     r.opts,
+		bashOpts: r.bashOpts,
 		exit:     r.exit,
+
+		extraOptsTable: r.extraOptsTable,
+		extraOpts:      slices.Clone(r.extraOpts),
+
 		lastExit: r.lastExit,
+		lastArg:  r.lastArg,
 
 		origStdout: r.origStdout, // used for process substitutions
 
 		TTY:        r.TTY,
 		Commands:   r.Commands,
 		FileSystem: r.FileSystem,
+
+		funcDepth:         r.funcDepth,
+		maxFuncDepth:      r.maxFuncDepth,
+		maxProcs:          r.maxProcs,
+		maxCommands:       r.maxCommands,
+		maxLoopIterations: r.maxLoopIterations,
+		commandTimeout:    r.commandTimeout,
+		panicHandler:      r.panicHandler,
+		preRun:            r.preRun,
+		postRun:           r.postRun,
+		noPathLookup:      r.noPathLookup,
+		network:           r.network,
+		dialer:            r.dialer,
+		homeLookup:        r.homeLookup,
+		argv0:             r.argv0,
+		logger:            r.logger,
+		debugLogger:       r.debugLogger,
+		rand:              r.rand,
+		regexps:           r.regexps,
+		eventSink:         r.eventSink,
+		metrics:           r.metrics,
+		tempDir:           r.tempDir,
+		clock:             r.clock,
+		procs:             r.procs,
+		commands:          r.commands,
+		secondsStart:      r.secondsStart,
+		lineNo:            r.lineNo,
+		callStack:         slices.Clone(r.callStack),
 	}
 	r2.writeEnv = newOverlayEnviron(r.writeEnv, background)
-	// Funcs are copied, since they might be modified.
-	r2.Funcs = maps.Clone(r.Funcs)
+	// Funcs and friends are rarely modified, so they are only copied when
+	// either runner first does so.
+	r2.Funcs = r.Funcs
+	r2.alias = r.alias
+	r2.disabled = r.disabled
+	r2.sharedMaps = true
+	r.sharedMaps = true
 	r2.Vars = make(map[string]expand.Variable)
-	r2.alias = maps.Clone(r.alias)
 
 	r2.dirStack = append(r2.dirBootstrap[:0], r.dirStack...)
 	r2.fillExpandConfig(r.ectx)
 	r2.didReset = true
+	if ctx := cmp.Or(r.ectx, context.Background()); r.debugging(ctx) {
+		r.debugLogger.DebugContext(ctx, "subshell", "background", background)
+	}
 	return r2
 }
+
+// ownMaps copies Funcs, alias and disabled if they are shared with another
+// runner, so that they can be modified.
+func (r *Runner) ownMaps() {
+	if !r.sharedMaps {
+		return
+	}
+	r.Funcs = maps.Clone(r.Funcs)
+	r.alias = maps.Clone(r.alias)
+	r.disabled = maps.Clone(r.disabled)
+	r.sharedMaps = false
+}
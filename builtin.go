@@ -6,6 +6,8 @@ import (
 	"cmp"
 	"context"
 	"errors"
+	"io"
+	"maps"
 	filepath "path"
 	"slices"
 	"strconv"
@@ -16,17 +18,25 @@ import (
 	"mvdan.cc/sh/v3/syntax"
 )
 
+// builtinNames lists the names of all shell builtins, sorted.
+var builtinNames = []string{
+	".", "[", "alias", "at", "bg", "break", "builtin", "caller", "cd",
+	"command", "continue", "dirs", "echo", "enable", "eval", "exec", "exit",
+	"false", "fg", "getopts", "jobs", "mapfile", "popd", "printf",
+	"pushd", "pwd", "read", "readarray", "return", "set", "shift",
+	"shopt", "source", "test", "trap", "true", "type", "umask",
+	"unalias", "unset", "wait",
+}
+
 func isBuiltin(name string) bool {
-	switch name {
-	case "true", "false", "exit", "set", "shift", "unset",
-		"echo", "printf", "break", "continue", "pwd", "cd",
-		"wait", "builtin", "trap", "type", "source", ".", "command",
-		"dirs", "pushd", "popd", "umask", "alias", "unalias",
-		"fg", "bg", "getopts", "eval", "test", "[", "exec",
-		"return", "read", "mapfile", "readarray", "shopt":
-		return true
-	}
-	return false
+	_, ok := slices.BinarySearch(builtinNames, name)
+	return ok
+}
+
+// builtinEnabled is like [isBuiltin], but it also reports false for builtins
+// which were turned off via "enable -n".
+func (r *Runner) builtinEnabled(name string) bool {
+	return isBuiltin(name) && !r.disabled[name]
 }
 
 func oneIf(b bool) int {
@@ -111,6 +121,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			if vars && r.lookupVar(arg).IsSet() {
 				r.delVar(arg)
 			} else if _, ok := r.Funcs[arg]; ok && funcs {
+				r.ownMaps()
 				delete(r.Funcs, arg)
 			}
 		}
@@ -142,25 +153,49 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.out("\n")
 		}
 	case "printf":
+		// With "-v name", the output is assigned to the variable name.
+		varName := ""
+		if len(args) > 0 && args[0] == "-v" {
+			if len(args) < 2 {
+				r.errf("printf: -v: option requires an argument\n")
+				return 2
+			}
+			varName, args = args[1], args[2:]
+			if !syntax.ValidName(varName) {
+				r.errf("printf: invalid identifier %q\n", varName)
+				return 2
+			}
+		}
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
 		if len(args) == 0 {
-			r.errf("usage: printf format [arguments]\n")
+			r.errf("usage: printf [-v var] format [arguments]\n")
 			return 2
 		}
 		format, args := args[0], args[1:]
+		var sb strings.Builder
 		for {
 			s, n, err := expand.Format(r.ecfg, format, args)
 			if err != nil {
 				r.errf("%v\n", err)
 				return 1
 			}
-			r.out(s)
+			if varName != "" {
+				sb.WriteString(s)
+			} else {
+				r.out(s)
+			}
 			args = args[n:]
 			if n == 0 || len(args) == 0 {
 				break
 			}
 		}
+		if varName != "" {
+			r.setVarString(varName, sb.String())
+		}
 	case "break", "continue":
-		if !r.inLoop {
+		if r.loopDepth == 0 {
 			r.errf("%s is only useful in a loop\n", name)
 			break
 		}
@@ -168,19 +203,31 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		if name == "continue" {
 			enclosing = &r.contnEnclosing
 		}
+		n := 1
 		switch len(args) {
 		case 0:
-			*enclosing = 1
 		case 1:
-			if n, err := strconv.Atoi(args[0]); err == nil {
-				*enclosing = n
-				break
+			var err error
+			// Like bash, leave all the enclosing loops on errors, even
+			// with continue, so that a loop can't keep going forever.
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				r.errf("%s: %s: numeric argument required\n", name, args[0])
+				r.breakEnclosing = r.loopDepth
+				r.exitShell(ctx, 128)
+				return 128
+			}
+			if n < 1 {
+				r.errf("%s: %d: loop count out of range\n", name, n)
+				r.breakEnclosing = r.loopDepth
+				return 1
 			}
-			fallthrough
 		default:
 			r.errf("usage: %s [n]\n", name)
 			return 2
 		}
+		// Like in other shells, break or continue out of all the
+		// enclosing loops if there are fewer than n of them.
+		*enclosing = min(n, r.loopDepth)
 	case "pwd":
 		for len(args) > 0 {
 			r.errf("invalid option: %q\n", args[0])
@@ -221,7 +268,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		if len(args) == 0 {
 			// Note that "wait" without arguments always returns exit status zero.
 			for _, bg := range r.bgProcs {
-				<-bg.done
+				if !bg.disowned {
+					<-bg.done
+				}
 			}
 			return 0
 		}
@@ -229,7 +278,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		for _, arg := range args {
 			arg, ok := strings.CutPrefix(arg, "g")
 			pid := atoi(arg)
-			if !ok || pid <= 0 || pid > len(r.bgProcs) {
+			if !ok || pid <= 0 || pid > len(r.bgProcs) || r.bgProcs[pid-1].disowned {
 				r.errf("wait: pid %s is not a child of this shell\n", arg)
 				return 1
 			}
@@ -240,14 +289,40 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			}
 		}
 		return exit
+	case "at":
+		return r.atBuiltin(ctx, args)
+	case "jobs":
+		if len(args) > 0 {
+			r.errf("jobs: arguments are not supported\n")
+			return 2
+		}
+		printer := syntax.NewPrinter(syntax.SingleLine(true))
+		for i, bg := range r.bgProcs {
+			if bg.disowned {
+				continue
+			}
+			state := "Running"
+			select {
+			case <-bg.done:
+				state = "Done"
+				if *bg.exit != 0 {
+					state = "Exit " + strconv.Itoa(*bg.exit)
+				}
+			default:
+			}
+			var buf bytes.Buffer
+			printer.Print(&buf, bg.node)
+			cmd := strings.TrimSpace(buf.String()) + " &"
+			if !bg.at.IsZero() {
+				cmd = "at " + bg.at.Format(time.ANSIC) + ": " + strings.TrimSpace(buf.String())
+			}
+			r.outf("[%d]  %-8s %s\n", i+1, state, cmd)
+		}
 	case "builtin":
 		if len(args) < 1 {
 			break
 		}
-		if !isBuiltin(args[0]) {
-			return 1
-		}
-		return r.builtinCode(ctx, pos, args[0], args[1:])
+		return r.builtinOnly(ctx, pos, args)
 	case "type":
 		anyNotFound := false
 		mode := ""
@@ -267,7 +342,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		args := fp.args()
 		for _, arg := range args {
 			if mode == "-p" {
-				if path, err := lookPathDir(r.Dir, r.writeEnv, arg); err == nil {
+				if path, err := r.lookPath(arg); err == nil {
 					r.outf("%s\n", path)
 				} else {
 					anyNotFound = true
@@ -291,7 +366,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				}
 				continue
 			}
-			if isBuiltin(arg) {
+			if r.builtinEnabled(arg) {
 				if mode == "-t" {
 					r.out("builtin\n")
 				} else {
@@ -299,7 +374,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				}
 				continue
 			}
-			if path, err := lookPathDir(r.Dir, r.writeEnv, arg); err == nil {
+			if path, err := r.lookPath(arg); err == nil {
 				if mode == "-t" {
 					r.out("file\n")
 				} else {
@@ -330,7 +405,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("%v: source: need filename\n", pos)
 			return 2
 		}
-		path, err := lookPathDir(r.Dir, r.writeEnv, args[0])
+		path, err := r.lookPath(args[0])
 		if err != nil {
 			// If the script was not found in PATH or there was any error, pass
 			// the source path to the open handler so it has a chance to look
@@ -351,6 +426,11 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			return 1
 		}
 
+		if !r.enterRecursion(args[0]) {
+			return 1
+		}
+		defer r.leaveRecursion()
+
 		// Keep the current versions of some fields we might modify.
 		oldParams := r.Params
 		oldSourceSetParams := r.sourceSetParams
@@ -430,7 +510,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			break
 		}
 		if !show {
-			if isBuiltin(args[0]) {
+			if r.builtinEnabled(args[0]) {
 				return r.builtinCode(ctx, pos, args[0], args[1:])
 			}
 			r.exec(ctx, args)
@@ -439,9 +519,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		last := 0
 		for _, arg := range args {
 			last = 0
-			if r.Funcs[arg] != nil || isBuiltin(arg) {
+			if r.Funcs[arg] != nil || r.builtinEnabled(arg) {
 				r.outf("%s\n", arg)
-			} else if path, err := lookPathDir(r.Dir, r.writeEnv, arg); err == nil {
+			} else if path, err := r.lookPath(arg); err == nil {
 				r.outf("%s\n", path)
 			} else {
 				last = 1
@@ -525,6 +605,37 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("popd: invalid argument\n")
 			return 2
 		}
+	case "caller":
+		// Like in Bash, "caller" prints the line and file of the current
+		// function call, and "caller n" the line, calling function and
+		// file of the call n frames up. $0 stands in for the file.
+		n := 0
+		switch len(args) {
+		case 0:
+		case 1:
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 0 {
+				r.errf("caller: %s: invalid number\n", args[0])
+				return 2
+			}
+		default:
+			r.errf("usage: caller [n]\n")
+			return 2
+		}
+		i := len(r.callStack) - 1 - n
+		if i < 0 {
+			return 1
+		}
+		file := r.lookupVar("0").String()
+		if len(args) == 0 {
+			r.outf("%d %s\n", r.callStack[i].line, file)
+			break
+		}
+		sub := "main"
+		if i > 0 {
+			sub = r.callStack[i-1].name
+		}
+		r.outf("%d %s %s\n", r.callStack[i].line, sub, file)
 	case "return":
 		if !r.inFunc && !r.inSource {
 			r.errf("return: can only be done from a func or sourced script\n")
@@ -533,8 +644,15 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		code := 0
 		switch len(args) {
 		case 0:
+			code = r.lastExit
 		case 1:
-			code = atoi(args[0])
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				r.errf("return: %s: numeric argument required\n", args[0])
+				r.returning = true
+				return 2
+			}
+			code = n
 		default:
 			r.errf("return: too many arguments\n")
 			return 2
@@ -577,11 +695,17 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 
 		line, err := r.readLine(ctx, raw)
+		ifs := " \t\n"
+		if vr := r.lookupVar("IFS"); vr.IsSet() {
+			ifs = vr.String()
+		}
 		if len(args) == 0 {
+			// REPLY gets the whole line, without any splitting.
 			args = append(args, shellReplyVar)
+			ifs = ""
 		}
 
-		values := expand.ReadFields(r.ecfg, string(line), len(args), raw)
+		values := readFields(ifs, string(line), len(args), raw)
 		for i, name := range args {
 			val := ""
 			if i < len(values) {
@@ -644,38 +768,76 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 
 	case "shopt":
 		mode := ""
+		posixOpts, quiet := false, false
 		fp := flagParser{remaining: args}
 		for fp.more() {
 			switch flag := fp.flag(); flag {
-			case "-s":
+			case "-s", "-u":
 				mode = flag
+			case "-o":
+				posixOpts = true
+			case "-q":
+				quiet = true
 			default:
 				r.errf("shopt: invalid option %q\n", flag)
 				return 2
 			}
 		}
-		args := fp.args()
-		if len(args) == 0 {
-			for i, opt := range &shellOptsTable {
-				r.printOptLine(opt.name, r.opts[i], true)
-			}
-			break
+		// Like in bash, the options of "set -o" are only used with -o.
+		type option struct {
+			name      string
+			status    *bool
+			supported bool
 		}
+		var opts []option
+		args := fp.args()
 		for _, arg := range args {
-			_, opt := r.optByName(arg)
-			if opt == nil {
+			opt := option{name: arg, supported: true}
+			if posixOpts {
+				_, opt.status = r.optByName(arg)
+			} else if i := bashOptIndex(arg); i >= 0 {
+				opt.status, opt.supported = &r.bashOpts[i], bashOptsTable[i].supported
+			}
+			if opt.status == nil {
 				r.errf("shopt: invalid option name %q\n", arg)
 				return 1
 			}
+			opts = append(opts, opt)
+		}
+		if len(args) == 0 {
+			if posixOpts {
+				for opt, status := range r.shellOpts() {
+					opts = append(opts, option{opt.name, status, true})
+				}
+			} else {
+				for i, opt := range bashOptsTable {
+					opts = append(opts, option{opt.name, &r.bashOpts[i], opt.supported})
+				}
+			}
+		}
 
-			switch mode {
-			case "-s":
-				*opt = true
-			default: // ""
-				r.printOptLine(arg, *opt, true)
+		exit := 0
+		for _, opt := range opts {
+			switch {
+			case mode != "" && len(args) > 0:
+				if mode == "-s" && !opt.supported {
+					r.errf("shopt: %s: %q not supported\n", opt.name, optStatusText(true))
+					return 1
+				}
+				*opt.status = mode == "-s"
+			case mode != "" && *opt.status != (mode == "-s"):
+				// Only list the options which are on with -s, or off with -u.
+			case len(args) > 0 && !*opt.status:
+				exit = 1
+				fallthrough
+			default:
+				if !quiet {
+					r.printOptLine(opt.name, *opt.status, opt.supported)
+				}
 			}
 		}
 		r.updateExpandOpts()
+		return exit
 
 	case "alias":
 		show := func(name string, als alias) {
@@ -721,6 +883,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				words = append(words, w)
 			}
 
+			r.ownMaps()
 			if r.alias == nil {
 				r.alias = make(map[string]alias)
 			}
@@ -730,6 +893,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			}
 		}
 	case "unalias":
+		r.ownMaps()
 		for _, name := range args {
 			delete(r.alias, name)
 		}
@@ -786,12 +950,29 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 	case "readarray", "mapfile":
 		dropDelim := false
 		delim := "\n"
+		maxLines, skipLines := 0, 0
 		fp := flagParser{remaining: args}
 		for fp.more() {
 			switch flag := fp.flag(); flag {
 			case "-t":
 				// Remove the delim from each line read
 				dropDelim = true
+			case "-n", "-s":
+				if len(fp.remaining) == 0 {
+					r.errf("%s: %s: option requires an argument\n", name, flag)
+					return 2
+				}
+				value := fp.value()
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					r.errf("%s: %s: invalid line count\n", name, value)
+					return 2
+				}
+				if flag == "-n" {
+					maxLines = n
+				} else {
+					skipLines = n
+				}
 			case "-d":
 				if len(fp.remaining) == 0 {
 					r.errf("%s: -d: option requires an argument\n", name)
@@ -827,9 +1008,19 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 
 		var vr expand.Variable
 		vr.Kind = expand.Indexed
-		scanner := bufio.NewScanner(r.stdin)
+		var in io.Reader = r.stdin
+		if maxLines > 0 {
+			// Don't read past the last line we want, so that the
+			// rest of the input is left for the next command.
+			in = oneByteReader{in}
+		}
+		scanner := bufio.NewScanner(in)
 		scanner.Split(mapfileSplit(delim[0], dropDelim))
-		for scanner.Scan() {
+		for (maxLines == 0 || len(vr.List) < maxLines) && scanner.Scan() {
+			if skipLines > 0 {
+				skipLines--
+				continue
+			}
 			vr.List = append(vr.List, scanner.Text())
 		}
 		if err := scanner.Err(); err != nil {
@@ -840,6 +1031,53 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 
 		return 0
 
+	case "enable":
+		disable, all := false, false
+		fp := flagParser{remaining: args}
+		for fp.more() {
+			switch flag := fp.flag(); flag {
+			case "-n":
+				disable = true
+			case "-a":
+				all = true
+			default:
+				r.errf("enable: invalid option %q\n", flag)
+				return 2
+			}
+		}
+		args := fp.args()
+		if len(args) == 0 {
+			for _, name := range r.enableNames() {
+				switch {
+				case r.disabled[name]:
+					if all || disable {
+						r.outf("enable -n %s\n", name)
+					}
+				case all || !disable:
+					r.outf("enable %s\n", name)
+				}
+			}
+			break
+		}
+		exit := 0
+		for _, arg := range args {
+			if _, ok := r.Commands[arg]; !ok && !isBuiltin(arg) {
+				r.errf("enable: %s: not a shell builtin\n", arg)
+				exit = 1
+				continue
+			}
+			r.ownMaps()
+			if !disable {
+				delete(r.disabled, arg)
+				continue
+			}
+			if r.disabled == nil {
+				r.disabled = make(map[string]bool)
+			}
+			r.disabled[arg] = true
+		}
+		return exit
+
 	default:
 		// "umask", "fg", "bg",
 		r.errf("%s: unimplemented builtin\n", name)
@@ -848,6 +1086,35 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 	return 0
 }
 
+// builtinOnly runs a shell builtin or a registered command, skipping any
+// function of the same name. This is what "builtin" does, so that functions
+// can wrap builtins without recursing into themselves.
+func (r *Runner) builtinOnly(ctx context.Context, pos syntax.Pos, args []string) int {
+	name := args[0]
+	if r.builtinEnabled(name) {
+		return r.builtinCode(ctx, pos, name, args[1:])
+	}
+	if _, ok := r.Commands[name]; ok && !r.disabled[name] {
+		r.exec(ctx, args)
+		return r.exit
+	}
+	r.errf("builtin: %s: not a shell builtin\n", name)
+	return 1
+}
+
+// enableNames returns the sorted names of all shell builtins and registered
+// commands, which are the names that "enable" can toggle.
+func (r *Runner) enableNames() []string {
+	names := slices.Collect(maps.Keys(r.Commands))
+	for _, name := range builtinNames {
+		if _, ok := r.Commands[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
 // mapfileSplit returns a suitable Split function for a [bufio.Scanner];
 // the code is mostly stolen from [bufio.ScanLines].
 func mapfileSplit(delim byte, dropDelim bool) bufio.SplitFunc {
@@ -872,6 +1139,19 @@ func mapfileSplit(delim byte, dropDelim bool) bufio.SplitFunc {
 	}
 }
 
+// oneByteReader reads at most one byte at a time, so that it never reads
+// past what its user consumes.
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
 // optStatusText returns a shell option's status text display
 func optStatusText(status bool) string {
 	if status {
@@ -936,6 +1216,80 @@ func (r *Runner) readLine(ctx context.Context, raw bool) ([]byte, error) {
 	}
 }
 
+// readFields splits s into at most n fields, like the read builtin. As with
+// word splitting, the IFS whitespace around fields is dropped, while any other
+// IFS character delimits a field on its own, so that "a,,b" has an empty
+// field in the middle. The last field gets the rest of the line. Unless raw
+// is set, a backslash makes the next character part of a field.
+func readFields(ifs, s string, n int, raw bool) []string {
+	type char struct {
+		r   rune
+		esc bool
+	}
+	chars := make([]char, 0, len(s))
+	esc := false
+	for _, r := range s {
+		if !raw && !esc && r == '\\' {
+			esc = true
+			continue
+		}
+		chars = append(chars, char{r, esc})
+		esc = false
+	}
+	isIFS := func(c char) bool { return !c.esc && strings.ContainsRune(ifs, c.r) }
+	isSpace := func(c char) bool { return isIFS(c) && (c.r == ' ' || c.r == '\t' || c.r == '\n') }
+	str := func(chars []char) string {
+		var sb strings.Builder
+		for _, c := range chars {
+			sb.WriteRune(c.r)
+		}
+		return sb.String()
+	}
+	// delimiter returns the end of the delimiter starting at i: any IFS
+	// whitespace, with at most one other IFS character among it.
+	delimiter := func(chars []char, i int) int {
+		for i < len(chars) && isSpace(chars[i]) {
+			i++
+		}
+		if i < len(chars) && isIFS(chars[i]) {
+			i++
+			for i < len(chars) && isSpace(chars[i]) {
+				i++
+			}
+		}
+		return i
+	}
+
+	i := 0
+	for i < len(chars) && isSpace(chars[i]) {
+		i++
+	}
+	var fields []string
+	for ; len(fields) < n-1 && i < len(chars); i = delimiter(chars, i) {
+		start := i
+		for i < len(chars) && !isIFS(chars[i]) {
+			i++
+		}
+		fields = append(fields, str(chars[start:i]))
+	}
+	if rest := chars[i:]; len(rest) > 0 {
+		end := 0
+		for end < len(rest) && !isIFS(rest[end]) {
+			end++
+		}
+		// A single field followed by a delimiter loses the delimiter;
+		// otherwise, only the trailing IFS whitespace is dropped.
+		if delimiter(rest, end) < len(rest) {
+			end = len(rest)
+			for end > 0 && isSpace(rest[end-1]) {
+				end--
+			}
+		}
+		fields = append(fields, str(rest[:end]))
+	}
+	return fields
+}
+
 func (r *Runner) changeDir(ctx context.Context, path string) int {
 	path = cmp.Or(path, ".")
 	path = r.absPath(path)
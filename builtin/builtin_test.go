@@ -0,0 +1,626 @@
+package builtin_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/builtin"
+	"github.com/wzshiming/vsh/fs"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+var commands = map[string]func(vsh.RunnerContext, []string) error{
+	"cat":       builtin.Cat,
+	"column":    builtin.Column,
+	"curl":      builtin.Http,
+	"date":      builtin.Date,
+	"df":        builtin.Df,
+	"disown":    builtin.Disown,
+	"du":        builtin.Du,
+	"ed":        builtin.Ed,
+	"emit":      builtin.Emit,
+	"fold":      builtin.Fold,
+	"jq":        builtin.Jq,
+	"json2yaml": builtin.Json2Yaml,
+	"logger":    builtin.Logger,
+	"ls":        builtin.Ls,
+	"md5sum":    builtin.Md5Sum,
+	"mkdir":     builtin.Mkdir,
+	"mktemp":    builtin.Mktemp,
+	"nl":        builtin.Nl,
+	"patch":     builtin.Patch,
+	"pathchk":   builtin.Pathchk,
+	"rm":        builtin.Rm,
+	"sed":       builtin.Sed,
+	"sponge":    builtin.Sponge,
+	"sha1sum":   builtin.Sha1Sum,
+	"sha256sum": builtin.Sha256Sum,
+	"sleep":     builtin.Sleep,
+	"stat":      builtin.Stat,
+	"tar":       builtin.Tar,
+	"watch":     builtin.Watch,
+	"yaml2json": builtin.Yaml2Json,
+}
+
+// concBuffer wraps a [bytes.Buffer] in a mutex so that concurrent writes
+// to it don't upset the race detector.
+type concBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (c *concBuffer) Write(p []byte) (int, error) {
+	c.Lock()
+	n, err := c.buf.Write(p)
+	c.Unlock()
+	return n, err
+}
+
+func (c *concBuffer) String() string {
+	c.Lock()
+	s := c.buf.String()
+	c.Unlock()
+	return s
+}
+
+// run runs src with all the commands in this package on fsys, returning the
+// combined standard output and error. A non-nil error from Run is appended
+// to the output.
+// run runs src with the commands above, and with fsys as the filesystem if
+// it's not nil. Any options are applied last.
+func run(t *testing.T, fsys fs.FileSystem, src string, opts ...func(*vsh.Runner) error) string {
+	t.Helper()
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	qt.Assert(t, qt.IsNil(err))
+	var out concBuffer
+	r, err := vsh.NewRunner(vsh.WithStdIO(nil, &out, &out))
+	qt.Assert(t, qt.IsNil(err))
+	if fsys != nil {
+		qt.Assert(t, qt.IsNil(vsh.WithDir(fsys, "/")(r)))
+	}
+	for name, fn := range commands {
+		vsh.WithCommand(name, fn)(r)
+	}
+	for _, opt := range opts {
+		qt.Assert(t, qt.IsNil(opt(r)))
+	}
+	if err := r.Run(context.Background(), file); err != nil {
+		fmt.Fprint(&out, err)
+	}
+	return out.String()
+}
+
+// memFS returns a new in-memory filesystem with the given files.
+func memFS(t *testing.T, files map[string]string) fs.FileSystem {
+	t.Helper()
+	fsys := fs.NewMemFS()
+	for name, data := range files {
+		qt.Assert(t, qt.IsNil(fsys.MkdirAll(path.Dir(name), 0o777)))
+		f, err := fsys.OpenFile(name, 0x241, 0o644) // O_WRONLY|O_CREATE|O_TRUNC
+		qt.Assert(t, qt.IsNil(err))
+		_, err = f.Write([]byte(data))
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(f.Close()))
+	}
+	return fsys
+}
+
+var duFiles = map[string]string{
+	"top":   "x",
+	"a/c":   strings.Repeat("c", 2048),
+	"a/b/x": strings.Repeat("x", 1000),
+	"a/b/y": strings.Repeat("y", 1000),
+}
+
+var tests = []struct {
+	files map[string]string
+	src   string
+	want  string
+}{
+	// nl
+	{nil, "printf 'a\\n\\nb\\n' | nl", "     1\ta\n       \n     2\tb\n"},
+	{nil, "printf 'a\\n\\nb\\n' | nl -b a -v 10 -i 5 -w 3 -s ': '", " 10: a\n 15: \n 20: b\n"},
+	{nil, "printf 'a\\nb' | nl -ba -w1", "1\ta\n2\tb"},
+	{nil, "printf 'a\\n' | nl -b n", "       a\n"},
+	{map[string]string{"f1": "a\n", "f2": "b\n"}, "nl f1 - f2 <f1", "     1\ta\n     2\ta\n     3\tb\n"},
+	{nil, "nl -b x", "nl: invalid body numbering style: \"x\"\nexit status 2"},
+	{nil, "curl http://example.com/", "curl: http://example.com/: network access is disabled\nexit status 1"},
+	{nil, "nl missing", "nl: missing: open missing: file does not exist\nexit status 1"},
+
+	// cat
+	{map[string]string{"f": "foo\n"}, "cat missing f || echo fail $?", "cat: missing: open missing: file does not exist\nfoo\nfail 1\n"},
+	{map[string]string{"a": "a\n", "b": "b\n"}, "cat a missing b missing 2>&1 >out; echo $?; cat out", "cat: missing: open missing: file does not exist\ncat: missing: open missing: file does not exist\n1\na\nb\n"},
+	{map[string]string{"a": "a\n", "b": "b\n"}, "cat a missing b 2>&1", "a\ncat: missing: open missing: file does not exist\nb\nexit status 1"},
+	{nil, "mkdir d; cat d; echo $?", "cat: d: is a directory\n1\n"},
+	{map[string]string{"f": "foo\n"}, "mkdir d; cd d; mkdir /e; cat /f; rm /f; ls /", "foo\nd\ne\n"},
+	{nil, "ls missing || echo fail $?", "ls: missing: readdir missing: file does not exist\nfail 1\n"},
+	{map[string]string{"f": ""}, "mkdir f/d a && echo ok; echo $?; ls", "mkdir: f/d: file already exists\n1\na\nf\n"},
+	{map[string]string{"f": "", "g": ""}, "rm missing f; echo $?; ls", "rm: missing: file does not exist\n1\ng\n"},
+	{nil, "printf 'a\\n\\nb\\n' | cat -n", "     1\ta\n     2\t\n     3\tb\n"},
+	{nil, "printf 'a\\n\\nb\\n' | cat -b", "     1\ta\n\n     2\tb\n"},
+
+	// stat
+	{map[string]string{"f": "foo", "e": ""}, "mkdir d; stat -c '%n %s %a %A %F' f e d", "f 3 644 -rw-r--r-- regular file\ne 0 644 -rw-r--r-- regular empty file\nd 256 777 drwxrwxrwx directory\n"},
+	{map[string]string{"f": "foo"}, "stat -L -c '%n: %s%%' f", "f: 3%\n"},
+	{map[string]string{"f": "foo"}, "stat f | while read -r line; do echo ${line%%:*}; done", "File\nSize\nMode\nModify\n"},
+	{nil, "stat missing", "stat: cannot stat missing: file does not exist\nexit status 1"},
+	{nil, "mkdir sub; cd sub; stat /a", "stat: cannot stat /a: file does not exist\nexit status 1"},
+
+	// du
+	{duFiles, "du", "2\t./a/b\n4\t./a\n5\t.\n"},
+	{duFiles, "du -b a", "2000\ta/b\n4048\ta\n"},
+	{duFiles, "du -a -b a/", "1000\ta/b/x\n1000\ta/b/y\n2000\ta/b\n2048\ta/c\n4048\ta/\n"},
+	{duFiles, "du -s -h a top", "4.0K\ta\n1.0K\ttop\n"},
+	{duFiles, "du -bd1", "4048\t./a\n4049\t.\n"},
+	{duFiles, "du nosuch", "du: nosuch: stat nosuch: file does not exist\nexit status 1"},
+
+	// md5sum, sha1sum, sha256sum
+	{sumFiles, "sha256sum foo bar", "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c  foo\n7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730  bar\n"},
+	{sumFiles, "printf foo | md5sum; sha1sum - <foo", "acbd18db4cc2f85cedef654fccc4a4d8  -\nf1d2d2f924e986ac86fdf7b36c94bcdf32beec15  -\n"},
+	{sumFiles, "sha256sum foo >ok; sha256sum -c ok", "foo: OK\n"},
+	{sumFiles, "sha256sum -c sums", "foo: OK\nbar: FAILED\nsha256sum: missing: open missing: file does not exist\nmissing: FAILED open or read\nsha256sum: WARNING: 1 line is improperly formatted\nsha256sum: WARNING: 1 listed file could not be read\nsha256sum: WARNING: 1 computed checksum did NOT match\nexit status 1"},
+	{sumFiles, "md5sum -c foo", "md5sum: foo: no properly formatted checksum lines found\nexit status 1"},
+
+	// pathchk
+	{map[string]string{"f": ""}, "pathchk a/b /c/ f; pathchk -p -P a_b-c.d", ""},
+	{nil, "pathchk a/" + strings.Repeat("x", 256), "pathchk: limit 255 exceeded by length 256 of file name component '" + strings.Repeat("x", 256) + "'\nexit status 1"},
+	{nil, "pathchk -p abcdefghijklmno 'a b' ok", "pathchk: limit 14 exceeded by length 15 of file name component 'abcdefghijklmno'\npathchk: nonportable character ' ' in file name 'a b'\nexit status 1"},
+	{nil, "pathchk -P -- -a a//b ''", "pathchk: leading '-' in a component of file name '-a'\npathchk: empty file name component in 'a//b'\npathchk: empty file name\nexit status 1"},
+	{map[string]string{"f": ""}, "pathchk f/x", "pathchk: 'f/x': Not a directory\nexit status 1"},
+
+	// tar
+	{tarFiles, "tar -cf x.tar src; tar -tf x.tar", "src/\nsrc/a\nsrc/sub/\nsrc/sub/b\n"},
+	{tarFiles, "tar cf x.tar -C src .; mkdir out; tar -xvf x.tar -C out; cat out/a out/sub/b", "./\na\nsub/\nsub/b\nfoobar"},
+	{tarFiles, "tar -c src/a /src/sub | tar -t", "tar: removing leading '/' from member names\nsrc/a\nsrc/sub/\nsrc/sub/b\n"},
+	{tarFiles, "tar -cf src/x.tar src; tar -tf src/x.tar", "tar: src/x.tar: file is the archive; not dumped\nsrc/\nsrc/a\nsrc/sub/\nsrc/sub/b\n"},
+	{tarFiles, "cd src/sub; tar -cf /x.tar /src/a; mkdir /out; tar -xf /x.tar -C /out; cat /out/src/a", "tar: removing leading '/' from member names\nfoo"},
+	{tarFiles, "tar -cx", "tar: only one of -c, -x or -t may be given\nexit status 2"},
+	{tarFiles, "tar -tf missing.tar", "tar: open missing.tar: file does not exist\nexit status 1"},
+
+	// ed
+	{nil, "printf 'a\\nfoo\\nbar\\n.\\nw f\\nq\\n' | ed; cat f", "8\nfoo\nbar\n"},
+	{map[string]string{"f": "1\n2\n3\n"}, "printf '2d\\n$a\\n4\\n.\\n1i\\n0\\n.\\n,p\\n=\\nw\\n' | ed -s f; cat f", "0\n1\n3\n4\n4\n0\n1\n3\n4\n"},
+	{map[string]string{"f": "a\nb\nc\n"}, "printf '2,$c\\nx\\n.\\n1p\\n$\\nw g\\n' | ed f; cat g", "6\na\nx\n4\na\nx\n"},
+	{map[string]string{"f": "a\n"}, "printf '5p\\nd\\nw\\n' | ed -s f || cat f", "?\na\n"},
+	{nil, "printf 'w\\n' | ed", "?\nexit status 1"},
+
+	// patch
+	{patchFiles, "patch -p1 -i d.patch; cat f", "patching file f\n1\n2\nthree\n4\n5\n6\n7\n8\n"},
+	{patchFiles, "patch -p1 <d.patch >out; patch -R -p1 <d.patch; cat f", "patching file f\n1\n2\n3\n4\n5\n6\n7\n"},
+	{patchFiles, "patch --dry-run -p1 <d.patch; cat f", "checking file f\n1\n2\n3\n4\n5\n6\n7\n"},
+	{patchFiles, "patch <d.patch >out; cat f", "1\n2\nthree\n4\n5\n6\n7\n8\n"},
+	{patchFiles, "printf 'x\\ny\\n' >g; cat f >>g; cat g >f; patch -p1 <d.patch", "patching file f\nHunk #1 succeeded at 4 (offset 2 lines).\nHunk #2 succeeded at 8 (offset 2 lines).\n"},
+	{patchFiles, "printf '1\\nTWO\\n3\\n4\\n5\\n6\\n7\\n' >f; patch -p1 <d.patch; cat f", "patching file f\nHunk #1 succeeded at 2 with fuzz 1.\n1\nTWO\nthree\n4\n5\n6\n7\n8\n"},
+	{patchFiles, "printf '1\\n2\\n6\\n7\\n' >f; patch -p1 <d.patch || cat f f.rej", "patching file f\nHunk #1 FAILED at 2.\nHunk #2 succeeded at 3 (offset -3 lines).\n1 out of 2 hunks FAILED -- saving rejects to file f.rej\n1\n2\n6\n7\n8\n--- a/f\n+++ b/f\n@@ -2,3 +2,3 @@\n 2\n-3\n+three\n 4\n"},
+	{patchFiles, "patch -p1 <new.patch; cat dir/n; patch -R -p1 <new.patch; ls", "patching file dir/n\nnew\npatching file dir/n\nd.patch\ndir\nf\nnew.patch\n"},
+	{patchFiles, "echo garbage | patch", "patch: **** Only garbage was found in the patch input.\nexit status 2"},
+	{patchFiles, "printf '%s\\n' '--- f' '+++ f' '@@ -1,2 +1,2 @@' ' 1' | patch", "patch: **** unexpected end of file in patch\nexit status 2"},
+
+	// sed
+	{nil, "printf 'foo bar\\nbaz foo foo\\n' | sed 's/foo/X/'", "X bar\nbaz X foo\n"},
+	{nil, "echo 'foo bar baz' | sed 's/foo/X/g;s/\\(ba\\)\\(.\\)/\\2\\1[&]/2'", "X bar zba[baz]\n"},
+	{nil, "echo Foo | sed -E 's/(f)(o+)/<\\2\\1>/I'", "<ooF>\n"},
+	{nil, "printf 'a\\nb\\nc\\nd\\n' | sed -n '2,3p;$='", "b\nc\n4\n"},
+	{nil, "printf 'a\\nb\\nc\\nd\\n' | sed -e '/b/,/c/d' -e 1q", "a\n"},
+	{nil, "printf 'a\\nb\\nc\\n' | sed '2!d'", "b\n"},
+	{map[string]string{"f": "1\n2\n", "g": "3\n4\n"}, "sed '1d' f g; sed -i 's/$/!/;1d' f g; cat f g", "2\n3\n4\n2!\n4!\n"},
+	{nil, "sed 's/a/b'", "sed: -e expression #1, char 5: unterminated `s' command\nexit status 2"},
+	{nil, "sed x", "sed: -e expression #1, char 1: unknown command: `x'\nexit status 2"},
+	{nil, "sed p missing", "sed: can't read missing: open missing: file does not exist\nexit status 2"},
+
+	// sponge
+	{map[string]string{"f": "b\na\n"}, "sed 's/^/x/' f >f; cat f; echo ---", "---\n"},
+	{map[string]string{"f": "b\na\n"}, "sed 's/^/x/' f | sponge f; cat f", "xb\nxa\n"},
+	{map[string]string{"f": "b\n"}, "echo c | sponge -a f; cat f; echo d | sponge", "b\nc\nd\n"},
+	{nil, "echo x | sponge nosuch/f", "sponge: nosuch/f: file does not exist\nexit status 1"},
+
+	// jq
+	{map[string]string{"f": `{"b": [1, 2.50], "a": "x<y"}`}, "jq . f", "{\n  \"a\": \"x<y\",\n  \"b\": [\n    1,\n    2.50\n  ]\n}\n"},
+	{map[string]string{"f": `{"a": {"b": [1, 2, 3]}}`}, "jq -c '.a.b[1], .a.b[-1]' f", "jq: invalid filter \".a.b[1], .a.b[-1]\": unexpected \", .a.b[-1]\"\nexit status 2"},
+	{map[string]string{"f": `{"a": {"b": [1, 2, 3]}}`}, "jq .a.b[1] f; jq '.a.b[-1]' f; jq .a.b[5] f", "2\n3\nnull\n"},
+	{map[string]string{"f": `{"items": [{"name": "x"}, {"name": "y"}]} {"items": []}`}, "jq -r '.items[] | .name' f", "x\ny\n"},
+	{map[string]string{"f": `{"a b": {"c": true}, "d": null}`}, `jq -c '."a b" | .["c"]' f; jq .d.e.[0] f`, "true\nnull\n"},
+	{map[string]string{"f": `{"b": 2, "a": 1}`}, "jq -c '.[]' f; jq -c '.[] | .x' f", "1\n2\njq: error: cannot index number with \"x\"\nexit status 1"},
+	{nil, `echo '[1, "two"]' | jq -c '.[1]'; echo '[1' | jq .`, "\"two\"\njq: -: invalid JSON: unexpected EOF\nexit status 1"},
+	{nil, "jq .. ; jq", "jq: invalid filter \"..\": unexpected \".\"\njq: no filter given\nexit status 2"},
+
+	// column
+	{map[string]string{"f": "name size\nmain.go 1200\n\nREADME 3 extra\nx\n"}, "column -t f", "name     size\nmain.go  1200\nREADME   3     extra\nx\n"},
+	{map[string]string{"f": "a,bb,,c\nddd,e\n"}, "column -t -s, -o ' | ' -N X,Y f", "X   | Y  |\na   | bb | c\nddd | e  |\n"},
+	{nil, "printf '%s\\n' one two three four five | column -c 20; printf 'a\\nb\\n' | column", "one\tfour\ntwo\tfive\nthree\na\tb\n"},
+	{nil, "column -c 0", "column: invalid columns argument: 0\nexit status 2"},
+
+	// fold
+	{map[string]string{"f": "the quick brown fox jumps\nover\n"}, "fold -w 10 f", "the quick \nbrown fox \njumps\nover\n"},
+	{map[string]string{"f": "the quick brown fox jumps\nover\n"}, "fold -s -w 12 f", "the quick \nbrown fox \njumps\nover\n"},
+	{map[string]string{"f": "abcdefghijkl mn"}, "fold -s -w 5 f", "abcde\nfghij\nkl mn"},
+	{map[string]string{"f": "a\tbc\n\u00e9\u00e9\u00e9\n"}, "fold -w 9 f; fold -w 2 f; fold -b -w 2 f", "a\tb\nc\n\u00e9\u00e9\u00e9\na\n\t\nbc\n\u00e9\u00e9\n\u00e9\na\t\nbc\n\u00e9\n\u00e9\n\u00e9\n"},
+	{nil, "echo abc | fold -w 0", "fold: invalid number of columns: 0\nexit status 2"},
+
+	// yaml2json and json2yaml
+	{map[string]string{"f": "b: 1\na: [x, 'true', true, ~, 1.5, 0x10]\nc: {z: <y>}\n"}, "yaml2json -c f", "{\"b\":1,\"a\":[\"x\",\"true\",true,null,1.5,16],\"c\":{\"z\":\"<y>\"}}\n"},
+	{map[string]string{"f": "base: &b {x: 1, y: 2}\nd:\n  <<: *b\n  y: 3\n  z: *b\n---\n[12345678901234567890, 2001-12-14]\n"}, "yaml2json f",
+		"{\n  \"base\": {\n    \"x\": 1,\n    \"y\": 2\n  },\n  \"d\": {\n    \"x\": 1,\n    \"y\": 3,\n    \"z\": {\n      \"x\": 1,\n      \"y\": 2\n    }\n  }\n}\n[\n  12345678901234567890,\n  \"2001-12-14\"\n]\n"},
+	{nil, "echo 'a: [1' | yaml2json; echo 'a: .inf' | yaml2json", "yaml2json: -: yaml: line 1: did not find expected ',' or ']'\nyaml2json: -: line 1: cannot convert .inf to JSON\nexit status 1"},
+	{map[string]string{"f": `{"b": [1, 2.50, "true", null, false], "a": {}, "c": "x: y"} [] "s"`}, "json2yaml f",
+		"b:\n  - 1\n  - 2.50\n  - \"true\"\n  - null\n  - false\na: {}\nc: 'x: y'\n---\n[]\n---\ns\n"},
+	{map[string]string{"f": "b: 1\na: [x, {k: v}]\n"}, "yaml2json f | json2yaml", "b: 1\na:\n  - x\n  - k: v\n"},
+	{nil, "echo '{\"a\": 1,}' | json2yaml", "json2yaml: -: invalid character ',' looking for beginning of value\nexit status 1"},
+
+	// disown
+	{nil, "true & false & disown %1; wait; jobs", "[2]  Exit 1   false &\n"},
+	{nil, "true & true & disown g2; wait; jobs; wait g2", "[1]  Done     true &\nwait: pid 2 is not a child of this shell\nexit status 1"},
+	{nil, "true & true & disown; disown -a; wait; jobs; disown", "disown: current: no such job\nexit status 1"},
+	{nil, "true & disown %2 x %1; echo $?; jobs", "disown: %2: no such job\ndisown: x: no such job\n1\n"},
+	{nil, "disown -h", "disown: invalid option \"-h\"\nexit status 2"},
+
+	// watch
+	{nil, "watch", "watch: no command given\nexit status 2"},
+	{nil, "watch -n x ls", "watch: failed to parse argument: \"x\"\nexit status 2"},
+
+	// mktemp
+	{nil, "f=$(mktemp); case $f in /tmp/tmp.??????????) test -f $f && echo ok;; esac", "ok\n"},
+	{nil, "d=$(TMPDIR=/t mktemp -d -t x.XXX); case $d in /t/x.???) test -d $d && echo ok;; esac", "ok\n"},
+	{nil, "mkdir d; f=$(mktemp -p d); case $f in /d/tmp.*) test -f $f && echo ok;; esac", "ok\n"},
+	{nil, "mkdir t sub; cd sub; f=$(mktemp -p /t); case $f in /t/tmp.*) test -f $f && echo ok;; esac", "ok\n"},
+	{nil, "mkdir t sub; cd sub; f=$(mktemp /t/a.XXX); case $f in /t/a.???) test -f $f && echo ok;; esac", "ok\n"},
+	{nil, "f=$(mktemp -u a.XXXX); case $f in a.????) test -e $f || echo ok;; esac", "ok\n"},
+	{nil, "mktemp a.XX", "mktemp: too few X's in template \"a.XX\"\nexit status 1"},
+	{nil, "mktemp -q a.XX", "exit status 1"},
+	{nil, "mktemp -t a/b.XXX", "mktemp: invalid template \"a/b.XXX\", contains directory separator\nexit status 1"},
+
+	// logger
+	{nil, "logger -t app hello world; printf 'a\\n\\nb\\n' | logger", "app: hello world\nvsh: a\nvsh: b\n"},
+	{nil, "logger -p nosuch.info x", "logger: unknown facility name: nosuch\nexit status 2"},
+	{nil, "logger -p local0.loud x", "logger: unknown priority name: loud\nexit status 2"},
+
+	// emit
+	{nil, "emit done; emit progress step=1 msg='a=b c'", ""},
+	{nil, "emit", "emit: missing event name\nexit status 2"},
+	{nil, "emit x -y", "emit: invalid field \"-y\", expected KEY=VALUE\nexit status 2"},
+	{nil, "emit x =y", "emit: invalid field \"=y\", expected KEY=VALUE\nexit status 2"},
+
+	// df
+	{nil, "df", "Filesystem  1K-blocks       Used  Available Use% Mounted on\nvsh           unknown    unknown    unknown    - /\n"},
+}
+
+var sumFiles = map[string]string{
+	"foo": "foo\n",
+	"bar": "bar\n",
+	"sums": "" +
+		"b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c  foo\n" +
+		"0000000000000000000000000000000000000000000000000000000000000000  bar\n" +
+		"b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c *missing\n" +
+		"not a checksum line\n",
+}
+
+var patchFiles = map[string]string{
+	"f": "1\n2\n3\n4\n5\n6\n7\n",
+	"d.patch": "" +
+		"diff -u a/f b/f\n" +
+		"--- a/f\t2024-01-01 00:00:00\n" +
+		"+++ b/f\t2024-01-01 00:00:00\n" +
+		"@@ -2,3 +2,3 @@\n" +
+		" 2\n" +
+		"-3\n" +
+		"+three\n" +
+		" 4\n" +
+		"@@ -6,2 +6,3 @@\n" +
+		" 6\n" +
+		" 7\n" +
+		"+8\n",
+	"new.patch": "" +
+		"--- /dev/null\n" +
+		"+++ b/dir/n\n" +
+		"@@ -0,0 +1 @@\n" +
+		"+new\n",
+}
+
+var tarFiles = map[string]string{
+	"src/a":     "foo",
+	"src/sub/b": "bar",
+}
+
+func TestTarDotDot(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"../evil", "good", "a/../../evil2"} {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 1, Typeflag: tar.TypeReg})
+		qt.Assert(t, qt.IsNil(err))
+		_, err = tw.Write([]byte("x"))
+		qt.Assert(t, qt.IsNil(err))
+	}
+	qt.Assert(t, qt.IsNil(tw.Close()))
+
+	fsys := memFS(t, map[string]string{"evil.tar": buf.String()})
+	got := run(t, fsys, "mkdir out; tar -xf evil.tar -C out || ls out; ls")
+	qt.Assert(t, qt.Equals(got, ""+
+		"tar: ../evil: member name contains '..'\n"+
+		"tar: a/../../evil2: member name contains '..'\n"+
+		"good\n"+
+		"evil.tar\nout\n"))
+}
+
+func TestDf(t *testing.T) {
+	t.Parallel()
+	fsys := fs.NewMemFSWithQuota(1 << 20)
+	got := run(t, fsys, "printf %3000s x >f; df; df -h f nosuch")
+	qt.Assert(t, qt.Equals(got, ""+
+		"Filesystem  1K-blocks       Used  Available Use% Mounted on\n"+
+		"vsh              1024          3       1022   1% /\n"+
+		"df: nosuch: stat nosuch: file does not exist\n"+
+		"Filesystem    Size    Used   Avail Use% Mounted on\n"+
+		"vsh           1.0M    2.9K   1021K   1% /\n"+
+		"exit status 1"))
+}
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+	var logs concBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	got := run(t, nil, "logger -t app -p local0.err disk full; echo warn | logger -p warn; logger -s -p debug hi",
+		vsh.WithLogger(logger))
+	qt.Assert(t, qt.Equals(got, "vsh: hi\n"))
+	qt.Assert(t, qt.Equals(logs.String(), ""+
+		"level=ERROR msg=\"disk full\" tag=app priority=local0.err\n"+
+		"level=WARN msg=warn tag=vsh priority=user.warning\n"+
+		"level=DEBUG msg=hi tag=vsh priority=user.debug\n"))
+}
+
+func TestEmit(t *testing.T) {
+	t.Parallel()
+	type event struct {
+		Name   string
+		Fields map[string]string
+	}
+	var events []event
+	sink := func(name string, fields map[string]string) {
+		events = append(events, event{name, fields})
+	}
+	got := run(t, nil, "for i in 1 2; do emit progress step=$i total=2 step=x$i; done; emit done ok= msg='a=b c'",
+		vsh.WithEventSink(sink))
+	qt.Assert(t, qt.Equals(got, ""))
+	qt.Assert(t, qt.DeepEquals(events, []event{
+		{"progress", map[string]string{"step": "x1", "total": "2"}},
+		{"progress", map[string]string{"step": "x2", "total": "2"}},
+		{"done", map[string]string{"ok": "", "msg": "a=b c"}},
+	}))
+}
+
+func TestMktempRandSource(t *testing.T) {
+	t.Parallel()
+	mktemp := func() string {
+		return run(t, nil, "mktemp; mktemp -d", vsh.WithRandSource(rand.NewPCG(1, 0)))
+	}
+	first := mktemp()
+	qt.Assert(t, qt.Equals(mktemp(), first))
+	qt.Assert(t, qt.Matches(first, `/tmp/tmp\.\w{10}\n/tmp/tmp\.\w{10}\n`))
+}
+
+// stopClock is a [vsh.Clock] whose timers fire right away, until it has
+// been waited on n times; it then cancels the context and never fires.
+type stopClock struct {
+	n      int
+	cancel context.CancelFunc
+	waits  []time.Duration
+}
+
+func (c *stopClock) Now() time.Time { return time.Time{} }
+
+func (c *stopClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	if len(c.waits) < c.n {
+		ch <- time.Time{}
+	} else {
+		c.cancel()
+	}
+	return ch
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	file, err := syntax.NewParser().Parse(strings.NewReader("watch -n 0.5 ls; echo unreachable"), "")
+	qt.Assert(t, qt.IsNil(err))
+	for _, tty := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		clock := &stopClock{n: 2, cancel: cancel}
+		var out concBuffer
+		r, err := vsh.NewRunner(vsh.WithStdIO(nil, &out, &out), vsh.WithClock(clock),
+			vsh.WithCommand("ls", builtin.Ls), vsh.WithCommand("watch", builtin.Watch))
+		qt.Assert(t, qt.IsNil(err))
+		r.TTY = tty
+		qt.Assert(t, qt.IsNil(vsh.WithDir(memFS(t, map[string]string{"f": ""}), "/")(r)))
+		err = r.Run(ctx, file)
+		qt.Assert(t, qt.IsNotNil(err))
+
+		clear := ""
+		if tty {
+			clear = "\x1b[H\x1b[2J"
+		}
+		qt.Assert(t, qt.Equals(out.String(), strings.Repeat(clear+"Every 0.5s: ls\n\nf\n", 2)))
+		qt.Assert(t, qt.DeepEquals(clock.waits, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}))
+	}
+}
+
+func TestHttp(t *testing.T) {
+	t.Parallel()
+	started := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/missing":
+			http.Error(w, "not here", http.StatusNotFound)
+			return
+		case "/hang":
+			started <- true
+			<-req.Context().Done()
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "%s %s %s %s\n", req.Method, req.Header.Get("X-Test"), req.Header.Get("Content-Type"), body)
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		src, want string
+	}{
+		{"curl $URL/", "GET   \n"},
+		{"curl -X PUT -H 'X-Test: yes' $URL/", "PUT yes  \n"},
+		{"curl -d a=1 -d b=2 $URL/", "POST  application/x-www-form-urlencoded a=1&b=2\n"},
+		{"curl -o out $URL/ && cat out", "GET   \n"},
+		{"curl $URL/missing", "not here\n"},
+		{"curl -f $URL/missing", "curl: " + srv.URL + "/missing: the requested URL returned error: 404 Not Found\nexit status 22"},
+		{"curl -fs $URL/missing", "exit status 22"},
+		{"curl -fsS $URL/missing 2>&1 || echo $?", "curl: " + srv.URL + "/missing: the requested URL returned error: 404 Not Found\n22\n"},
+		{"curl -H bad $URL/", "curl: invalid header \"bad\"\nexit status 2"},
+	} {
+		got := run(t, fs.NewMemFS(), test.src, vsh.WithNetwork(true), vsh.WithVar("URL", srv.URL))
+		qt.Check(t, qt.Equals(got, test.want), qt.Commentf("%s", test.src))
+	}
+
+	// Connections go through the runner's dialer, which can send them
+	// elsewhere or deny them.
+	addr := srv.Listener.Addr().String()
+	dialer := func(ctx context.Context, network, host string) (net.Conn, error) {
+		if host != "allowed.test:80" {
+			return nil, fmt.Errorf("%s is not allowed", host)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	got := run(t, nil, "curl http://allowed.test/; curl -s http://denied.test/; echo $?", vsh.WithNetwork(true), vsh.WithDialer(dialer))
+	qt.Check(t, qt.Equals(got, "GET   \n1\n"))
+	got = run(t, nil, "curl http://allowed.test/", vsh.WithDialer(dialer))
+	qt.Check(t, qt.Equals(got, "curl: http://allowed.test/: network access is disabled\nexit status 1"))
+
+	// Requests stop when the shell is interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	file, err := syntax.NewParser().Parse(strings.NewReader("curl $URL/hang"), "")
+	qt.Assert(t, qt.IsNil(err))
+	r, err := vsh.NewRunner(vsh.WithVar("URL", srv.URL), vsh.WithNetwork(true), vsh.WithCommand("curl", builtin.Http))
+	qt.Assert(t, qt.IsNil(err))
+	err = r.Run(ctx, file)
+	qt.Assert(t, qt.ErrorIs(err, context.Canceled))
+}
+
+// cancelWriter cancels a context after the first write, keeping what's
+// written to it.
+type cancelWriter struct {
+	buf    bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.buf.Write(p)
+}
+
+func TestCatInterrupted(t *testing.T) {
+	t.Parallel()
+	var big strings.Builder
+	for i := range 100000 {
+		fmt.Fprintf(&big, "line %d\n", i)
+	}
+	fsys := memFS(t, map[string]string{"big": big.String()})
+	for _, src := range []string{"cat big", "cat <big", "cat -n big", "nl big", "sed p big"} {
+		t.Run(src, func(t *testing.T) {
+			t.Parallel()
+			file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+			qt.Assert(t, qt.IsNil(err))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			out := &cancelWriter{cancel: cancel}
+			r, err := vsh.NewRunner(vsh.WithStdIO(nil, out, out), vsh.WithDir(fsys, "/"),
+				vsh.WithCommand("cat", builtin.Cat), vsh.WithCommand("nl", builtin.Nl), vsh.WithCommand("sed", builtin.Sed))
+			qt.Assert(t, qt.IsNil(err))
+			err = r.Run(ctx, file)
+			qt.Assert(t, qt.ErrorIs(err, context.Canceled))
+
+			// What was produced before the interrupt is there, and no more.
+			got := out.buf.String()
+			qt.Assert(t, qt.Not(qt.Equals(got, "")))
+			qt.Assert(t, qt.IsTrue(len(got) < big.Len()))
+			qt.Assert(t, qt.StringContains(got, "line 0\n"))
+		})
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	t.Parallel()
+	for _, tc := range tests {
+		t.Run("", func(t *testing.T) {
+			var fsys fs.FileSystem
+			if tc.files != nil {
+				fsys = memFS(t, tc.files)
+			}
+			qt.Assert(t, qt.Equals(run(t, fsys, tc.src), tc.want))
+		})
+	}
+}
+
+// writeCounter counts the writes made to it, discarding the data.
+type writeCounter struct{ writes int }
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func BenchmarkCatPipe(b *testing.B) {
+	// Like "yes | head -n 100000", writing each line on its own.
+	yes := func(hc vsh.RunnerContext, args []string) error {
+		line := []byte("y\n")
+		for range 100000 {
+			if _, err := hc.Stdout.Write(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	file, err := syntax.NewParser().Parse(strings.NewReader("yes | cat"), "")
+	qt.Assert(b, qt.IsNil(err))
+	var out writeCounter
+	r, err := vsh.NewRunner(
+		vsh.WithStdIO(nil, &out, nil),
+		vsh.WithCommand("yes", yes),
+		vsh.WithCommand("cat", builtin.Cat),
+	)
+	qt.Assert(b, qt.IsNil(err))
+	b.SetBytes(200000)
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset()
+		if err := r.Run(context.Background(), file); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(out.writes)/float64(b.N), "writes/op")
+}
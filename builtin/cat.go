@@ -1,45 +1,76 @@
 package builtin
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"path"
 
 	"github.com/wzshiming/vsh"
 )
 
 func Cat(hc vsh.RunnerContext, args []string) error {
+	var number *lineNumberer
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-n", "-b":
+			// Like nl, but numbering blank lines with -n,
+			// and leaving blank lines untouched with -b.
+			number = &lineNumberer{next: 1, incr: 1, width: 6, sep: "\t", style: 'a'}
+			if flag == "-b" {
+				number.style = 't'
+			}
+		default:
+			return usageError(hc.Stderr, "cat", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	copyOut := func(w io.Writer, r io.Reader) error {
+		r = contextReader{hc.Context, r}
+		if number != nil {
+			return number.copy(w, r)
+		}
+		_, err := io.Copy(w, r)
+		return err
+	}
+
 	if len(args) == 0 {
 		if hc.Stdin == nil || hc.Stdout == nil {
 			return nil
 		}
-		_, err := io.Copy(hc.Stdout, hc.Stdin)
-		return err
+		// No extra buffering: each read from a pipe already returns all
+		// that's been written so far, and holding on to the output would
+		// keep it from whoever reads it interactively until cat is done.
+		return copyOut(hc.Stdout, hc.Stdin)
 	}
+	var failed bool
 	for _, arg := range args {
-		f, err := hc.FileSytem.Open(path.Join(hc.Dir, arg))
-		if err != nil {
-			fmt.Fprintf(hc.Stderr, "cat: %s: %v\n", arg, err)
-			return nil
-		}
-		fi, err := f.Stat()
-		if err != nil {
+		if err := catFile(hc, arg, copyOut); err != nil {
+			if err := hc.Context.Err(); err != nil {
+				return err
+			}
 			fmt.Fprintf(hc.Stderr, "cat: %s: %v\n", arg, err)
-			f.Close()
-			return nil
-		}
-		if fi.IsDir() {
-			fmt.Fprintf(hc.Stderr, "cat: %s: is a directory\n", arg)
-			f.Close()
-			return nil
-		}
-
-		_, err = io.Copy(hc.Stdout, f)
-		f.Close()
-		if err != nil {
-			fmt.Fprintf(hc.Stderr, "cat file: %s: %v\n", arg, err)
-			return nil
+			failed = true
 		}
 	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
 	return nil
 }
+
+func catFile(hc vsh.RunnerContext, name string, copyOut func(io.Writer, io.Reader) error) error {
+	f, err := hc.FileSytem.Open(resolvePath(hc.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New("is a directory")
+	}
+	return copyOut(hc.Stdout, f)
+}
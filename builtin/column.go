@@ -0,0 +1,181 @@
+package builtin
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Column formats the lines of the named files, or of standard input, into
+// columns. Blank lines are ignored.
+//
+// By default, the lines are laid out in as many columns as fit in a width of
+// -c characters, or $COLUMNS, or 80, filling each column before the next one
+// and padding them with tabs.
+//
+// With -t, each line is a row of a table instead, whose cells are separated
+// by runs of whitespace, or of any of the characters given with -s. The cells
+// are aligned, and separated by the -o string, which is two spaces by default.
+// Rows shorter than others get empty cells. -N gives the names of the
+// columns, separated by commas, as a header for the table; it implies -t.
+func Column(hc vsh.RunnerContext, args []string) (err error) {
+	table := false
+	width := 0
+	inSep, outSep := "", "  "
+	var names []string
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-t":
+			table = true
+		case "-c":
+			if width, err = fp.intValue(); err == nil && width < 1 {
+				err = fmt.Errorf("invalid columns argument: %d", width)
+			}
+			if err != nil {
+				return usageError(hc.Stderr, "column", "%v", err)
+			}
+		case "-s", "-o", "-N":
+			value, ok := fp.value()
+			if !ok {
+				return usageError(hc.Stderr, "column", "option %s requires an argument", flag)
+			}
+			switch flag {
+			case "-s":
+				inSep = value
+			case "-o":
+				outSep = value
+			case "-N":
+				names = strings.Split(value, ",")
+				table = true
+			}
+		default:
+			return usageError(hc.Stderr, "column", "invalid option %q", flag)
+		}
+	}
+	if width == 0 {
+		width, _ = strconv.Atoi(hc.Env.Get("COLUMNS").String())
+		if width < 1 {
+			width = 80
+		}
+	}
+
+	// All of the input is needed to know how wide each column is.
+	var lines []string
+	files := fp.args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var failed bool
+	for _, name := range files {
+		f, err := openInput(hc, name)
+		if err != nil {
+			fmt.Fprintf(hc.Stderr, "column: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		sc := bufio.NewScanner(contextReader{hc.Context, f})
+		for sc.Scan() {
+			if line := sc.Text(); strings.TrimSpace(line) != "" {
+				lines = append(lines, line)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			if err := hc.Context.Err(); err != nil {
+				return err
+			}
+			fmt.Fprintf(hc.Stderr, "column: %s: %v\n", name, err)
+			failed = true
+		}
+	}
+
+	bw := bufio.NewWriter(hc.Stdout)
+	defer flushOutput(bw, &err)
+	if table {
+		writeTable(bw, lines, names, inSep, outSep)
+	} else {
+		writeColumns(bw, lines, width)
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// writeTable writes the rows of a table with their cells aligned.
+func writeTable(bw *bufio.Writer, lines, names []string, inSep, outSep string) {
+	var rows [][]string
+	if names != nil {
+		rows = append(rows, names)
+	}
+	for _, line := range lines {
+		if inSep == "" {
+			rows = append(rows, strings.Fields(line))
+		} else {
+			rows = append(rows, strings.FieldsFunc(line, func(r rune) bool {
+				return strings.ContainsRune(inSep, r)
+			}))
+		}
+	}
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	var sb strings.Builder
+	for _, row := range rows {
+		sb.Reset()
+		for i, width := range widths {
+			cell := ""
+			if i < len(row) {
+				cell = row[i]
+			}
+			sb.WriteString(cell)
+			if i < len(widths)-1 {
+				sb.WriteString(strings.Repeat(" ", width-utf8.RuneCountInString(cell)))
+				sb.WriteString(outSep)
+			}
+		}
+		// Missing cells at the end of a row leave no trailing blanks.
+		fmt.Fprintln(bw, strings.TrimRight(sb.String(), " "))
+	}
+}
+
+// writeColumns lays out entries in columns filled one after the other, each
+// of them padded with tabs, in at most width characters.
+func writeColumns(bw *bufio.Writer, entries []string, width int) {
+	if len(entries) == 0 {
+		return
+	}
+	maxLen := 0
+	for _, entry := range entries {
+		maxLen = max(maxLen, utf8.RuneCountInString(entry))
+	}
+	colWidth := (maxLen + 8) &^ 7 // the next tab stop
+	cols := max(width/colWidth, 1)
+	rows := (len(entries) + cols - 1) / cols
+	for row := range rows {
+		for col := 0; ; col++ {
+			i := col*rows + row
+			if i >= len(entries) {
+				break
+			}
+			entry := entries[i]
+			bw.WriteString(entry)
+			if i+rows < len(entries) {
+				n := utf8.RuneCountInString(entry)
+				bw.WriteString(strings.Repeat("\t", (colWidth-n+7)/8))
+			}
+		}
+		bw.WriteByte('\n')
+	}
+}
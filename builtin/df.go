@@ -0,0 +1,86 @@
+package builtin
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/fs"
+)
+
+// Df prints the total, used and available space of the filesystem, either as
+// a whole or for the filesystem holding each named file.
+//
+// Sizes are counted in 1024-byte blocks by default, and -h prints them in
+// human readable form. Only filesystems implementing [fs.UsageFS], such as
+// those created with [fs.NewMemFSWithQuota], know their usage; for any other
+// filesystem the sizes are reported as unknown.
+func Df(hc vsh.RunnerContext, args []string) error {
+	human := false
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-h":
+			human = true
+		default:
+			return usageError(hc.Stderr, "df", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+
+	var total, used int64
+	ok := false
+	if u, isUsage := hc.FileSytem.(fs.UsageFS); isUsage {
+		total, used, ok = u.Usage()
+	}
+	size, usedStr, avail, percent := "unknown", "unknown", "unknown", "-"
+	if ok {
+		size = dfSize(total, human)
+		usedStr = dfSize(used, human)
+		avail = dfSize(max(total-used, 0), human)
+		if total > 0 {
+			// Like coreutils, round the percentage up.
+			percent = strconv.FormatInt((used*100+total-1)/total, 10) + "%"
+		}
+	}
+
+	format := "%-10s %10s %10s %10s %4s %s\n"
+	header := []any{"Filesystem", "1K-blocks", "Used", "Available", "Use%", "Mounted on"}
+	if human {
+		format = "%-10s %7s %7s %7s %4s %s\n"
+		header = []any{"Filesystem", "Size", "Used", "Avail", "Use%", "Mounted on"}
+	}
+
+	var failed bool
+	var rows int
+	if len(args) == 0 {
+		rows = 1
+	}
+	for _, name := range args {
+		if _, err := hc.FileSytem.Stat(resolvePath(hc.Dir, name)); err != nil {
+			fmt.Fprintf(hc.Stderr, "df: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		rows++
+	}
+	if rows > 0 {
+		fmt.Fprintf(hc.Stdout, format, header...)
+	}
+	for range rows {
+		fmt.Fprintf(hc.Stdout, format, "vsh", size, usedStr, avail, percent, "/")
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// dfSize formats a number of bytes as 1024-byte blocks, rounding up,
+// or in human readable form.
+func dfSize(n int64, human bool) string {
+	if human {
+		return humanSize(n)
+	}
+	return strconv.FormatInt((n+1023)/1024, 10)
+}
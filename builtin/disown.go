@@ -0,0 +1,77 @@
+package builtin
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Disown stops the shell from tracking background jobs, so that "wait" no
+// longer waits for them and "jobs" no longer lists them; see
+// [vsh.RunnerContext.Disown]. The jobs keep running to completion.
+//
+// Each argument is a job spec like "%2", with "%%" or "%+" being the current
+// job, or a PID like "g2" as printed by "echo $!". Without arguments, the
+// current job is disowned, and with -a, all of them are.
+func Disown(hc vsh.RunnerContext, args []string) error {
+	all := false
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-a":
+			all = true
+		default:
+			return usageError(hc.Stderr, "disown", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	jobs := hc.Jobs()
+	if all {
+		for _, job := range jobs {
+			hc.Disown(job)
+		}
+		return nil
+	}
+	if len(args) == 0 {
+		args = []string{"%%"}
+	}
+	failed := false
+	for _, arg := range args {
+		job, ok := parseJob(arg, jobs)
+		if !ok || !hc.Disown(job) {
+			name := arg
+			if arg == "%%" || arg == "%+" {
+				name = "current"
+			}
+			fmt.Fprintf(hc.Stderr, "disown: %s: no such job\n", name)
+			failed = true
+		}
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// parseJob parses a job spec or PID into a job number, given the numbers of
+// the shell's jobs.
+func parseJob(arg string, jobs []int) (int, bool) {
+	if arg == "%%" || arg == "%+" {
+		if len(jobs) == 0 {
+			return 0, false
+		}
+		return jobs[len(jobs)-1], true
+	}
+	num, ok := strings.CutPrefix(arg, "%")
+	if !ok {
+		num, ok = strings.CutPrefix(arg, "g")
+	}
+	job, err := strconv.Atoi(num)
+	if !ok || err != nil || !slices.Contains(jobs, job) {
+		return 0, false
+	}
+	return job, true
+}
@@ -0,0 +1,8 @@
+// Package builtin implements common commands, to be registered with a runner
+// via [vsh.WithCommand].
+//
+// The commands report errors like other programs do: they print a message
+// prefixed by their name to standard error, and return a [vsh.ExitStatus],
+// which is 1 on failure and 2 on invalid usage. Where a command works on
+// many files, it carries on after one fails, and fails at the end.
+package builtin
@@ -0,0 +1,172 @@
+package builtin
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Du prints the disk usage of each named file or directory, recursively.
+//
+// Sizes are counted in 1024-byte blocks by default, or in bytes with -b,
+// and -h prints them in human readable form. Only regular files count
+// towards the totals, since directory sizes are placeholders on the in-memory
+// filesystem. -a prints files as well as directories, -s prints only the
+// total for each argument, and -d N limits the output to N levels deep.
+func Du(hc vsh.RunnerContext, args []string) error {
+	var du diskUsage
+	du.maxDepth = -1
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-a":
+			du.all = true
+		case "-b":
+			du.bytes = true
+		case "-h":
+			du.human = true
+		case "-s":
+			du.maxDepth = 0
+		case "-d":
+			n, err := fp.intValue()
+			if err != nil || n < 0 {
+				return usageError(hc.Stderr, "du", "-d: invalid maximum depth")
+			}
+			du.maxDepth = n
+		default:
+			return usageError(hc.Stderr, "du", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	du.w = hc.Stdout
+	du.stderr = hc.Stderr
+	for _, arg := range args {
+		du.walk(hc.FileSytem, arg, resolvePath(hc.Dir, arg))
+	}
+	if du.failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+type diskUsage struct {
+	w, stderr io.Writer
+
+	all, bytes, human bool
+	maxDepth          int
+
+	failed bool
+}
+
+type duEntry struct {
+	name  string
+	depth int
+	size  int64
+}
+
+func (du *diskUsage) walk(fsys fs.FS, arg, root string) {
+	// Directories are pushed onto the stack as they are visited, and since
+	// the walk is depth-first, they are printed as soon as the walk moves
+	// past their last descendant, which gives the same order as coreutils.
+	var stack []duEntry
+	pop := func() {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		du.print(top)
+		if len(stack) > 0 {
+			stack[len(stack)-1].size += top.size
+		}
+	}
+	fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Fprintf(du.stderr, "du: %s: %v\n", arg, err)
+			du.failed = true
+			return nil
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		entry := duEntry{name: arg, depth: 0}
+		if rel != "" {
+			entry.name = strings.TrimSuffix(arg, "/") + "/" + rel
+			entry.depth = strings.Count(rel, "/") + 1
+		}
+		for len(stack) > 0 && stack[len(stack)-1].depth >= entry.depth {
+			pop()
+		}
+		if d.IsDir() {
+			stack = append(stack, entry)
+			return nil
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				fmt.Fprintf(du.stderr, "du: %s: %v\n", entry.name, err)
+				du.failed = true
+				return nil
+			}
+			entry.size = du.usage(info.Size())
+		}
+		if len(stack) == 0 {
+			// The argument itself is a file.
+			du.print(entry)
+			return nil
+		}
+		stack[len(stack)-1].size += entry.size
+		if du.all {
+			du.print(entry)
+		}
+		return nil
+	})
+	for len(stack) > 0 {
+		pop()
+	}
+}
+
+// usage returns the space used by a file of the given size, in bytes with -b,
+// or in 1024-byte blocks otherwise.
+func (du *diskUsage) usage(size int64) int64 {
+	if du.bytes {
+		return size
+	}
+	return (size + 1023) / 1024
+}
+
+func (du *diskUsage) print(e duEntry) {
+	if du.maxDepth >= 0 && e.depth > du.maxDepth {
+		return
+	}
+	size := strconv.FormatInt(e.size, 10)
+	if du.human {
+		n := e.size
+		if !du.bytes {
+			n *= 1024
+		}
+		size = humanSize(n)
+	}
+	fmt.Fprintf(du.w, "%s\t%s\n", size, e.name)
+}
+
+// humanSize formats a number of bytes with a binary unit suffix, such as
+// "1.5K" or "12M", like the -h flag of coreutils.
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if f < 10 {
+		return fmt.Sprintf("%.1f%c", f, units[i])
+	}
+	return fmt.Sprintf("%.0f%c", f, units[i])
+}
@@ -0,0 +1,301 @@
+package builtin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Ed is a minimal version of the ed line editor, reading its commands from
+// standard input and editing a buffer loaded from the named file, if any.
+//
+// The supported commands are p (print), a, i and c (append, insert and
+// change, reading text until a line with a single "."), d (delete), w
+// (write, optionally to a new file name), q and Q (quit), and = (print the
+// line number). Commands may be prefixed with an address such as "N", "." or
+// "$", optionally followed by "+N" or "-N", or by a range of two addresses
+// separated by a comma; a lone "," is the whole buffer. An address with no
+// command prints the addressed line.
+//
+// As with ed when not reading from a terminal, the first error prints "?"
+// and stops the editor with a non-zero exit status. -s suppresses the byte
+// counts printed when reading and writing files.
+func Ed(hc vsh.RunnerContext, args []string) error {
+	e := editor{hc: hc}
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-s":
+			e.silent = true
+		default:
+			return usageError(hc.Stderr, "ed", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) > 1 {
+		return usageError(hc.Stderr, "ed", "too many arguments")
+	}
+	if len(args) == 1 {
+		e.file = args[0]
+		if err := e.load(); err != nil {
+			fmt.Fprintf(hc.Stderr, "%s: %v\n", e.file, err)
+			fmt.Fprintln(hc.Stdout, "?")
+			return vsh.ExitStatus(1)
+		}
+	}
+
+	in := hc.Stdin
+	if in == nil {
+		in = strings.NewReader("")
+	}
+	e.in = bufio.NewScanner(in)
+	for e.in.Scan() {
+		quit, err := e.command(e.in.Text())
+		if err != nil {
+			fmt.Fprintln(hc.Stdout, "?")
+			return vsh.ExitStatus(1)
+		}
+		if quit {
+			break
+		}
+	}
+	return nil
+}
+
+var errEd = errors.New("invalid command")
+
+// editor holds the state of an ed session.
+type editor struct {
+	hc     vsh.RunnerContext
+	in     *bufio.Scanner
+	silent bool
+
+	file  string   // the default file name
+	lines []string // the buffer, without line endings
+	cur   int      // the current line, 1-indexed; 0 if the buffer is empty
+}
+
+func (e *editor) load() error {
+	data, err := e.hc.FileSytem.ReadFile(resolvePath(e.hc.Dir, e.file))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Editing a new file is fine.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		e.lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	e.cur = len(e.lines)
+	if !e.silent {
+		fmt.Fprintln(e.hc.Stdout, len(data))
+	}
+	return nil
+}
+
+// command runs a single command line, reporting whether the editor should quit.
+func (e *editor) command(line string) (quit bool, err error) {
+	from, to, rest, err := e.addressRange(line)
+	if err != nil {
+		return false, err
+	}
+	cmd, arg := "", ""
+	if rest != "" {
+		cmd, arg = rest[:1], strings.TrimSpace(rest[1:])
+	}
+	if arg != "" && cmd != "w" {
+		return false, errEd
+	}
+	switch cmd {
+	case "":
+		// A bare address prints the addressed line,
+		// and an empty command prints the next one.
+		if line == "" {
+			from, to = e.cur+1, e.cur+1
+		}
+		return false, e.print(to, to)
+	case "p":
+		return false, e.print(from, to)
+	case "=":
+		if line == "=" {
+			to = len(e.lines)
+		}
+		fmt.Fprintln(e.hc.Stdout, to)
+	case "a":
+		e.insert(to, e.readText())
+	case "i":
+		e.insert(max(to-1, 0), e.readText())
+	case "c":
+		if err := e.delete(from, to); err != nil {
+			return false, err
+		}
+		e.insert(from-1, e.readText())
+	case "d":
+		return false, e.delete(from, to)
+	case "w":
+		if arg != "" {
+			e.file = arg
+		}
+		return false, e.write()
+	case "q", "Q":
+		return true, nil
+	default:
+		return false, errEd
+	}
+	return false, nil
+}
+
+// addressRange parses the addresses at the start of line, returning them
+// along with the rest of the line. Without addresses, both default to the
+// current line.
+func (e *editor) addressRange(line string) (from, to int, rest string, err error) {
+	if strings.HasPrefix(line, ",") && (len(line) == 1 || !isAddrStart(line[1])) {
+		return 1, len(e.lines), line[1:], nil
+	}
+	from, rest, ok, err := e.address(line)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if !ok {
+		from = e.cur
+	}
+	to = from
+	if strings.HasPrefix(rest, ",") {
+		if to, rest, ok, err = e.address(rest[1:]); err != nil {
+			return 0, 0, "", err
+		}
+		if !ok {
+			to = len(e.lines)
+		}
+	}
+	if from > to {
+		return 0, 0, "", errEd
+	}
+	return from, to, rest, nil
+}
+
+func isAddrStart(c byte) bool {
+	return c == '.' || c == '$' || c == '+' || c == '-' || ('0' <= c && c <= '9')
+}
+
+// address parses a single address at the start of s.
+func (e *editor) address(s string) (n int, rest string, ok bool, err error) {
+	n = e.cur
+	switch {
+	case s == "":
+		return 0, s, false, nil
+	case s[0] == '.':
+		s, ok = s[1:], true
+	case s[0] == '$':
+		n, s, ok = len(e.lines), s[1:], true
+	case '0' <= s[0] && s[0] <= '9':
+		i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+		if i < 0 {
+			i = len(s)
+		}
+		n, _ = strconv.Atoi(s[:i])
+		s, ok = s[i:], true
+	}
+	// Any number of relative offsets may follow, like "$-1" or "+2".
+	for len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		sign := 1
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+		i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+		if i < 0 {
+			i = len(s)
+		}
+		delta := 1
+		if i > 0 {
+			delta, _ = strconv.Atoi(s[:i])
+		}
+		n += sign * delta
+		s, ok = s[i:], true
+	}
+	if ok && (n < 0 || n > len(e.lines)) {
+		return 0, "", false, errEd
+	}
+	return n, s, ok, nil
+}
+
+// readText reads the lines of input text for a, i and c, up to a line
+// containing just ".".
+func (e *editor) readText() []string {
+	var text []string
+	for e.in.Scan() {
+		line := e.in.Text()
+		if line == "." {
+			break
+		}
+		text = append(text, line)
+	}
+	return text
+}
+
+func (e *editor) print(from, to int) error {
+	if from < 1 || to > len(e.lines) {
+		return errEd
+	}
+	for _, line := range e.lines[from-1 : to] {
+		fmt.Fprintln(e.hc.Stdout, line)
+	}
+	e.cur = to
+	return nil
+}
+
+// insert adds text after line n, where 0 means the start of the buffer.
+func (e *editor) insert(n int, text []string) {
+	lines := make([]string, 0, len(e.lines)+len(text))
+	lines = append(lines, e.lines[:n]...)
+	lines = append(lines, text...)
+	e.lines = append(lines, e.lines[n:]...)
+	e.cur = n + len(text)
+}
+
+func (e *editor) delete(from, to int) error {
+	if from < 1 || to > len(e.lines) {
+		return errEd
+	}
+	e.lines = append(e.lines[:from-1], e.lines[to:]...)
+	// The current line becomes the one after the deleted lines, if any.
+	e.cur = min(from, len(e.lines))
+	return nil
+}
+
+func (e *editor) write() error {
+	if e.file == "" {
+		return errEd
+	}
+	var sb strings.Builder
+	for _, line := range e.lines {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	f, err := e.hc.FileSytem.OpenFile(resolvePath(e.hc.Dir, e.file), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		fmt.Fprintf(e.hc.Stderr, "%s: %v\n", e.file, err)
+		return err
+	}
+	_, err = io.WriteString(f, sb.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(e.hc.Stderr, "%s: %v\n", e.file, err)
+		return err
+	}
+	if !e.silent {
+		fmt.Fprintln(e.hc.Stdout, sb.Len())
+	}
+	return nil
+}
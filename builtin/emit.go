@@ -0,0 +1,35 @@
+package builtin
+
+import (
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Emit sends a structured event to the host, via the sink set with
+// [vsh.WithEventSink], as in "emit progress step=2 total=5". The first
+// argument is the event's name, and the others are KEY=VALUE fields, where a
+// later KEY replaces an earlier one. Without a sink, the event is dropped.
+func Emit(hc vsh.RunnerContext, args []string) error {
+	fp := flagParser{remaining: args}
+	if fp.more() {
+		return usageError(hc.Stderr, "emit", "invalid option %q", fp.flag())
+	}
+	args = fp.args()
+	if len(args) == 0 || args[0] == "" {
+		return usageError(hc.Stderr, "emit", "missing event name")
+	}
+	name := args[0]
+	fields := make(map[string]string, len(args)-1)
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return usageError(hc.Stderr, "emit", "invalid field %q, expected KEY=VALUE", arg)
+		}
+		fields[key] = value
+	}
+	if hc.EventSink != nil {
+		hc.EventSink(name, fields)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package builtin
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/wzshiming/vsh"
+)
+
+// flagParser is used to parse command flags.
+//
+// It mirrors the parser used by the shell builtins: "-ab" is the same as
+// "-a -b", "--" stops the parsing, and a lone "-" is an argument rather than
+// a flag, as it usually stands for standard input.
+type flagParser struct {
+	current   string
+	remaining []string
+}
+
+func (p *flagParser) more() bool {
+	if p.current != "" {
+		// We're still parsing part of "-ab".
+		return true
+	}
+	if len(p.remaining) == 0 {
+		p.remaining = nil
+		return false
+	}
+	arg := p.remaining[0]
+	if arg == "--" {
+		p.remaining = p.remaining[1:]
+		return false
+	}
+	return len(arg) > 1 && arg[0] == '-'
+}
+
+func (p *flagParser) flag() string {
+	arg := p.current
+	if arg == "" {
+		arg = p.remaining[0]
+		p.remaining = p.remaining[1:]
+	} else {
+		p.current = ""
+	}
+	if len(arg) > 2 && arg[1] != '-' {
+		// We have "-ab", so return "-a" and keep "-b".
+		p.current = arg[:1] + arg[2:]
+		arg = arg[:2]
+	}
+	return arg
+}
+
+// value returns the value of the flag that was just parsed, which is either
+// the rest of the current flag group, as in "-w8", or the next argument.
+func (p *flagParser) value() (string, bool) {
+	if p.current != "" {
+		v := p.current[1:]
+		p.current = ""
+		return v, true
+	}
+	if len(p.remaining) == 0 {
+		return "", false
+	}
+	arg := p.remaining[0]
+	p.remaining = p.remaining[1:]
+	return arg, true
+}
+
+// intValue is like value, but it also parses the value as an integer.
+func (p *flagParser) intValue() (int, error) {
+	s, ok := p.value()
+	if !ok {
+		return 0, fmt.Errorf("option requires an argument")
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return n, nil
+}
+
+func (p *flagParser) args() []string { return p.remaining }
+
+// usageError prints a usage error for the named command and returns the
+// exit status that commands use for invalid invocations.
+func usageError(w io.Writer, name string, format string, a ...any) error {
+	fmt.Fprintf(w, "%s: %s\n", name, fmt.Sprintf(format, a...))
+	return vsh.ExitStatus(2)
+}
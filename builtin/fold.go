@@ -0,0 +1,147 @@
+package builtin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Fold wraps the lines of the named files, or of standard input, so that none
+// is wider than -w columns, 80 by default. Lines are read and written one at
+// a time, so fold can sit in the middle of a pipeline.
+//
+// Widths are counted in columns, where a tab moves to the next multiple of 8,
+// a backspace goes back one and a carriage return goes back to the start;
+// with -b, they are counted in bytes instead. With -s, lines are broken after
+// the last blank which fits, if any, rather than at the width exactly.
+func Fold(hc vsh.RunnerContext, args []string) (err error) {
+	f := folder{width: 80}
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-w":
+			if f.width, err = fp.intValue(); err == nil && f.width < 1 {
+				err = fmt.Errorf("invalid number of columns: %d", f.width)
+			}
+			if err != nil {
+				return usageError(hc.Stderr, "fold", "%v", err)
+			}
+		case "-s":
+			f.spaces = true
+		case "-b":
+			f.bytes = true
+		default:
+			return usageError(hc.Stderr, "fold", "invalid option %q", flag)
+		}
+	}
+	files := fp.args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	bw := bufio.NewWriter(hc.Stdout)
+	defer flushOutput(bw, &err)
+	var failed bool
+	for _, name := range files {
+		in, err := openInput(hc, name)
+		if err != nil {
+			fmt.Fprintf(hc.Stderr, "fold: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		err = f.copy(bw, contextReader{hc.Context, in})
+		in.Close()
+		if err != nil {
+			if err := hc.Context.Err(); err != nil {
+				return err
+			}
+			fmt.Fprintf(hc.Stderr, "fold: %s: %v\n", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+type folder struct {
+	width  int
+	spaces bool // break at blanks, with -s
+	bytes  bool // count bytes rather than columns, with -b
+}
+
+// copy writes the lines read from r to bw, wrapped.
+func (f *folder) copy(bw *bufio.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			f.line(bw, line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// line writes a line, with its newline if it has one, wrapped.
+func (f *folder) line(bw *bufio.Writer, line string) {
+	line, newline := strings.CutSuffix(line, "\n")
+	start, col := 0, 0
+	for i := 0; i < len(line); {
+		c, size := utf8.DecodeRuneInString(line[i:])
+		next := f.advance(col, c, size)
+		if next > f.width && i > start {
+			end := i
+			if f.spaces {
+				if blank := strings.LastIndexAny(line[start:i], " \t"); blank >= 0 {
+					end = start + blank + 1
+				}
+			}
+			bw.WriteString(line[start:end])
+			bw.WriteByte('\n')
+			start, col = end, f.columns(line[end:i])
+			continue // count c again, on the new line
+		}
+		col = next
+		i += size
+	}
+	bw.WriteString(line[start:])
+	if newline {
+		bw.WriteByte('\n')
+	}
+}
+
+// advance returns the column after writing c, of size bytes, at col.
+func (f *folder) advance(col int, c rune, size int) int {
+	if f.bytes {
+		return col + size
+	}
+	switch c {
+	case '\b':
+		return max(col-1, 0)
+	case '\r':
+		return 0
+	case '\t':
+		return col + 8 - col%8
+	}
+	return col + 1
+}
+
+// columns returns the column after writing s at the start of a line.
+func (f *folder) columns(s string) int {
+	col := 0
+	for len(s) > 0 {
+		c, size := utf8.DecodeRuneInString(s)
+		col = f.advance(col, c, size)
+		s = s[size:]
+	}
+	return col
+}
@@ -0,0 +1,139 @@
+package builtin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Http fetches a URL, like a small curl, and writes the body of the response
+// to standard output, or to the file given with -o. It can only be used when
+// the runner allows it via [vsh.WithNetwork], and it connects through
+// [vsh.RunnerContext.Dial], so that the dialer set via [vsh.WithDialer]
+// decides which hosts can be reached.
+//
+// The request is a GET, unless -X gives another method. Each -H adds a header
+// like "Name: value", and -d sends data as the body of a POST, joining the
+// data of many -d flags with "&" as curl does.
+//
+// By default, an HTTP error status such as 404 is not a failure, and the body
+// of the response is written all the same. With -f, it fails with the exit
+// status 22 instead, like curl. -s silences the error messages, unless -S is
+// also given.
+func Http(hc vsh.RunnerContext, args []string) error {
+	method := ""
+	header := make(http.Header)
+	var data []string
+	output := ""
+	fail, silent, showErrors := false, false, false
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-o", "-X", "-H", "-d":
+			value, ok := fp.value()
+			if !ok {
+				return usageError(hc.Stderr, "curl", "option %s requires an argument", flag)
+			}
+			switch flag {
+			case "-o":
+				output = value
+			case "-X":
+				method = value
+			case "-H":
+				name, hvalue, ok := strings.Cut(value, ":")
+				if !ok {
+					return usageError(hc.Stderr, "curl", "invalid header %q", value)
+				}
+				header.Add(strings.TrimSpace(name), strings.TrimSpace(hvalue))
+			case "-d":
+				data = append(data, value)
+			}
+		case "-f":
+			fail = true
+		case "-s":
+			silent = true
+		case "-S":
+			showErrors = true
+		default:
+			return usageError(hc.Stderr, "curl", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	switch {
+	case len(args) == 0:
+		return usageError(hc.Stderr, "curl", "no URL specified")
+	case len(args) > 1:
+		return usageError(hc.Stderr, "curl", "too many arguments")
+	}
+	url := args[0]
+	errorf := func(status int, format string, a ...any) error {
+		if !silent || showErrors {
+			fmt.Fprintf(hc.Stderr, "curl: "+format+"\n", a...)
+		}
+		return vsh.ExitStatus(status)
+	}
+	if !hc.Network {
+		return errorf(1, "%s: network access is disabled", url)
+	}
+
+	var body io.Reader
+	if data != nil {
+		body = strings.NewReader(strings.Join(data, "&"))
+		if method == "" {
+			method = http.MethodPost
+		}
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(hc.Context, method, url, body)
+	if err != nil {
+		return errorf(1, "%v", err)
+	}
+	req.Header = header
+	// Connect via the runner, which decides what the command can reach.
+	// Proxies from the host's environment are not used, for the same reason.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = hc.Dial
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		if err := hc.Context.Err(); err != nil {
+			return err
+		}
+		return errorf(1, "%v", err)
+	}
+	defer resp.Body.Close()
+	if fail && resp.StatusCode >= 400 {
+		return errorf(22, "%s: the requested URL returned error: %s", url, resp.Status)
+	}
+
+	if output == "" {
+		_, err = io.Copy(hc.Stdout, resp.Body)
+	} else {
+		var f io.WriteCloser
+		f, err = hc.FileSytem.OpenFile(resolvePath(hc.Dir, output), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			return errorf(1, "%s: %v", output, err)
+		}
+		_, err = io.Copy(f, resp.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		if err := hc.Context.Err(); err != nil {
+			return err
+		}
+		return errorf(1, "%s: %v", url, err)
+	}
+	return nil
+}
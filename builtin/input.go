@@ -0,0 +1,55 @@
+package builtin
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// openInput opens the named file relative to the current directory. The name
+// "-" stands for standard input, which is never closed.
+func openInput(hc vsh.RunnerContext, name string) (io.ReadCloser, error) {
+	if name == "-" {
+		if hc.Stdin == nil {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return io.NopCloser(hc.Stdin), nil
+	}
+	return hc.FileSytem.Open(resolvePath(hc.Dir, name))
+}
+
+// resolvePath returns the path of the named file, which is relative to dir
+// unless it is absolute.
+func resolvePath(dir, name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(dir, name)
+}
+
+// contextReader stops reading from r once ctx is done, so that commands
+// copying their input stop when the shell is interrupted.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// flushOutput flushes bw, keeping the first error in errp. It is meant to be
+// deferred by commands which buffer their output, so that what they produced
+// before an error or an interrupt still reaches the user.
+func flushOutput(bw *bufio.Writer, errp *error) {
+	if err := bw.Flush(); *errp == nil {
+		*errp = err
+	}
+}
@@ -0,0 +1,363 @@
+package builtin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Jq runs a filter over each JSON value read from the named files, or from
+// standard input, and writes the results as JSON, like a small jq.
+//
+// Filters are paths made of the identity ".", fields like ".foo.bar" or
+// `."a key"`, indexes like ".[0]", where negative ones count from the end,
+// and iterations over the elements of arrays or the values of objects, like
+// ".[]". Paths are joined with "|", which runs the filter on its right on
+// each result of the one on its left. As with jq, indexing null gives null.
+//
+// Results are indented, unless -c is given. With -r, strings are written as
+// they are, without quotes. Note that the keys of objects are sorted in the
+// output, as with jq -S.
+func Jq(hc vsh.RunnerContext, args []string) (err error) {
+	raw, compact := false, false
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-r":
+			raw = true
+		case "-c":
+			compact = true
+		default:
+			return usageError(hc.Stderr, "jq", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) == 0 {
+		return usageError(hc.Stderr, "jq", "no filter given")
+	}
+	filter, err := parseJq(args[0])
+	if err != nil {
+		return usageError(hc.Stderr, "jq", "%v", err)
+	}
+	files := args[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	bw := bufio.NewWriter(hc.Stdout)
+	defer flushOutput(bw, &err)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if !compact {
+		enc.SetIndent("", "  ")
+	}
+	emit := func(v any) error {
+		if s, ok := v.(string); ok && raw {
+			_, err := fmt.Fprintln(bw, s)
+			return err
+		}
+		return enc.Encode(v)
+	}
+
+	var failed bool
+	for _, name := range files {
+		f, err := openInput(hc, name)
+		if err != nil {
+			fmt.Fprintf(hc.Stderr, "jq: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		dec := json.NewDecoder(contextReader{hc.Context, f})
+		dec.UseNumber()
+		for {
+			var v any
+			err := dec.Decode(&v)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if err := hc.Context.Err(); err != nil {
+					f.Close()
+					return err
+				}
+				fmt.Fprintf(hc.Stderr, "jq: %s: invalid JSON: %v\n", name, err)
+				failed = true
+				break
+			}
+			if err := filter(v, emit); err != nil {
+				var jerr jqError
+				if !errors.As(err, &jerr) {
+					f.Close()
+					return err // failed to write the output
+				}
+				fmt.Fprintf(hc.Stderr, "jq: error: %v\n", err)
+				failed = true
+			}
+		}
+		f.Close()
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// jqFilter runs a filter on v, calling emit with each of its results.
+type jqFilter func(v any, emit func(any) error) error
+
+// jqError is an error from running a filter on a value, as opposed to one
+// from writing its results.
+type jqError string
+
+func (e jqError) Error() string { return string(e) }
+
+// jqType returns the name of the type of a JSON value, as used by jq.
+func jqType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number, float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+func jqIdentity(v any, emit func(any) error) error { return emit(v) }
+
+func jqField(key string) jqFilter {
+	return func(v any, emit func(any) error) error {
+		switch v := v.(type) {
+		case nil:
+			return emit(nil)
+		case map[string]any:
+			return emit(v[key])
+		}
+		return jqError(fmt.Sprintf("cannot index %s with %q", jqType(v), key))
+	}
+}
+
+func jqIndex(i int) jqFilter {
+	return func(v any, emit func(any) error) error {
+		switch v := v.(type) {
+		case nil:
+			return emit(nil)
+		case []any:
+			j := i
+			if j < 0 {
+				j += len(v)
+			}
+			if j < 0 || j >= len(v) {
+				return emit(nil)
+			}
+			return emit(v[j])
+		}
+		return jqError(fmt.Sprintf("cannot index %s with number", jqType(v)))
+	}
+}
+
+func jqIterate(v any, emit func(any) error) error {
+	switch v := v.(type) {
+	case []any:
+		for _, elem := range v {
+			if err := emit(elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			if err := emit(v[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return jqError(fmt.Sprintf("cannot iterate over %s", jqType(v)))
+}
+
+// jqPipe runs g on each result of f.
+func jqPipe(f, g jqFilter) jqFilter {
+	return func(v any, emit func(any) error) error {
+		return f(v, func(v any) error { return g(v, emit) })
+	}
+}
+
+// parseJq parses a filter, which is one or more paths joined with "|".
+func parseJq(src string) (jqFilter, error) {
+	p := jqParser{src: src}
+	f, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos == len(p.src) {
+			return f, nil
+		}
+		if p.src[p.pos] != '|' {
+			return nil, p.errorf("unexpected %q", p.src[p.pos:])
+		}
+		p.pos++
+		g, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		f = jqPipe(f, g)
+	}
+}
+
+type jqParser struct {
+	src string
+	pos int
+}
+
+func (p *jqParser) errorf(format string, a ...any) error {
+	return fmt.Errorf("invalid filter %q: %s", p.src, fmt.Sprintf(format, a...))
+}
+
+func (p *jqParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// peek reports whether the next byte is c.
+func (p *jqParser) peek(c byte) bool {
+	return p.pos < len(p.src) && p.src[p.pos] == c
+}
+
+// path parses a path such as ".", ".foo[0]" or `.[]."a b"`.
+func (p *jqParser) path() (jqFilter, error) {
+	p.skipSpace()
+	if !p.peek('.') {
+		if p.pos == len(p.src) {
+			return nil, p.errorf("missing path")
+		}
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	p.pos++
+	f := jqFilter(jqIdentity)
+	first := true
+	for {
+		var step jqFilter
+		var err error
+		switch {
+		case p.peek('['):
+			step, err = p.bracket()
+		case first && p.fieldStart(p.pos):
+			step, err = p.field()
+		case p.peek('.') && (p.fieldStart(p.pos+1) || p.pos+1 < len(p.src) && p.src[p.pos+1] == '['):
+			p.pos++
+			if p.peek('[') {
+				step, err = p.bracket()
+			} else {
+				step, err = p.field()
+			}
+		default:
+			return f, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			f = step
+		} else {
+			f = jqPipe(f, step)
+		}
+		first = false
+	}
+}
+
+func isJqIdent(c byte, rest bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || rest && '0' <= c && c <= '9'
+}
+
+// fieldStart reports whether a field name starts at i.
+func (p *jqParser) fieldStart(i int) bool {
+	return i < len(p.src) && (p.src[i] == '"' || isJqIdent(p.src[i], false))
+}
+
+// field parses the name of a field, either as an identifier or quoted.
+func (p *jqParser) field() (jqFilter, error) {
+	if p.peek('"') {
+		key, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return jqField(key), nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) && isJqIdent(p.src[p.pos], true) {
+		p.pos++
+	}
+	return jqField(p.src[start:p.pos]), nil
+}
+
+// str parses a string literal, as in JSON.
+func (p *jqParser) str() (string, error) {
+	start := p.pos
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos++
+		case '"':
+			p.pos++
+			var s string
+			if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+				return "", p.errorf("invalid string %s", p.src[start:p.pos])
+			}
+			return s, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// bracket parses an iteration "[]", or an index such as "[0]" or `["key"]`.
+func (p *jqParser) bracket() (jqFilter, error) {
+	p.pos++ // '['
+	p.skipSpace()
+	var f jqFilter
+	switch {
+	case p.peek(']'):
+		f = jqIterate
+	case p.peek('"'):
+		key, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		f = jqField(key)
+	default:
+		start := p.pos
+		if p.peek('-') {
+			p.pos++
+		}
+		for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		i, err := strconv.Atoi(p.src[start:p.pos])
+		if err != nil {
+			return nil, p.errorf("invalid index %q", p.src[start:])
+		}
+		f = jqIndex(i)
+	}
+	p.skipSpace()
+	if !p.peek(']') {
+		return nil, p.errorf("missing ]")
+	}
+	p.pos++
+	return f, nil
+}
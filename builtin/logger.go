@@ -0,0 +1,129 @@
+package builtin
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Logger sends a message to the host's log sink, set via [vsh.WithLogger],
+// like logger does with syslog. The message is made of the arguments, or else
+// each non-empty line of standard input is sent as a separate message.
+//
+// -t TAG sets the tag recorded with each message, which defaults to "vsh".
+// -p PRIORITY sets the priority, as FACILITY.LEVEL or just LEVEL, and defaults
+// to "user.notice". Messages are recorded with the "tag" and "priority"
+// attributes, at the slog level closest to the priority's level. Without a log
+// sink, or with -s, messages are also written to standard error as "TAG: MSG".
+func Logger(hc vsh.RunnerContext, args []string) error {
+	tag := "vsh"
+	facility, level := "user", "notice"
+	toStderr := hc.Logger == nil
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-t":
+			var ok bool
+			if tag, ok = fp.value(); !ok {
+				return usageError(hc.Stderr, "logger", "-t: option requires an argument")
+			}
+		case "-p":
+			pri, ok := fp.value()
+			if !ok {
+				return usageError(hc.Stderr, "logger", "-p: option requires an argument")
+			}
+			var err error
+			if facility, level, err = parsePriority(pri); err != nil {
+				return usageError(hc.Stderr, "logger", "%v", err)
+			}
+		case "-s":
+			toStderr = true
+		default:
+			return usageError(hc.Stderr, "logger", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+
+	log := func(msg string) {
+		if hc.Logger != nil {
+			hc.Logger.Log(hc.Context, syslogLevels[level], msg,
+				slog.String("tag", tag),
+				slog.String("priority", facility+"."+level),
+			)
+		}
+		if toStderr {
+			fmt.Fprintf(hc.Stderr, "%s: %s\n", tag, msg)
+		}
+	}
+	if len(args) > 0 {
+		log(strings.Join(args, " "))
+		return nil
+	}
+	f, err := openInput(hc, "-")
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "logger: %v\n", err)
+		return vsh.ExitStatus(1)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			log(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(hc.Stderr, "logger: %v\n", err)
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// syslogLevels maps the syslog levels to the closest slog levels.
+var syslogLevels = map[string]slog.Level{
+	"emerg":   slog.LevelError,
+	"alert":   slog.LevelError,
+	"crit":    slog.LevelError,
+	"err":     slog.LevelError,
+	"warning": slog.LevelWarn,
+	"notice":  slog.LevelInfo,
+	"info":    slog.LevelInfo,
+	"debug":   slog.LevelDebug,
+}
+
+// syslogLevelAliases are the deprecated names for some levels.
+var syslogLevelAliases = map[string]string{
+	"panic": "emerg",
+	"error": "err",
+	"warn":  "warning",
+}
+
+var syslogFacilities = []string{
+	"auth", "authpriv", "cron", "daemon", "ftp", "kern", "local0", "local1",
+	"local2", "local3", "local4", "local5", "local6", "local7", "lpr", "mail",
+	"news", "security", "syslog", "user", "uucp",
+}
+
+// parsePriority parses a priority like "local0.info" or "err", returning the
+// canonical names of its facility and level.
+func parsePriority(pri string) (facility, level string, err error) {
+	facility, level, found := strings.Cut(strings.ToLower(pri), ".")
+	if !found {
+		facility, level = "user", facility
+	}
+	if facility == "security" {
+		facility = "auth"
+	} else if !slices.Contains(syslogFacilities, facility) {
+		return "", "", fmt.Errorf("unknown facility name: %s", facility)
+	}
+	if alias, ok := syslogLevelAliases[level]; ok {
+		level = alias
+	}
+	if _, ok := syslogLevels[level]; !ok {
+		return "", "", fmt.Errorf("unknown priority name: %s", level)
+	}
+	return facility, level, nil
+}
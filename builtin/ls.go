@@ -18,7 +18,7 @@ func Ls(hc vsh.RunnerContext, arg []string) error {
 	entries, err := fs.ReadDir(hc.FileSytem, dir)
 	if err != nil {
 		fmt.Fprintf(hc.Stderr, "ls: %s: %v\n", dir, err)
-		return nil
+		return vsh.ExitStatus(1)
 	}
 
 	for _, entry := range entries {
@@ -0,0 +1,139 @@
+package builtin
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Mktemp creates a file or, with -d, a directory with a unique name, and
+// prints its path.
+//
+// The name comes from TEMPLATE, which defaults to "tmp.XXXXXXXXXX", with its
+// trailing run of at least three X characters replaced by random ones. With no
+// TEMPLATE, or with -t, the file is created in $TMPDIR, or /tmp if that is not
+// set; the directory is created first if needed. -p DIR creates it in DIR
+// instead, and a TEMPLATE on its own is relative to the current directory.
+// -u only prints a name without creating anything, and -q silences errors.
+func Mktemp(hc vsh.RunnerContext, args []string) error {
+	var dir, quiet, dryRun, inTemp bool
+	parent := ""
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-d":
+			dir = true
+		case "-q":
+			quiet = true
+		case "-u":
+			dryRun = true
+		case "-t":
+			inTemp = true
+		case "-p":
+			var ok bool
+			if parent, ok = fp.value(); !ok {
+				return usageError(hc.Stderr, "mktemp", "-p: option requires an argument")
+			}
+		default:
+			return usageError(hc.Stderr, "mktemp", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) > 1 {
+		return usageError(hc.Stderr, "mktemp", "too many templates")
+	}
+	template := "tmp.XXXXXXXXXX"
+	if len(args) == 1 {
+		template = args[0]
+	} else {
+		inTemp = true
+	}
+
+	fail := func(format string, a ...any) error {
+		if !quiet {
+			fmt.Fprintf(hc.Stderr, "mktemp: "+format+"\n", a...)
+		}
+		return vsh.ExitStatus(1)
+	}
+	prefix := strings.TrimRight(template, "X")
+	if n := len(template) - len(prefix); n < 3 {
+		return fail("too few X's in template %q", template)
+	}
+	if (inTemp || parent != "") && strings.Contains(template, "/") {
+		return fail("invalid template %q, contains directory separator", template)
+	}
+
+	base := hc.Dir
+	switch {
+	case parent != "":
+		base = resolvePath(hc.Dir, parent)
+	case inTemp:
+		base = tempDir(hc)
+		if !dryRun {
+			if err := hc.FileSytem.MkdirAll(base, 0o777); err != nil {
+				return fail("%s: %v", base, err)
+			}
+		}
+	}
+
+	for range 100 {
+		name := prefix + randomSuffix(hc, len(template)-len(prefix))
+		full := resolvePath(base, name)
+		if _, err := hc.FileSytem.Lstat(full); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if !dryRun {
+			var err error
+			if dir {
+				err = hc.FileSytem.MkdirAll(full, 0o700)
+			} else {
+				var f fs.File
+				if f, err = hc.FileSytem.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600); err == nil {
+					err = f.Close()
+				}
+			}
+			if err != nil {
+				return fail("failed to create %q: %v", full, err)
+			}
+		}
+		// Like coreutils, a TEMPLATE on its own is printed as a relative path.
+		if inTemp || parent != "" {
+			fmt.Fprintln(hc.Stdout, full)
+		} else {
+			fmt.Fprintln(hc.Stdout, name)
+		}
+		return nil
+	}
+	return fail("failed to create a unique name from template %q", template)
+}
+
+// tempDir returns $TMPDIR if it's an absolute path, or /tmp otherwise.
+func tempDir(hc vsh.RunnerContext) string {
+	if hc.Env != nil {
+		if dir := hc.Env.Get("TMPDIR").String(); path.IsAbs(dir) {
+			return dir
+		}
+	}
+	return "/tmp"
+}
+
+// randomSuffix returns n random letters and digits from hc.Rand, or from
+// the global source if that is not set.
+func randomSuffix(hc vsh.RunnerContext, n int) string {
+	intN := rand.IntN
+	if hc.Rand != nil {
+		intN = hc.Rand.IntN
+	}
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = chars[intN(len(chars))]
+	}
+	return string(b)
+}
@@ -0,0 +1,129 @@
+package builtin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Nl writes the named files, or standard input, with line numbers.
+//
+// It supports the start (-v), increment (-i), width (-w), separator (-s) and
+// body numbering style (-b a|t|n) options. Numbering continues across files.
+func Nl(hc vsh.RunnerContext, args []string) error {
+	n := lineNumberer{
+		next:  1,
+		incr:  1,
+		width: 6,
+		sep:   "\t",
+		style: 't',
+	}
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		var err error
+		switch flag := fp.flag(); flag {
+		case "-v":
+			n.next, err = fp.intValue()
+		case "-i":
+			n.incr, err = fp.intValue()
+		case "-w":
+			n.width, err = fp.intValue()
+			if err == nil && n.width < 1 {
+				err = fmt.Errorf("invalid line number field width: %d", n.width)
+			}
+		case "-s":
+			var ok bool
+			if n.sep, ok = fp.value(); !ok {
+				err = fmt.Errorf("option requires an argument")
+			}
+		case "-b":
+			style, _ := fp.value()
+			switch style {
+			case "a", "t", "n":
+				n.style = style[0]
+			default:
+				err = fmt.Errorf("invalid body numbering style: %q", style)
+			}
+		default:
+			err = fmt.Errorf("invalid option %q", flag)
+		}
+		if err != nil {
+			return usageError(hc.Stderr, "nl", "%v", err)
+		}
+	}
+	n.blank = strings.Repeat(" ", n.width+len(n.sep))
+
+	files := fp.args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var failed bool
+	for _, name := range files {
+		f, err := openInput(hc, name)
+		if err != nil {
+			fmt.Fprintf(hc.Stderr, "nl: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		err = n.copy(hc.Stdout, contextReader{hc.Context, f})
+		f.Close()
+		if err != nil {
+			if err := hc.Context.Err(); err != nil {
+				return err
+			}
+			fmt.Fprintf(hc.Stderr, "nl: %s: %v\n", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// lineNumberer prefixes lines with their number, as done by nl and cat -n.
+type lineNumberer struct {
+	next  int
+	incr  int
+	width int
+	sep   string
+
+	// style is 'a' to number all lines, 't' to number non-empty lines only,
+	// and 'n' to number no lines.
+	style byte
+
+	// blank is written before the lines that aren't numbered.
+	blank string
+}
+
+func (n *lineNumberer) copy(w io.Writer, r io.Reader) (err error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	defer flushOutput(bw, &err)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			n.writeLine(bw, line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (n *lineNumberer) writeLine(w io.Writer, line string) {
+	numbered := n.style == 'a' || (n.style == 't' && line != "\n")
+	if !numbered {
+		io.WriteString(w, n.blank)
+		io.WriteString(w, line)
+		return
+	}
+	fmt.Fprintf(w, "%*d%s%s", n.width, n.next, n.sep, line)
+	n.next += n.incr
+}
@@ -0,0 +1,482 @@
+package builtin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// patchMaxFuzz is the number of context lines at either end of a hunk which
+// may be ignored when it doesn't apply cleanly, like the default of GNU patch.
+const patchMaxFuzz = 2
+
+// Patch applies a unified diff, read from standard input or from the file
+// given with -i, to the files it names.
+//
+// -pN strips the N leading components from the file names in the diff; by
+// default only the base names are used. -R applies the diff in reverse, and
+// --dry-run prints what would happen without changing any files.
+//
+// Hunks which don't apply at their stated line are looked for elsewhere in
+// the file, ignoring up to two lines of context at either end if needed.
+// Hunks which still don't apply are saved to FILE.rej, and patch exits with
+// status 1.
+func Patch(hc vsh.RunnerContext, args []string) error {
+	p := patchCmd{hc: hc, strip: -1}
+	input := "-"
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-p":
+			n, err := fp.intValue()
+			if err != nil || n < 0 {
+				return usageError(hc.Stderr, "patch", "-p: invalid strip count")
+			}
+			p.strip = n
+		case "-i":
+			var ok bool
+			if input, ok = fp.value(); !ok {
+				return usageError(hc.Stderr, "patch", "-i: option requires an argument")
+			}
+		case "-R":
+			p.reverse = true
+		case "--dry-run":
+			p.dryRun = true
+		default:
+			return usageError(hc.Stderr, "patch", "invalid option %q", flag)
+		}
+	}
+	if len(fp.args()) > 0 {
+		return usageError(hc.Stderr, "patch", "file operands are not supported")
+	}
+
+	f, err := openInput(hc, input)
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "patch: %s: %v\n", input, err)
+		return vsh.ExitStatus(2)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "patch: %s: %v\n", input, err)
+		return vsh.ExitStatus(2)
+	}
+	patches, err := parsePatch(string(data))
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "patch: **** %v\n", err)
+		return vsh.ExitStatus(2)
+	}
+	if len(patches) == 0 {
+		fmt.Fprintln(hc.Stderr, "patch: **** Only garbage was found in the patch input.")
+		return vsh.ExitStatus(2)
+	}
+
+	for _, fpatch := range patches {
+		if p.reverse {
+			fpatch.reverse()
+		}
+		p.apply(fpatch)
+	}
+	if p.failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+const devNull = "/dev/null"
+
+type patchCmd struct {
+	hc vsh.RunnerContext
+
+	strip   int // -1 to use base names
+	reverse bool
+	dryRun  bool
+
+	// failed records hunks or files which could not be patched, which
+	// doesn't stop the rest of the patch from being applied.
+	failed bool
+}
+
+// filePatch holds the hunks of a diff for a single file.
+type filePatch struct {
+	oldName, newName string
+	hunks            []*hunk
+}
+
+// hunk is a single hunk of a unified diff. Each line starts with ' ', '-'
+// or '+', and ends with a newline unless the file it comes from doesn't.
+type hunk struct {
+	oldStart, oldLines int
+	newStart, newLines int
+	lines              []string
+}
+
+func (fp *filePatch) reverse() {
+	fp.oldName, fp.newName = fp.newName, fp.oldName
+	for _, h := range fp.hunks {
+		h.oldStart, h.newStart = h.newStart, h.oldStart
+		h.oldLines, h.newLines = h.newLines, h.oldLines
+		for i, line := range h.lines {
+			switch line[0] {
+			case '-':
+				h.lines[i] = "+" + line[1:]
+			case '+':
+				h.lines[i] = "-" + line[1:]
+			}
+		}
+	}
+}
+
+// sides returns the lines the hunk expects to find, and the lines it
+// replaces them with, ignoring lead and trail lines of context at either end.
+func (h *hunk) sides(lead, trail int) (from, to []string) {
+	for _, line := range h.lines[lead : len(h.lines)-trail] {
+		if line[0] != '+' {
+			from = append(from, line[1:])
+		}
+		if line[0] != '-' {
+			to = append(to, line[1:])
+		}
+	}
+	return from, to
+}
+
+// context returns the number of context lines at the start and end of the hunk.
+func (h *hunk) context() (lead, trail int) {
+	for lead < len(h.lines) && h.lines[lead][0] == ' ' {
+		lead++
+	}
+	for trail < len(h.lines)-lead && h.lines[len(h.lines)-1-trail][0] == ' ' {
+		trail++
+	}
+	return lead, trail
+}
+
+func (h *hunk) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", h.oldStart, h.oldLines, h.newStart, h.newLines)
+	for _, line := range h.lines {
+		sb.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	return sb.String()
+}
+
+// parsePatch parses the unified diffs in text. Lines outside of the diffs,
+// such as "diff" or "index" headers, are ignored.
+func parsePatch(text string) ([]*filePatch, error) {
+	lines := strings.SplitAfter(text, "\n")
+	var patches []*filePatch
+	var cur *filePatch
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			cur = &filePatch{
+				oldName: patchFileName(line[4:]),
+				newName: patchFileName(lines[i+1][4:]),
+			}
+			patches = append(patches, cur)
+			i++
+		case strings.HasPrefix(line, "@@ ") && cur != nil:
+			h, err := parseHunkHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("malformed patch at line %d: %s", i+1, strings.TrimSuffix(line, "\n"))
+			}
+			oldLeft, newLeft := h.oldLines, h.newLines
+			for oldLeft > 0 || newLeft > 0 {
+				i++
+				if i >= len(lines) || lines[i] == "" {
+					return nil, fmt.Errorf("unexpected end of file in patch")
+				}
+				line := lines[i]
+				if line == "\n" {
+					// Some tools strip the trailing space of empty context lines.
+					line = " \n"
+				}
+				switch line[0] {
+				case ' ':
+					oldLeft--
+					newLeft--
+				case '-':
+					oldLeft--
+				case '+':
+					newLeft--
+				case '\\':
+					h.noNewline()
+					continue
+				default:
+					return nil, fmt.Errorf("malformed patch at line %d: %s", i+1, strings.TrimSuffix(line, "\n"))
+				}
+				if oldLeft < 0 || newLeft < 0 {
+					return nil, fmt.Errorf("malformed patch at line %d: %s", i+1, strings.TrimSuffix(line, "\n"))
+				}
+				h.lines = append(h.lines, line)
+			}
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\") {
+				h.noNewline()
+				i++
+			}
+			cur.hunks = append(cur.hunks, h)
+		}
+	}
+	return patches, nil
+}
+
+// noNewline handles a "\ No newline at end of file" marker, which applies to
+// the line before it.
+func (h *hunk) noNewline() {
+	if n := len(h.lines); n > 0 {
+		h.lines[n-1] = strings.TrimSuffix(h.lines[n-1], "\n")
+	}
+}
+
+// patchFileName returns the name from a "---" or "+++" line, without any
+// timestamp which follows it.
+func patchFileName(s string) string {
+	s = strings.TrimRight(s, "\r\n")
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// parseHunkHeader parses a line like "@@ -1,3 +1,4 @@".
+func parseHunkHeader(line string) (*hunk, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[3] != "@@" ||
+		!strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return nil, errors.New("invalid hunk header")
+	}
+	h := &hunk{}
+	var err error
+	if h.oldStart, h.oldLines, err = parseHunkRange(fields[1][1:]); err != nil {
+		return nil, err
+	}
+	if h.newStart, h.newLines, err = parseHunkRange(fields[2][1:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseHunkRange parses "start,count", where the count defaults to one.
+func parseHunkRange(s string) (start, count int, err error) {
+	startStr, countStr, found := strings.Cut(s, ",")
+	if start, err = strconv.Atoi(startStr); err != nil || start < 0 {
+		return 0, 0, errors.New("invalid hunk range")
+	}
+	count = 1
+	if found {
+		if count, err = strconv.Atoi(countStr); err != nil || count < 0 {
+			return 0, 0, errors.New("invalid hunk range")
+		}
+	}
+	return start, count, nil
+}
+
+// target returns the name of the file to patch, after stripping its leading
+// components, and whether the patch creates or deletes it.
+func (p *patchCmd) target(fpatch *filePatch) (name string, creates, deletes bool) {
+	creates = fpatch.oldName == devNull
+	deletes = fpatch.newName == devNull
+	oldName, newName := p.stripName(fpatch.oldName), p.stripName(fpatch.newName)
+	switch {
+	case creates:
+		return newName, true, false
+	case deletes:
+		return oldName, false, true
+	}
+	// Prefer whichever file exists, starting with the old one.
+	if _, err := p.hc.FileSytem.Stat(resolvePath(p.hc.Dir, oldName)); err == nil {
+		return oldName, false, false
+	}
+	return newName, false, false
+}
+
+func (p *patchCmd) stripName(name string) string {
+	if p.strip < 0 {
+		return path.Base(name)
+	}
+	name = path.Clean(name)
+	for range p.strip {
+		_, rest, found := strings.Cut(strings.TrimLeft(name, "/"), "/")
+		if !found {
+			break
+		}
+		name = rest
+	}
+	return name
+}
+
+// apply applies the hunks of a single file's diff.
+func (p *patchCmd) apply(fpatch *filePatch) {
+	name, creates, deletes := p.target(fpatch)
+	full := resolvePath(p.hc.Dir, name)
+	if p.dryRun {
+		fmt.Fprintf(p.hc.Stdout, "checking file %s\n", name)
+	} else {
+		fmt.Fprintf(p.hc.Stdout, "patching file %s\n", name)
+	}
+
+	var lines []string
+	data, err := p.hc.FileSytem.ReadFile(full)
+	switch {
+	case err == nil:
+		lines = strings.SplitAfter(string(data), "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+	case creates && errors.Is(err, fs.ErrNotExist):
+	default:
+		fmt.Fprintf(p.hc.Stderr, "patch: %s: %v\n", name, err)
+		p.failed = true
+		return
+	}
+
+	var rejects []*hunk
+	offset, minPos := 0, 0
+	for i, h := range fpatch.hunks {
+		var ok bool
+		if lines, minPos, ok = p.applyHunk(lines, h, i+1, minPos, &offset); !ok {
+			rejects = append(rejects, h)
+		}
+	}
+
+	if len(rejects) > 0 {
+		p.failed = true
+		plural := "s"
+		if len(fpatch.hunks) == 1 {
+			plural = ""
+		}
+		rej := name + ".rej"
+		fmt.Fprintf(p.hc.Stdout, "%d out of %d hunk%s FAILED -- saving rejects to file %s\n",
+			len(rejects), len(fpatch.hunks), plural, rej)
+		if !p.dryRun {
+			var sb strings.Builder
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fpatch.oldName, fpatch.newName)
+			for _, h := range rejects {
+				sb.WriteString(h.String())
+			}
+			if err := p.writeFile(resolvePath(p.hc.Dir, rej), sb.String()); err != nil {
+				fmt.Fprintf(p.hc.Stderr, "patch: %s: %v\n", rej, err)
+			}
+		}
+	}
+	if p.dryRun || len(rejects) == len(fpatch.hunks) {
+		return
+	}
+
+	content := strings.Join(lines, "")
+	if deletes && content == "" {
+		err = p.hc.FileSytem.Remove(full)
+	} else {
+		if creates {
+			err = p.hc.FileSytem.MkdirAll(path.Dir(full), 0o755)
+		}
+		if err == nil {
+			err = p.writeFile(full, content)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(p.hc.Stderr, "patch: %s: %v\n", name, err)
+		p.failed = true
+	}
+}
+
+// applyHunk applies h to lines, looking for it at its stated position first
+// and then further away, with increasing fuzz. minPos is the first line the
+// hunk may touch, so that hunks are applied in order. The line numbers of
+// later hunks are adjusted by the offset at which earlier ones applied.
+func (p *patchCmd) applyHunk(lines []string, h *hunk, num, minPos int, offset *int) ([]string, int, bool) {
+	lead, trail := h.context()
+	for fuzz := 0; fuzz <= patchMaxFuzz; fuzz++ {
+		if fuzz > 0 && fuzz > lead && fuzz > trail {
+			// Ignoring more context than the hunk has wouldn't change anything.
+			break
+		}
+		skipLead, skipTrail := min(fuzz, lead), min(fuzz, trail)
+		from, to := h.sides(skipLead, skipTrail)
+		want := h.oldStart - 1 + *offset + skipLead
+		if h.oldLines == 0 {
+			// An insertion goes after its stated line.
+			want++
+		}
+		pos, ok := findLines(lines, from, want, minPos)
+		if !ok {
+			continue
+		}
+		out := make([]string, 0, len(lines)-len(from)+len(to))
+		out = append(out, lines[:pos]...)
+		out = append(out, to...)
+		out = append(out, lines[pos+len(from):]...)
+
+		// Like GNU patch, the offset reported is from the line stated in
+		// the hunk, and not from where earlier hunks suggested it would be.
+		if moved := pos - (want - *offset); moved != 0 || fuzz > 0 {
+			msg := fmt.Sprintf("Hunk #%d succeeded at %d", num, pos-skipLead+1)
+			if fuzz > 0 {
+				msg += fmt.Sprintf(" with fuzz %d", fuzz)
+			}
+			if moved != 0 {
+				unit := "lines"
+				if moved == 1 || moved == -1 {
+					unit = "line"
+				}
+				msg += fmt.Sprintf(" (offset %d %s)", moved, unit)
+			}
+			fmt.Fprintln(p.hc.Stdout, msg+".")
+		}
+		*offset += pos - want
+		return out, pos + len(to), true
+	}
+	fmt.Fprintf(p.hc.Stdout, "Hunk #%d FAILED at %d.\n", num, h.oldStart)
+	return lines, minPos, false
+}
+
+// findLines returns the position of old in lines closest to want, and no
+// earlier than minPos.
+func findLines(lines, old []string, want, minPos int) (int, bool) {
+	last := len(lines) - len(old)
+	for dist := 0; ; dist++ {
+		before, after := want-dist, want+dist
+		if before < minPos && after > last {
+			return 0, false
+		}
+		if after <= last && after >= minPos && matchLines(lines[after:], old) {
+			return after, true
+		}
+		if dist > 0 && before >= minPos && before <= last && matchLines(lines[before:], old) {
+			return before, true
+		}
+	}
+}
+
+func matchLines(lines, old []string) bool {
+	for i, line := range old {
+		if lines[i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *patchCmd) writeFile(name, content string) error {
+	f, err := p.hc.FileSytem.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package builtin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Pathchk checks whether each named path is valid and portable.
+//
+// By default, file name components may be up to 255 bytes long and whole
+// file names up to 4095 bytes, and any leading components which exist on the
+// filesystem must be directories. With -p, the lengths are limited to the
+// POSIX minimums of 14 and 255 bytes, and only characters from the portable
+// file name character set are allowed. -P additionally rejects empty file
+// names and components, as well as components starting with "-".
+func Pathchk(hc vsh.RunnerContext, args []string) error {
+	var portable, extra bool
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-p":
+			portable = true
+		case "-P":
+			extra = true
+		default:
+			return usageError(hc.Stderr, "pathchk", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) == 0 {
+		return usageError(hc.Stderr, "pathchk", "missing operand")
+	}
+
+	var failed bool
+	for _, name := range args {
+		if err := checkPath(hc, name, portable, extra); err != "" {
+			fmt.Fprintf(hc.Stderr, "pathchk: %s\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// checkPath returns a description of the first problem with name,
+// or the empty string if there is none.
+func checkPath(hc vsh.RunnerContext, name string, portable, extra bool) string {
+	nameMax, pathMax := 255, 4095
+	if portable {
+		nameMax, pathMax = 14, 255
+	}
+	if name == "" {
+		if extra {
+			return "empty file name"
+		}
+		return "'': No such file or directory"
+	}
+	if portable {
+		for _, c := range name {
+			if !isPortableChar(c) {
+				return fmt.Sprintf("nonportable character '%c' in file name '%s'", c, name)
+			}
+		}
+	}
+	if len(name) > pathMax {
+		return fmt.Sprintf("limit %d exceeded by length %d of file name '%s'", pathMax, len(name), name)
+	}
+	components := strings.Split(name, "/")
+	for i, comp := range components {
+		if comp == "" {
+			// Leading and trailing slashes are fine, as is "/" itself.
+			if extra && i > 0 && i < len(components)-1 {
+				return fmt.Sprintf("empty file name component in '%s'", name)
+			}
+			continue
+		}
+		if extra && comp[0] == '-' {
+			return fmt.Sprintf("leading '-' in a component of file name '%s'", name)
+		}
+		if len(comp) > nameMax {
+			return fmt.Sprintf("limit %d exceeded by length %d of file name component '%s'", nameMax, len(comp), comp)
+		}
+	}
+	if portable {
+		// Like coreutils, -p only checks the name itself.
+		return ""
+	}
+	// Every existing parent must be a directory, or the name can't be used.
+	for i := range components[:len(components)-1] {
+		parent := strings.Join(components[:i+1], "/")
+		if parent == "" {
+			continue
+		}
+		info, err := hc.FileSytem.Stat(resolvePath(hc.Dir, parent))
+		if err != nil {
+			break
+		}
+		if !info.IsDir() {
+			return fmt.Sprintf("'%s': Not a directory", name)
+		}
+	}
+	return ""
+}
+
+// isPortableChar reports whether c is in the POSIX portable filename
+// character set, or is a slash.
+func isPortableChar(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("._-/", c)
+}
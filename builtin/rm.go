@@ -2,20 +2,23 @@ package builtin
 
 import (
 	"fmt"
-	"path"
 
 	"github.com/wzshiming/vsh"
 )
 
 func Rm(hc vsh.RunnerContext, args []string) error {
+	var failed bool
 	for _, arg := range args {
 		if arg == "-r" {
 			continue
 		}
-		if err := hc.FileSytem.RemoveAll(path.Join(hc.Dir, arg)); err != nil {
+		if err := hc.FileSytem.RemoveAll(resolvePath(hc.Dir, arg)); err != nil {
 			fmt.Fprintf(hc.Stderr, "rm: %s: %v\n", arg, err)
-			return nil
+			failed = true
 		}
 	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
 	return nil
 }
@@ -0,0 +1,575 @@
+package builtin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Sed is a minimal version of the sed stream editor. It runs a script on each
+// line of the named files, or of standard input, and writes the results to
+// standard output.
+//
+// The script is the first argument, or the joined values of any -e options.
+// Its commands are separated by newlines or semicolons, and are s (substitute,
+// with the g, i, p and N flags, and with & and \1 to \9 in the replacement),
+// d (delete), p (print), q (quit) and = (print the line number). Commands may
+// be prefixed with an address, which is a line number, "$" for the last line,
+// or /REGEX/, or with a range of two addresses separated by a comma; a "!"
+// after the address negates it.
+//
+// Regular expressions are POSIX basic ones, or extended ones with -E or -r,
+// as supported by Go's regexp package; backreferences within them are not
+// supported. -n disables printing each line at the end of the script, and -i
+// edits the files in place rather than printing them.
+func Sed(hc vsh.RunnerContext, args []string) error {
+	var quiet, inPlace, extended bool
+	var scripts []string
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-n":
+			quiet = true
+		case "-i":
+			inPlace = true
+		case "-E", "-r":
+			extended = true
+		case "-e":
+			script, ok := fp.value()
+			if !ok {
+				return usageError(hc.Stderr, "sed", "-e: option requires an argument")
+			}
+			scripts = append(scripts, script)
+		default:
+			return usageError(hc.Stderr, "sed", "invalid option %q", flag)
+		}
+	}
+	files := fp.args()
+	if len(scripts) == 0 {
+		if len(files) == 0 {
+			return usageError(hc.Stderr, "sed", "no script given")
+		}
+		scripts, files = files[:1], files[1:]
+	}
+	prog, err := parseSed(strings.Join(scripts, "\n"), extended, hc.CompileRegexp)
+	if err != nil {
+		return usageError(hc.Stderr, "sed", "%v", err)
+	}
+
+	if inPlace {
+		if len(files) == 0 {
+			return usageError(hc.Stderr, "sed", "no input files")
+		}
+		var failed bool
+		for _, name := range files {
+			if err := sedInPlace(hc, prog, quiet, name); err != nil {
+				fmt.Fprintf(hc.Stderr, "sed: %s: %v\n", name, err)
+				failed = true
+			}
+		}
+		if failed {
+			return vsh.ExitStatus(2)
+		}
+		return nil
+	}
+
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var inputs []io.Reader
+	var failed bool
+	for _, name := range files {
+		f, err := openInput(hc, name)
+		if err != nil {
+			fmt.Fprintf(hc.Stderr, "sed: can't read %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		defer f.Close()
+		inputs = append(inputs, contextReader{hc.Context, f})
+	}
+	s := sedRunner{prog: prog, quiet: quiet}
+	if err := s.process(hc.Stdout, inputs); err != nil {
+		if err := hc.Context.Err(); err != nil {
+			return err
+		}
+		fmt.Fprintf(hc.Stderr, "sed: %v\n", err)
+		return vsh.ExitStatus(2)
+	}
+	if failed {
+		return vsh.ExitStatus(2)
+	}
+	return nil
+}
+
+// sedInPlace runs the program on the named file, replacing its contents with
+// the output.
+func sedInPlace(hc vsh.RunnerContext, prog []*sedCmd, quiet bool, name string) error {
+	name = resolvePath(hc.Dir, name)
+	data, err := hc.FileSytem.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	// As with GNU sed, each file is edited separately, so line numbers
+	// and ranges start anew.
+	for _, c := range prog {
+		c.active = false
+	}
+	var sb strings.Builder
+	s := sedRunner{prog: prog, quiet: quiet}
+	if err := s.process(&sb, []io.Reader{strings.NewReader(string(data))}); err != nil {
+		return err
+	}
+	f, err := hc.FileSytem.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, sb.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sedCmd is a single command in a sed script.
+type sedCmd struct {
+	addr1, addr2 *sedAddr
+	negate       bool
+
+	// active is set while in the range between addr1 and addr2.
+	active bool
+
+	name byte
+
+	// The fields below are only used by the s command.
+	re     *regexp.Regexp
+	repl   string // in the template syntax of [regexp.Regexp.Expand]
+	global bool
+	nth    int
+	print  bool
+}
+
+// sedAddr is a line number, the last line, or a regular expression.
+type sedAddr struct {
+	line int
+	last bool
+	re   *regexp.Regexp
+}
+
+func (a *sedAddr) matches(text string, n int, last bool) bool {
+	switch {
+	case a.re != nil:
+		return a.re.MatchString(text)
+	case a.last:
+		return last
+	}
+	return a.line == n
+}
+
+func (c *sedCmd) selects(text string, n int, last bool) bool {
+	return c.inRange(text, n, last) != c.negate
+}
+
+func (c *sedCmd) inRange(text string, n int, last bool) bool {
+	if c.addr1 == nil {
+		return true
+	}
+	if c.addr2 == nil {
+		return c.addr1.matches(text, n, last)
+	}
+	if c.active {
+		if c.addr2.matches(text, n, last) {
+			c.active = false
+		}
+		return true
+	}
+	if !c.addr1.matches(text, n, last) {
+		return false
+	}
+	// A range whose end is a line already reached only selects one line.
+	a2 := c.addr2
+	c.active = a2.re != nil || (a2.last && !last) || (!a2.last && a2.line > n)
+	return true
+}
+
+// subst runs an s command on text, reporting whether anything was replaced.
+func (c *sedCmd) subst(text string) (string, bool) {
+	var sb strings.Builder
+	prev, count := 0, 0
+	for _, m := range c.re.FindAllStringSubmatchIndex(text, -1) {
+		count++
+		if count < c.nth || (count > c.nth && !c.global) {
+			continue
+		}
+		sb.WriteString(text[prev:m[0]])
+		sb.Write(c.re.ExpandString(nil, c.repl, text, m))
+		prev = m[1]
+	}
+	if count < c.nth {
+		return text, false
+	}
+	sb.WriteString(text[prev:])
+	return sb.String(), true
+}
+
+// sedRunner runs a sed script on a stream of lines.
+type sedRunner struct {
+	prog   []*sedCmd
+	quiet  bool
+	lineNo int
+	quit   bool
+}
+
+// process runs the program on each line of the inputs, which form a single
+// stream. Each line is only run once the next one has been read, so that
+// the last line can be told apart.
+func (s *sedRunner) process(w io.Writer, inputs []io.Reader) (err error) {
+	bw := bufio.NewWriter(w)
+	defer flushOutput(bw, &err)
+	var pending string
+	for _, r := range inputs {
+		br := bufio.NewReader(r)
+		for !s.quit {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				if pending != "" {
+					s.line(bw, pending, false)
+				}
+				pending = line
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if pending != "" && !s.quit {
+		s.line(bw, pending, true)
+	}
+	return nil
+}
+
+func (s *sedRunner) line(w io.Writer, line string, last bool) {
+	s.lineNo++
+	text, found := strings.CutSuffix(line, "\n")
+	end := ""
+	if found {
+		end = "\n"
+	}
+loop:
+	for _, c := range s.prog {
+		if !c.selects(text, s.lineNo, last) {
+			continue
+		}
+		switch c.name {
+		case 'd':
+			return
+		case 'p':
+			fmt.Fprintln(w, text)
+		case '=':
+			fmt.Fprintln(w, s.lineNo)
+		case 'q':
+			s.quit = true
+			break loop
+		case 's':
+			var ok bool
+			if text, ok = c.subst(text); ok && c.print {
+				fmt.Fprintln(w, text)
+			}
+		}
+	}
+	if !s.quiet {
+		io.WriteString(w, text+end)
+	}
+}
+
+// sedParser parses sed scripts.
+type sedParser struct {
+	src      string
+	pos      int
+	extended bool
+
+	compileRegexp func(expr string) (*regexp.Regexp, error)
+}
+
+func parseSed(src string, extended bool, compileRegexp func(string) (*regexp.Regexp, error)) ([]*sedCmd, error) {
+	p := sedParser{src: src, extended: extended, compileRegexp: compileRegexp}
+	var prog []*sedCmd
+	for {
+		p.skip(" \t\n;")
+		if p.pos >= len(p.src) {
+			return prog, nil
+		}
+		c, err := p.command()
+		if err != nil {
+			return nil, fmt.Errorf("-e expression #1, char %d: %v", p.pos, err)
+		}
+		prog = append(prog, c)
+	}
+}
+
+func (p *sedParser) skip(chars string) {
+	for p.pos < len(p.src) && strings.IndexByte(chars, p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *sedParser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *sedParser) command() (*sedCmd, error) {
+	c := &sedCmd{}
+	var err error
+	if c.addr1, err = p.address(); err != nil {
+		return nil, err
+	}
+	if c.addr1 != nil && p.peek() == ',' {
+		p.pos++
+		if c.addr2, err = p.address(); err != nil {
+			return nil, err
+		}
+		if c.addr2 == nil {
+			return nil, fmt.Errorf("unexpected `,'")
+		}
+	}
+	p.skip(" \t")
+	if p.peek() == '!' {
+		p.pos++
+		c.negate = true
+		p.skip(" \t")
+	}
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("missing command")
+	}
+	c.name = p.src[p.pos]
+	p.pos++
+	switch c.name {
+	case 'd', 'p', 'q', '=':
+	case 's':
+		if err := p.substitute(c); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown command: `%c'", c.name)
+	}
+	p.skip(" \t")
+	if p.pos < len(p.src) && p.src[p.pos] != ';' && p.src[p.pos] != '\n' {
+		return nil, fmt.Errorf("extra characters after command")
+	}
+	return c, nil
+}
+
+func (p *sedParser) address() (*sedAddr, error) {
+	switch b := p.peek(); {
+	case b == '$':
+		p.pos++
+		return &sedAddr{last: true}, nil
+	case b >= '0' && b <= '9':
+		start := p.pos
+		p.skip("0123456789")
+		n, _ := strconv.Atoi(p.src[start:p.pos])
+		if n == 0 {
+			return nil, fmt.Errorf("invalid usage of line address 0")
+		}
+		return &sedAddr{line: n}, nil
+	case b == '/' || b == '\\':
+		if b == '\\' {
+			p.pos++
+		}
+		delim := p.peek()
+		p.pos++
+		expr, ok := p.delimited(delim)
+		if !ok {
+			return nil, fmt.Errorf("unterminated address regex")
+		}
+		re, err := p.compile(expr, false)
+		if err != nil {
+			return nil, err
+		}
+		return &sedAddr{re: re}, nil
+	}
+	return nil, nil
+}
+
+func (p *sedParser) substitute(c *sedCmd) error {
+	delim := p.peek()
+	if delim == 0 || delim == '\n' || delim == '\\' {
+		return fmt.Errorf("unterminated `s' command")
+	}
+	p.pos++
+	expr, ok := p.delimited(delim)
+	if !ok {
+		return fmt.Errorf("unterminated `s' command")
+	}
+	repl, ok := p.delimited(delim)
+	if !ok {
+		return fmt.Errorf("unterminated `s' command")
+	}
+	c.repl = sedTemplate(repl)
+	c.nth = 1
+	var icase, nthSet bool
+flags:
+	for p.pos < len(p.src) {
+		switch b := p.src[p.pos]; {
+		case b == 'g':
+			c.global = true
+		case b == 'i' || b == 'I':
+			icase = true
+		case b == 'p':
+			c.print = true
+		case b >= '1' && b <= '9':
+			if nthSet {
+				return fmt.Errorf("multiple number options to `s' command")
+			}
+			start := p.pos
+			p.skip("0123456789")
+			c.nth, _ = strconv.Atoi(p.src[start:p.pos])
+			nthSet = true
+			continue
+		case b == ';' || b == '\n' || b == ' ' || b == '\t':
+			break flags
+		default:
+			return fmt.Errorf("unknown option to `s'")
+		}
+		p.pos++
+	}
+	var err error
+	c.re, err = p.compile(expr, icase)
+	return err
+}
+
+// delimited reads up to the next unescaped delim, which is dropped, and
+// unescapes any escaped delimiters along the way.
+func (p *sedParser) delimited(delim byte) (string, bool) {
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		b := p.src[p.pos]
+		p.pos++
+		switch {
+		case b == delim:
+			return sb.String(), true
+		case b == '\\' && p.pos < len(p.src):
+			next := p.src[p.pos]
+			p.pos++
+			if next == delim {
+				sb.WriteByte(next)
+			} else {
+				sb.WriteByte(b)
+				sb.WriteByte(next)
+			}
+		case b == '\n':
+			return "", false
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return "", false
+}
+
+func (p *sedParser) compile(expr string, icase bool) (*regexp.Regexp, error) {
+	if !p.extended {
+		expr = breToGo(expr)
+	}
+	if icase {
+		expr = "(?i)" + expr
+	}
+	return p.compileRegexp(expr)
+}
+
+// breToGo converts a POSIX basic regular expression to Go's syntax, in which
+// the escaped grouping and repetition characters of the former are special,
+// and their unescaped forms are literal.
+func breToGo(expr string) string {
+	var sb strings.Builder
+	for i := 0; i < len(expr); i++ {
+		b := expr[i]
+		switch {
+		case b == '\\' && i+1 < len(expr):
+			i++
+			switch next := expr[i]; next {
+			case '(', ')', '{', '}', '+', '?', '|':
+				sb.WriteByte(next)
+			default:
+				sb.WriteByte(b)
+				sb.WriteByte(next)
+			}
+		case strings.IndexByte("(){}+?|", b) >= 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b == '[':
+			// Copy bracket expressions as they are, as a "]" right after
+			// the opening "[" or "[^" is part of the set.
+			j := i + 1
+			if j < len(expr) && expr[j] == '^' {
+				j++
+			}
+			if j < len(expr) && expr[j] == ']' {
+				j++
+			}
+			for j < len(expr) && expr[j] != ']' {
+				if expr[j] == '[' && j+1 < len(expr) && expr[j+1] == ':' {
+					if end := strings.Index(expr[j:], ":]"); end >= 0 {
+						j += end + 2
+						continue
+					}
+				}
+				j++
+			}
+			if j >= len(expr) {
+				sb.WriteString(expr[i:])
+				return sb.String()
+			}
+			sb.WriteString(expr[i : j+1])
+			i = j
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// sedTemplate converts the replacement of an s command to a template for
+// [regexp.Regexp.Expand], where "&" is the whole match and "\N" is a group.
+func sedTemplate(repl string) string {
+	var sb strings.Builder
+	for i := 0; i < len(repl); i++ {
+		switch b := repl[i]; b {
+		case '\\':
+			if i+1 == len(repl) {
+				sb.WriteByte(b)
+				break
+			}
+			i++
+			switch next := repl[i]; {
+			case next >= '0' && next <= '9':
+				sb.WriteString("${" + string(next) + "}")
+			case next == 'n':
+				sb.WriteByte('\n')
+			case next == '$':
+				sb.WriteString("$$")
+			default:
+				sb.WriteByte(next)
+			}
+		case '&':
+			sb.WriteString("${0}")
+		case '$':
+			sb.WriteString("$$")
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
@@ -19,7 +19,19 @@ func Sleep(hc vsh.RunnerContext, args []string) error {
 			}
 			d = time.Duration(i) * time.Second
 		}
-		time.Sleep(d)
+		select {
+		case <-hc.Context.Done():
+			return hc.Context.Err()
+		case <-after(hc)(d):
+		}
 	}
 	return nil
 }
+
+// after returns the After method of hc.Clock, or [time.After] if it's nil.
+func after(hc vsh.RunnerContext) func(time.Duration) <-chan time.Time {
+	if hc.Clock != nil {
+		return hc.Clock.After
+	}
+	return time.After
+}
@@ -0,0 +1,64 @@
+package builtin
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Sponge soaks up all of standard input before writing it to the named file,
+// or to standard output if there is none. -a appends to the file instead.
+//
+// As a redirection like "> file" truncates the file when it is opened, before
+// the command reads anything, a pipeline like "sed s/a/b/ file > file" would
+// leave the file empty; "sed s/a/b/ file | sponge file" does not.
+func Sponge(hc vsh.RunnerContext, args []string) error {
+	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-a":
+			mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		default:
+			return usageError(hc.Stderr, "sponge", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) > 1 {
+		return usageError(hc.Stderr, "sponge", "too many arguments")
+	}
+
+	in, err := openInput(hc, "-")
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "sponge: %v\n", err)
+		return vsh.ExitStatus(1)
+	}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "sponge: %v\n", err)
+		return vsh.ExitStatus(1)
+	}
+	if len(args) == 0 {
+		_, err := hc.Stdout.Write(data)
+		return err
+	}
+
+	name := args[0]
+	f, err := hc.FileSytem.OpenFile(resolvePath(hc.Dir, name), mode, 0o644)
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "sponge: %s: %v\n", name, err)
+		return vsh.ExitStatus(1)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "sponge: %s: %v\n", name, err)
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package builtin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Stat prints the metadata of each named file.
+//
+// With -c FORMAT, the output is built from FORMAT, where %n is the file name,
+// %s the size in bytes, %y the modification time, %a the permission bits in
+// octal, %A the permission bits in human readable form, and %F the file type.
+// Symbolic links are not followed unless -L is given.
+func Stat(hc vsh.RunnerContext, args []string) error {
+	format := ""
+	follow := false
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-c":
+			var ok bool
+			if format, ok = fp.value(); !ok {
+				return usageError(hc.Stderr, "stat", "-c: option requires an argument")
+			}
+			format += "\n"
+		case "-L":
+			follow = true
+		default:
+			return usageError(hc.Stderr, "stat", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) == 0 {
+		return usageError(hc.Stderr, "stat", "missing operand")
+	}
+
+	var failed bool
+	for _, name := range args {
+		p := resolvePath(hc.Dir, name)
+		var fi fs.FileInfo
+		var err error
+		if follow {
+			fi, err = hc.FileSytem.Stat(p)
+		} else {
+			fi, err = hc.FileSytem.Lstat(p)
+		}
+		if err != nil {
+			// The name is already given, so leave out the path in the error.
+			var pe *fs.PathError
+			if errors.As(err, &pe) {
+				err = pe.Err
+			}
+			fmt.Fprintf(hc.Stderr, "stat: cannot stat %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		if format != "" {
+			writeStat(hc.Stdout, format, name, fi)
+			continue
+		}
+		writeStat(hc.Stdout, "  File: %n\n  Size: %s\tType: %F\n  Mode: (0%a/%A)\nModify: %y\n", name, fi)
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+func writeStat(w io.Writer, format, name string, fi fs.FileInfo) {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'n':
+			sb.WriteString(name)
+		case 's':
+			sb.WriteString(strconv.FormatInt(fi.Size(), 10))
+		case 'y':
+			sb.WriteString(fi.ModTime().Format("2006-01-02 15:04:05.000000000 -0700"))
+		case 'a':
+			sb.WriteString(strconv.FormatUint(uint64(fi.Mode().Perm()), 8))
+		case 'A':
+			sb.WriteString(fi.Mode().String())
+		case 'F':
+			sb.WriteString(fileType(fi))
+		case '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(format[i])
+		}
+	}
+	io.WriteString(w, sb.String())
+}
+
+// fileType describes the type of a file like GNU stat's %F.
+func fileType(fi fs.FileInfo) string {
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&fs.ModeSymlink != 0:
+		return "symbolic link"
+	case mode&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character special file"
+	case mode&fs.ModeDevice != 0:
+		return "block special file"
+	case fi.Size() == 0:
+		return "regular empty file"
+	}
+	return "regular file"
+}
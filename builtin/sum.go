@@ -0,0 +1,152 @@
+package builtin
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Md5Sum prints the MD5 checksum of each named file, like md5sum.
+func Md5Sum(hc vsh.RunnerContext, args []string) error {
+	return checksum(hc, "md5sum", md5.New, args)
+}
+
+// Sha1Sum prints the SHA-1 checksum of each named file, like sha1sum.
+func Sha1Sum(hc vsh.RunnerContext, args []string) error {
+	return checksum(hc, "sha1sum", sha1.New, args)
+}
+
+// Sha256Sum prints the SHA-256 checksum of each named file, like sha256sum.
+func Sha256Sum(hc vsh.RunnerContext, args []string) error {
+	return checksum(hc, "sha256sum", sha256.New, args)
+}
+
+// checksum implements the *sum commands. With no files, or when a file is
+// "-", standard input is read. With -c, the files are instead read as lists
+// of checksums and names as printed by the command, and each listed file is
+// checked against its checksum.
+func checksum(hc vsh.RunnerContext, name string, newHash func() hash.Hash, args []string) error {
+	check := false
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-c":
+			check = true
+		default:
+			return usageError(hc.Stderr, name, "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	var failed bool
+	for _, arg := range args {
+		if check {
+			if !checkSums(hc, name, newHash, arg) {
+				failed = true
+			}
+			continue
+		}
+		sum, err := hashFile(hc, newHash, arg)
+		if err != nil {
+			fmt.Fprintf(hc.Stderr, "%s: %s: %v\n", name, arg, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(hc.Stdout, "%s  %s\n", sum, arg)
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// hashFile returns the hex digest of the named file. The contents are
+// streamed through the hash, so large files are never held in memory.
+func hashFile(hc vsh.RunnerContext, newHash func() hash.Hash, name string) (string, error) {
+	f, err := openInput(hc, name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkSums verifies the files listed in the named checksum file, reporting
+// whether all of them matched.
+func checkSums(hc vsh.RunnerContext, name string, newHash func() hash.Hash, list string) bool {
+	f, err := openInput(hc, list)
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "%s: %s: %v\n", name, list, err)
+		return false
+	}
+	defer f.Close()
+
+	var checked, mismatched, unreadable, malformed int
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		want, file, ok := strings.Cut(sc.Text(), " ")
+		// A "*" marks files hashed in binary mode, which is no different here.
+		file = strings.TrimPrefix(file, " ")
+		file = strings.TrimPrefix(file, "*")
+		if !ok || file == "" || len(want) != hex.EncodedLen(newHash().Size()) {
+			malformed++
+			continue
+		}
+		checked++
+		got, err := hashFile(hc, newHash, file)
+		switch {
+		case err != nil:
+			fmt.Fprintf(hc.Stderr, "%s: %s: %v\n", name, file, err)
+			fmt.Fprintf(hc.Stdout, "%s: FAILED open or read\n", file)
+			unreadable++
+		case !strings.EqualFold(got, want):
+			fmt.Fprintf(hc.Stdout, "%s: FAILED\n", file)
+			mismatched++
+		default:
+			fmt.Fprintf(hc.Stdout, "%s: OK\n", file)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintf(hc.Stderr, "%s: %s: %v\n", name, list, err)
+		return false
+	}
+
+	if checked == 0 {
+		fmt.Fprintf(hc.Stderr, "%s: %s: no properly formatted checksum lines found\n", name, list)
+		return false
+	}
+	// Like coreutils, improperly formatted lines are only a warning
+	// as long as some other lines could be checked.
+	if malformed > 0 {
+		fmt.Fprintf(hc.Stderr, "%s: WARNING: %s improperly formatted\n", name, plural(malformed, "line is", "lines are"))
+	}
+	if unreadable > 0 {
+		fmt.Fprintf(hc.Stderr, "%s: WARNING: %s could not be read\n", name, plural(unreadable, "listed file", "listed files"))
+	}
+	if mismatched > 0 {
+		fmt.Fprintf(hc.Stderr, "%s: WARNING: %s did NOT match\n", name, plural(mismatched, "computed checksum", "computed checksums"))
+	}
+	return unreadable == 0 && mismatched == 0
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
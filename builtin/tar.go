@@ -0,0 +1,255 @@
+package builtin
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/fs"
+)
+
+// Tar creates, extracts or lists tar archives on the filesystem.
+//
+// Exactly one of -c (create), -x (extract) or -t (list) must be given.
+// -f ARCHIVE names the archive, which defaults to standard input or output,
+// and -C DIR changes to DIR before adding or extracting files. -v prints
+// each member as it is processed. The dash before the first group of flags
+// is optional, as in "tar cf out.tar dir".
+//
+// Member names are always relative; extracting a member whose name contains
+// a ".." component is refused, so that an archive can't write outside of the
+// target directory.
+func Tar(hc vsh.RunnerContext, args []string) error {
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		args = append([]string{"-" + args[0]}, args[1:]...)
+	}
+	var mode string
+	t := tarCmd{hc: hc, archive: "-", dir: hc.Dir}
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-c", "-x", "-t":
+			if mode != "" && mode != flag {
+				return usageError(hc.Stderr, "tar", "only one of -c, -x or -t may be given")
+			}
+			mode = flag
+		case "-f":
+			var ok bool
+			if t.archive, ok = fp.value(); !ok {
+				return usageError(hc.Stderr, "tar", "-f: option requires an argument")
+			}
+		case "-C":
+			dir, ok := fp.value()
+			if !ok {
+				return usageError(hc.Stderr, "tar", "-C: option requires an argument")
+			}
+			t.dir = resolvePath(hc.Dir, dir)
+		case "-v":
+			t.verbose = true
+		default:
+			return usageError(hc.Stderr, "tar", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+
+	var err error
+	switch mode {
+	case "-c":
+		if len(args) == 0 {
+			return usageError(hc.Stderr, "tar", "refusing to create an empty archive")
+		}
+		err = t.create(args)
+	case "-x", "-t":
+		if len(args) > 0 {
+			return usageError(hc.Stderr, "tar", "selecting members is not supported")
+		}
+		err = t.read(mode == "-x")
+	default:
+		return usageError(hc.Stderr, "tar", "one of -c, -x or -t must be given")
+	}
+	if err != nil {
+		fmt.Fprintf(hc.Stderr, "tar: %v\n", err)
+		t.failed = true
+	}
+	if t.failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+type tarCmd struct {
+	hc vsh.RunnerContext
+
+	archive string // "-" for standard input or output
+	dir     string // absolute directory to add or extract files in
+	verbose bool
+
+	// failed records errors for single members, which don't stop the
+	// processing of the rest of the archive.
+	failed bool
+}
+
+func (t *tarCmd) warnf(format string, a ...any) {
+	fmt.Fprintf(t.hc.Stderr, "tar: "+format+"\n", a...)
+	t.failed = true
+}
+
+func (t *tarCmd) create(names []string) error {
+	var w io.Writer = t.hc.Stdout
+	archivePath := ""
+	if t.archive != "-" {
+		archivePath = resolvePath(t.hc.Dir, t.archive)
+		f, err := t.hc.FileSytem.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	tw := tar.NewWriter(w)
+	warnedSlash := false
+	for _, name := range names {
+		member := strings.TrimLeft(path.Clean(name), "/")
+		if member == "" {
+			member = "."
+		}
+		if strings.HasPrefix(name, "/") && !warnedSlash {
+			// Like coreutils, this is only a notice and not an error.
+			fmt.Fprintln(t.hc.Stderr, "tar: removing leading '/' from member names")
+			warnedSlash = true
+		}
+		root := resolvePath(t.dir, name)
+		err := iofs.WalkDir(t.hc.FileSytem, root, func(p string, d iofs.DirEntry, err error) error {
+			if err != nil {
+				t.warnf("%s: %v", name, err)
+				return nil
+			}
+			if p == archivePath {
+				fmt.Fprintf(t.hc.Stderr, "tar: %s: file is the archive; not dumped\n", t.archive)
+				return nil
+			}
+			rel := path.Join(member, strings.TrimPrefix(p, root))
+			return t.add(tw, p, rel, d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// add writes a single file or directory to the archive.
+func (t *tarCmd) add(tw *tar.Writer, p, name string, d iofs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		t.warnf("%s: %v", name, err)
+		return nil
+	}
+	var data []byte
+	switch {
+	case d.IsDir():
+		name += "/"
+	case d.Type().IsRegular():
+		// The contents are read upfront, as the sizes reported by lazily
+		// loaded files aren't reliable.
+		if data, err = t.hc.FileSytem.ReadFile(p); err != nil {
+			t.warnf("%s: %v", name, err)
+			return nil
+		}
+	default:
+		t.warnf("%s: unsupported file type", name)
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		t.warnf("%s: %v", name, err)
+		return nil
+	}
+	hdr.Name = name
+	hdr.Size = int64(len(data))
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if t.verbose {
+		fmt.Fprintln(t.hc.Stderr, name)
+	}
+	return nil
+}
+
+// read lists the members of the archive, and extracts them if extract is true.
+func (t *tarCmd) read(extract bool) error {
+	f, err := openInput(t.hc, t.archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !extract {
+			if t.verbose {
+				fmt.Fprintf(t.hc.Stdout, "%s %8d %s %s\n", hdr.FileInfo().Mode(), hdr.Size, hdr.ModTime.Format("2006-01-02 15:04"), hdr.Name)
+			} else {
+				fmt.Fprintln(t.hc.Stdout, hdr.Name)
+			}
+			continue
+		}
+		if err := t.extract(tr, hdr); err != nil {
+			t.warnf("%s: %v", hdr.Name, err)
+			continue
+		}
+		if t.verbose {
+			fmt.Fprintln(t.hc.Stdout, hdr.Name)
+		}
+	}
+}
+
+var errDotDot = errors.New("member name contains '..'")
+
+func (t *tarCmd) extract(tr *tar.Reader, hdr *tar.Header) error {
+	name := strings.TrimLeft(hdr.Name, "/")
+	if slices.Contains(strings.Split(name, "/"), "..") {
+		return errDotDot
+	}
+	target := path.Join(t.dir, name)
+	perm := hdr.FileInfo().Mode().Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return t.hc.FileSytem.MkdirAll(target, perm|0o700)
+	case tar.TypeReg:
+		if err := t.hc.FileSytem.MkdirAll(path.Dir(target), 0o777); err != nil {
+			return err
+		}
+		if wfs, ok := t.hc.FileSytem.(fs.WriteFileFS); ok {
+			_, err := wfs.WriteFileFrom(target, tr, perm)
+			return err
+		}
+		f, err := t.hc.FileSytem.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	default:
+		return fmt.Errorf("unsupported file type %q", hdr.Typeflag)
+	}
+}
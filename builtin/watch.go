@@ -0,0 +1,62 @@
+package builtin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/vsh"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// Watch runs a command every -n SECONDS, 2 by default, until the shell's
+// context is cancelled, such as by an interrupt.
+//
+// Each run is preceded by a header with the interval and the command, unless
+// -t is given. When the shell is interactive, the screen is cleared first, so
+// that the latest output replaces the previous one; otherwise, the outputs
+// are simply written one after the other.
+func Watch(hc vsh.RunnerContext, args []string) error {
+	secs := 2.0
+	header := true
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-n":
+			s, _ := fp.value()
+			var err error
+			if secs, err = strconv.ParseFloat(s, 64); err != nil || secs < 0 {
+				return usageError(hc.Stderr, "watch", "failed to parse argument: %q", s)
+			}
+			// Like procps, don't let the command run in a busy loop.
+			secs = max(secs, 0.1)
+		case "-t":
+			header = false
+		default:
+			return usageError(hc.Stderr, "watch", "invalid option %q", flag)
+		}
+	}
+	args = fp.args()
+	if len(args) == 0 {
+		return usageError(hc.Stderr, "watch", "no command given")
+	}
+	interval := time.Duration(secs * float64(time.Second))
+
+	for {
+		if hc.TTY {
+			fmt.Fprint(hc.Stdout, clearScreen)
+		}
+		if header {
+			fmt.Fprintf(hc.Stdout, "Every %.1fs: %s\n\n", secs, strings.Join(args, " "))
+		}
+		hc.Command(hc.Context, args)
+		select {
+		case <-hc.Context.Done():
+			return nil
+		case <-after(hc)(interval):
+		}
+	}
+}
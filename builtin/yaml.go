@@ -0,0 +1,319 @@
+package builtin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/wzshiming/vsh"
+	"gopkg.in/yaml.v3"
+)
+
+// Yaml2Json converts the YAML documents in the named files, or in standard
+// input, to JSON values, one for each document. The keys of mappings keep
+// their order, aliases are expanded, and merge keys like "<<: *base" are
+// applied. Results are indented, unless -c is given.
+//
+// Values which JSON cannot hold, such as the floating point ".inf", are an
+// error. Keys which aren't strings are written as they appear in the YAML,
+// and timestamps are kept as strings.
+func Yaml2Json(hc vsh.RunnerContext, args []string) (err error) {
+	compact := false
+	fp := flagParser{remaining: args}
+	for fp.more() {
+		switch flag := fp.flag(); flag {
+		case "-c":
+			compact = true
+		default:
+			return usageError(hc.Stderr, "yaml2json", "invalid option %q", flag)
+		}
+	}
+	bw := bufio.NewWriter(hc.Stdout)
+	defer flushOutput(bw, &err)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if !compact {
+		enc.SetIndent("", "  ")
+	}
+	return convertFiles(hc, "yaml2json", fp.args(), func(r io.Reader) error {
+		dec := yaml.NewDecoder(r)
+		for {
+			var doc yaml.Node
+			if err := dec.Decode(&doc); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			v, err := yamlToJSON(&doc)
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(v); err != nil {
+				return writeError{err}
+			}
+		}
+	})
+}
+
+// Json2Yaml converts the JSON values in the named files, or in standard input,
+// to YAML documents, separated by "---" lines. The keys of objects keep their
+// order, and numbers are written as they appear in the JSON.
+func Json2Yaml(hc vsh.RunnerContext, args []string) (err error) {
+	fp := flagParser{remaining: args}
+	if fp.more() {
+		return usageError(hc.Stderr, "json2yaml", "invalid option %q", fp.flag())
+	}
+	bw := bufio.NewWriter(hc.Stdout)
+	defer flushOutput(bw, &err)
+	enc := yaml.NewEncoder(bw)
+	enc.SetIndent(2)
+	defer func() {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return convertFiles(hc, "json2yaml", fp.args(), func(r io.Reader) error {
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		for {
+			node, err := jsonToYAML(dec)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := enc.Encode(node); err != nil {
+				return writeError{err}
+			}
+		}
+	})
+}
+
+// writeError is an error writing the output of a conversion, as opposed to
+// one in its input.
+type writeError struct{ err error }
+
+func (e writeError) Error() string { return e.err.Error() }
+func (e writeError) Unwrap() error { return e.err }
+
+// convertFiles runs convert on each of the named files, or on standard input,
+// reporting the errors in their contents as the command with the given name.
+func convertFiles(hc vsh.RunnerContext, cmd string, files []string, convert func(io.Reader) error) error {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var failed bool
+	for _, name := range files {
+		f, err := openInput(hc, name)
+		if err != nil {
+			fmt.Fprintf(hc.Stderr, "%s: %s: %v\n", cmd, name, err)
+			failed = true
+			continue
+		}
+		err = convert(contextReader{hc.Context, f})
+		f.Close()
+		if err != nil {
+			if err := hc.Context.Err(); err != nil {
+				return err
+			}
+			var werr writeError
+			if errors.As(err, &werr) {
+				return werr.err
+			}
+			fmt.Fprintf(hc.Stderr, "%s: %s: %v\n", cmd, name, err)
+			failed = true
+		}
+	}
+	if failed {
+		return vsh.ExitStatus(1)
+	}
+	return nil
+}
+
+// jsonObject is a JSON object which keeps the order of its members.
+type jsonObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func (o *jsonObject) set(key string, value any) {
+	if o.values == nil {
+		o.values = make(map[string]any)
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := enc.Encode(key); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := enc.Encode(o.values[key]); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// yamlToJSON turns a YAML node into a value to be encoded as JSON.
+func yamlToJSON(n *yaml.Node) (any, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return yamlToJSON(n.Content[0])
+	case yaml.AliasNode:
+		return yamlToJSON(n.Alias)
+	case yaml.SequenceNode:
+		list := make([]any, 0, len(n.Content))
+		for _, elem := range n.Content {
+			v, err := yamlToJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		obj := &jsonObject{}
+		if err := mergeYAML(obj, n); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	switch n.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		err := n.Decode(&b)
+		return b, err
+	case "!!int":
+		if i, err := strconv.ParseInt(n.Value, 0, 64); err == nil {
+			return i, nil
+		}
+		// Keep the digits of integers too big for an int64, rather than
+		// rounding them.
+		if json.Valid([]byte(n.Value)) {
+			return json.Number(n.Value), nil
+		}
+	case "!!float":
+		var f float64
+		if err := n.Decode(&f); err != nil {
+			return nil, err
+		}
+		if !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f, nil
+		}
+	default:
+		return n.Value, nil
+	}
+	return nil, fmt.Errorf("line %d: cannot convert %s to JSON", n.Line, n.Value)
+}
+
+// mergeYAML sets the members of obj from the mapping n, applying its merge
+// keys first, so that the mapping's own keys override them.
+func mergeYAML(obj *jsonObject, n *yaml.Node) error {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.ShortTag() != "!!merge" {
+			continue
+		}
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		sources := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			sources = value.Content
+		}
+		for _, src := range sources {
+			if src.Kind == yaml.AliasNode {
+				src = src.Alias
+			}
+			if src.Kind != yaml.MappingNode {
+				return fmt.Errorf("line %d: map merge requires a mapping or a list of mappings", src.Line)
+			}
+			if err := mergeYAML(obj, src); err != nil {
+				return err
+			}
+		}
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.ShortTag() == "!!merge" {
+			continue
+		}
+		if key.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: cannot convert a key which isn't a scalar to JSON", key.Line)
+		}
+		v, err := yamlToJSON(value)
+		if err != nil {
+			return err
+		}
+		obj.set(key.Value, v)
+	}
+	return nil
+}
+
+// jsonToYAML reads the next JSON value from dec as a YAML node.
+func jsonToYAML(dec *json.Decoder) (*yaml.Node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if tok == '{' {
+			n = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for dec.More() {
+			if n.Kind == yaml.MappingNode {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			elem, err := jsonToYAML(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, elem)
+		}
+		if _, err := dec.Token(); err != nil { // the closing delimiter
+			return nil, err
+		}
+		return n, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: tok}, nil
+	case json.Number:
+		tag := "!!float"
+		if _, err := tok.Int64(); err == nil {
+			tag = "!!int"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: tok.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(tok)}, nil
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
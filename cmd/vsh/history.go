@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// historySize is the maximum number of lines kept in the history.
+const historySize = 1000
+
+// history holds the lines entered in the interactive shell, and appends them
+// to a file so that they can be recalled in later sessions. It implements
+// [golang.org/x/term.History].
+type history struct {
+	lines []string // most recent last
+	file  string
+}
+
+// historyFile returns the path of the history file, which is $VSH_HISTFILE,
+// or .vsh_history in the home directory. It is empty if neither is known.
+func historyFile() string {
+	if file := os.Getenv("VSH_HISTFILE"); file != "" {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".vsh_history")
+}
+
+// loadHistory reads the history from file, if it exists. If the file has
+// more than [historySize] lines, it is rewritten with just the latest ones.
+func loadHistory(file string) (*history, error) {
+	h := &history{file: file}
+	if file == "" {
+		return h, nil
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		h.lines = append(h.lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return h, err
+	}
+	if len(h.lines) > historySize {
+		h.lines = h.lines[len(h.lines)-historySize:]
+		data := strings.Join(h.lines, "\n") + "\n"
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// Add records a line, unless it's blank or the same as the previous one.
+func (h *history) Add(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > historySize {
+		h.lines = h.lines[1:]
+	}
+	if h.file == "" {
+		return
+	}
+	// The file is trimmed by loadHistory, so it's fine to only append here.
+	// Failing to save the history should not get in the way of the shell.
+	f, err := os.OpenFile(h.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(f, line)
+	f.Close()
+}
+
+func (h *history) Len() int { return len(h.lines) }
+
+func (h *history) At(idx int) string { return h.lines[len(h.lines)-1-idx] }
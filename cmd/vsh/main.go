@@ -7,15 +7,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/wzshiming/vsh"
 	"github.com/wzshiming/vsh/builtin"
+	vshterm "github.com/wzshiming/vsh/term"
 	"golang.org/x/term"
-	"mvdan.cc/sh/v3/syntax"
 )
 
-var command = flag.String("c", "", "command to be executed")
+var (
+	command = flag.String("c", "", "command to be executed")
+	network = flag.Bool("network", false, "allow commands such as curl to make network requests")
+)
 
 func main() {
 	flag.Parse()
@@ -24,6 +28,10 @@ func main() {
 	if errors.As(err, &es) {
 		os.Exit(int(es))
 	}
+	if errors.Is(err, context.Canceled) {
+		// Interrupted, like a shell killed by SIGINT.
+		os.Exit(130)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -31,7 +39,15 @@ func main() {
 }
 
 func runAll() error {
+	// Like in other shells, "-c command name args..." sets $0 and the
+	// positional parameters.
+	argv0, params := "vsh", []string(nil)
+	if *command != "" && flag.NArg() > 0 {
+		argv0, params = flag.Arg(0), flag.Args()[1:]
+	}
 	r, err := vsh.NewRunner(
+		vsh.WithArgv0(argv0),
+		vsh.WithParams(append([]string{"--"}, params...)...),
 		vsh.WithStdIO(os.Stdin, os.Stdout, os.Stderr),
 		vsh.WithCommand("ls", builtin.Ls),
 		vsh.WithCommand("cat", builtin.Cat),
@@ -39,19 +55,62 @@ func runAll() error {
 		vsh.WithCommand("rm", builtin.Rm),
 		vsh.WithCommand("date", builtin.Date),
 		vsh.WithCommand("sleep", builtin.Sleep),
+		vsh.WithCommand("nl", builtin.Nl),
+		vsh.WithCommand("stat", builtin.Stat),
+		vsh.WithCommand("du", builtin.Du),
+		vsh.WithCommand("df", builtin.Df),
+		vsh.WithCommand("disown", builtin.Disown),
+		vsh.WithCommand("md5sum", builtin.Md5Sum),
+		vsh.WithCommand("sha1sum", builtin.Sha1Sum),
+		vsh.WithCommand("sha256sum", builtin.Sha256Sum),
+		vsh.WithCommand("pathchk", builtin.Pathchk),
+		vsh.WithCommand("tar", builtin.Tar),
+		vsh.WithCommand("ed", builtin.Ed),
+		vsh.WithCommand("patch", builtin.Patch),
+		vsh.WithCommand("mktemp", builtin.Mktemp),
+		vsh.WithCommand("logger", builtin.Logger),
+		vsh.WithCommand("emit", builtin.Emit),
+		vsh.WithCommand("sed", builtin.Sed),
+		vsh.WithCommand("sponge", builtin.Sponge),
+		vsh.WithCommand("watch", builtin.Watch),
+		vsh.WithCommand("jq", builtin.Jq),
+		vsh.WithCommand("column", builtin.Column),
+		vsh.WithCommand("fold", builtin.Fold),
+		vsh.WithCommand("yaml2json", builtin.Yaml2Json),
+		vsh.WithCommand("json2yaml", builtin.Json2Yaml),
+		vsh.WithCommand("curl", builtin.Http),
+		vsh.WithNetwork(*network),
 	)
 	if err != nil {
 		return err
 	}
 	ctx := context.Background()
 
+	if *command == "" && flag.NArg() == 0 && term.IsTerminal(int(os.Stdin.Fd())) {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		defer signal.Stop(interrupts)
+		hist, err := loadHistory(historyFile())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history: %v\n", err)
+		}
+		s := &vshterm.Session{
+			Runner:     r,
+			Input:      vshterm.NewLineEditor(os.Stdin, os.Stdout, hist, vshterm.RunnerCompleter(r)),
+			Stdout:     os.Stdout,
+			Stderr:     os.Stderr,
+			Interrupts: interrupts,
+		}
+		return s.Run(ctx)
+	}
+
+	// Otherwise, an interrupt stops the whole program.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
 	if *command != "" {
 		return run(ctx, r, strings.NewReader(*command), "")
 	}
 	if flag.NArg() == 0 {
-		if term.IsTerminal(int(os.Stdin.Fd())) {
-			return runInteractive(ctx, r, os.Stdin, os.Stdout, os.Stderr)
-		}
 		return run(ctx, r, os.Stdin, "")
 	}
 	for _, path := range flag.Args() {
@@ -63,12 +122,8 @@ func runAll() error {
 }
 
 func run(ctx context.Context, r *vsh.Runner, reader io.Reader, name string) error {
-	prog, err := syntax.NewParser().Parse(reader, name)
-	if err != nil {
-		return err
-	}
 	r.Reset()
-	return r.Run(ctx, prog)
+	return r.RunReader(ctx, reader, name)
 }
 
 func runPath(ctx context.Context, r *vsh.Runner, path string) error {
@@ -79,34 +134,3 @@ func runPath(ctx context.Context, r *vsh.Runner, path string) error {
 	defer f.Close()
 	return run(ctx, r, f, path)
 }
-
-func runInteractive(ctx context.Context, r *vsh.Runner, stdin io.Reader, stdout, stderr io.Writer) error {
-	parser := syntax.NewParser()
-	fmt.Fprintf(stdout, "$ ")
-	var runErr error
-	fn := func(stmts []*syntax.Stmt) bool {
-		if parser.Incomplete() {
-			fmt.Fprintf(stdout, "> ")
-			return true
-		}
-		ctx := context.Background()
-		for _, stmt := range stmts {
-			runErr = r.Run(ctx, stmt)
-			if r.Exited() {
-				return false
-			}
-
-			if err := r.FatalErr(); err != nil {
-				fmt.Fprintf(stderr, "%s", err.Error())
-				return false
-			}
-
-		}
-		fmt.Fprintf(stdout, "$ ")
-		return true
-	}
-	if err := parser.Interactive(stdin, fn); err != nil {
-		return err
-	}
-	return runErr
-}
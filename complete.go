@@ -0,0 +1,28 @@
+package vsh
+
+import (
+	"maps"
+	"slices"
+)
+
+// CommandNames returns the sorted names of all that can be run as a command:
+// aliases, functions, shell builtins and the commands set via [WithCommand],
+// except for those turned off with "enable -n". It is meant for completion in
+// interactive shells.
+func (r *Runner) CommandNames() []string {
+	names := make(map[string]bool)
+	for name := range r.alias {
+		names[name] = true
+	}
+	for name := range r.Funcs {
+		names[name] = true
+	}
+	for _, name := range builtinNames {
+		names[name] = !r.disabled[name]
+	}
+	for name := range r.Commands {
+		names[name] = !r.disabled[name]
+	}
+	maps.DeleteFunc(names, func(_ string, ok bool) bool { return !ok })
+	return slices.Sorted(maps.Keys(names))
+}
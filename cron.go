@@ -0,0 +1,384 @@
+package vsh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Clock tells the time, and waits for time to pass. It can be set via
+// [WithClock], such as to control when [WithCron] jobs run in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock sets the clock used to schedule [WithCron] jobs, which is also
+// given to commands via [RunnerContext]. The default is the system's clock.
+func WithClock(c Clock) runnerOption {
+	return func(r *Runner) error {
+		r.clock = c
+		return nil
+	}
+}
+
+// getClock returns the clock set via [WithClock], or the system's clock.
+func (r *Runner) getClock() Clock {
+	if r.clock == nil {
+		return realClock{}
+	}
+	return r.clock
+}
+
+// WithCron adds a job which runs command on the schedule given by spec, once
+// [Runner.StartCron] is called.
+//
+// spec is either five crontab fields (minute, hour, day of month, month and
+// day of week, each being "*", a number, a range like "1-5", a list like
+// "1,3", or a step like "*/15"), one of the macros "@yearly", "@monthly",
+// "@weekly", "@daily" and "@hourly", or "@every DURATION", such as "@every
+// 30s". Unlike crontab, names like "mon" or "jan" are not supported.
+func WithCron(spec, command string) runnerOption {
+	return func(r *Runner) error {
+		sched, err := parseCronSpec(spec)
+		if err != nil {
+			return fmt.Errorf("cron %q: %w", spec, err)
+		}
+		file, err := syntax.NewParser().Parse(strings.NewReader(command), "")
+		if err != nil {
+			return fmt.Errorf("cron %q: %w", spec, err)
+		}
+		r.cronJobs = append(r.cronJobs, &cronJob{sched: sched, file: file})
+		return nil
+	}
+}
+
+type cronJob struct {
+	sched cronSchedule
+	file  *syntax.File
+}
+
+// StartCron starts running the jobs added via [WithCron] in the background,
+// until ctx is cancelled. The returned function waits for that to happen,
+// including for any job which is still running.
+//
+// Each job runs in a new subshell of a copy of r taken when StartCron is
+// called, so jobs see the functions and variables defined until then, and r
+// can keep running other programs while the jobs run. Jobs run one at a time,
+// and a job which is due while another runs is started right after it. Times
+// are taken from the clock set via [WithClock].
+func (r *Runner) StartCron(ctx context.Context) (wait func()) {
+	base := r.Subshell()
+	clock := r.getClock()
+	jobs := r.cronJobs
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runCron(ctx, base, clock, jobs)
+	}()
+	return wg.Wait
+}
+
+func runCron(ctx context.Context, base *Runner, clock Clock, jobs []*cronJob) {
+	next := make([]time.Time, len(jobs))
+	now := clock.Now()
+	for i, job := range jobs {
+		next[i] = job.sched.next(now)
+	}
+	for {
+		var soonest time.Time
+		for _, t := range next {
+			if !t.IsZero() && (soonest.IsZero() || t.Before(soonest)) {
+				soonest = t
+			}
+		}
+		if soonest.IsZero() {
+			// No job will ever run again.
+			<-ctx.Done()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(soonest.Sub(clock.Now())):
+		}
+		now = clock.Now()
+		for i, job := range jobs {
+			if next[i].IsZero() || next[i].After(now) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// Errors and exit statuses are up to the job to report,
+			// as they would be for a crontab entry.
+			_ = base.Subshell().Run(ctx, job.file)
+			next[i] = job.sched.next(now)
+		}
+	}
+}
+
+// cronSchedule returns the next time a job should run, strictly after t.
+// The zero time means that the job will never run again.
+type cronSchedule interface {
+	next(t time.Time) time.Time
+}
+
+// everySchedule is the schedule for "@every DURATION".
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time { return t.Add(time.Duration(s)) }
+
+// fieldsSchedule is the schedule for the five crontab fields, with each
+// field being a set of bits for the allowed values.
+type fieldsSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// anyDay is set if either of dom or dow is "*", in which case both must
+	// match. Otherwise, like in crontab, matching either is enough.
+	anyDay bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronSpec(spec string) (cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		dur, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, err
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("duration must be positive")
+		}
+		return everySchedule(dur), nil
+	}
+	if expanded, ok := cronMacros[spec]; ok {
+		spec = expanded
+	} else if strings.HasPrefix(spec, "@") {
+		return nil, fmt.Errorf("unknown macro")
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	var s fieldsSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 << 0
+	}
+	s.anyDay = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps
+// between lo and hi, inclusive.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for part := range strings.SplitSeq(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+		start, end := lo, hi
+		if rng != "*" {
+			startStr, endStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = strconv.Atoi(startStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(endStr); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				// "5/10" means from 5 to the end, every 10.
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// cronSearchYears bounds how far ahead fieldsSchedule.next looks, so that
+// impossible dates like "0 0 31 2 *" don't loop forever.
+const cronSearchYears = 5
+
+func (s fieldsSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + cronSearchYears
+	for t.Year() <= limit {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s fieldsSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// atBuiltin implements "at TIME", which reads a script from standard input
+// and runs it in the background once the clock set via [WithClock] reaches
+// TIME. Like a command ending in "&", the job can be waited for with "wait"
+// and listed with "jobs", and it stops if the shell's context is cancelled.
+//
+// TIME is "now", "now + N UNIT" with UNIT being one of seconds, minutes,
+// hours, days or weeks, or "HH:MM" for the next time the clock shows it.
+func (r *Runner) atBuiltin(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		r.errf("usage: at TIME\n")
+		return 2
+	}
+	clock := r.getClock()
+	now := clock.Now()
+	when, err := parseAtTime(now, strings.Join(args, " "))
+	if err != nil {
+		r.errf("at: %v\n", err)
+		return 1
+	}
+	var src []byte
+	if r.stdin != nil {
+		if src, err = io.ReadAll(r.stdin); err != nil {
+			r.errf("at: %v\n", err)
+			return 1
+		}
+	}
+	file, err := syntax.NewParser().Parse(bytes.NewReader(src), "")
+	if err != nil {
+		r.errf("at: %v\n", err)
+		return 1
+	}
+	if !r.startProc() {
+		return 1
+	}
+	r2 := r.subshell(true)
+	// The script was read from standard input, so it's not there for the job.
+	r2.stdin = nil
+	bg := bgProc{
+		done: make(chan struct{}),
+		exit: new(int),
+		node: file,
+		at:   when,
+	}
+	r.bgProcs = append(r.bgProcs, bg)
+	r.errf("job %d at %s\n", len(r.bgProcs), when.Format(time.ANSIC))
+	go func() {
+		defer close(bg.done)
+		defer r.procs.end()
+		select {
+		case <-ctx.Done():
+			*bg.exit = 1
+			return
+		case <-clock.After(when.Sub(now)):
+		}
+		r2.Run(ctx, file)
+		*bg.exit = r2.exit
+	}()
+	return 0
+}
+
+var atUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// parseAtTime parses the TIME of "at" relative to now.
+func parseAtTime(now time.Time, spec string) (time.Time, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if rest, ok := strings.CutPrefix(spec, "now"); ok {
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return now, nil
+		}
+		rest, ok = strings.CutPrefix(rest, "+")
+		fields := strings.Fields(rest)
+		if !ok || len(fields) != 2 {
+			return time.Time{}, fmt.Errorf("garbled time %q", spec)
+		}
+		n, err := strconv.Atoi(fields[0])
+		unit, ok := atUnits[strings.TrimSuffix(fields[1], "s")]
+		if err != nil || n < 0 || !ok {
+			return time.Time{}, fmt.Errorf("garbled time %q", spec)
+		}
+		return now.Add(time.Duration(n) * unit), nil
+	}
+	hh, mm, ok := strings.Cut(spec, ":")
+	hour, err1 := strconv.Atoi(hh)
+	minute, err2 := strconv.Atoi(mm)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return time.Time{}, fmt.Errorf("garbled time %q", spec)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
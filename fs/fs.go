@@ -29,7 +29,26 @@ type FileSystem interface {
 	RemoveAll(name string) error
 }
 
-// SnapshotFS allows you to take on fs.FS and wrap it in an fs that is writable
+// WriteFileFS is implemented by filesystems which can write whole files at
+// once, such as the in-memory one from [NewMemFS]. This saves the copies made
+// when writing a file via OpenFile bit by bit.
+type WriteFileFS interface {
+	// WriteFile writes data to the named file, creating it if needed.
+	// If the file exists, it is overwritten, and its mode set to perm.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+
+	// WriteFileString is like WriteFile, with the contents as a string.
+	WriteFileString(name string, data string, perm fs.FileMode) error
+
+	// WriteFileFrom is like WriteFile, with the contents read from r until
+	// io.EOF. It returns the number of bytes written.
+	WriteFileFrom(name string, r io.Reader, perm fs.FileMode) (int64, error)
+}
+
+// SnapshotFS allows you to take on fs.FS and wrap it in an fs that is writable.
+// All of the directories in base are walked up front, so that later changes to
+// base don't show through, other than to the contents of files which were not
+// read yet. See [LazySnapshotFS] for a faster alternative with large bases.
 func SnapshotFS(base fs.FS) FileSystem {
 	newFS := newMemFS()
 	fs.WalkDir(base, ".", func(path string, d fs.DirEntry, err error) error {
@@ -46,6 +65,20 @@ func SnapshotFS(base fs.FS) FileSystem {
 			return base.Open(path)
 		}, d.Type().Perm())
 	})
+	// Populating the snapshot doesn't count as changing it.
+	newFS.ResetChanges()
 
 	return newFS
 }
+
+// LazySnapshotFS is like [SnapshotFS], but each directory in base is only read
+// when it is first needed, such as to open or list something in it. This is
+// much cheaper with a large base, as only the directories a script gets to
+// are held in memory. In exchange, the snapshot isn't taken at once: changes
+// to base show through until the directories they are in are first read.
+func LazySnapshotFS(base fs.FS) FileSystem {
+	newFS := newMemFS()
+	newFS.dir.base = base
+	newFS.dir.basePath = "."
+	return newFS
+}
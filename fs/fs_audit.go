@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"io/fs"
+	"os"
+)
+
+// NewAuditFS wraps base so that audit is called before each operation which
+// would change it, with the name of the operation and the path it is on. The
+// operations are "write" when a file is opened for writing, "mkdir" and
+// "remove". If audit returns an error, the operation is not done, and the
+// error is returned wrapped in an [fs.PathError].
+//
+// This lets a caller preview what a script would change, by recording the
+// operations and refusing them, or only allow writes to some paths.
+func NewAuditFS(base FileSystem, audit func(op, path string) error) FileSystem {
+	return &auditFS{FileSystem: base, audit: audit}
+}
+
+// auditFS asks for permission before changing the filesystem it wraps
+type auditFS struct {
+	FileSystem
+	audit func(op, path string) error
+}
+
+func (a *auditFS) check(op, path string) error {
+	if err := a.audit(op, path); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	return nil
+}
+
+// OpenFile opens the named file, auditing it first if it is opened for writing.
+func (a *auditFS) OpenFile(name string, flag int, perm fs.FileMode) (FileWriter, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := a.check("write", name); err != nil {
+			return nil, err
+		}
+	}
+	return a.FileSystem.OpenFile(name, flag, perm)
+}
+
+// MkdirAll creates a directory along with any necessary parents, if the audit allows it.
+func (a *auditFS) MkdirAll(path string, perm fs.FileMode) error {
+	if err := a.check("mkdir", path); err != nil {
+		return err
+	}
+	return a.FileSystem.MkdirAll(path, perm)
+}
+
+// Remove deletes a file or directory, if the audit allows it.
+func (a *auditFS) Remove(path string) error {
+	if err := a.check("remove", path); err != nil {
+		return err
+	}
+	return a.FileSystem.Remove(path)
+}
+
+// RemoveAll deletes a file or directory and any children, if the audit allows it.
+func (a *auditFS) RemoveAll(path string) error {
+	if err := a.check("remove", path); err != nil {
+		return err
+	}
+	return a.FileSystem.RemoveAll(path)
+}
+
+// Usage reports the usage of the wrapped filesystem, if it implements [UsageFS].
+func (a *auditFS) Usage() (total, used int64, ok bool) {
+	if u, isUsage := a.FileSystem.(UsageFS); isUsage {
+		return u.Usage()
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,157 @@
+package fs
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ChangeOp is the kind of change made to a path.
+type ChangeOp int
+
+const (
+	ChangeCreate ChangeOp = iota + 1 // the path did not exist before
+	ChangeModify                     // the path existed before, and was written to
+	ChangeRemove                     // the path existed before, and was removed
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeCreate:
+		return "create"
+	case ChangeModify:
+		return "modify"
+	case ChangeRemove:
+		return "remove"
+	}
+	return "unknown"
+}
+
+// Change describes how a path differs from when tracking started.
+type Change struct {
+	Op   ChangeOp
+	Path string
+
+	// OldSize is the size before tracking started, and NewSize the current
+	// size. Sizes of directories and of missing paths are zero.
+	OldSize, NewSize int64
+}
+
+// ChangeTracker is implemented by filesystems which record the changes made
+// to them, such as the in-memory filesystem from [NewMemFS].
+type ChangeTracker interface {
+	// Changes returns the paths which were created, modified or removed
+	// since the filesystem was created or since the last ResetChanges,
+	// sorted by path. Each path appears once, with the overall change,
+	// so a file which was created and then removed does not appear at all.
+	Changes() []Change
+
+	// ResetChanges forgets all recorded changes.
+	ResetChanges()
+}
+
+// changeLog records the changes made to a memFS
+type changeLog struct {
+	mu      sync.Mutex
+	changes map[string]*Change
+}
+
+// record merges a change to path with any earlier change to the same path.
+func (c *changeLog) record(path string, op ChangeOp, oldSize, newSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changes == nil {
+		c.changes = map[string]*Change{}
+	}
+	prev := c.changes[path]
+	if prev == nil {
+		c.changes[path] = &Change{Op: op, Path: path, OldSize: oldSize, NewSize: newSize}
+		return
+	}
+	switch {
+	case prev.Op == ChangeCreate && op == ChangeRemove:
+		delete(c.changes, path)
+		return
+	case prev.Op == ChangeRemove && op != ChangeRemove:
+		// Removed and then created again.
+		prev.Op = ChangeModify
+	case prev.Op == ChangeModify && op == ChangeRemove:
+		prev.Op = ChangeRemove
+	}
+	prev.NewSize = newSize
+}
+
+// changed records a change to path, and notifies any watchers of it.
+func (m *memFS) changed(path string, op ChangeOp, oldSize, newSize int64) {
+	m.changes.record(path, op, oldSize, newSize)
+	if m.resized != nil && newSize != oldSize {
+		m.resized(newSize - oldSize)
+	}
+	m.watchers.notify(WatchEvent{Op: op, Path: path})
+}
+
+// Changes implements [ChangeTracker].
+func (m *memFS) Changes() []Change {
+	c := &m.changes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]Change, 0, len(c.changes))
+	for _, change := range c.changes {
+		list = append(list, *change)
+	}
+	slices.SortFunc(list, func(a, b Change) int { return strings.Compare(a.Path, b.Path) })
+	return list
+}
+
+// ResetChanges implements [ChangeTracker].
+func (m *memFS) ResetChanges() {
+	c := &m.changes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.changes)
+}
+
+// sizeOf returns the size of the named file, and whether it exists.
+// Directories have a size of zero.
+func (m *memFS) sizeOf(name string) (int64, bool) {
+	if f, err := m.dir.getFile(name); err == nil {
+		return f.stat().Size(), true
+	}
+	if _, err := m.dir.getDir(name); err == nil {
+		return 0, true
+	}
+	return 0, false
+}
+
+// subtree returns the sizes of name and everything under it, if it exists.
+func (m *memFS) subtree(name string) map[string]int64 {
+	paths := map[string]int64{}
+	if size, ok := m.sizeOf(name); ok && name != "" {
+		paths[name] = size
+	}
+	if d, err := m.dir.getDir(name); err == nil {
+		prefix := name + separator
+		if name == "" {
+			prefix = ""
+		}
+		d.walk(prefix, func(path string, size int64) {
+			paths[path] = size
+		})
+	}
+	return paths
+}
+
+// walk calls fn for every file and directory under d, with their names
+// prefixed by prefix.
+func (d *dir) walk(prefix string, fn func(path string, size int64)) {
+	d.load()
+	d.RLock()
+	defer d.RUnlock()
+	for name, f := range d.files {
+		fn(prefix+name, f.stat().Size())
+	}
+	for name, sub := range d.dirs {
+		fn(prefix+name, 0)
+		sub.walk(prefix+name+separator, fn)
+	}
+}
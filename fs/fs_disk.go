@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"errors"
 	"io/fs"
 	"os"
 	"path"
@@ -60,7 +61,15 @@ func (dir dirFS) Lstat(name string) (fs.FileInfo, error) {
 	return os.Lstat(dir.join(name))
 }
 
+// Watch implements [Watcher], but watching the host filesystem is not supported.
+func (dir dirFS) Watch(path string) (<-chan WatchEvent, func(), error) {
+	return nil, nil, errors.ErrUnsupported
+}
+
 // join constructs a full path by joining the directory and name
 func (dir dirFS) join(name string) string {
-	return path.Join(".", string(dir), name)
+	if dir == "" {
+		dir = "."
+	}
+	return path.Join(string(dir), name)
 }
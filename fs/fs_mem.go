@@ -1,15 +1,16 @@
 package fs
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -17,7 +18,13 @@ import (
 
 // memFS is an in-memory filesystem
 type memFS struct {
-	dir *dir
+	dir      *dir
+	changes  changeLog
+	watchers watchers
+
+	// resized, if set, is called with how much the total size of the files
+	// grew, or shrank, with each change.
+	resized func(delta int64)
 }
 
 // NewMemFS creates a new filesystem
@@ -55,7 +62,11 @@ func (m *memFS) Stat(name string) (fs.FileInfo, error) {
 // ReadDir reads the named directory
 // and returns a list of directory entries sorted by filename.
 func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
-	return m.dir.ReadDir(cleanse(name))
+	entries, err := m.dir.ReadDir(cleanse(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
 }
 
 // Open opens the named file for reading.
@@ -65,34 +76,127 @@ func (m *memFS) Open(name string) (fs.File, error) {
 
 // WriteFile writes the specified bytes to the named file. If the file exists, it will be overwritten.
 func (m *memFS) WriteFile(path string, data []byte, perm fs.FileMode) error {
-	return m.dir.WriteFile(cleanse(path), data, perm)
+	path = cleanse(path)
+	oldSize, existed := m.sizeOf(path)
+	if err := m.dir.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	m.changed(path, createOrModify(existed), oldSize, int64(len(data)))
+	return nil
+}
+
+// WriteFileString is like WriteFile, but with the contents as a string,
+// which are copied straight into the file.
+func (m *memFS) WriteFileString(path string, data string, perm fs.FileMode) error {
+	return m.putFile(path, perm, func(content []byte) []byte {
+		return append(content, data...)
+	})
+}
+
+// WriteFileFrom writes what is read from r to the named file until io.EOF,
+// returning the number of bytes written. If the file exists, it will be
+// overwritten once all of r was read; if reading fails, nothing is written.
+// The contents are read straight into the file's new buffer, without copying
+// them again.
+func (m *memFS) WriteFileFrom(path string, r io.Reader, perm fs.FileMode) (int64, error) {
+	content, err := readAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.putFile(path, perm, func([]byte) []byte { return content }); err != nil {
+		return 0, err
+	}
+	return int64(len(content)), nil
+}
+
+// putFile is like [dir.putFile], recording the change.
+func (m *memFS) putFile(path string, perm fs.FileMode, fill func(content []byte) []byte) error {
+	path = cleanse(path)
+	oldSize, existed := m.sizeOf(path)
+	var newSize int64
+	err := m.dir.putFile(path, perm, func(content []byte) []byte {
+		content = fill(content)
+		newSize = int64(len(content))
+		return content
+	})
+	if err != nil {
+		return err
+	}
+	m.changed(path, createOrModify(existed), oldSize, newSize)
+	return nil
+}
+
+// readAll is like [io.ReadAll], but it starts with a buffer of the right size
+// if r can tell how much it has left to read, so that it need not grow.
+func readAll(r io.Reader) ([]byte, error) {
+	size := 512
+	switch r := r.(type) {
+	case interface{ Len() int }: // such as bytes.Reader and strings.Reader
+		size = r.Len() + 1 // room to read io.EOF
+	case fs.File:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			size = int(info.Size()) + 1
+		}
+	}
+	b := make([]byte, 0, size)
+	for {
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+	}
 }
 
+func createOrModify(existed bool) ChangeOp {
+	if existed {
+		return ChangeModify
+	}
+	return ChangeCreate
+}
+
+// Lstat is like Stat, as the in-memory filesystem has no symbolic links.
 func (m *memFS) Lstat(name string) (fs.FileInfo, error) {
-	return nil, fs.ErrInvalid
+	return m.Stat(name)
 }
 
 func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (FileWriter, error) {
 	name = cleanse(name)
 
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
 	// Check if file exists
 	if f, err := m.dir.getFile(name); err == nil {
+		if writing {
+			f.Lock()
+			err := f.toMemory(flag&os.O_TRUNC == 0)
+			f.Unlock()
+			if err != nil {
+				return nil, err
+			}
+		}
 		// If O_TRUNC is set, truncate the file
 		if flag&os.O_TRUNC != 0 {
-			if err := m.dir.WriteFile(name, []byte{}, perm); err != nil {
+			if err := m.WriteFile(name, []byte{}, perm); err != nil {
 				return nil, err
 			}
 		}
-		return f.open()
+		return m.openTracked(f, name, flag, writing)
 	}
 
 	// If O_CREATE is set, create new file
 	if flag&os.O_CREATE != 0 {
-		if err := m.dir.WriteFile(name, []byte{}, perm); err != nil {
+		if err := m.WriteFile(name, []byte{}, perm); err != nil {
 			return nil, err
 		}
 		if f, err := m.dir.getFile(name); err == nil {
-			return f.open()
+			return m.openTracked(f, name, flag, writing)
 		}
 	}
 
@@ -107,7 +211,30 @@ func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (FileWriter, e
 // If path is already a directory, MkdirAll does nothing
 // and returns nil.
 func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
-	return m.dir.MkdirAll(cleanse(path), perm)
+	path = cleanse(path)
+	// Find the directories which don't exist yet, to record them as created.
+	var created []string
+	for p := path; p != "" && p != "."; p = pathDir(p) {
+		if _, ok := m.sizeOf(p); ok {
+			break
+		}
+		created = append(created, p)
+	}
+	if err := m.dir.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	for _, p := range slices.Backward(created) {
+		m.changed(p, ChangeCreate, 0, 0)
+	}
+	return nil
+}
+
+// pathDir is like [path.Dir], but it returns "" for the root directory.
+func pathDir(p string) string {
+	if d := path.Dir(p); d != "." {
+		return d
+	}
+	return ""
 }
 
 // ReadFile reads the named file and returns its contents.
@@ -134,12 +261,34 @@ func (m *memFS) writeLazyFile(path string, opener lazyOpener, perm fs.FileMode)
 
 // Remove deletes a file or directory from the filesystem
 func (m *memFS) Remove(path string) error {
-	return m.dir.Remove(cleanse(path))
+	path = cleanse(path)
+	removed := m.subtree(path)
+	if err := m.dir.Remove(path); err != nil {
+		return err
+	}
+	m.recordRemoved(removed)
+	return nil
 }
 
 // RemoveAll deletes a file or directory and any children if present from the filesystem
 func (m *memFS) RemoveAll(path string) error {
-	return m.dir.RemoveAll(cleanse(path))
+	path = cleanse(path)
+	removed := m.subtree(path)
+	if err := m.dir.RemoveAll(path); err != nil {
+		return err
+	}
+	m.recordRemoved(removed)
+	return nil
+}
+
+// recordRemoved records the removal of the paths which no longer exist,
+// out of those returned by [memFS.subtree] before removing them.
+func (m *memFS) recordRemoved(paths map[string]int64) {
+	for p, size := range paths {
+		if _, ok := m.sizeOf(p); !ok {
+			m.changed(p, ChangeRemove, size, 0)
+		}
+	}
 }
 
 type fileinfo struct {
@@ -196,47 +345,101 @@ type file struct {
 	info    fileinfo
 	opener  lazyOpener
 	content []byte
+	lazy    bool // whether opener reads from somewhere other than content
 }
 
 type fileAccess struct {
 	file   *file
 	reader io.Reader
+	append bool // whether the file was opened with O_APPEND
+
+	// onWrite, if set, is called after every write with the file's sizes.
+	onWrite func(oldSize, newSize int64)
 }
 
 // lazyOpener provides an io.Reader that can be used to access the content of a file, whatever the actual storage medium.
-// If the lazyOpener returns an io.ReadCloser, it will be closed after each read.
+// If the lazyOpener returns an io.ReadCloser, it will be closed along with the file handle.
+// Writing to a file with an opener for another medium first moves it into memory, see [file.toMemory].
 type lazyOpener func() (io.Reader, error)
 
 const bufferSize = 0x100
 
-func (f *file) overwrite(data []byte, perm fs.FileMode) error {
+// overwrite replaces the contents of f with those returned by fill, which is
+// given the old contents truncated to be reused, as with [dir.putFile].
+func (f *file) overwrite(fill func(content []byte) []byte, perm fs.FileMode) error {
 
-	f.RLock()
+	f.Lock()
+	defer f.Unlock()
 	if f.opener == nil {
-		f.RUnlock()
 		return fmt.Errorf("missing opener")
 	}
-	f.RUnlock()
+	if err := f.toMemory(false); err != nil {
+		return err
+	}
+	f.content = fill(f.content[:0])
+	f.info.size = int64(len(f.content))
+	f.info.modified = time.Now()
+	f.info.mode = perm
+	return nil
+}
+
+// openTracked opens f like [openFlag], recording writes to it as changes.
+func (m *memFS) openTracked(f *file, name string, flag int, writing bool) (*fileAccess, error) {
+	access, err := openFlag(f, flag)
+	if err != nil || !writing {
+		return access, err
+	}
+	access.onWrite = func(oldSize, newSize int64) {
+		m.changed(name, ChangeModify, oldSize, newSize)
+	}
+	return access, nil
+}
 
-	rw, err := f.open()
+// openFlag opens f like [file.open], remembering whether writes should
+// append to the file.
+func openFlag(f *file, flag int) (*fileAccess, error) {
+	access, err := f.open()
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
+	access.append = flag&os.O_APPEND != 0
+	return access, nil
+}
 
-	f.Lock()
-	f.info.size = int64(len(data))
-	f.info.modified = time.Now()
-	f.info.mode = perm
-	f.Unlock()
+// memOpener returns an opener for the contents of f held in memory.
+func (f *file) memOpener() lazyOpener {
+	return func() (io.Reader, error) {
+		return &lazyAccess{
+			file: f,
+		}, nil
+	}
+}
 
-	for len(data) > 0 {
-		n, err := rw.Write(data)
+// toMemory turns a lazily loaded file into one held in memory, so that it can
+// be written to. Its contents are loaded if keep is true, and dropped otherwise.
+// The caller must hold the lock on f.
+func (f *file) toMemory(keep bool) error {
+	if !f.lazy {
+		return nil
+	}
+	var content []byte
+	if keep {
+		r, err := f.opener()
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		content, err = io.ReadAll(r)
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
 		}
-		data = data[n:]
 	}
-
+	f.content = content
+	f.info.size = int64(len(content))
+	f.opener = f.memOpener()
+	f.lazy = false
 	return nil
 }
 
@@ -282,6 +485,33 @@ func (f *fileAccess) Read(data []byte) (int, error) {
 	return r.Read(data)
 }
 
+// Seek sets the offset for the next Read or Write, as both share a single
+// offset for files held in memory. Seeking past the end is allowed, and a
+// write there leaves a hole of zeros. With O_APPEND, writes always go to the
+// end of the file regardless of the offset.
+func (f *fileAccess) Seek(offset int64, whence int) (int64, error) {
+	s, err := func() (io.Seeker, error) {
+		f.file.Lock()
+		defer f.file.Unlock()
+		if f.reader == nil {
+			r, err := f.file.opener()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file: %w", err)
+			}
+			f.reader = r
+		}
+		s, ok := f.reader.(io.Seeker)
+		if !ok {
+			return nil, fmt.Errorf("cannot seek - opener did not provide io.Seeker")
+		}
+		return s, nil
+	}()
+	if err != nil {
+		return 0, err
+	}
+	return s.Seek(offset, whence)
+}
+
 func (f *fileAccess) Close() error {
 	f.file.Lock()
 	defer f.file.Unlock()
@@ -309,42 +539,93 @@ func (f *fileAccess) Write(p []byte) (n int, err error) {
 		if !ok {
 			return nil, fmt.Errorf("cannot write - opener did not provide io.Writer")
 		}
+		if l, ok := w.(*lazyAccess); ok {
+			l.append = f.append
+		}
 		return w, nil
 	}()
 	if err != nil {
 		return 0, err
 	}
-	return w.Write(p)
+	if f.onWrite == nil {
+		return w.Write(p)
+	}
+	oldSize := f.file.stat().Size()
+	n, err = w.Write(p)
+	f.onWrite(oldSize, f.file.stat().Size())
+	return n, err
 }
 
+// lazyAccess reads and writes the contents of a file held in memory. Like
+// with a file descriptor, reads and writes share the same offset, which
+// belongs to a single open handle; each call to [file.memOpener]'s opener
+// gets its own.
 type lazyAccess struct {
-	file   *file
-	reader io.Reader
-	writer *bytes.Buffer
+	file *file
+
+	// mu guards offset, as the file's lock may be shared by many readers.
+	mu     sync.Mutex
+	offset int
+	append bool // whether each write first moves to the end of the file
 }
 
 func (l *lazyAccess) Read(data []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.file.RLock()
 	defer l.file.RUnlock()
-	if l.reader == nil {
-		l.reader = bytes.NewReader(l.file.content)
+	if l.offset >= len(l.file.content) {
+		return 0, io.EOF
 	}
-	return l.reader.Read(data)
+	n := copy(data, l.file.content[l.offset:])
+	l.offset += n
+	return n, nil
+}
+
+func (l *lazyAccess) Seek(offset int64, whence int) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.RLock()
+	defer l.file.RUnlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(l.offset)
+	case io.SeekEnd:
+		offset += int64(len(l.file.content))
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative position %d", offset)
+	}
+	l.offset = int(offset)
+	return offset, nil
 }
 
 func (l *lazyAccess) Write(data []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.file.Lock()
 	defer l.file.Unlock()
-	if l.writer == nil {
-		l.writer = bytes.NewBuffer(l.file.content)
-		l.writer.Reset()
-	}
-	n, err := l.writer.Write(data)
-	if err != nil {
-		return 0, err
+	// Seeking to the end happens under the lock,
+	// so that concurrent appenders never overwrite each other.
+	if l.append {
+		l.offset = len(l.file.content)
+	}
+	end := l.offset + len(data)
+	if size := len(l.file.content); end > size {
+		l.file.content = slices.Grow(l.file.content, end-size)[:end]
+		if l.offset > size {
+			// The file was truncated since our last write; leave a hole of zeros.
+			clear(l.file.content[size:l.offset])
+		}
 	}
-	l.file.content = l.writer.Bytes()
-	return n, nil
+	copy(l.file.content[l.offset:], data)
+	l.offset = end
+	l.file.info.size = int64(len(l.file.content))
+	l.file.info.modified = time.Now()
+	return len(data), nil
 }
 
 var separator = "/"
@@ -354,6 +635,55 @@ type dir struct {
 	info  fileinfo
 	dirs  map[string]*dir
 	files map[string]*file
+
+	// base is set for the directories of a [LazySnapshotFS], whose entries
+	// are only read from basePath in base once they are first needed.
+	base     fs.FS
+	basePath string
+	loadOnce sync.Once
+}
+
+// load reads the entries of d from its base, if it has one and they haven't
+// been read yet. It must be called before using d.dirs or d.files, without
+// holding the lock of d.
+func (d *dir) load() {
+	if d.base == nil {
+		return
+	}
+	d.loadOnce.Do(func() {
+		entries, _ := fs.ReadDir(d.base, d.basePath)
+		d.Lock()
+		defer d.Unlock()
+		for _, entry := range entries {
+			name := entry.Name()
+			p := path.Join(d.basePath, name)
+			info := fileinfo{
+				name:     name,
+				modified: time.Now(),
+				mode:     entry.Type().Perm(),
+			}
+			if entry.IsDir() {
+				info.size = 0x100
+				info.mode |= fs.ModeDir
+				d.dirs[name] = &dir{
+					info:     info,
+					dirs:     map[string]*dir{},
+					files:    map[string]*file{},
+					base:     d.base,
+					basePath: p,
+				}
+				continue
+			}
+			base := d.base
+			d.files[name] = &file{
+				info: info,
+				opener: func() (io.Reader, error) {
+					return base.Open(p)
+				},
+				lazy: true,
+			}
+		}
+	})
 }
 
 func (d *dir) Open(name string) (fs.File, error) {
@@ -396,9 +726,9 @@ func (d *dir) Stat() (fs.FileInfo, error) {
 }
 
 func (d *dir) removePath(name string, recursive bool) error {
-
-	parts := strings.Split(name, separator)
-	if len(parts) == 1 {
+	d.load()
+	first, rest, nested := strings.Cut(name, separator)
+	if !nested {
 		d.RLock()
 		_, ok := d.files[name]
 		d.RUnlock()
@@ -407,11 +737,12 @@ func (d *dir) removePath(name string, recursive bool) error {
 			return nil
 		}
 
-		if sub, err := d.getDir(parts[0]); err == nil {
+		if sub, err := d.getDir(first); err == nil {
+			sub.load()
 			d.Lock()
 			defer d.Unlock()
 			if len(sub.dirs) == 0 && len(sub.files) == 0 {
-				delete(d.dirs, parts[0])
+				delete(d.dirs, first)
 				return nil
 			} else if recursive {
 				for _, s := range sub.dirs {
@@ -420,7 +751,7 @@ func (d *dir) removePath(name string, recursive bool) error {
 				for _, f := range sub.files {
 					sub.removePath(f.info.name, recursive)
 				}
-				delete(d.dirs, parts[0])
+				delete(d.dirs, first)
 				return nil
 			}
 			return fs.ErrInvalid
@@ -428,18 +759,18 @@ func (d *dir) removePath(name string, recursive bool) error {
 		return fs.ErrNotExist
 	}
 
-	sub, err := d.getDir(parts[0])
+	sub, err := d.getDir(first)
 	if err != nil {
 		return err
 	}
 
-	return sub.removePath(strings.Join(parts[1:], separator), recursive)
+	return sub.removePath(rest, recursive)
 }
 
 func (d *dir) getFile(name string) (*file, error) {
-
-	parts := strings.Split(name, separator)
-	if len(parts) == 1 {
+	d.load()
+	first, rest, nested := strings.Cut(name, separator)
+	if !nested {
 		d.RLock()
 		f, ok := d.files[name]
 		d.RUnlock()
@@ -449,12 +780,12 @@ func (d *dir) getFile(name string) (*file, error) {
 		return nil, fs.ErrNotExist
 	}
 
-	sub, err := d.getDir(parts[0])
+	sub, err := d.getDir(first)
 	if err != nil {
 		return nil, err
 	}
 
-	return sub.getFile(strings.Join(parts[1:], separator))
+	return sub.getFile(rest)
 }
 
 func (d *dir) getDir(name string) (*dir, error) {
@@ -463,19 +794,21 @@ func (d *dir) getDir(name string) (*dir, error) {
 		return d, nil
 	}
 
-	parts := strings.Split(name, separator)
+	d.load()
+	first, rest, _ := strings.Cut(name, separator)
 
 	d.RLock()
-	f, ok := d.dirs[parts[0]]
+	f, ok := d.dirs[first]
 	d.RUnlock()
 	if ok {
-		return f.getDir(strings.Join(parts[1:], separator))
+		return f.getDir(rest)
 	}
 
 	return nil, fs.ErrNotExist
 }
 
 func (d *dir) ReadDir(name string) ([]fs.DirEntry, error) {
+	d.load()
 	if name == "" {
 		var entries []fs.DirEntry
 		d.RLock()
@@ -492,15 +825,21 @@ func (d *dir) ReadDir(name string) ([]fs.DirEntry, error) {
 		return entries, nil
 	}
 
-	parts := strings.Split(name, separator)
+	first, rest, _ := strings.Cut(name, separator)
 
 	d.RLock()
-	dir, ok := d.dirs[parts[0]]
+	dir, ok := d.dirs[first]
+	_, isFile := d.files[first]
 	d.RUnlock()
+	if isFile {
+		// Like os.ReadDir, a file in the path is not a directory,
+		// whether it's the last component or not.
+		return nil, syscall.ENOTDIR
+	}
 	if !ok {
 		return nil, fs.ErrNotExist
 	}
-	return dir.ReadDir(strings.Join(parts[1:], separator))
+	return dir.ReadDir(rest)
 }
 
 func (d *dir) Read(_ []byte) (int, error) {
@@ -512,14 +851,14 @@ func (d *dir) Close() error {
 }
 
 func (d *dir) MkdirAll(path string, perm fs.FileMode) error {
-	parts := strings.Split(path, separator)
-
 	if path == "" {
 		return nil
 	}
+	d.load()
+	first, rest, nested := strings.Cut(path, separator)
 
 	d.RLock()
-	_, ok := d.files[parts[0]]
+	_, ok := d.files[first]
 	d.RUnlock()
 	if ok {
 		return fs.ErrExist
@@ -529,10 +868,10 @@ func (d *dir) MkdirAll(path string, perm fs.FileMode) error {
 	if perm&fs.ModeDir == 0 {
 		perm |= fs.ModeDir
 	}
-	if _, ok := d.dirs[parts[0]]; !ok {
-		d.dirs[parts[0]] = &dir{
+	if _, ok := d.dirs[first]; !ok {
+		d.dirs[first] = &dir{
 			info: fileinfo{
-				name:     parts[0],
+				name:     first,
 				size:     0x100,
 				modified: time.Now(),
 				mode:     perm,
@@ -544,57 +883,60 @@ func (d *dir) MkdirAll(path string, perm fs.FileMode) error {
 	d.info.modified = time.Now()
 	d.Unlock()
 
-	if len(parts) == 1 {
+	if !nested {
 		return nil
 	}
 
 	d.RLock()
 	defer d.RUnlock()
-	return d.dirs[parts[0]].MkdirAll(strings.Join(parts[1:], separator), perm)
+	return d.dirs[first].MkdirAll(rest, perm)
 }
 
 func (d *dir) WriteFile(path string, data []byte, perm fs.FileMode) error {
-	parts := strings.Split(path, separator)
+	return d.putFile(path, perm, func(content []byte) []byte {
+		if content == nil {
+			content = make([]byte, 0, max(bufferSize, len(data)))
+		}
+		return append(content, data...)
+	})
+}
+
+// putFile creates or overwrites the named file, with the contents returned by
+// fill. fill is given the old contents truncated to be reused, or nil.
+func (d *dir) putFile(path string, perm fs.FileMode, fill func(content []byte) []byte) error {
+	d.load()
+	first, rest, nested := strings.Cut(path, separator)
 
 	if perm&fs.ModeDir != 0 {
 		return fmt.Errorf("invalid perm: %v", perm)
 	}
 
-	if len(parts) == 1 {
-		max := bufferSize
-		if len(data) > max {
-			max = len(data)
-		}
-		buffer := make([]byte, len(data), max)
-		copy(buffer, data)
+	if !nested {
 		d.Lock()
 		defer d.Unlock()
-		if existing, ok := d.files[parts[0]]; ok {
-			if err := existing.overwrite(buffer, perm); err != nil {
+		if existing, ok := d.files[first]; ok {
+			if err := existing.overwrite(fill, perm); err != nil {
 				return err
 			}
 		} else {
+			content := fill(nil)
 			newFile := &file{
 				info: fileinfo{
-					name:     parts[0],
-					size:     int64(len(buffer)),
+					name:     first,
+					size:     int64(len(content)),
 					modified: time.Now(),
 					mode:     perm,
 				},
-				content: buffer,
+				content: content,
 			}
-			newFile.opener = func() (io.Reader, error) {
-				return &lazyAccess{
-					file: newFile,
-				}, nil
-			}
-			d.files[parts[0]] = newFile
+			newFile.opener = newFile.memOpener()
+			d.files[first] = newFile
 		}
 		return nil
 	}
 
 	d.RLock()
-	_, ok := d.dirs[parts[0]]
+	_, ok := d.dirs[first]
 	d.RUnlock()
 	if !ok {
 		return fs.ErrNotExist
@@ -602,33 +944,35 @@ func (d *dir) WriteFile(path string, data []byte, perm fs.FileMode) error {
 
 	d.RLock()
 	defer d.RUnlock()
-	return d.dirs[parts[0]].WriteFile(strings.Join(parts[1:], separator), data, perm)
+	return d.dirs[first].putFile(rest, perm, fill)
 }
 
 func (d *dir) writeLazyFile(path string, opener lazyOpener, perm fs.FileMode) error {
-	parts := strings.Split(path, separator)
+	d.load()
+	first, rest, nested := strings.Cut(path, separator)
 
 	if perm&fs.ModeDir != 0 {
 		return fmt.Errorf("invalid perm: %v", perm)
 	}
 
-	if len(parts) == 1 {
+	if !nested {
 		d.Lock()
 		defer d.Unlock()
-		d.files[parts[0]] = &file{
+		d.files[first] = &file{
 			info: fileinfo{
-				name:     parts[0],
+				name:     first,
 				size:     0,
 				modified: time.Now(),
 				mode:     perm,
 			},
 			opener: opener,
+			lazy:   true,
 		}
 		return nil
 	}
 
 	d.RLock()
-	_, ok := d.dirs[parts[0]]
+	_, ok := d.dirs[first]
 	d.RUnlock()
 	if !ok {
 		return fs.ErrNotExist
@@ -636,15 +980,13 @@ func (d *dir) writeLazyFile(path string, opener lazyOpener, perm fs.FileMode) er
 
 	d.RLock()
 	defer d.RUnlock()
-	return d.dirs[parts[0]].writeLazyFile(strings.Join(parts[1:], separator), opener, perm)
+	return d.dirs[first].writeLazyFile(rest, opener, perm)
 }
 
+// cleanse normalizes p into a path relative to the root of the filesystem,
+// with "" being the root itself. Paths are resolved as if they were rooted,
+// so ".." never climbs above the root: "../x" and "/a/../../x" are both "x".
 func cleanse(p string) string {
-	p = path.Clean(p)
-	p = strings.TrimPrefix(p, "."+separator)
-	p = strings.TrimPrefix(p, separator)
-	if p == "." {
-		return ""
-	}
-	return p
+	p = path.Clean(separator + p)
+	return strings.TrimPrefix(p, separator)
 }
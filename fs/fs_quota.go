@@ -0,0 +1,159 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoSpace is returned when a write would exceed the quota of a filesystem
+// created with [NewMemFSWithQuota].
+var ErrNoSpace = errors.New("no space left on device")
+
+// UsageFS is implemented by filesystems that can report their storage usage,
+// such as those created with [NewMemFSWithQuota].
+type UsageFS interface {
+	// Usage returns the total and used size of the filesystem in bytes.
+	// ok is false if the usage is unknown.
+	Usage() (total, used int64, ok bool)
+}
+
+// NewMemFSWithQuota creates a new in-memory filesystem which holds at most
+// quota bytes of file contents. Writes beyond the quota fail with [ErrNoSpace].
+func NewMemFSWithQuota(quota int64) FileSystem {
+	q := &quotaFS{
+		memFS: newMemFS(),
+		total: quota,
+	}
+	q.memFS.resized = func(delta int64) { q.used.Add(delta) }
+	return q
+}
+
+// quotaFS is an in-memory filesystem with a fixed size
+type quotaFS struct {
+	*memFS
+	total int64
+
+	// used is the sum of the sizes of all files, kept up to date as they
+	// are written to, truncated and removed.
+	used atomic.Int64
+
+	// mu serializes writes, so that concurrent ones can't overrun the quota.
+	mu sync.Mutex
+}
+
+// Usage returns the quota and the sum of the sizes of all files.
+// Directories don't count towards the usage.
+func (q *quotaFS) Usage() (total, used int64, ok bool) {
+	return q.total, q.used.Load(), true
+}
+
+// WriteFile writes the specified bytes to the named file, as long as the new contents fit in the quota.
+func (q *quotaFS) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkWrite(path, int64(len(data))); err != nil {
+		return err
+	}
+	return q.memFS.WriteFile(path, data, perm)
+}
+
+// WriteFileString writes the specified string to the named file, as long as it fits in the quota.
+func (q *quotaFS) WriteFileString(path string, data string, perm fs.FileMode) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkWrite(path, int64(len(data))); err != nil {
+		return err
+	}
+	return q.memFS.WriteFileString(path, data, perm)
+}
+
+// WriteFileFrom writes what is read from r to the named file, as long as it fits in the quota.
+// No more than what would fit is read from r.
+func (q *quotaFS) WriteFileFrom(path string, r io.Reader, perm fs.FileMode) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	avail := q.total - q.used.Load()
+	if f, err := q.dir.getFile(cleanse(path)); err == nil {
+		avail += f.stat().Size()
+	}
+	lr := &io.LimitedReader{R: r, N: max(avail, 0) + 1}
+	content, err := readAll(lr)
+	if err != nil {
+		return 0, err
+	}
+	if err := q.checkWrite(path, int64(len(content))); err != nil {
+		return 0, err
+	}
+	if err := q.putFile(path, perm, func([]byte) []byte { return content }); err != nil {
+		return 0, err
+	}
+	return int64(len(content)), nil
+}
+
+// checkWrite returns an error if replacing the named file with size bytes
+// would go over the quota. The caller must hold q.mu.
+func (q *quotaFS) checkWrite(path string, size int64) error {
+	grow := size
+	if f, err := q.dir.getFile(cleanse(path)); err == nil {
+		grow -= f.stat().Size()
+	}
+	if q.used.Load()+grow > q.total {
+		return &fs.PathError{Op: "write", Path: path, Err: ErrNoSpace}
+	}
+	return nil
+}
+
+// OpenFile opens the named file, returning a writer which is limited by the quota.
+func (q *quotaFS) OpenFile(name string, flag int, perm fs.FileMode) (FileWriter, error) {
+	f, err := q.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaFile{FileWriter: f, fs: q, append: flag&os.O_APPEND != 0}, nil
+}
+
+type quotaFile struct {
+	FileWriter
+	fs     *quotaFS
+	append bool // whether writes always go to the end of the file
+}
+
+// Write writes as much of p as fits in the quota, returning ErrNoSpace if not all of it did.
+// Only the bytes which grow the file count, so overwriting its contents always fits.
+func (f *quotaFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size, offset := info.Size(), info.Size()
+	if !f.append {
+		if pos, err := f.Seek(0, io.SeekCurrent); err == nil {
+			offset = pos
+		}
+	}
+	// A write past the end also grows the file by the hole it leaves.
+	fits := max(size+max(f.fs.total-f.fs.used.Load(), 0)-offset, 0)
+	if int64(len(p)) <= fits {
+		return f.FileWriter.Write(p)
+	}
+	n, err := f.FileWriter.Write(p[:fits])
+	if err == nil {
+		err = ErrNoSpace
+	}
+	return n, err
+}
+
+// Seek sets the offset of the underlying file, if it supports seeking.
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.FileWriter.(io.Seeker)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return s.Seek(offset, whence)
+}
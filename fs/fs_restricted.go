@@ -0,0 +1,199 @@
+package fs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// NewRestrictedFS wraps base so that only the paths under the allow patterns
+// can be used, except for those under the deny patterns, which win. A path is
+// under a pattern if it, or one of its parent directories, matches it with
+// [path.Match]; so "/home/*" allows everything in each home directory, and
+// "/" allows everything. Any other path behaves as if it didn't have the
+// permission, failing with [fs.ErrPermission].
+//
+// The directories leading to the allowed paths can still be listed, to find
+// them, but nothing else. Listing a directory leaves out the entries which
+// can't be used. NewRestrictedFS panics if a pattern is malformed.
+func NewRestrictedFS(base FileSystem, allow, deny []string) FileSystem {
+	return &restrictedFS{
+		base:  base,
+		allow: splitPatterns(allow),
+		deny:  splitPatterns(deny),
+	}
+}
+
+// restrictedFS hides the paths of the filesystem it wraps which aren't allowed
+type restrictedFS struct {
+	base        FileSystem
+	allow, deny [][]string
+}
+
+// access is how much of a path a restrictedFS lets through.
+type access int
+
+const (
+	accessNone   access = iota
+	accessParent        // the path leads to an allowed one; it can only be listed
+	accessFull
+)
+
+func splitPatterns(patterns []string) [][]string {
+	split := make([][]string, len(patterns))
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic("fs: bad pattern " + pattern + ": " + err.Error())
+		}
+		split[i] = splitPath(cleanse(pattern))
+	}
+	return split
+}
+
+func splitPath(p string) []string {
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, separator)
+}
+
+// matchParts reports whether the first components of name match all those of
+// pattern, and whether name is under pattern rather than one of its parents.
+func matchParts(pattern, name []string) (matched, under bool) {
+	for i, part := range name {
+		if i == len(pattern) {
+			return true, true
+		}
+		if ok, _ := path.Match(pattern[i], part); !ok {
+			return false, false
+		}
+	}
+	return true, len(name) >= len(pattern)
+}
+
+func (r *restrictedFS) access(name string) access {
+	parts := splitPath(cleanse(name))
+	for _, pattern := range r.deny {
+		if _, under := matchParts(pattern, parts); under {
+			return accessNone
+		}
+	}
+	acc := accessNone
+	for _, pattern := range r.allow {
+		matched, under := matchParts(pattern, parts)
+		if under {
+			return accessFull
+		}
+		if matched {
+			acc = accessParent
+		}
+	}
+	return acc
+}
+
+// check returns an error unless name has at least the given access.
+func (r *restrictedFS) check(op, name string, need access) error {
+	if r.access(name) < need {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// Open opens the named file, if it's allowed.
+func (r *restrictedFS) Open(name string) (fs.File, error) {
+	if err := r.check("open", name, accessFull); err != nil {
+		return nil, err
+	}
+	return r.base.Open(name)
+}
+
+// OpenFile opens the named file with the given flags, if it's allowed.
+func (r *restrictedFS) OpenFile(name string, flag int, perm fs.FileMode) (FileWriter, error) {
+	if err := r.check("open", name, accessFull); err != nil {
+		return nil, err
+	}
+	return r.base.OpenFile(name, flag, perm)
+}
+
+// ReadFile reads the named file, if it's allowed.
+func (r *restrictedFS) ReadFile(name string) ([]byte, error) {
+	if err := r.check("open", name, accessFull); err != nil {
+		return nil, err
+	}
+	return r.base.ReadFile(name)
+}
+
+// ReadDir lists the entries of the named directory which can be used, as long
+// as the directory is allowed or leads to an allowed path.
+func (r *restrictedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := r.check("readdir", name, accessParent); err != nil {
+		return nil, err
+	}
+	entries, err := r.base.ReadDir(name)
+	var visible []fs.DirEntry
+	for _, entry := range entries {
+		if r.access(path.Join(name, entry.Name())) != accessNone {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+// Stat returns the info of the named file, if it's visible.
+func (r *restrictedFS) Stat(name string) (fs.FileInfo, error) {
+	if err := r.check("stat", name, accessParent); err != nil {
+		return nil, err
+	}
+	return r.base.Stat(name)
+}
+
+// Lstat returns the info of the named file without following links, if it's visible.
+func (r *restrictedFS) Lstat(name string) (fs.FileInfo, error) {
+	if err := r.check("lstat", name, accessParent); err != nil {
+		return nil, err
+	}
+	return r.base.Lstat(name)
+}
+
+// MkdirAll creates a directory along with any necessary parents, if it's allowed.
+func (r *restrictedFS) MkdirAll(path string, perm fs.FileMode) error {
+	if err := r.check("mkdir", path, accessFull); err != nil {
+		return err
+	}
+	return r.base.MkdirAll(path, perm)
+}
+
+// Remove deletes a file or directory, if it's allowed.
+func (r *restrictedFS) Remove(path string) error {
+	if err := r.check("remove", path, accessFull); err != nil {
+		return err
+	}
+	return r.base.Remove(path)
+}
+
+// RemoveAll deletes a file or directory and any children, if they are all
+// allowed; so denied paths can't be removed along with their parents.
+func (r *restrictedFS) RemoveAll(path string) error {
+	if err := r.check("remove", path, accessFull); err != nil {
+		return err
+	}
+	err := fs.WalkDir(r.base, path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return r.check("remove", name, accessFull)
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return r.base.RemoveAll(path)
+}
+
+// Usage reports the usage of the wrapped filesystem, if it implements [UsageFS].
+func (r *restrictedFS) Usage() (total, used int64, ok bool) {
+	if u, isUsage := r.base.(UsageFS); isUsage {
+		return u.Usage()
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,768 @@
+package fs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+
+	"github.com/go-quicktest/qt"
+	"github.com/wzshiming/vsh/fs"
+)
+
+func writeFile(fsys fs.FileSystem, name, data string) (int, error) {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Write([]byte(data))
+}
+
+func TestMemFSWithQuota(t *testing.T) {
+	fsys := fs.NewMemFSWithQuota(10)
+	usage := fsys.(fs.UsageFS)
+
+	_, err := writeFile(fsys, "a", "12345")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("d", 0o755)))
+	n, err := writeFile(fsys, "d/b", "123456")
+	qt.Assert(t, qt.ErrorIs(err, fs.ErrNoSpace))
+	qt.Assert(t, qt.Equals(n, 5))
+
+	total, used, ok := usage.Usage()
+	qt.Assert(t, qt.IsTrue(ok))
+	qt.Assert(t, qt.Equals(total, int64(10)))
+	qt.Assert(t, qt.Equals(used, int64(10)))
+
+	// Truncating a file frees its space.
+	_, err = writeFile(fsys, "a", "1")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.RemoveAll("d")))
+	_, used, _ = usage.Usage()
+	qt.Assert(t, qt.Equals(used, int64(1)))
+	_, err = writeFile(fsys, "b", "123456789")
+	qt.Assert(t, qt.IsNil(err))
+
+	// Removing a file frees its space, and appending uses it again.
+	qt.Assert(t, qt.IsNil(fsys.Remove("b")))
+	_, used, _ = usage.Usage()
+	qt.Assert(t, qt.Equals(used, int64(1)))
+	f, err := fsys.OpenFile("a", os.O_WRONLY|os.O_APPEND, 0o644)
+	qt.Assert(t, qt.IsNil(err))
+	n, err = f.Write([]byte("2345678901"))
+	qt.Assert(t, qt.ErrorIs(err, fs.ErrNoSpace))
+	qt.Assert(t, qt.Equals(n, 9))
+	qt.Assert(t, qt.IsNil(f.Close()))
+	_, used, _ = usage.Usage()
+	qt.Assert(t, qt.Equals(used, int64(10)))
+
+	// Overwriting bytes in place doesn't need any more space.
+	f, err = fsys.OpenFile("a", os.O_RDWR, 0o644)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = f.(io.Seeker).Seek(2, io.SeekStart)
+	qt.Assert(t, qt.IsNil(err))
+	n, err = f.Write([]byte("abcdefghij"))
+	qt.Assert(t, qt.ErrorIs(err, fs.ErrNoSpace))
+	qt.Assert(t, qt.Equals(n, 8))
+	qt.Assert(t, qt.IsNil(f.Close()))
+	data, err := fsys.ReadFile("a")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "12abcdefgh"))
+}
+
+func TestMemFSWriteFileFS(t *testing.T) {
+	for _, fsys := range []fs.FileSystem{
+		fs.NewMemFS(),
+		fs.NewMemFSWithQuota(100),
+		fs.LazySnapshotFS(fstest.MapFS{"f": {Data: []byte("base")}}),
+	} {
+		wfs := fsys.(fs.WriteFileFS)
+		qt.Assert(t, qt.IsNil(wfs.WriteFileString("f", "string", 0o600)))
+		data, err := fsys.ReadFile("f")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(string(data), "string"))
+
+		n, err := wfs.WriteFileFrom("f", strings.NewReader("reader"), 0o644)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(n, int64(6)))
+		n, err = wfs.WriteFileFrom("g", iotest.HalfReader(strings.NewReader("slow reader")), 0o644)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(n, int64(11)))
+		for name, want := range map[string]string{"f": "reader", "g": "slow reader"} {
+			data, err := fsys.ReadFile(name)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(string(data), want))
+			fi, err := fsys.Stat(name)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(fi.Size(), int64(len(want))))
+			qt.Assert(t, qt.Equals(fi.Mode(), 0o644))
+		}
+
+		// A failed read leaves the file as it was.
+		_, err = wfs.WriteFileFrom("f", iotest.ErrReader(io.ErrUnexpectedEOF), 0o644)
+		qt.Assert(t, qt.ErrorIs(err, io.ErrUnexpectedEOF))
+		data, err = fsys.ReadFile("f")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(string(data), "reader"))
+		_, err = wfs.WriteFileFrom("nosuch/f", strings.NewReader(""), 0o644)
+		qt.Assert(t, qt.ErrorIs(err, iofs.ErrNotExist))
+	}
+
+	fsys := fs.NewMemFSWithQuota(10).(fs.WriteFileFS)
+	qt.Assert(t, qt.IsNil(fsys.WriteFileString("a", "12345", 0o644)))
+	err := fsys.WriteFileString("b", "123456", 0o644)
+	qt.Assert(t, qt.ErrorIs(err, fs.ErrNoSpace))
+	_, err = fsys.WriteFileFrom("b", strings.NewReader("123456"), 0o644)
+	qt.Assert(t, qt.ErrorIs(err, fs.ErrNoSpace))
+	// Overwriting a file frees its space first.
+	n, err := fsys.WriteFileFrom("a", strings.NewReader("1234567890"), 0o644)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(n, int64(10)))
+}
+
+func TestMemFSAppend(t *testing.T) {
+	fsys := fs.NewMemFS()
+	const appendFlag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	write := func(flag int, data string) {
+		f, err := fsys.OpenFile("f", flag, 0o644)
+		qt.Assert(t, qt.IsNil(err))
+		_, err = f.Write([]byte(data))
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(f.Close()))
+	}
+	read := func() string {
+		data, err := fsys.ReadFile("f")
+		qt.Assert(t, qt.IsNil(err))
+		return string(data)
+	}
+
+	// Appending creates the file if missing, and appends otherwise.
+	write(appendFlag, "a\n")
+	write(appendFlag, "b\n")
+	qt.Assert(t, qt.Equals(read(), "a\nb\n"))
+
+	// Without O_APPEND nor O_TRUNC, writes overwrite from the start.
+	write(os.O_WRONLY, "xy")
+	qt.Assert(t, qt.Equals(read(), "xyb\n"))
+	write(os.O_WRONLY|os.O_TRUNC, "c\n")
+	qt.Assert(t, qt.Equals(read(), "c\n"))
+	info, err := fsys.Stat("f")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info.Size(), int64(2)))
+
+	// Concurrent appenders never overwrite each other.
+	write(os.O_WRONLY|os.O_TRUNC, "")
+	var wg sync.WaitGroup
+	for _, line := range []string{"A\n", "B\n"} {
+		f, err := fsys.OpenFile("f", appendFlag, 0o644)
+		qt.Assert(t, qt.IsNil(err))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				f.Write([]byte(line))
+			}
+			f.Close()
+		}()
+	}
+	wg.Wait()
+	got := read()
+	qt.Assert(t, qt.Equals(strings.Count(got, "A\n"), 100))
+	qt.Assert(t, qt.Equals(strings.Count(got, "B\n"), 100))
+	qt.Assert(t, qt.Equals(len(got), 400))
+}
+
+func TestMemFSChanges(t *testing.T) {
+	fsys := fs.NewMemFS()
+	tracker := fsys.(fs.ChangeTracker)
+	_, err := writeFile(fsys, "existing", "12345")
+	qt.Assert(t, qt.IsNil(err))
+	_, err = writeFile(fsys, "gone", "123")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("old/dir", 0o755)))
+	_, err = writeFile(fsys, "old/dir/file", "1")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(tracker.Changes(), []fs.Change{
+		{Op: fs.ChangeCreate, Path: "existing", NewSize: 5},
+		{Op: fs.ChangeCreate, Path: "gone", NewSize: 3},
+		{Op: fs.ChangeCreate, Path: "old"},
+		{Op: fs.ChangeCreate, Path: "old/dir"},
+		{Op: fs.ChangeCreate, Path: "old/dir/file", NewSize: 1},
+	}))
+	tracker.ResetChanges()
+	qt.Assert(t, qt.HasLen(tracker.Changes(), 0))
+
+	f, err := fsys.OpenFile("existing", os.O_WRONLY|os.O_APPEND, 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = f.Write([]byte("678"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(f.Close()))
+	qt.Assert(t, qt.IsNil(fsys.Remove("gone")))
+	qt.Assert(t, qt.IsNil(fsys.RemoveAll("old")))
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("new", 0o755)))
+	_, err = writeFile(fsys, "new/tmp", "x")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.Remove("new/tmp")))
+	_, err = writeFile(fsys, "old/dir/file", "recreated")
+	qt.Assert(t, qt.ErrorIs(err, iofs.ErrNotExist))
+
+	qt.Assert(t, qt.DeepEquals(tracker.Changes(), []fs.Change{
+		{Op: fs.ChangeModify, Path: "existing", OldSize: 5, NewSize: 8},
+		{Op: fs.ChangeRemove, Path: "gone", OldSize: 3},
+		{Op: fs.ChangeCreate, Path: "new"},
+		{Op: fs.ChangeRemove, Path: "old"},
+		{Op: fs.ChangeRemove, Path: "old/dir"},
+		{Op: fs.ChangeRemove, Path: "old/dir/file", OldSize: 1},
+	}))
+
+	// A snapshot starts out with no changes.
+	snap := fs.SnapshotFS(fsys)
+	qt.Assert(t, qt.HasLen(snap.(fs.ChangeTracker).Changes(), 0))
+}
+
+func TestMemFSWatch(t *testing.T) {
+	fsys := fs.NewMemFS()
+	events, cancel, err := fsys.(fs.Watcher).Watch("dir")
+	qt.Assert(t, qt.IsNil(err))
+
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("dir/sub", 0o755)))
+	_, err = writeFile(fsys, "other", "ignored")
+	qt.Assert(t, qt.IsNil(err))
+	_, err = writeFile(fsys, "dir/sub/f", "data")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.Remove("dir/sub/f")))
+	_, err = writeFile(fsys, "dirty", "ignored")
+	qt.Assert(t, qt.IsNil(err))
+
+	var got []fs.WatchEvent
+	for range 5 {
+		got = append(got, <-events)
+	}
+	qt.Assert(t, qt.DeepEquals(got, []fs.WatchEvent{
+		{Op: fs.ChangeCreate, Path: "dir"},
+		{Op: fs.ChangeCreate, Path: "dir/sub"},
+		{Op: fs.ChangeCreate, Path: "dir/sub/f"},
+		{Op: fs.ChangeModify, Path: "dir/sub/f"},
+		{Op: fs.ChangeRemove, Path: "dir/sub/f"},
+	}))
+
+	cancel()
+	_, ok := <-events
+	qt.Assert(t, qt.IsFalse(ok))
+	cancel() // a second call is a no-op
+
+	_, _, err = fs.NewDiskFS(t.TempDir()).(fs.Watcher).Watch(".")
+	qt.Assert(t, qt.ErrorIs(err, errors.ErrUnsupported))
+}
+
+func TestMemFSReadWriteSeek(t *testing.T) {
+	fsys := fs.NewMemFS()
+	_, err := writeFile(fsys, "f", "hello world")
+	qt.Assert(t, qt.IsNil(err))
+
+	f, err := fsys.OpenFile("f", os.O_RDWR, 0)
+	qt.Assert(t, qt.IsNil(err))
+	rws, ok := f.(io.ReadWriteSeeker)
+	qt.Assert(t, qt.IsTrue(ok))
+
+	// Reads and writes share the same offset.
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(rws, buf)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(buf), "hello"))
+	_, err = rws.Write([]byte("_"))
+	qt.Assert(t, qt.IsNil(err))
+
+	pos, err := rws.Seek(-5, io.SeekEnd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(pos, int64(6)))
+	_, err = rws.Write([]byte("WORLD!"))
+	qt.Assert(t, qt.IsNil(err))
+
+	_, err = rws.Seek(0, io.SeekStart)
+	qt.Assert(t, qt.IsNil(err))
+	all, err := io.ReadAll(rws)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(all), "hello_WORLD!"))
+
+	// Writing past the end leaves a hole of zeros.
+	_, err = rws.Seek(2, io.SeekCurrent)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = rws.Write([]byte("x"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(f.Close()))
+	data, err := fsys.ReadFile("f")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "hello_WORLD!\x00\x00x"))
+
+	_, err = rws.Seek(-1, io.SeekStart)
+	qt.Assert(t, qt.IsNotNil(err))
+}
+
+func TestWritethroughFS(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"keep":     "keep\n",
+		"modify":   "old\n",
+		"remove":   "remove\n",
+		"sub/gone": "gone\n",
+	} {
+		qt.Assert(t, qt.IsNil(os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)))
+		qt.Assert(t, qt.IsNil(os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644)))
+	}
+	fsys, flush := fs.NewWritethroughFS(fs.NewDiskFS(dir))
+
+	_, err := writeFile(fsys, "modify", "new\n")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("new/dir", 0o755)))
+	_, err = fsys.(fs.WriteFileFS).WriteFileFrom("new/dir/file", strings.NewReader("created\n"), 0o644)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.Remove("remove")))
+	qt.Assert(t, qt.IsNil(fsys.RemoveAll("sub")))
+
+	data, err := fsys.ReadFile("keep")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "keep\n"))
+	data, err = fsys.ReadFile("modify")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "new\n"))
+
+	// Nothing reaches the disk until the flush.
+	want := []string{"keep", "modify", "remove", "sub", "sub/gone"}
+	qt.Assert(t, qt.DeepEquals(listDisk(t, dir), want))
+	data, err = os.ReadFile(filepath.Join(dir, "modify"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "old\n"))
+
+	qt.Assert(t, qt.IsNil(flush()))
+	want = []string{"keep", "modify", "new", "new/dir", "new/dir/file"}
+	qt.Assert(t, qt.DeepEquals(listDisk(t, dir), want))
+	data, err = os.ReadFile(filepath.Join(dir, "modify"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "new\n"))
+	data, err = os.ReadFile(filepath.Join(dir, "new/dir/file"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "created\n"))
+
+	// A second flush has nothing left to do.
+	qt.Assert(t, qt.IsNil(os.WriteFile(filepath.Join(dir, "modify"), []byte("changed on disk\n"), 0o644)))
+	qt.Assert(t, qt.IsNil(flush()))
+	data, err = os.ReadFile(filepath.Join(dir, "modify"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "changed on disk\n"))
+
+	// A directory which is replaced by a file.
+	qt.Assert(t, qt.IsNil(fsys.RemoveAll("new")))
+	_, err = writeFile(fsys, "new", "now a file\n")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(flush()))
+	want = []string{"keep", "modify", "new"}
+	qt.Assert(t, qt.DeepEquals(listDisk(t, dir), want))
+	data, err = os.ReadFile(filepath.Join(dir, "new"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "now a file\n"))
+}
+
+// listDisk returns the paths of all files and directories under dir.
+func listDisk(t *testing.T, dir string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.WalkDir(dir, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		paths = append(paths, filepath.ToSlash(rel))
+		return err
+	})
+	qt.Assert(t, qt.IsNil(err))
+	return paths
+}
+
+func TestMemFSCleanPaths(t *testing.T) {
+	fsys := fs.NewMemFS()
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("a", 0o755)))
+	_, err := writeFile(fsys, "a/../b", "b")
+	qt.Assert(t, qt.IsNil(err))
+
+	for _, name := range []string{"b", "./b", "//b", "/b", "a/../b", "../b", "../../a/../b"} {
+		data, err := fsys.ReadFile(name)
+		qt.Assert(t, qt.IsNil(err), qt.Commentf("%q", name))
+		qt.Assert(t, qt.Equals(string(data), "b"), qt.Commentf("%q", name))
+	}
+	for _, name := range []string{"a", "a/", "./a/.", "//a//", "../a"} {
+		fi, err := fsys.Stat(name)
+		qt.Assert(t, qt.IsNil(err), qt.Commentf("%q", name))
+		qt.Assert(t, qt.IsTrue(fi.IsDir()), qt.Commentf("%q", name))
+	}
+
+	// ".." can't escape the root, so these all name the root directory.
+	for _, name := range []string{".", "/", "..", "a/../..", "../../"} {
+		entries, err := fsys.ReadDir(name)
+		qt.Assert(t, qt.IsNil(err), qt.Commentf("%q", name))
+		qt.Assert(t, qt.HasLen(entries, 2), qt.Commentf("%q", name))
+	}
+
+	_, err = writeFile(fsys, "../c", "c")
+	qt.Assert(t, qt.IsNil(err))
+	data, err := fsys.ReadFile("c")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "c"))
+}
+
+func TestMemFSReadDirErrors(t *testing.T) {
+	fsys := fs.NewMemFS()
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("a/empty", 0o755)))
+	_, err := writeFile(fsys, "a/f", "")
+	qt.Assert(t, qt.IsNil(err))
+
+	entries, err := fsys.ReadDir("a/empty")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(entries, 0))
+
+	for _, name := range []string{"a/f", "a/f/x"} {
+		_, err = fsys.ReadDir(name)
+		qt.Assert(t, qt.ErrorIs(err, syscall.ENOTDIR), qt.Commentf("%q", name))
+		var perr *iofs.PathError
+		qt.Assert(t, qt.ErrorAs(err, &perr))
+		qt.Assert(t, qt.Equals(perr.Path, name))
+	}
+
+	_, err = fsys.ReadDir("a/missing")
+	qt.Assert(t, qt.ErrorIs(err, iofs.ErrNotExist))
+	qt.Assert(t, qt.Not(qt.ErrorIs(err, syscall.ENOTDIR)))
+}
+
+func TestMemFSConcurrentReads(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	mem := fs.NewMemFS()
+	_, err := writeFile(mem, "f", content)
+	qt.Assert(t, qt.IsNil(err))
+	// Files in a snapshot are read lazily from the base filesystem.
+	dir := t.TempDir()
+	qt.Assert(t, qt.IsNil(os.Mkdir(filepath.Join(dir, "d"), 0o755)))
+	qt.Assert(t, qt.IsNil(os.WriteFile(filepath.Join(dir, "d", "f"), []byte(content), 0o644)))
+	snap := fs.SnapshotFS(os.DirFS(dir))
+
+	for _, tc := range []struct {
+		fsys fs.FileSystem
+		name string
+	}{{mem, "f"}, {snap, "d/f"}} {
+		// Each handle has its own offset, so that readers of the same file
+		// don't interfere with each other.
+		var wg sync.WaitGroup
+		for range 8 {
+			f, err := tc.fsys.Open(tc.name)
+			qt.Assert(t, qt.IsNil(err))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer f.Close()
+				var sb strings.Builder
+				buf := make([]byte, 7)
+				for {
+					n, err := f.Read(buf)
+					sb.Write(buf[:n])
+					if err == io.EOF {
+						break
+					}
+					qt.Check(t, qt.IsNil(err))
+				}
+				qt.Check(t, qt.Equals(sb.String(), content))
+				n, err := f.Read(buf)
+				qt.Check(t, qt.Equals(n, 0))
+				qt.Check(t, qt.Equals(err, io.EOF))
+			}()
+		}
+		wg.Wait()
+
+		// Concurrent reads of a single handle split the contents between them.
+		f, err := tc.fsys.Open(tc.name)
+		qt.Assert(t, qt.IsNil(err))
+		var total sync.Map
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 3)
+				n := 0
+				for {
+					m, err := f.Read(buf)
+					n += m
+					if err != nil {
+						break
+					}
+				}
+				total.Store(i, n)
+			}()
+		}
+		wg.Wait()
+		qt.Assert(t, qt.IsNil(f.Close()))
+		sum := 0
+		total.Range(func(_, n any) bool {
+			sum += n.(int)
+			return true
+		})
+		qt.Assert(t, qt.Equals(sum, len(content)))
+	}
+}
+
+func TestSnapshotFSOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		qt.Assert(t, qt.IsNil(os.WriteFile(filepath.Join(dir, name), []byte("base "+name), 0o644)))
+	}
+	snap := fs.SnapshotFS(os.DirFS(dir))
+
+	err := snap.(interface {
+		WriteFile(string, []byte, iofs.FileMode) error
+	}).WriteFile("a", []byte("new a"), 0o644)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = writeFile(snap, "b", "new b")
+	qt.Assert(t, qt.IsNil(err))
+	f, err := snap.OpenFile("c", os.O_WRONLY|os.O_APPEND, 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = f.Write([]byte(" and more"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(f.Close()))
+
+	// Changes to the base after writing don't show through the snapshot.
+	for _, name := range []string{"a", "b", "c"} {
+		qt.Assert(t, qt.IsNil(os.WriteFile(filepath.Join(dir, name), []byte("changed"), 0o644)))
+	}
+	for name, want := range map[string]string{"a": "new a", "b": "new b", "c": "base c and more"} {
+		data, err := snap.ReadFile(name)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(string(data), want))
+		fi, err := snap.Stat(name)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(fi.Size(), int64(len(want))))
+	}
+}
+
+func TestLazySnapshotFS(t *testing.T) {
+	base := fstest.MapFS{
+		"a/b/c": {Data: []byte("abc")},
+		"a/d":   {Data: []byte("ad")},
+		"e":     {Data: []byte("e")},
+	}
+	for _, snap := range []fs.FileSystem{fs.SnapshotFS(base), fs.LazySnapshotFS(base)} {
+		entries, err := snap.ReadDir("/a")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.HasLen(entries, 2))
+		qt.Assert(t, qt.IsTrue(entries[0].IsDir()))
+		qt.Assert(t, qt.Equals(entries[1].Name(), "d"))
+		data, err := snap.ReadFile("a/b/c")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(string(data), "abc"))
+		_, err = snap.Stat("a/nosuch")
+		qt.Assert(t, qt.ErrorIs(err, iofs.ErrNotExist))
+
+		_, err = writeFile(snap, "a/b/new", "new")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(snap.RemoveAll("a/b")))
+		qt.Assert(t, qt.IsNil(snap.Remove("e")))
+		entries, err = snap.ReadDir("")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.HasLen(entries, 1))
+		entries, err = snap.ReadDir("a")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.HasLen(entries, 1))
+	}
+	qt.Assert(t, qt.HasLen(base, 3))
+
+	// Only the directories which were read are snapshotted.
+	snap := fs.LazySnapshotFS(base)
+	_, err := snap.Stat("a/d")
+	qt.Assert(t, qt.IsNil(err))
+	base["a/f"] = &fstest.MapFile{}
+	base["a/b/g"] = &fstest.MapFile{}
+	_, err = snap.Stat("a/f")
+	qt.Assert(t, qt.ErrorIs(err, iofs.ErrNotExist))
+	_, err = snap.Stat("a/b/g")
+	qt.Assert(t, qt.IsNil(err))
+}
+
+func TestAuditFS(t *testing.T) {
+	var ops []string
+	fsys := fs.NewAuditFS(fs.NewMemFSWithQuota(100), func(op, path string) error {
+		ops = append(ops, op+" "+path)
+		if strings.HasPrefix(path, "ro") {
+			return os.ErrPermission
+		}
+		return nil
+	})
+
+	_, err := writeFile(fsys, "a", "data")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("d", 0o755)))
+	qt.Assert(t, qt.IsNil(fsys.Remove("a")))
+	qt.Assert(t, qt.IsNil(fsys.RemoveAll("d")))
+
+	// Reading is not audited.
+	_, err = fsys.OpenFile("missing", os.O_RDONLY, 0)
+	qt.Assert(t, qt.ErrorIs(err, iofs.ErrNotExist))
+
+	_, err = writeFile(fsys, "ro", "data")
+	qt.Assert(t, qt.ErrorIs(err, os.ErrPermission))
+	qt.Assert(t, qt.ErrorMatches(err, "write ro: permission denied"))
+	qt.Assert(t, qt.ErrorIs(fsys.MkdirAll("ro/d", 0o755), os.ErrPermission))
+	_, err = fsys.Stat("ro")
+	qt.Assert(t, qt.ErrorIs(err, iofs.ErrNotExist))
+
+	qt.Assert(t, qt.DeepEquals(ops, []string{
+		"write a", "mkdir d", "remove a", "remove d", "write ro", "mkdir ro/d",
+	}))
+
+	// The usage of the wrapped filesystem is still reported.
+	total, _, ok := fsys.(fs.UsageFS).Usage()
+	qt.Assert(t, qt.IsTrue(ok))
+	qt.Assert(t, qt.Equals(total, int64(100)))
+}
+
+func TestRestrictedFS(t *testing.T) {
+	base := fs.NewMemFS()
+	for _, name := range []string{"/etc/passwd", "/home/a/notes", "/home/a/.ssh/key", "/home/b/notes", "/tmp/x"} {
+		qt.Assert(t, qt.IsNil(base.MkdirAll(path.Dir(name), 0o755)))
+		_, err := writeFile(base, name, "data")
+		qt.Assert(t, qt.IsNil(err))
+	}
+	fsys := fs.NewRestrictedFS(base, []string{"/home/*", "/tmp"}, []string{"/home/*/.ssh", "/home/b"})
+
+	listDir := func(name string) []string {
+		t.Helper()
+		entries, err := fsys.ReadDir(name)
+		qt.Assert(t, qt.IsNil(err))
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	// The parents of allowed paths can be listed, but only show what's allowed.
+	qt.Assert(t, qt.DeepEquals(listDir("/"), []string{"home", "tmp"}))
+	qt.Assert(t, qt.DeepEquals(listDir("/home"), []string{"a"}))
+	qt.Assert(t, qt.DeepEquals(listDir("/home/a"), []string{"notes"}))
+	_, err := fsys.Stat("/home")
+	qt.Assert(t, qt.IsNil(err))
+	_, err = writeFile(fsys, "/new", "data")
+	qt.Assert(t, qt.ErrorIs(err, iofs.ErrPermission))
+
+	data, err := fsys.ReadFile("home/a/../a/notes")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "data"))
+	_, err = writeFile(fsys, "/tmp/y", "data")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("/home/a/dir", 0o755)))
+
+	for _, name := range []string{"/etc/passwd", "/home/a/.ssh/key", "/home/b/notes", "/home/a/../b/notes"} {
+		_, err := fsys.ReadFile(name)
+		qt.Assert(t, qt.ErrorIs(err, iofs.ErrPermission), qt.Commentf("%s", name))
+		_, err = fsys.Stat(name)
+		qt.Assert(t, qt.ErrorIs(err, iofs.ErrPermission), qt.Commentf("%s", name))
+		qt.Assert(t, qt.ErrorIs(fsys.Remove(name), iofs.ErrPermission), qt.Commentf("%s", name))
+	}
+	// Removing a parent doesn't take the denied paths with it.
+	err = fsys.RemoveAll("/home/a")
+	qt.Assert(t, qt.ErrorIs(err, iofs.ErrPermission))
+	_, err = base.Stat("/home/a/.ssh/key")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(fsys.RemoveAll("/tmp")))
+}
+
+// BenchmarkMemFSWrite100MB writes a large file in the ways a command could.
+func BenchmarkMemFSWrite100MB(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 100<<20)
+	for _, bc := range []struct {
+		name  string
+		write func(fs.FileSystem) error
+	}{
+		{"WriteFile", func(fsys fs.FileSystem) error {
+			return fsys.(fs.WriteFileFS).WriteFile("f", data, 0o644)
+		}},
+		{"WriteFileFrom", func(fsys fs.FileSystem) error {
+			_, err := fsys.(fs.WriteFileFS).WriteFileFrom("f", bytes.NewReader(data), 0o644)
+			return err
+		}},
+		{"OpenFile", func(fsys fs.FileSystem) error {
+			f, err := fsys.OpenFile("f", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+			if err != nil {
+				return err
+			}
+			// Without WriterTo, like most readers.
+			_, err = io.Copy(f, struct{ io.Reader }{bytes.NewReader(data)})
+			f.Close()
+			return err
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := bc.write(fs.NewMemFS()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSnapshotFS takes a snapshot of a large filesystem and reads one of
+// its files, as a script touching little of its filesystem would.
+func BenchmarkSnapshotFS(b *testing.B) {
+	base := fstest.MapFS{}
+	for i := range 100 {
+		for j := range 20 {
+			base[fmt.Sprintf("dir%d/sub%d/file", i, j)] = &fstest.MapFile{Data: []byte("x")}
+		}
+	}
+	for _, bc := range []struct {
+		name     string
+		snapshot func(iofs.FS) fs.FileSystem
+	}{
+		{"Eager", fs.SnapshotFS},
+		{"Lazy", fs.LazySnapshotFS},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				snap := bc.snapshot(base)
+				if _, err := snap.ReadFile("dir50/sub10/file"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemFSDeepPaths(b *testing.B) {
+	const dir = "/a/b/c/d/e/f/g/h"
+	fsys := fs.NewMemFS()
+	qt.Assert(b, qt.IsNil(fsys.MkdirAll(dir, 0o755)))
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = dir + "/file" + strconv.Itoa(i)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, name := range names {
+			if _, err := writeFile(fsys, name, "x"); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := fsys.Stat(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
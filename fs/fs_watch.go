@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"strings"
+	"sync"
+)
+
+// WatchEvent describes a change to a path being watched.
+// Writes to an existing file are reported as [ChangeModify].
+type WatchEvent struct {
+	Op   ChangeOp
+	Path string
+}
+
+// Watcher is implemented by filesystems which can report changes as they
+// happen, such as the in-memory filesystem from [NewMemFS].
+//
+// The filesystem from [NewDiskFS] returns [errors.ErrUnsupported]; a
+// filesystem built on the host's notifications, such as via fsnotify, could
+// implement it instead.
+type Watcher interface {
+	// Watch returns a channel receiving an event for every change to path
+	// or to anything under it, whether path exists yet or not. Events are
+	// queued rather than dropped, so a slow reader never blocks writes.
+	// Calling the returned function stops watching and closes the channel.
+	Watch(path string) (<-chan WatchEvent, func(), error)
+}
+
+// Watch implements [Watcher].
+func (m *memFS) Watch(path string) (<-chan WatchEvent, func(), error) {
+	w := &watcher{
+		prefix: cleanse(path),
+		ch:     make(chan WatchEvent),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	m.watchers.add(w)
+	go w.run()
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			m.watchers.remove(w)
+			close(w.done)
+		})
+	}
+	return w.ch, cancel, nil
+}
+
+// watchers is the set of watchers of a memFS
+type watchers struct {
+	mu   sync.Mutex
+	list []*watcher
+}
+
+func (ws *watchers) add(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.list = append(ws.list, w)
+}
+
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for i, w2 := range ws.list {
+		if w2 == w {
+			ws.list = append(ws.list[:i], ws.list[i+1:]...)
+			break
+		}
+	}
+}
+
+func (ws *watchers) notify(ev WatchEvent) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, w := range ws.list {
+		if w.matches(ev.Path) {
+			w.push(ev)
+		}
+	}
+}
+
+// watcher queues the events for a single call to Watch, and forwards them
+// to its channel from its own goroutine.
+type watcher struct {
+	prefix string
+
+	mu    sync.Mutex
+	queue []WatchEvent
+
+	ch   chan WatchEvent
+	wake chan struct{} // signals that the queue is no longer empty
+	done chan struct{} // closed when the watcher is cancelled
+}
+
+func (w *watcher) matches(path string) bool {
+	return w.prefix == "" || path == w.prefix || strings.HasPrefix(path, w.prefix+separator)
+}
+
+func (w *watcher) push(ev WatchEvent) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ev)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) run() {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, ev := range queue {
+			select {
+			case w.ch <- ev:
+			case <-w.done:
+				return
+			}
+		}
+		select {
+		case <-w.wake:
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// NewWritethroughFS returns an in-memory copy of base, along with a function
+// which writes the changes made to the copy back to base.
+//
+// Like with [SnapshotFS], the contents of the files in base are only read
+// when needed. The flush only touches the paths in [ChangeTracker.Changes],
+// and resets them once they are written, so that the next flush only writes
+// what changed since. This lets a script work on a copy of a directory, with
+// its results only being committed once it succeeded.
+func NewWritethroughFS(base FileSystem) (FileSystem, func() error) {
+	w := &writethroughFS{
+		memFS: SnapshotFS(base).(*memFS),
+		base:  base,
+	}
+	return w, w.flush
+}
+
+// writethroughFS is an in-memory filesystem which can be flushed to a base
+type writethroughFS struct {
+	*memFS
+	base FileSystem
+
+	mu sync.Mutex // serializes flushes
+}
+
+// flush writes the changes to base. Removals are applied first, so that a
+// path which was removed and then created again ends up with the new contents.
+func (w *writethroughFS) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changes := w.memFS.Changes()
+	for _, c := range changes {
+		if c.Op != ChangeRemove {
+			continue
+		}
+		if err := w.base.RemoveAll(c.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	// Changes are sorted by path, so directories come before what is in them.
+	for _, c := range changes {
+		if c.Op == ChangeRemove {
+			continue
+		}
+		info, err := w.memFS.Stat(c.Path)
+		if err != nil {
+			// Gone again since, along with its directory.
+			continue
+		}
+		if err := w.replaceKind(c.Path, info.IsDir()); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = w.base.MkdirAll(c.Path, info.Mode().Perm())
+		} else {
+			err = w.writeFile(c.Path, info.Mode().Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.memFS.ResetChanges()
+	return nil
+}
+
+// replaceKind removes name from base if it is a file where a directory is
+// wanted, or the other way around, as happens when a path was removed and
+// then created again as the other kind.
+func (w *writethroughFS) replaceKind(name string, dir bool) error {
+	info, err := w.base.Stat(name)
+	if err != nil || info.IsDir() == dir {
+		return nil
+	}
+	return w.base.RemoveAll(name)
+}
+
+// writeFile copies the contents of the named file to base.
+func (w *writethroughFS) writeFile(name string, perm fs.FileMode) error {
+	data, err := w.memFS.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	f, err := w.base.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
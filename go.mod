@@ -4,7 +4,9 @@ go 1.24
 
 require (
 	github.com/go-quicktest/qt v1.101.0
+	golang.org/x/crypto v0.38.0
 	golang.org/x/term v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
 	mvdan.cc/sh/v3 v3.11.0
 )
 
@@ -4,8 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
 	"os"
 	filepath "path"
+	"regexp"
 	"strings"
 
 	"github.com/wzshiming/vsh/fs"
@@ -25,8 +29,17 @@ type RunnerContext struct {
 
 	Command func(ctx context.Context, args []string)
 
+	// Builtin runs a shell builtin or registered command, skipping any shell
+	// function of the same name, like the "builtin" builtin does.
+	// A non-zero exit status is returned as an [ExitStatus] error.
+	Builtin func(ctx context.Context, args []string) error
+
 	TTY bool
 
+	// Network reports whether the command may make network requests,
+	// as allowed via [WithNetwork].
+	Network bool
+
 	// Dir is the interpreter's current directory.
 	Dir string
 
@@ -40,6 +53,77 @@ type RunnerContext struct {
 	Stdout io.Writer
 	// Stderr is the interpreter's current standard error writer.
 	Stderr io.Writer
+
+	// Logger is the host's log sink set via [WithLogger], or nil.
+	Logger *slog.Logger
+
+	// Clock is the clock set via [WithClock], or the system's clock.
+	Clock Clock
+
+	// Rand is the source of randomness set via [WithRandSource].
+	// It is safe for concurrent use.
+	Rand *rand.Rand
+
+	// EventSink receives events sent to the host, as set via [WithEventSink],
+	// or is nil.
+	EventSink func(name string, fields map[string]string)
+
+	shellOption   func(name string) bool
+	jobs          func() []int
+	disown        func(job int) bool
+	compileRegexp func(expr string) (*regexp.Regexp, error)
+	dial          func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ShellOption reports whether the shell option with the given name is set,
+// such as "errexit", "globstar" as set via "shopt", or an option added via
+// [WithShellOption].
+func (hc RunnerContext) ShellOption(name string) bool {
+	return hc.shellOption != nil && hc.shellOption(name)
+}
+
+// Jobs returns the numbers of the shell's background jobs, as listed by the
+// "jobs" builtin, in the order they were started. Disowned jobs are left out.
+func (hc RunnerContext) Jobs() []int {
+	if hc.jobs == nil {
+		return nil
+	}
+	return hc.jobs()
+}
+
+// Disown stops the shell from tracking the background job with the given
+// number, so that the "wait" and "jobs" builtins leave it alone. It reports
+// whether there was such a job.
+//
+// A disowned job still runs to completion, unless the context given to
+// [Runner.Run] is cancelled first. Note that the shell never waits for its
+// background jobs when it exits, so the EXIT trap runs straight away whether
+// or not they are disowned.
+func (hc RunnerContext) Disown(job int) bool {
+	return hc.disown != nil && hc.disown(job)
+}
+
+// CompileRegexp is like [regexp.Compile], but it reuses the expressions
+// compiled earlier by the shell and its commands, such as when a command
+// matching a pattern is run in a loop. The runner keeps a bounded number of
+// them, dropping those used least recently first.
+func (hc RunnerContext) CompileRegexp(expr string) (*regexp.Regexp, error) {
+	if hc.compileRegexp == nil {
+		return regexp.Compile(expr)
+	}
+	return hc.compileRegexp(expr)
+}
+
+// Dial connects to addr on the named network, like [net.Dialer.DialContext],
+// through the dialer set via [WithDialer]. It fails with [ErrNetworkDisabled]
+// unless the runner allows network access via [WithNetwork]. Commands which
+// connect to the network should always do so via Dial, so that the host stays
+// in control of where they can reach.
+func (hc RunnerContext) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if hc.dial == nil {
+		return nil, ErrNetworkDisabled
+	}
+	return hc.dial(ctx, network, addr)
 }
 
 func checkStat(dir, file string) (string, error) {
@@ -60,6 +144,15 @@ func checkStat(dir, file string) (string, error) {
 	return file, nil
 }
 
+// lookPath is like lookPathDir in the interpreter's current directory and
+// environment, but it never finds anything if [WithNoPathLookup] is used.
+func (r *Runner) lookPath(file string) (string, error) {
+	if r.noPathLookup {
+		return "", fmt.Errorf("%q: executable file not found", file)
+	}
+	return lookPathDir(r.Dir, r.writeEnv, file)
+}
+
 func lookPathDir(cwd string, env expand.Environ, file string) (string, error) {
 	pathList := strings.Split(env.Get("PATH").String(), ":")
 	if len(pathList) == 0 {
@@ -0,0 +1,88 @@
+package vsh
+
+import (
+	iofs "io/fs"
+	"os"
+	"time"
+
+	"github.com/wzshiming/vsh/fs"
+)
+
+// Recorder receives metrics about what a runner does, such as to export them
+// to a monitoring system; see [WithMetrics]. Its methods may be called
+// concurrently, such as by background jobs, so they should be safe for that
+// and return quickly.
+type Recorder interface {
+	// CommandRun is called after each simple command, be it a function, a
+	// builtin, or a command set via [WithCommand], with how long it took
+	// and its exit status.
+	CommandRun(name string, dur time.Duration, exit int)
+
+	// FileOp is called for each operation on the FileSystem: "open",
+	// "write" when opening a file for writing, "read" for reading a whole
+	// file, "readdir", "stat", "lstat", "mkdir", or "remove".
+	FileOp(op string)
+}
+
+// metricsFS reports each operation on the filesystem it wraps to a [Recorder].
+type metricsFS struct {
+	fs.FileSystem
+	rec Recorder
+}
+
+func (m *metricsFS) Open(name string) (iofs.File, error) {
+	m.rec.FileOp("open")
+	return m.FileSystem.Open(name)
+}
+
+func (m *metricsFS) OpenFile(name string, flag int, perm iofs.FileMode) (fs.FileWriter, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		m.rec.FileOp("write")
+	} else {
+		m.rec.FileOp("open")
+	}
+	return m.FileSystem.OpenFile(name, flag, perm)
+}
+
+func (m *metricsFS) ReadFile(name string) ([]byte, error) {
+	m.rec.FileOp("read")
+	return m.FileSystem.ReadFile(name)
+}
+
+func (m *metricsFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	m.rec.FileOp("readdir")
+	return m.FileSystem.ReadDir(name)
+}
+
+func (m *metricsFS) Stat(name string) (iofs.FileInfo, error) {
+	m.rec.FileOp("stat")
+	return m.FileSystem.Stat(name)
+}
+
+func (m *metricsFS) Lstat(name string) (iofs.FileInfo, error) {
+	m.rec.FileOp("lstat")
+	return m.FileSystem.Lstat(name)
+}
+
+func (m *metricsFS) MkdirAll(name string, perm iofs.FileMode) error {
+	m.rec.FileOp("mkdir")
+	return m.FileSystem.MkdirAll(name, perm)
+}
+
+func (m *metricsFS) Remove(name string) error {
+	m.rec.FileOp("remove")
+	return m.FileSystem.Remove(name)
+}
+
+func (m *metricsFS) RemoveAll(name string) error {
+	m.rec.FileOp("remove")
+	return m.FileSystem.RemoveAll(name)
+}
+
+// Usage reports the usage of the wrapped filesystem, if it implements [fs.UsageFS].
+func (m *metricsFS) Usage() (total, used int64, ok bool) {
+	if u, isUsage := m.FileSystem.(fs.UsageFS); isUsage {
+		return u.Usage()
+	}
+	return 0, 0, false
+}
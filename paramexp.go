@@ -0,0 +1,253 @@
+package vsh
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/pattern"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// paramExps returns word with the parameter expansions which the expand
+// package gets wrong or panics on replaced, copying the parts it changes.
+// The replacements expand variables held in expandVars, which only live until
+// the end of the current expansion; see [Runner.clearExpandVars].
+//
+// Only the parameter expansions directly in word, or in its double quotes,
+// are replaced; not those nested in other expansions.
+func (r *Runner) paramExps(word *syntax.Word) *syntax.Word {
+	if word == nil {
+		return nil
+	}
+	if parts, ok := r.paramExpParts(word.Parts); ok {
+		return &syntax.Word{Parts: parts}
+	}
+	return word
+}
+
+func (r *Runner) paramExpParts(parts []syntax.WordPart) ([]syntax.WordPart, bool) {
+	var changed []syntax.WordPart
+	for i, wp := range parts {
+		var wp2 syntax.WordPart
+		switch wp := wp.(type) {
+		case *syntax.ParamExp:
+			if pe := r.fixParamExp(wp); pe != nil {
+				wp2 = pe
+			}
+		case *syntax.DblQuoted:
+			if dqParts, ok := r.paramExpParts(wp.Parts); ok {
+				dq := *wp
+				dq.Parts = dqParts
+				wp2 = &dq
+			}
+		}
+		if wp2 == nil {
+			continue
+		}
+		if changed == nil {
+			changed = slices.Clone(parts)
+		}
+		changed[i] = wp2
+	}
+	return changed, changed != nil
+}
+
+// fixParamExp returns a replacement for pe, or nil if the expand package can
+// deal with it as is.
+func (r *Runner) fixParamExp(pe *syntax.ParamExp) *syntax.ParamExp {
+	if pe.Excl || pe.Length {
+		return nil
+	}
+	name := pe.Param.Value
+	switch {
+	case pe.Exp != nil && (pe.Exp.Op == syntax.ErrorUnset || pe.Exp.Op == syntax.ErrorUnsetOrNull) &&
+		(pe.Exp.Word == nil || len(pe.Exp.Word.Parts) == 0):
+		// "${foo:?}" uses a default message like in bash.
+		msg := "parameter null or not set"
+		if pe.Exp.Op == syntax.ErrorUnset {
+			msg = "parameter not set"
+		}
+		pe2, exp := *pe, *pe.Exp
+		exp.Word = &syntax.Word{Parts: []syntax.WordPart{&syntax.Lit{Value: msg}}}
+		pe2.Exp = &exp
+		return &pe2
+
+	case pe.Slice != nil && pe.Index == nil && (name == "@" || name == "*"):
+		// The positional parameters are sliced as if $0 came first,
+		// so that "${@:2}" starts at $2.
+		all := append([]string{r.lookupVar("0").String()}, r.Params...)
+		offset, length := 0, len(all)
+		if pe.Slice.Offset != nil {
+			offset = r.arithm(pe.Slice.Offset)
+		}
+		if pe.Slice.Length != nil {
+			length = r.arithm(pe.Slice.Length)
+		}
+		if offset < 0 {
+			offset += len(all)
+		}
+		var elems []string
+		if offset >= 0 && offset < len(all) && length > 0 {
+			elems = all[offset:min(offset+length, len(all))]
+		}
+		return r.expandVarExp(expand.Variable{Kind: expand.Indexed, List: elems}, name)
+
+	case pe.Repl != nil && !pe.Repl.All && anchoredPattern(pe.Repl.Orig) != 0:
+		// "${foo/#pattern/with}" and "${foo/%pattern/with}".
+		orig := pe.Repl.Orig
+		lit := orig.Parts[0].(*syntax.Lit)
+		fromEnd := lit.Value[0] == '%'
+		unanchored := &syntax.Word{Parts: slices.Clone(orig.Parts)}
+		if rest := lit.Value[1:]; rest == "" {
+			unanchored.Parts = unanchored.Parts[1:]
+		} else {
+			unanchored.Parts[0] = &syntax.Lit{ValuePos: lit.ValuePos, Value: rest}
+		}
+		pat, err := expand.Pattern(r.ecfg, unanchored)
+		if err != nil {
+			r.expandErr(err)
+			return nil
+		}
+		with := ""
+		if pe.Repl.With != nil {
+			if with, err = expand.Literal(r.ecfg, pe.Repl.With); err != nil {
+				r.expandErr(err)
+				return nil
+			}
+		}
+		return r.mapParamExp(pe, func(s string) string {
+			return r.replaceAnchored(s, pat, with, fromEnd)
+		})
+
+	case pe.Exp != nil && pe.Exp.Op == syntax.OtherParamOps:
+		op, err := expand.Literal(r.ecfg, pe.Exp.Word)
+		if err != nil {
+			r.expandErr(err)
+			return nil
+		}
+		switch op {
+		case "Q", "E":
+			return nil // supported by the expand package
+		case "U":
+			return r.mapParamExp(pe, strings.ToUpper)
+		case "L":
+			return r.mapParamExp(pe, strings.ToLower)
+		case "u":
+			return r.mapParamExp(pe, func(s string) string {
+				first, size := utf8.DecodeRuneInString(s)
+				return string(unicode.ToUpper(first)) + s[size:]
+			})
+		}
+		// The expand package would panic on these.
+		r.expandErr(fmt.Errorf("${%s@%s} is not supported", name, op))
+		return r.expandVarExp(expand.Variable{Kind: expand.String}, "")
+	}
+	return nil
+}
+
+// anchoredPattern returns the '#' or '%' which anchors the pattern in a
+// "${foo/#pattern}" or "${foo/%pattern}" replacement, or 0 if there is none.
+func anchoredPattern(word *syntax.Word) byte {
+	if word == nil || len(word.Parts) == 0 {
+		return 0
+	}
+	lit, ok := word.Parts[0].(*syntax.Lit)
+	if !ok || lit.Value == "" {
+		return 0
+	}
+	switch c := lit.Value[0]; c {
+	case '#', '%':
+		return c
+	}
+	return 0
+}
+
+// replaceAnchored replaces the longest match of the shell pattern pat at the
+// start of s, or at its end if fromEnd is true, with with.
+func (r *Runner) replaceAnchored(s, pat, with string, fromEnd bool) string {
+	if pat == "" {
+		return s // nothing to replace, like in the expand package
+	}
+	rx, err := r.compilePattern(pat, pattern.EntireString)
+	if err != nil {
+		return s
+	}
+	if fromEnd {
+		for i := 0; i <= len(s); i++ {
+			if (i == len(s) || utf8.RuneStart(s[i])) && rx.MatchString(s[i:]) {
+				return s[:i] + with
+			}
+		}
+		return s
+	}
+	for i := len(s); i >= 0; i-- {
+		if (i == len(s) || utf8.RuneStart(s[i])) && rx.MatchString(s[:i]) {
+			return with + s[i:]
+		}
+	}
+	return s
+}
+
+// mapParamExp returns a parameter expansion of the value of pe, with fn
+// applied to it, or to each of its elements if it expands to a list like
+// "${foo[@]}" or "$@" does.
+func (r *Runner) mapParamExp(pe *syntax.ParamExp, fn func(string) string) *syntax.ParamExp {
+	base := &syntax.ParamExp{Dollar: pe.Dollar, Param: pe.Param, Index: pe.Index}
+	index := ""
+	switch {
+	case pe.Param.Value == "@" || pe.Param.Value == "*":
+		index = pe.Param.Value
+	case pe.Index != nil:
+		if w, ok := pe.Index.(*syntax.Word); ok && (w.Lit() == "@" || w.Lit() == "*") {
+			index = w.Lit()
+			base.Index = &syntax.Word{Parts: []syntax.WordPart{&syntax.Lit{Value: "@"}}}
+		}
+	}
+	if index == "" {
+		str, err := expand.Literal(r.ecfg, &syntax.Word{Parts: []syntax.WordPart{base}})
+		if err != nil {
+			r.expandErr(err)
+			return nil
+		}
+		return r.expandVarExp(expand.Variable{Kind: expand.String, Str: fn(str)}, "")
+	}
+	elems, err := expand.Fields(r.ecfg, &syntax.Word{Parts: []syntax.WordPart{
+		&syntax.DblQuoted{Parts: []syntax.WordPart{base}},
+	}})
+	if err != nil {
+		r.expandErr(err)
+		return nil
+	}
+	for i, elem := range elems {
+		elems[i] = fn(elem)
+	}
+	return r.expandVarExp(expand.Variable{Kind: expand.Indexed, List: elems}, index)
+}
+
+// expandVarExp returns a parameter expansion of vr, which is kept in
+// expandVars under a name which no script can use. If index is "@" or "*",
+// vr is expanded as a list like in "${foo[@]}".
+func (r *Runner) expandVarExp(vr expand.Variable, index string) *syntax.ParamExp {
+	if r.expandVars == nil {
+		r.expandVars = make(map[string]expand.Variable)
+	}
+	name := " " + strconv.Itoa(len(r.expandVars))
+	vr.Set = true
+	r.expandVars[name] = vr
+	pe := &syntax.ParamExp{Param: &syntax.Lit{Value: name}}
+	if index != "" {
+		pe.Index = &syntax.Word{Parts: []syntax.WordPart{&syntax.Lit{Value: index}}}
+	}
+	return pe
+}
+
+// clearExpandVars drops the variables used by [Runner.paramExps] once the
+// expansion using them is done.
+func (r *Runner) clearExpandVars() {
+	clear(r.expandVars)
+}
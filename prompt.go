@@ -0,0 +1,93 @@
+package vsh
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Prompt returns the prompt in the variable name, such as PS1 or PS2, as an
+// interactive shell shows it before reading each line; if the variable is
+// unset, def is returned as is. It should be called before each prompt, so
+// that it reflects changes like those of the current directory.
+//
+// As in bash, the backslash escapes in the prompt are replaced first, and
+// then its parameter expansions and command substitutions are done. The
+// escapes are \w and \W for the current directory and its base name, with
+// $HOME shown as "~", \u for $USER, \h and \H for $HOSTNAME up to its first
+// dot and in full, \s for "vsh", \n for a newline, \\ for a backslash, and \$
+// for "#" if $USER is root or "$" otherwise. \[ and \] are dropped. As the
+// shell doesn't look at the host for the user or host names, they can be set
+// via [WithEnv].
+func (r *Runner) Prompt(name, def string) string {
+	if !r.didReset {
+		r.Reset()
+	}
+	vr := r.lookupVar(name)
+	if !vr.IsSet() {
+		return def
+	}
+	ps := r.promptEscapes(vr.String())
+	word, err := syntax.NewParser().Document(strings.NewReader(ps))
+	if err != nil {
+		return ps
+	}
+	if r.ecfg == nil {
+		r.fillExpandConfig(context.Background())
+	}
+	expanded, err := expand.Document(r.ecfg, word)
+	if err != nil {
+		return ps
+	}
+	return expanded
+}
+
+func (r *Runner) promptEscapes(ps string) string {
+	var sb strings.Builder
+	for i := 0; i < len(ps); i++ {
+		if ps[i] != '\\' || i+1 == len(ps) {
+			sb.WriteByte(ps[i])
+			continue
+		}
+		i++
+		switch c := ps[i]; c {
+		case 'w', 'W':
+			dir := r.Dir
+			if home := r.envGet("HOME"); home != "" && home != "/" &&
+				(dir == home || strings.HasPrefix(dir, home+"/")) {
+				dir = "~" + dir[len(home):]
+			}
+			if c == 'W' && dir != "/" && dir != "~" {
+				dir = path.Base(dir)
+			}
+			sb.WriteString(dir)
+		case 'u':
+			sb.WriteString(r.envGet("USER"))
+		case 'h':
+			host, _, _ := strings.Cut(r.envGet("HOSTNAME"), ".")
+			sb.WriteString(host)
+		case 'H':
+			sb.WriteString(r.envGet("HOSTNAME"))
+		case 's':
+			sb.WriteString("vsh")
+		case 'n':
+			sb.WriteByte('\n')
+		case '$':
+			if r.envGet("USER") == "root" {
+				sb.WriteByte('#')
+			} else {
+				sb.WriteByte('$')
+			}
+		case '\\':
+			sb.WriteByte('\\')
+		case '[', ']':
+		default:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,94 @@
+package vsh
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+
+	"mvdan.cc/sh/v3/pattern"
+)
+
+// regexpCacheSize is how many compiled regular expressions a runner keeps,
+// so that scripts matching the same patterns in a loop only compile them
+// once, while those using many different patterns don't hoard memory.
+const regexpCacheSize = 256
+
+// regexpCache is a least recently used cache of compiled regular expressions,
+// keyed by their source, which is either a regular expression or a shell
+// pattern. It is shared by a runner and its subshells, so it is safe for
+// concurrent use.
+type regexpCache struct {
+	mu    sync.Mutex
+	order list.List // of *regexpEntry, the most recently used first
+	index map[regexpKey]*list.Element
+}
+
+type regexpKey struct {
+	src  string
+	glob bool // whether src is a shell pattern, turned into a regexp with mode
+	mode pattern.Mode
+}
+
+type regexpEntry struct {
+	key regexpKey
+	rx  *regexp.Regexp
+	err error
+}
+
+// get returns the result of compile for key, reusing an earlier one.
+func (c *regexpCache) get(key regexpKey, compile func() (*regexp.Regexp, error)) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if elem, ok := c.index[key]; ok {
+		c.order.MoveToFront(elem)
+		entry := elem.Value.(*regexpEntry)
+		c.mu.Unlock()
+		return entry.rx, entry.err
+	}
+	c.mu.Unlock()
+
+	// Compile without holding the lock; at worst, two goroutines both
+	// compile the same expression, and the last one wins.
+	rx, err := compile()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.index == nil {
+		c.index = make(map[regexpKey]*list.Element)
+	}
+	if elem, ok := c.index[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.index[key] = c.order.PushFront(&regexpEntry{key: key, rx: rx, err: err})
+	if c.order.Len() > regexpCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.index, oldest.Value.(*regexpEntry).key)
+	}
+	return rx, err
+}
+
+// compileRegexp is like [regexp.Compile], using the runner's cache.
+// It implements [RunnerContext.CompileRegexp].
+func (r *Runner) compileRegexp(expr string) (*regexp.Regexp, error) {
+	compile := func() (*regexp.Regexp, error) { return regexp.Compile(expr) }
+	if r.regexps == nil {
+		return compile()
+	}
+	return r.regexps.get(regexpKey{src: expr}, compile)
+}
+
+// compilePattern turns the shell pattern pat into a compiled regular
+// expression, like [pattern.Regexp] does, using the runner's cache.
+func (r *Runner) compilePattern(pat string, mode pattern.Mode) (*regexp.Regexp, error) {
+	compile := func() (*regexp.Regexp, error) {
+		expr, err := pattern.Regexp(pat, mode)
+		if err != nil {
+			return nil, err
+		}
+		return regexp.Compile(expr)
+	}
+	if r.regexps == nil {
+		return compile()
+	}
+	return r.regexps.get(regexpKey{src: pat, glob: true, mode: mode}, compile)
+}
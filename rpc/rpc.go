@@ -0,0 +1,162 @@
+// Package rpc serves a runner over a line protocol, so that vsh can be run as
+// a sidecar process by programs which aren't written in Go.
+//
+// Each line read is a JSON request, such as
+//
+//	{"cmd": "cat | wc -l", "stdin": "a\nb\n"}
+//
+// and each is answered by a line with what the command wrote and its exit
+// status, such as
+//
+//	{"stdout": "2\n", "stderr": "", "exit": 0}
+//
+// Requests are run one at a time, in order. For example, to serve the
+// standard input and output of the process:
+//
+//	r, err := vsh.NewRunner(vsh.WithDir(fsys, "/"))
+//	...
+//	err = rpc.Serve(ctx, r, struct {
+//		io.Reader
+//		io.Writer
+//	}{os.Stdin, os.Stdout})
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/wzshiming/vsh"
+)
+
+// Request is a command to be run, as read from a line of input.
+type Request struct {
+	// Cmd is the shell program to run.
+	Cmd string `json:"cmd"`
+
+	// Stdin is the standard input of the program.
+	Stdin string `json:"stdin,omitempty"`
+
+	// Session keeps the state of the shell left by the previous request,
+	// such as its variables, functions and current directory. Otherwise,
+	// the runner is reset before running Cmd, so that nothing leaks from
+	// one request to the next.
+	Session bool `json:"session,omitempty"`
+}
+
+// Response is the result of a [Request], as written in a line of output.
+type Response struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	Exit   int    `json:"exit"`
+
+	// Error is set when the request could not be run as a whole, such as
+	// when it isn't valid JSON or Cmd cannot be parsed.
+	Error string `json:"error,omitempty"`
+}
+
+// Serve reads requests from rw, runs each of them with r, and writes the
+// responses back to rw, until the end of its input. Each request runs with
+// its own standard input and output, replacing those r was set up with.
+//
+// Output written by background commands once a request has been answered is
+// dropped. Serve stops with the error of ctx if it is done, or with the error
+// of reading or writing rw.
+func Serve(ctx context.Context, r *vsh.Runner, rw io.ReadWriter) error {
+	br := bufio.NewReader(rw)
+	enc := json.NewEncoder(rw)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			resp := serveLine(ctx, r, line)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := enc.Encode(resp); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// serveLine runs the request in line.
+func serveLine(ctx context.Context, r *vsh.Runner, line []byte) *Response {
+	var req Request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return &Response{Exit: 2, Error: err.Error()}
+	}
+	// Reset before setting the standard input and output, so that they
+	// don't replace those the runner is reset to.
+	if !req.Session {
+		r.Reset()
+	}
+
+	// A pipe is used as standard input, rather than leaving it to
+	// [vsh.WithStdIO], so that it can be closed once the request is done.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return &Response{Exit: 1, Error: err.Error()}
+	}
+	defer pr.Close()
+	go func() {
+		io.Copy(pw, strings.NewReader(req.Stdin))
+		pw.Close()
+	}()
+	var stdout, stderr captureWriter
+	defer stdout.close()
+	defer stderr.close()
+	if err := vsh.WithStdIO(pr, &stdout, &stderr)(r); err != nil {
+		return &Response{Exit: 1, Error: err.Error()}
+	}
+
+	err = r.RunString(ctx, req.Cmd)
+	resp := &Response{Stdout: stdout.close(), Stderr: stderr.close()}
+	var es vsh.ExitStatus
+	switch {
+	case err == nil:
+	case errors.As(err, &es):
+		resp.Exit = int(es)
+	default:
+		resp.Exit = 1
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// captureWriter keeps what is written to it until it is closed, after which
+// writes are dropped. It is safe for concurrent use, as background commands
+// may write to it.
+type captureWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+// close stops keeping writes, and returns what was written so far.
+func (w *captureWriter) close() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return w.buf.String()
+}
@@ -0,0 +1,72 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/builtin"
+	"github.com/wzshiming/vsh/fs"
+	"github.com/wzshiming/vsh/rpc"
+)
+
+// serve runs the requests in input, and returns the responses.
+func serve(t *testing.T, input string) []rpc.Response {
+	t.Helper()
+	r, err := vsh.NewRunner(
+		vsh.WithDir(fs.NewMemFS(), "/"),
+		vsh.WithCommand("cat", builtin.Cat),
+	)
+	qt.Assert(t, qt.IsNil(err))
+	var out bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(input), &out}
+	err = rpc.Serve(context.Background(), r, rw)
+	qt.Assert(t, qt.IsNil(err))
+
+	var resps []rpc.Response
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var resp rpc.Response
+		qt.Assert(t, qt.IsNil(dec.Decode(&resp)))
+		resps = append(resps, resp)
+	}
+	return resps
+}
+
+func TestServe(t *testing.T) {
+	resps := serve(t, `{"cmd": "echo hi; echo oops >&2; exit 3"}
+{"cmd": "cat", "stdin": "a\nb\n"}
+
+{"cmd": "if"}
+not json
+`)
+	qt.Assert(t, qt.HasLen(resps, 4))
+	qt.Check(t, qt.DeepEquals(resps[0], rpc.Response{Stdout: "hi\n", Stderr: "oops\n", Exit: 3}))
+	qt.Check(t, qt.DeepEquals(resps[1], rpc.Response{Stdout: "a\nb\n"}))
+	qt.Check(t, qt.Equals(resps[2].Exit, 1))
+	qt.Check(t, qt.StringContains(resps[2].Error, "must be followed by"))
+	qt.Check(t, qt.Equals(resps[3].Exit, 2))
+	qt.Check(t, qt.Not(qt.Equals(resps[3].Error, "")))
+}
+
+func TestServeSession(t *testing.T) {
+	resps := serve(t, `{"cmd": "x=1; f() { echo f; }"}
+{"cmd": "echo \"x=$x\"; f"}
+{"cmd": "x=2; f() { echo g; }"}
+{"cmd": "echo \"x=$x\"; f", "session": true}
+`)
+	qt.Assert(t, qt.HasLen(resps, 4))
+	// Without a session, nothing is left from the request before.
+	qt.Check(t, qt.Equals(resps[1].Stdout, "x=\n"))
+	qt.Check(t, qt.Not(qt.Equals(resps[1].Exit, 0)))
+	qt.Check(t, qt.Equals(resps[3].Stdout, "x=2\ng\n"))
+	qt.Check(t, qt.Equals(resps[3].Exit, 0))
+}
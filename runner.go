@@ -9,11 +9,14 @@ import (
 	iofs "io/fs"
 	"iter"
 	"math"
+	"net"
 	"os"
-	"regexp"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wzshiming/vsh/fs"
@@ -55,12 +58,19 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 				f.Close()
 				return err
 			}
+			if !r.startProc() {
+				return ErrMaxProcs
+			}
+			defer r.procs.end()
 			r2 := r.subshell(false)
 			r2.stdout = w
 			r2.stmts(ctx, cs.Stmts)
 			r.lastExpandExit = r2.exit
 			return r2.fatalErr
 		},
+		ProcSubst: func(ps *syntax.ProcSubst) (string, error) {
+			return r.procSubst(ctx, ps)
+		},
 	}
 	r.updateExpandOpts()
 }
@@ -91,6 +101,9 @@ func (r *Runner) updateExpandOpts() {
 	}
 
 	r.ecfg.NoUnset = r.opts[optNoUnset]
+	r.ecfg.GlobStar = r.bashOpts[optGlobStar]
+	r.ecfg.NoCaseGlob = r.bashOpts[optNoCaseGlob]
+	r.ecfg.NullGlob = r.bashOpts[optNullGlob]
 }
 
 func (r *Runner) expandErr(err error) {
@@ -119,29 +132,158 @@ func (r *Runner) arithm(expr syntax.ArithmExpr) int {
 }
 
 func (r *Runner) fields(words ...*syntax.Word) []string {
+	if strs, ok := literalFields(words); ok {
+		return strs
+	}
+	defer r.clearExpandVars()
+	cloned := false
+	for i, word := range words {
+		if word2 := r.tilde(r.paramExps(word), true); word2 != word {
+			if !cloned {
+				words, cloned = slices.Clone(words), true
+			}
+			words[i] = word2
+		}
+	}
+	if r.bashOpts[optFailGlob] {
+		return r.failGlobFields(words)
+	}
 	strs, err := expand.Fields(r.ecfg, words...)
 	r.expandErr(err)
 	return strs
 }
 
+// failGlobFields is like [Runner.fields] with failglob set. Each word with a
+// pattern is expanded on its own, as if with nullglob, so that one which
+// matches nothing can be reported; that word is then left out.
+func (r *Runner) failGlobFields(words []*syntax.Word) []string {
+	var strs []string
+	for _, word := range words {
+		glob := hasGlob(word)
+		r.ecfg.NullGlob = glob
+		fields, err := expand.Fields(r.ecfg, word)
+		r.ecfg.NullGlob = r.bashOpts[optNullGlob]
+		r.expandErr(err)
+		if err == nil && glob && len(fields) == 0 {
+			var sb strings.Builder
+			syntax.NewPrinter().Print(&sb, word)
+			r.errf("no match: %s\n", sb.String())
+			r.noMatch = true
+		}
+		strs = append(strs, fields...)
+	}
+	return strs
+}
+
+// hasGlob reports whether word has a pattern outside of quotes, which
+// pathname expansion would match against files.
+func hasGlob(word *syntax.Word) bool {
+	for _, part := range word.Parts {
+		if lit, ok := part.(*syntax.Lit); ok && pattern.HasMeta(lit.Value, pattern.Filenames) {
+			return true
+		}
+	}
+	return false
+}
+
+// globFailed reports whether a pattern matched nothing with failglob set
+// since the last call, in which case the command using it isn't run.
+func (r *Runner) globFailed() bool {
+	failed := r.noMatch
+	r.noMatch = false
+	return failed
+}
+
+// literalFields returns the fields of words if they are all plain literals,
+// like most command names and arguments, which expand to themselves. This
+// saves going through the expand package, which allocates far more.
+func literalFields(words []*syntax.Word) ([]string, bool) {
+	for _, word := range words {
+		if len(word.Parts) != 1 {
+			return nil, false
+		}
+		lit, ok := word.Parts[0].(*syntax.Lit)
+		// Leave anything which could be escaped, expanded or globbed.
+		if !ok || lit.Value == "" || strings.ContainsAny(lit.Value, "\\~*?[]{}") {
+			return nil, false
+		}
+	}
+	strs := make([]string, len(words))
+	for i, word := range words {
+		strs[i] = word.Parts[0].(*syntax.Lit).Value
+	}
+	return strs, true
+}
+
 func (r *Runner) literal(word *syntax.Word) string {
-	str, err := expand.Literal(r.ecfg, word)
+	defer r.clearExpandVars()
+	str, err := expand.Literal(r.ecfg, r.tilde(r.paramExps(word), false))
 	r.expandErr(err)
 	return str
 }
 
 func (r *Runner) document(word *syntax.Word) string {
-	str, err := expand.Document(r.ecfg, word)
+	defer r.clearExpandVars()
+	str, err := expand.Document(r.ecfg, r.paramExps(word))
 	r.expandErr(err)
 	return str
 }
 
 func (r *Runner) pattern(word *syntax.Word) string {
-	str, err := expand.Pattern(r.ecfg, word)
+	defer r.clearExpandVars()
+	str, err := expand.Pattern(r.ecfg, r.tilde(r.paramExps(word), true))
 	r.expandErr(err)
 	return str
 }
 
+// tilde does the tilde expansion of "~+", "~-" and "~user" at the start of
+// word, returning a copy of it with the result quoted. The expand package is
+// left to expand a plain "~" via $HOME, but it would look up any other user
+// in the host's user database, so those are only found via [WithHomeLookup]
+// and are otherwise left as is. If glob is true, the rest of a word left as
+// is may still be a glob pattern.
+func (r *Runner) tilde(word *syntax.Word, glob bool) *syntax.Word {
+	if word == nil || len(word.Parts) == 0 {
+		return word
+	}
+	lit, ok := word.Parts[0].(*syntax.Lit)
+	if !ok || !strings.HasPrefix(lit.Value, "~") {
+		return word
+	}
+	name, rest := lit.Value[1:], ""
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	home, found := "", false
+	switch {
+	case rest == "" && len(word.Parts) > 1:
+		// The prefix goes on past this literal, such as in "~$user",
+		// so it cannot be a user name.
+	case name == "":
+		return word
+	case name == "+":
+		home, found = r.envGet("PWD"), true
+	case name == "-":
+		vr := r.lookupVar("OLDPWD")
+		home, found = vr.String(), vr.IsSet()
+	case r.homeLookup != nil:
+		home, found = r.homeLookup(name)
+	}
+	var parts []syntax.WordPart
+	switch {
+	case found:
+		parts = []syntax.WordPart{
+			&syntax.SglQuoted{Left: lit.Pos(), Value: home},
+			&syntax.Lit{ValuePos: lit.Pos(), Value: rest},
+		}
+	case glob:
+		parts = []syntax.WordPart{&syntax.Lit{ValuePos: lit.Pos(), Value: `\` + lit.Value}}
+	default:
+		parts = []syntax.WordPart{&syntax.SglQuoted{Left: lit.Pos(), Value: lit.Value}}
+	}
+	return &syntax.Word{Parts: append(parts, word.Parts[1:]...)}
+}
+
 // expandEnviron exposes [Runner]'s variables to the expand package.
 type expandEnv struct {
 	r *Runner
@@ -150,6 +292,9 @@ type expandEnv struct {
 var _ expand.WriteEnviron = expandEnv{}
 
 func (e expandEnv) Get(name string) expand.Variable {
+	if vr, ok := e.r.expandVars[name]; ok {
+		return vr
+	}
 	return e.r.lookupVar(name)
 }
 
@@ -180,12 +325,98 @@ func (r *Runner) errf(format string, a ...any) {
 	fmt.Fprintf(r.stderr, format, a...)
 }
 
+// procLimit counts the subshells running at once in a shell and all of its
+// subshells, as limited by [WithMaxProcs].
+type procLimit struct {
+	max     int64
+	running atomic.Int64
+
+	// exceeded is set once the limit is hit, so that every shell sharing
+	// the limit stops as well.
+	exceeded atomic.Bool
+}
+
+// startProc reserves a slot for a new subshell, which must be released via
+// [procLimit.end] once the subshell is done. If the limit was reached, it
+// sets a fatal error and returns false.
+func (r *Runner) startProc() bool {
+	p := r.procs
+	if p == nil {
+		return true
+	}
+	if p.running.Add(1) > p.max {
+		p.running.Add(-1)
+		p.exceeded.Store(true)
+		r.setFatalErr(ErrMaxProcs)
+		r.exit = 1
+		return false
+	}
+	return true
+}
+
+func (p *procLimit) end() {
+	if p != nil {
+		p.running.Add(-1)
+	}
+}
+
+// commandBudget counts the commands run in a shell and all of its subshells,
+// as limited by [WithMaxCommands].
+type commandBudget struct {
+	max int64
+	ran atomic.Int64
+}
+
+func (b *commandBudget) exceeded() bool {
+	return b != nil && b.ran.Load() > b.max
+}
+
+// countCommand counts a command about to be run. If the budget was used up,
+// it sets a fatal error and returns false.
+func (r *Runner) countCommand() bool {
+	b := r.commands
+	if b == nil {
+		return true
+	}
+	if b.ran.Add(1) > b.max {
+		r.setFatalErr(ErrCommandBudgetExceeded)
+		r.exit = 1
+		return false
+	}
+	return true
+}
+
+// loopIteration counts an iteration of a loop, given its count so far. If
+// the loop went over the limit, it sets a fatal error and returns false.
+func (r *Runner) loopIteration(n *int) bool {
+	*n++
+	if r.maxLoopIterations > 0 && *n > r.maxLoopIterations {
+		r.setFatalErr(ErrMaxLoopIterations)
+		r.exit = 1
+		return false
+	}
+	return true
+}
+
+// exitInterrupted is the exit status of statements stopped by the
+// cancellation of the context, like that of commands killed by SIGINT.
+const exitInterrupted = 130
+
 func (r *Runner) stop(ctx context.Context) bool {
 	if r.fatalErr != nil || r.returning || r.exiting {
 		return true
 	}
+	if r.procs != nil && r.procs.exceeded.Load() {
+		r.fatalErr = ErrMaxProcs
+		return true
+	}
+	if r.commands.exceeded() {
+		r.fatalErr = ErrCommandBudgetExceeded
+		return true
+	}
 	if err := ctx.Err(); err != nil {
 		r.fatalErr = err
+		r.exit = exitInterrupted
 		return true
 	}
 	if r.opts[optNoExec] {
@@ -200,32 +431,63 @@ func (r *Runner) stmt(ctx context.Context, st *syntax.Stmt) {
 	}
 	r.exit = 0
 	r.nonFatalHandlerErr = nil
+	r.lineNo = st.Pos().Line()
 	if st.Background {
+		if !r.startProc() {
+			return
+		}
 		r2 := r.subshell(true)
 		st2 := *st
 		st2.Background = false
 		bg := bgProc{
 			done: make(chan struct{}),
 			exit: new(int),
+			node: &st2,
 		}
 		r.bgProcs = append(r.bgProcs, bg)
+		job := len(r.bgProcs)
+		if r.debugging(ctx) {
+			r.debugLogger.DebugContext(ctx, "background job started", "job", job)
+		}
+		var flushOut, flushErr func()
+		r2.stdout, flushOut = backgroundWriter(r2.stdout)
+		r2.stderr, flushErr = backgroundWriter(r2.stderr)
 		go func() {
-			r2.Run(ctx, &st2)
+			// Like [Runner.Run], but without filling Vars,
+			// which nobody reads for a background job.
+			if ctx != r2.ectx {
+				r2.fillExpandConfig(ctx)
+			}
+			r2.filename = ""
+			r2.stmt(ctx, &st2)
+			flushOut()
+			flushErr()
+			if r2.debugging(ctx) {
+				r2.debugLogger.DebugContext(ctx, "background job done", "job", job, "exit", r2.exit)
+			}
 			*bg.exit = r2.exit
+			r.procs.end()
 			close(bg.done)
 		}()
 	} else {
 		r.stmtSync(ctx, st)
 	}
+	if err := ctx.Err(); err != nil && errors.Is(r.fatalErr, err) {
+		// Stopped by a command which gave up once the context was done.
+		r.exit = exitInterrupted
+	}
 	r.lastExit = r.exit
 }
 
 func (r *Runner) stmtSync(ctx context.Context, st *syntax.Stmt) {
 	oldIn, oldOut, oldErr := r.stdin, r.stdout, r.stderr
+	defer r.endProcSubsts(ctx, len(r.procSubstFiles))
 	for _, rd := range st.Redirs {
 		cls, err := r.redir(ctx, rd)
 		if err != nil {
-			r.setFatalErr(err)
+			if err != errNoClobber {
+				r.setFatalErr(err)
+			}
 			r.exit = 1
 			break
 		}
@@ -267,8 +529,12 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 	case *syntax.Block:
 		r.stmts(ctx, cm.Stmts)
 	case *syntax.Subshell:
+		if !r.startProc() {
+			return
+		}
 		r2 := r.subshell(false)
 		r2.stmts(ctx, cm.Stmts)
+		r.procs.end()
 		r.exit = r2.exit
 		r.setFatalErr(r2.fatalErr)
 	case *syntax.CallExpr:
@@ -286,9 +552,18 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				break
 			}
 		}
-		args = append(args, left...)
+		if args == nil {
+			args = left // no aliases; fields doesn't modify the slice
+		} else {
+			args = append(args, left...)
+		}
 		r.lastExpandExit = 0
+		r.noMatch = false
 		fields := r.fields(args...)
+		if r.globFailed() {
+			r.exit = 1
+			break
+		}
 		if len(fields) == 0 {
 			for _, as := range cm.Assigns {
 				prev := r.lookupVar(as.Name.Value)
@@ -325,6 +600,9 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			if r.exit == 0 {
 				r.exit = r.lastExpandExit
 			}
+			if r.globFailed() {
+				r.exit = 1
+			}
 			break
 		}
 
@@ -354,6 +632,7 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		for _, restore := range restores {
 			r.setVar(restore.name, restore.vr)
 		}
+		r.lastArg = fields[len(fields)-1]
 	case *syntax.BinaryCmd:
 		switch cm.Op {
 		case syntax.AndStmt, syntax.OrStmt:
@@ -365,6 +644,10 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				r.stmt(ctx, cm.Y)
 			}
 		case syntax.Pipe, syntax.PipeAll:
+			if !r.startProc() {
+				return
+			}
+			defer r.procs.end()
 			pr, pw, err := os.Pipe()
 			if err != nil {
 				r.setFatalErr(err) // not being able to create a pipe is rare but critical
@@ -409,7 +692,8 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			r.cmd(ctx, cm.Else)
 		}
 	case *syntax.WhileClause:
-		for !r.stop(ctx) {
+		iters := 0
+		for !r.stop(ctx) && r.loopIteration(&iters) {
 			oldNoErrExit := r.noErrExit
 			r.noErrExit = true
 			r.stmts(ctx, cm.Cond)
@@ -429,7 +713,12 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 
 			inToken := y.InPos.IsValid()
 			if inToken {
+				r.noMatch = false
 				items = r.fields(y.Items...) // for i in ...; do ...
+				if r.globFailed() {
+					r.exit = 1
+					break
+				}
 			}
 
 			if cm.Select {
@@ -438,42 +727,50 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 					ps3 = e
 				}
 
-				prompt := func() []byte {
-					// display menu
-					for i, word := range items {
-						r.errf("%d) %v\n", i+1, word)
+				// The menu is shown on the first iteration, and again
+				// whenever the reply is empty.
+				menu := true
+				iters := 0
+				for !r.stop(ctx) && r.loopIteration(&iters) {
+					if menu {
+						for i, word := range items {
+							r.errf("%d) %v\n", i+1, word)
+						}
 					}
 					r.errf("%s", ps3)
 
 					line, err := r.readLine(ctx, true)
-					if err != nil {
-						r.exit = 1
-						return nil
+					if err != nil && (len(line) == 0 || err != io.EOF) {
+						// On EOF, end the loop on a new line.
+						r.errf("\n")
+						break
 					}
-					return line
-				}
-
-			retry:
-				choice := prompt()
-				if len(choice) == 0 {
-					goto retry // no reply; try again
-				}
-
-				reply := string(choice)
-				r.setVarString(shellReplyVar, reply)
+					reply := string(line)
+					if menu = reply == ""; menu {
+						continue
+					}
+					r.setVarString(shellReplyVar, reply)
 
-				c, _ := strconv.Atoi(reply)
-				if c > 0 && c <= len(items) {
-					r.setVarString(name, items[c-1])
-				}
+					// An invalid choice leaves the name empty.
+					choice := ""
+					if c, err := strconv.Atoi(reply); err == nil && c > 0 && c <= len(items) {
+						choice = items[c-1]
+					}
+					r.setVarString(name, choice)
 
-				// execute commands until break or return is encountered
-				if r.loopStmtsBroken(ctx, cm.Do) {
-					break
+					// execute commands until break or return is encountered
+					if r.loopStmtsBroken(ctx, cm.Do) {
+						break
+					}
 				}
+				break
 			}
 
+			iters := 0
 			for _, field := range items {
+				if !r.loopIteration(&iters) {
+					break
+				}
 				r.setVarString(name, field)
 				trace.stringf("for %s in", y.Name.Value)
 				if inToken {
@@ -493,8 +790,9 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			if y.Init != nil {
 				r.arithm(y.Init)
 			}
+			iters := 0
 			for y.Cond == nil || r.arithm(y.Cond) != 0 {
-				if r.exit != 0 || r.loopStmtsBroken(ctx, cm.Do) {
+				if r.exit != 0 || !r.loopIteration(&iters) || r.loopStmtsBroken(ctx, cm.Do) {
 					break
 				}
 				if y.Post != nil {
@@ -537,13 +835,22 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		trace.string(" in")
 		trace.newLineFlush()
 		str := r.literal(cm.Word)
+		fallThrough := false
 		for _, ci := range cm.Items {
-			for _, word := range ci.Patterns {
-				pattern := r.pattern(word)
-				if match(pattern, str) {
-					r.stmts(ctx, ci.Stmts)
-					return
-				}
+			if !fallThrough && !r.matchAny(ci.Patterns, str) {
+				continue
+			}
+			r.stmts(ctx, ci.Stmts)
+			if r.stop(ctx) || r.breakEnclosing > 0 || r.contnEnclosing > 0 {
+				return
+			}
+			switch ci.Op {
+			case syntax.Fallthrough: // ;&
+				fallThrough = true
+			case syntax.Resume, syntax.ResumeKorn: // ;;& and ;|
+				fallThrough = false
+			default: // ;;
+				return
 			}
 		}
 	case *syntax.TestClause:
@@ -574,6 +881,7 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		case "nameref":
 			valType = "-n"
 		}
+		r.noMatch = false
 	assignLoop:
 		for as := range r.flattenAssigns(cm.Args) {
 			fp := flagParser{remaining: []string{as.Name.Value}}
@@ -623,22 +931,32 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			}
 			r.setVar(name, vr)
 		}
+		if r.globFailed() {
+			r.exit = 1
+		}
 	case *syntax.TimeClause:
-		start := time.Now()
+		clock := r.getClock()
+		start := clock.Now()
 		if cm.Stmt != nil {
 			r.stmt(ctx, cm.Stmt)
 		}
+		real := clock.Now().Sub(start)
+		if tf := r.lookupVar("TIMEFORMAT"); tf.IsSet() && !cm.PosixFormat {
+			if s := timeFormat(tf.String(), real); s != "" {
+				r.errf("%s\n", s)
+			}
+			break
+		}
 		format := "%s\t%s\n"
 		if cm.PosixFormat {
 			format = "%s %s\n"
 		} else {
-			r.outf("\n")
+			r.errf("\n")
 		}
-		real := time.Since(start)
-		r.outf(format, "real", elapsedString(real, cm.PosixFormat))
-		// TODO: can we do these?
-		r.outf(format, "user", elapsedString(0, cm.PosixFormat))
-		r.outf(format, "sys", elapsedString(0, cm.PosixFormat))
+		// There is no accounting of CPU time, so user and sys are always zero.
+		r.errf(format, "real", elapsedString(real, cm.PosixFormat))
+		r.errf(format, "user", elapsedString(0, cm.PosixFormat))
+		r.errf(format, "sys", elapsedString(0, cm.PosixFormat))
 	default:
 		panic(fmt.Sprintf("unhandled command node: %T", cm))
 	}
@@ -709,12 +1027,114 @@ func (r *Runner) flattenAssigns(args []*syntax.Assign) iter.Seq[*syntax.Assign]
 	}
 }
 
-func match(pat, name string) bool {
-	expr, err := pattern.Regexp(pat, pattern.EntireString)
+// matchAny reports whether str matches any of the case patterns in words.
+func (r *Runner) matchAny(words []*syntax.Word, str string) bool {
+	for _, word := range words {
+		if r.matchPattern(word, str) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern is like [match] on the expanded pattern word, but it also
+// supports the extended globs like "@(a|b)" which [expand.Pattern] does not.
+func (r *Runner) matchPattern(word *syntax.Word, str string) bool {
+	if !slices.ContainsFunc(word.Parts, isExtGlob) {
+		return r.match(r.pattern(word), str)
+	}
+	if len(word.Parts) == 1 {
+		if eg := word.Parts[0].(*syntax.ExtGlob); eg.Op == syntax.GlobExcept {
+			// Regular expressions cannot express negation, but we don't need
+			// to when the entire pattern is negated.
+			rx, err := extGlobRegexp(&syntax.ExtGlob{Op: syntax.GlobOne, Pattern: eg.Pattern})
+			if err != nil {
+				return false
+			}
+			re, err := r.compileRegexp("^" + rx + "$")
+			if err != nil {
+				return false
+			}
+			return !re.MatchString(str)
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	var lits []syntax.WordPart
+	flush := func() bool {
+		if len(lits) == 0 {
+			return true
+		}
+		rx, err := pattern.Regexp(r.pattern(&syntax.Word{Parts: lits}), 0)
+		lits = lits[:0]
+		if err != nil {
+			return false
+		}
+		sb.WriteString(rx)
+		return true
+	}
+	for _, wp := range word.Parts {
+		eg, ok := wp.(*syntax.ExtGlob)
+		if !ok {
+			lits = append(lits, wp)
+			continue
+		}
+		if !flush() {
+			return false
+		}
+		rx, err := extGlobRegexp(eg)
+		if err != nil {
+			r.expandErr(err)
+			return false
+		}
+		sb.WriteString(rx)
+	}
+	if !flush() {
+		return false
+	}
+	sb.WriteString("$")
+	rx, err := r.compileRegexp(sb.String())
+	if err != nil {
+		return false
+	}
+	return rx.MatchString(str)
+}
+
+func isExtGlob(wp syntax.WordPart) bool {
+	_, ok := wp.(*syntax.ExtGlob)
+	return ok
+}
+
+// extGlobRegexp turns an extended glob into a regular expression group.
+// The alternatives are plain patterns; nested extended globs are not supported.
+func extGlobRegexp(eg *syntax.ExtGlob) (string, error) {
+	var alts []string
+	for _, alt := range strings.Split(eg.Pattern.Value, "|") {
+		rx, err := pattern.Regexp(alt, 0)
+		if err != nil {
+			return "", err
+		}
+		alts = append(alts, rx)
+	}
+	group := "(?:" + strings.Join(alts, "|") + ")"
+	switch eg.Op {
+	case syntax.GlobZeroOrOne:
+		return group + "?", nil
+	case syntax.GlobZeroOrMore:
+		return group + "*", nil
+	case syntax.GlobOneOrMore:
+		return group + "+", nil
+	case syntax.GlobOne:
+		return group, nil
+	}
+	return "", fmt.Errorf("%s...) within a pattern is not supported", eg.Op)
+}
+
+func (r *Runner) match(pat, name string) bool {
+	rx, err := r.compilePattern(pat, pattern.EntireString)
 	if err != nil {
 		return false
 	}
-	rx := regexp.MustCompile(expr)
 	return rx.MatchString(name)
 }
 
@@ -727,6 +1147,56 @@ func elapsedString(d time.Duration, posix bool) string {
 	return fmt.Sprintf("%dm%.3fs", min, sec)
 }
 
+// timeFormat expands a TIMEFORMAT value for a command which took real time.
+// As in bash, %R, %U and %S are the real, user and system times in seconds;
+// they may have a digit between the "%" and the letter for the number of
+// decimal places, 3 by default, and an "l" for the longer "MmS.FFFs" form.
+// %P is the CPU usage percentage, and %% is a literal percent sign.
+func timeFormat(format string, real time.Duration) string {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			sb.WriteByte(format[i])
+			continue
+		}
+		start := i
+		i++
+		switch format[i] {
+		case '%':
+			sb.WriteByte('%')
+			continue
+		case 'P':
+			sb.WriteString("0.00")
+			continue
+		}
+		prec, long := 3, false
+		if c := format[i]; c >= '0' && c <= '9' && i+1 < len(format) {
+			prec = min(int(c-'0'), 3)
+			i++
+		}
+		if format[i] == 'l' && i+1 < len(format) {
+			long = true
+			i++
+		}
+		var d time.Duration
+		switch format[i] {
+		case 'R':
+			d = real
+		case 'U', 'S':
+			// There is no accounting of CPU time.
+		default:
+			sb.WriteString(format[start : i+1])
+			continue
+		}
+		if long {
+			fmt.Fprintf(&sb, "%dm%.*fs", int(d.Minutes()), prec, math.Mod(d.Seconds(), 60))
+		} else {
+			fmt.Fprintf(&sb, "%.*f", prec, d.Seconds())
+		}
+	}
+	return sb.String()
+}
+
 func (r *Runner) stmts(ctx context.Context, stmts []*syntax.Stmt) {
 	for _, stmt := range stmts {
 		r.stmt(ctx, stmt)
@@ -742,13 +1212,19 @@ func (r *Runner) hdocReader(rd *syntax.Redirect) (*os.File, error) {
 	// as pipe writes may block once the buffer gets full.
 	// We still construct and buffer the entire heredoc first,
 	// as doing it concurrently would lead to different semantics and be racy.
+	hdoc := r.hdocString(rd)
+	go func() {
+		pw.WriteString(hdoc)
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// hdocString returns the expanded body of a heredoc redirect, with leading
+// tabs removed for "<<-".
+func (r *Runner) hdocString(rd *syntax.Redirect) string {
 	if rd.Op != syntax.DashHdoc {
-		hdoc := r.document(rd.Hdoc)
-		go func() {
-			pw.WriteString(hdoc)
-			pw.Close()
-		}()
-		return pr, nil
+		return r.document(rd.Hdoc)
 	}
 	var buf bytes.Buffer
 	var cur []syntax.WordPart
@@ -775,13 +1251,14 @@ func (r *Runner) hdocReader(rd *syntax.Redirect) (*os.File, error) {
 		}
 	}
 	flushLine()
-	go func() {
-		pw.Write(buf.Bytes())
-		pw.Close()
-	}()
-	return pr, nil
+	return buf.String()
 }
 
+// errNoClobber is returned by redir when noclobber stops it from overwriting
+// a file. It has been reported already, and only fails the command, as in
+// other shells.
+var errNoClobber = errors.New("cannot overwrite existing file")
+
 func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, error) {
 	if rd.Hdoc != nil {
 		pr, err := r.hdocReader(rd)
@@ -807,6 +1284,13 @@ func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, err
 		}
 	}
 	arg := r.literal(rd.Word)
+	if r.debugging(ctx) {
+		fd := "1"
+		if rd.N != nil {
+			fd = rd.N.Value
+		}
+		r.debugLogger.DebugContext(ctx, "redirect", "fd", fd, "op", rd.Op.String(), "word", arg)
+	}
 	switch rd.Op {
 	case syntax.WordHdoc:
 		pr, pw, err := os.Pipe()
@@ -834,7 +1318,7 @@ func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, err
 			r.errf("unhandled %v arg: %q", rd.Op, arg)
 		}
 		return nil, nil
-	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut,
+	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut, syntax.ClbOut,
 		syntax.RdrAll, syntax.AppAll:
 		// done further below
 	case syntax.DplIn:
@@ -853,6 +1337,19 @@ func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, err
 	case syntax.AppOut, syntax.AppAll:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
 	case syntax.RdrOut, syntax.RdrAll:
+		// Like in other shells, the file is truncated right away, before
+		// the command runs; so "cmd <file >file" empties the file before
+		// cmd can read it. A command like sponge can be used instead.
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if r.opts[optNoClobber] {
+			// Only regular files are protected, so that redirecting
+			// to devices like /dev/null still works.
+			if info, err := r.stat(ctx, arg); err == nil && info.Mode().IsRegular() {
+				r.errf("%s: cannot overwrite existing file\n", arg)
+				return nil, errNoClobber
+			}
+		}
+	case syntax.ClbOut:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	}
 	f, err := r.openFile(ctx, arg, mode, 0644)
@@ -866,7 +1363,7 @@ func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, err
 			return nil, err
 		}
 		r.stdin = stdin
-	case syntax.RdrOut, syntax.AppOut:
+	case syntax.RdrOut, syntax.AppOut, syntax.ClbOut:
 		*orig = f
 	case syntax.RdrAll, syntax.AppAll:
 		r.stdout = f
@@ -878,9 +1375,8 @@ func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, err
 }
 
 func (r *Runner) loopStmtsBroken(ctx context.Context, stmts []*syntax.Stmt) bool {
-	oldInLoop := r.inLoop
-	r.inLoop = true
-	defer func() { r.inLoop = oldInLoop }()
+	r.loopDepth++
+	defer func() { r.loopDepth-- }()
 	for _, stmt := range stmts {
 		r.stmt(ctx, stmt)
 		if r.contnEnclosing > 0 {
@@ -900,8 +1396,40 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 		return
 	}
 
+	if !r.countCommand() {
+		return
+	}
+	if r.metrics != nil {
+		clock := r.getClock()
+		start := clock.Now()
+		defer func() { r.metrics.CommandRun(args[0], clock.Now().Sub(start), r.exit) }()
+	}
+	if r.preRun != nil || r.postRun != nil {
+		hc := r.handlerContext(ctx)
+		if r.preRun != nil {
+			if err := r.preRun(hc, args); err != nil {
+				r.handlerErr(err)
+				return
+			}
+		}
+		if r.postRun != nil {
+			// Deferred first, so that it sees the final exit status.
+			defer func() { r.postRun(hc, args, r.exit) }()
+		}
+	}
+
 	name := args[0]
 	if body := r.Funcs[name]; body != nil {
+		if r.debugging(ctx) {
+			r.debugLogger.DebugContext(ctx, "call", "kind", "function", "name", name, "args", args[1:])
+		}
+		if !r.enterRecursion(name) {
+			return
+		}
+		defer r.leaveRecursion()
+		r.callStack = append(r.callStack, callFrame{name: name, line: r.lineNo})
+		defer func() { r.callStack = r.callStack[:len(r.callStack)-1] }()
+
 		// stack them to support nested func calls
 		oldParams := r.Params
 		r.Params = args[1:]
@@ -922,35 +1450,136 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 		r.returning = false
 		return
 	}
-	if isBuiltin(name) {
+	if r.commandTimeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, r.commandTimeout, ErrCommandTimeout)
+		defer cancel()
+		defer func() {
+			if context.Cause(ctx) != ErrCommandTimeout || parent.Err() != nil ||
+				(r.exit == 0 && r.fatalErr == nil) {
+				return
+			}
+			// The command gave up on its own context, which doesn't stop
+			// the shell like the shell's context being done would.
+			if errors.Is(r.fatalErr, context.DeadlineExceeded) {
+				r.fatalErr = nil
+			}
+			r.nonFatalHandlerErr = ErrCommandTimeout
+			r.exit = exitTimeout
+		}()
+	}
+	defer r.recoverCommand(name)
+	if r.builtinEnabled(name) {
+		if r.debugging(ctx) {
+			r.debugLogger.DebugContext(ctx, "call", "kind", "builtin", "name", name, "args", args[1:])
+		}
 		r.exit = r.builtinCode(ctx, pos, name, args[1:])
 		return
 	}
 	r.exec(ctx, args)
 }
 
+// recoverCommand is deferred while running a command, so that a panic in it
+// makes the command fail rather than crash the host; see [WithPanicHandler].
+func (r *Runner) recoverCommand(name string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if r.panicHandler != nil {
+		r.panicHandler(name, v, debug.Stack())
+	}
+	r.errf("sh: %s: panic: %v\n", name, v)
+	r.nonFatalHandlerErr = ExitStatus(2)
+	r.exit = 2
+}
+
+// exitTimeout is the exit status of commands stopped by [WithCommandTimeout].
+const exitTimeout = 124
+
 func (r *Runner) exec(ctx context.Context, args []string) {
 	fun, ok := r.Commands[args[0]]
-	if !ok {
+	if !ok || r.disabled[args[0]] {
+		if r.debugging(ctx) {
+			r.debugLogger.DebugContext(ctx, "command not found", "name", args[0], "disabled", ok)
+		}
 		r.errf("sh: %s: command not found\n", args[0])
+		r.exit = 127
 		return
 	}
+	if r.debugging(ctx) {
+		r.debugLogger.DebugContext(ctx, "call", "kind", "command", "name", args[0], "args", args[1:])
+	}
 
+	r.handlerErr(fun(r.handlerContext(ctx), args[1:]))
+}
+
+// handlerContext returns the context for a handler, such as a command set via
+// [WithCommand], running in the current state of the runner.
+func (r *Runner) handlerContext(ctx context.Context) RunnerContext {
 	hc := RunnerContext{
 		Context:   ctx,
 		Env:       &overlayEnviron{parent: r.writeEnv},
 		FileSytem: r.FileSystem,
 		TTY:       r.TTY,
+		Network:   r.network,
 		Dir:       r.Dir,
 		Stdout:    r.stdout,
 		Stderr:    r.stderr,
 		Command:   r.exec,
+		Builtin:   r.handlerBuiltin,
+		Logger:    r.logger,
+		Clock:     r.getClock(),
+		Rand:      r.rand,
+		EventSink: r.eventSink,
+
+		shellOption:   r.shellOption,
+		jobs:          r.jobNumbers,
+		disown:        r.disown,
+		compileRegexp: r.compileRegexp,
+		dial:          r.dial,
 	}
 	if r.stdin != nil { // do not leave hc.Stdin as a typed nil
 		hc.Stdin = r.stdin
 	}
+	return hc
+}
+
+// dial implements [RunnerContext.Dial].
+func (r *Runner) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !r.network {
+		return nil, ErrNetworkDisabled
+	}
+	if r.dialer != nil {
+		return r.dialer(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// jobNumbers implements [RunnerContext.Jobs].
+func (r *Runner) jobNumbers() []int {
+	var jobs []int
+	for i, bg := range r.bgProcs {
+		if !bg.disowned {
+			jobs = append(jobs, i+1)
+		}
+	}
+	return jobs
+}
+
+// disown implements [RunnerContext.Disown].
+func (r *Runner) disown(job int) bool {
+	if job <= 0 || job > len(r.bgProcs) || r.bgProcs[job-1].disowned {
+		return false
+	}
+	r.bgProcs[job-1].disowned = true
+	return true
+}
 
-	err := fun(hc, args[1:])
+// handlerErr sets the exit status from the error returned by a handler.
+func (r *Runner) handlerErr(err error) {
 	if err != nil {
 		var es ExitStatus
 		if errors.As(err, &es) {
@@ -966,11 +1595,24 @@ func (r *Runner) exec(ctx context.Context, args []string) {
 	}
 }
 
-func (r *Runner) open(ctx context.Context, path string) (iofs.File, error) {
+// handlerBuiltin implements [RunnerContext.Builtin].
+func (r *Runner) handlerBuiltin(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if exit := r.builtinOnly(ctx, syntax.Pos{}, args); exit != 0 {
+		return ExitStatus(exit)
+	}
+	return nil
+}
+
+func (r *Runner) open(ctx context.Context, name string) (iofs.File, error) {
+	path := r.absPath(name)
 	return r.FileSystem.Open(path)
 }
 
-func (r *Runner) openFile(ctx context.Context, path string, flags int, mode iofs.FileMode) (fs.FileWriter, error) {
+func (r *Runner) openFile(ctx context.Context, name string, flags int, mode iofs.FileMode) (fs.FileWriter, error) {
+	path := r.absPath(name)
 	return r.FileSystem.OpenFile(path, flags, mode)
 }
 
@@ -983,3 +1625,27 @@ func (r *Runner) lstat(ctx context.Context, name string) (iofs.FileInfo, error)
 	path := r.absPath(name)
 	return r.FileSystem.Lstat(path)
 }
+
+// callFrame is a function call being run.
+type callFrame struct {
+	name string
+	line uint // the line the function was called from
+}
+
+// enterRecursion counts a function call or sourced file which is about to
+// run. If that goes over the limit set via [WithMaxFuncDepth], it sets a
+// fatal error and returns false instead, and the caller must not run it.
+func (r *Runner) enterRecursion(name string) bool {
+	if r.maxFuncDepth > 0 && r.funcDepth >= r.maxFuncDepth {
+		r.setFatalErr(fmt.Errorf("%s: %w (%d)", name, ErrRecursionLimit, r.maxFuncDepth))
+		r.exit = 1
+		return false
+	}
+	r.funcDepth++
+	return true
+}
+
+// leaveRecursion undoes [Runner.enterRecursion] once the call is done.
+func (r *Runner) leaveRecursion() {
+	r.funcDepth--
+}
@@ -0,0 +1,1507 @@
+package vsh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/wzshiming/vsh/fs"
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/pattern"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// concBuffer wraps a [bytes.Buffer] in a mutex so that concurrent writes
+// to it don't upset the race detector.
+type concBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (c *concBuffer) Write(p []byte) (int, error) {
+	c.Lock()
+	n, err := c.buf.Write(p)
+	c.Unlock()
+	return n, err
+}
+
+func (c *concBuffer) String() string {
+	c.Lock()
+	s := c.buf.String()
+	c.Unlock()
+	return s
+}
+
+// testCommands are small stand-ins for the commands in the builtin package,
+// which cannot be imported here without an import cycle.
+var testCommands = map[string]func(RunnerContext, []string) error{
+	"mkdir": func(hc RunnerContext, args []string) error {
+		for _, arg := range args {
+			if err := hc.FileSytem.MkdirAll(path.Join(hc.Dir, arg), 0o777); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"cat": func(hc RunnerContext, args []string) error {
+		if len(args) == 0 {
+			_, err := io.Copy(hc.Stdout, hc.Stdin)
+			return err
+		}
+		for _, arg := range args {
+			data, err := hc.FileSytem.ReadFile(path.Join(hc.Dir, arg))
+			if err != nil {
+				fmt.Fprintf(hc.Stderr, "cat: %s: %v\n", arg, err)
+				return ExitStatus(1)
+			}
+			hc.Stdout.Write(data)
+		}
+		return nil
+	},
+}
+
+func testRunner(t *testing.T, out io.Writer, opts ...runnerOption) *Runner {
+	t.Helper()
+	base := []runnerOption{WithStdIO(nil, out, out)}
+	for name, fn := range testCommands {
+		base = append(base, WithCommand(name, fn))
+	}
+	r, err := NewRunner(append(base, opts...)...)
+	qt.Assert(t, qt.IsNil(err))
+	return r
+}
+
+// runScript parses and runs src, returning the combined standard output and
+// error. A non-nil error from Run is appended to the output, like a shell
+// reporting the status of the last command.
+func runScript(t *testing.T, src string, opts ...runnerOption) string {
+	t.Helper()
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	qt.Assert(t, qt.IsNil(err))
+	var out concBuffer
+	r := testRunner(t, &out, opts...)
+	if err := r.Run(context.Background(), file); err != nil {
+		fmt.Fprint(&out, err)
+	}
+	return out.String()
+}
+
+var runTests = []struct {
+	src  string
+	want string
+}{
+	// $_
+	{"echo a b c; echo $_", "a b c\nc\n"},
+	{"mkdir x; echo $_", "x\n"},
+	{"mkdir dir && cd $_ && pwd", "/dir\n"},
+	{"echo $_", "\n"},
+
+	// process substitutions
+	{"cat <(echo hi) <(echo there)", "hi\nthere\n"},
+	{"while read l; do echo \"<$l>\"; done < <(echo a; echo b)", "<a>\n<b>\n"},
+	{"echo x > >(cat); echo y", "x\ny\n"},
+
+	// special variables
+	{"echo $LINENO\n\necho $LINENO", "1\n3\n"},
+	{"f() {\n\techo $LINENO\n}\nf; LINENO=9; echo $LINENO", "2\n4\n"},
+	{"RANDOM=7; a=$RANDOM; RANDOM=7; [ $a = $RANDOM ] && echo same", "same\n"},
+	{"SECONDS=60; echo $SECONDS", "60\n"},
+	{"echo $$ $PPID; (echo $$ $PPID); true & echo $!", "g0 0\ng0 0\ng1\n"},
+	{"x() {\n\ty=$LINENO\n}\n\nx; echo $y $LINENO", "2 5\n"},
+
+	// enable
+	{"enable -n echo; echo foo; enable echo; echo bar", "sh: echo: command not found\nbar\n"},
+	{"enable -n cat; cat || echo off; enable -n", "sh: cat: command not found\noff\nenable -n cat\n"},
+	{"enable -n cat; enable cat; echo foo | cat", "foo\n"},
+	{"enable -n cat; type cat; builtin cat", "type: cat: not found\nbuiltin: cat: not a shell builtin\nexit status 1"},
+	{"enable -n nosuch", "enable: nosuch: not a shell builtin\nexit status 1"},
+	{"enable -n cd; enable -a | while read line; do case $line in *' cd'|*' mkdir') echo $line;; esac; done", "enable -n cd\nenable mkdir\n"},
+	{"enable -n cd; enable | while read line; do case $line in *' cd'|*' mkdir') echo $line;; esac; done", "enable mkdir\n"},
+	{"nosuch; echo $?", "sh: nosuch: command not found\n127\n"},
+
+	// builtin
+	{"cd() { echo wrapped; builtin cd \"$@\"; }; mkdir d; cd d; pwd", "wrapped\n/d\n"},
+	{"cat() { echo wrapped; builtin cat \"$@\"; }; echo foo | cat", "wrapped\nfoo\n"},
+	{"builtin nosuch", "builtin: nosuch: not a shell builtin\nexit status 1"},
+	{"builtin false", "exit status 1"},
+
+	// cat heredoc to file
+	{"x=1; cat >f <<EOF\nval $x\nEOF\ncat f", "val 1\n"},
+	{"x=1; cat <<'EOF' >f\nval $x\nEOF\ncat f", "val $x\n"},
+	{"cat >f <<-EOF\n\tindented\n\tEOF\ncat >>f <<EOF\nmore\nEOF\ncat f", "indented\nmore\n"},
+	{"echo a >f; echo b >>f; echo c >>new; cat f new", "a\nb\nc\n"},
+	{"cat() { echo fn; }; cat >f <<EOF\nx\nEOF\nunset -f cat; cat f", "fn\n"},
+	{"! cat >f <<EOF\nx\nEOF\necho $? $_", "1 cat\n"},
+	{"echo old >f; set -C; cat >f <<EOF\nnew\nEOF\necho $?; cat f", "f: cannot overwrite existing file\n1\nold\n"},
+
+	// parameter expansion
+	{`e=; s=x; echo "${u:-d}|${e:-d}|${s:-d}|${u-d}|${e-d}"`, "d|d|x|d|\n"},
+	{`echo ${u:=d} $u; e=; echo ${e:=x} $e; s=y; echo ${s:=z}`, "d d\nx x\ny\n"},
+	{`echo ${u:?oops}; echo no`, "u: oops\nexit status 1"},
+	{`e=; (echo ${e:?}); (echo ${u?}); echo ${e?} ok`, "e: parameter null or not set\nu: parameter not set\nok\n"},
+	{`s=x; e=; echo "${s:+a}|${e:+a}|${u:+a}|${e+a}"`, "a|||a\n"},
+	{`s=héllo; echo ${#s} ${#u}; a=(1 2 3); echo ${#a[@]}`, "5 0\n3\n"},
+	{`p=a/b/c.tar.gz; echo ${p#*/} ${p##*/} ${p%.*} ${p%%.*} ${p#x}`, "b/c.tar.gz c.tar.gz a/b/c.tar a/b/c a/b/c.tar.gz\n"},
+	{`s=foo.bar.baz; echo ${s/./-} ${s//./-} ${s/o} ${s//[ao]/_} ${s/\./+}`, "foo-bar.baz foo-bar-baz fo.bar.baz f__.b_r.b_z foo+bar.baz\n"},
+	{`s=foo.bar.baz; echo ${s/#foo/X} ${s/%baz/X} ${s/#bar/X} ${s/#*./X} ${s/%.*/X} ${s/#}`, "X.bar.baz foo.bar.X foo.bar.baz Xbaz fooX foo.bar.baz\n"},
+	{`a=(xa ya xb); echo ${a[@]/#x/-} ${a[@]/%a/-}`, "-a ya -b x- y- xb\n"},
+	{`s=abcdef; echo ${s:2} ${s:2:2} ${s: -2} ${s:1:-1} ${s:(-3):2} ${s:10}.`, "cdef cd ef bcde de .\n"},
+	{`set -- a b c; echo ${@:2} ${@:0:2} ${@: -1} ${*:2:1} ${@:5}.`, "b c sh a c b .\n"},
+	{`set -- 'a b' c d; for x in "${@:1:2}"; do echo "<$x>"; done; IFS=,; echo "${*:2}"`, "<a b>\n<c>\nc,d\n"},
+	{`a=(x y z); echo ${a[@]:1} ${a[@]:0:1}`, "y z x\n"},
+	{`s=hello; S=HELLO; echo ${s^} ${s^^} ${S,} ${S,,} ${s^^[lo]}`, "Hello HELLO hELLO hello heLLO\n"},
+	{`s=hello; a=(ab cd); echo ${s@U} ${s@u} ${a[@]@U}; S=HeLLo; echo ${S@L}`, "HELLO Hello AB CD\nhello\n"},
+	{`s=x; echo ${s@P}; echo no`, "${s@P} is not supported\nexit status 1"},
+
+	// brace expansion
+	{"echo {a,b}{1,2}", "a1 a2 b1 b2\n"},
+	{"echo {x,y}-{a,b}-{1,2}", "x-a-1 x-a-2 x-b-1 x-b-2 y-a-1 y-a-2 y-b-1 y-b-2\n"},
+	{"echo {1..5} {5..1} {a..e}", "1 2 3 4 5 5 4 3 2 1 a b c d e\n"},
+	{"echo {1..10..2} {a..i..3}", "1 3 5 7 9 a d g\n"},
+	{"echo {a,{b,c}}d", "ad bd cd\n"},
+	{"echo {a,b x{}y {a} \"{a,b}\"", "{a,b x{}y {a} {a,b}\n"},
+	{"x=1; echo {$x,2}", "1 2\n"},
+	{"mkdir d; cd d; echo >f1; echo >f2; echo f{1,2,3} f*", "f1 f2 f3 f1 f2\n"},
+
+	// tilde expansion
+	{"echo ~ ~/foo; HOME=/h; echo ~ ~/x x~ '~' \"~\"", "/ //foo\n/h /h/x x~ ~ ~\n"},
+	{"mkdir d; HOME=/d; cd ~; pwd; x=~/y; echo $x", "/d\n/d/y\n"},
+	{"echo ~-; mkdir d; cd d; echo ~+ ~-; cd /; echo ~-/x", "~-\n/d /\n/d/x\n"},
+	{"x=u; echo ~root ~nosuch/x ~$x; y=~root; echo $y", "~root ~nosuch/x ~u\n~root\n"},
+	{"mkdir '~u'; echo ~u*", "~u\n"},
+
+	// case
+	{"for x in a b c; do case $x in a|b) echo ab;; *) echo other;; esac; done", "ab\nab\nother\n"},
+	{"for x in f.txt f.go g; do case $x in *.txt) echo text;; ?.g[aeo]) echo go;; *) echo $x;; esac; done", "text\ngo\ng\n"},
+	{"x=b; case $x in [!a]) echo not a;; esac", "not a\n"},
+	{"false; case x in y) echo no;; esac; echo $?", "0\n"},
+	{"case a in a) echo 1;& b) echo 2;& c) echo 3;; d) echo 4;; esac", "1\n2\n3\n"},
+	{"case a in a) echo 1;;& b) echo 2;;& ?) echo 3;;& *) echo 4;; esac", "1\n3\n4\n"},
+	{"for i in 1 2; do case $i in 1) break;& *) echo no;; esac; done; echo end", "end\n"},
+	{"for x in foo baz; do case $x in @(foo|bar)) echo $x;; esac; done", "foo\n"},
+	{"for x in f.txt f.md f.go; do case $x in *.@(txt|md)) echo doc;; esac; done", "doc\ndoc\n"},
+	{"for x in a aaa b; do case $x in +(a)) echo $x;; esac; done", "a\naaa\n"},
+	{"for x in ab ba; do case $x in !(a*)) echo $x;; esac; done", "ba\n"},
+	{"case xy in x!(a)) echo no;; esac; echo after", "!(...) within a pattern is not supported\nexit status 1"},
+
+	// select
+	{"printf '2\\n' | { select x in a b; do echo got $x $REPLY; break; done; }", "1) a\n2) b\n#? got b 2\n"},
+	{"printf '2\\n\\n9\\n1' | { select x in a b; do echo \"<$x> $REPLY\"; done; echo $?; }", "1) a\n2) b\n#? <b> 2\n#? 1) a\n2) b\n#? <> 9\n#? <a> 1\n#? \n0\n"},
+	{"printf '' | { PS3='pick: '; select x in a; do echo $x; done; }", "1) a\npick: \n"},
+
+	// break and continue
+	{"for i in 1 2; do for j in a b; do echo $i$j; break 2; done; done; echo end", "1a\nend\n"},
+	{"for i in 1 2; do for j in a b; do echo $i$j; continue 2; done; done; echo end", "1a\n2a\nend\n"},
+	{"i=0; while [ $i -lt 2 ]; do i=$((i+1)); for j in a b; do echo $i$j; break 2; done; done; echo $i", "1a\n1\n"},
+	{"for i in 1 2; do echo $i; break 5; done; for k in x y; do echo $k; done", "1\nx\ny\n"},
+	{"for i in 1 2; do echo $i; continue 5; done; for k in x y; do echo $k; done", "1\n2\nx\ny\n"},
+	{"break; echo $?", "break is only useful in a loop\n0\n"},
+	{"while true; do break 0; echo no; done; echo $?", "break: 0: loop count out of range\n1\n"},
+	{"for i in 1 2; do for j in a; do continue -1; echo no; done; echo no; done; echo $?", "continue: -1: loop count out of range\n1\n"},
+	{"while true; do continue 0; done; echo $?", "continue: 0: loop count out of range\n1\n"},
+	{"for i in 1; do break x; echo no; done; echo no", "break: x: numeric argument required\nexit status 128"},
+
+	// noclobber
+	{"echo a >f; set -C; echo b >f; echo $? after; cat f", "f: cannot overwrite existing file\n1 after\na\n"},
+	{"set -o noclobber; echo a &>f; echo b &>f", "f: cannot overwrite existing file\nexit status 1"},
+	{"echo a >f; set -Ce; echo b >f; echo unreachable", "f: cannot overwrite existing file\nexit status 1"},
+	{"echo a >f; set -o noclobber; echo b >|f; echo c >>f; echo new >g; cat f g", "b\nc\nnew\n"},
+	{"echo a >f; set -C; set +o noclobber; echo b >f; cat f; [[ -o noclobber ]] || echo off", "b\noff\n"},
+
+	// line editing modes
+	{"set -o vi; echo $?; [[ -o vi ]] && echo vi", "0\nvi\n"},
+	{"set -o vi; set -o emacs; [[ -o emacs && ! -o vi ]] && echo emacs; set -o vi; [[ -o emacs ]] || echo vi", "emacs\nvi\n"},
+	{"set -o vi; set +o vi; set -o | while read name state; do case $name in emacs|vi) echo $name $state;; esac; done", "emacs off\nvi off\n"},
+
+	// printf
+	{`printf '%s-%d\n' a 1 b 2`, "a-1\nb-2\n"},
+	{`printf -v x '%s=%03d' n 7; echo "[$x]"`, "[n=007]\n"},
+	{`printf -v x '%s,' a b c; echo "$x"; printf -v y -- '-%s' z; echo $y`, "a,b,c,\n-z\n"},
+	{`x=old; printf -v x ''; echo "[$x]"; printf -v -v x; echo $?`, "[]\nprintf: invalid identifier \"-v\"\n2\n"},
+	{`printf -v; echo $?; printf -v x; echo $?`, "printf: -v: option requires an argument\n2\nusage: printf [-v var] format [arguments]\n2\n"},
+	{`f() { local x; printf -v x %s in; echo $x; }; f; echo "[$x]"`, "in\n[]\n"},
+
+	// mapfile
+	{`printf 'a\nb\n' | { mapfile -t arr; echo ${arr[1]} ${#arr[@]}; }`, "b 2\n"},
+	{`printf 'a\nb' | { readarray arr; echo "${arr[0]}|${arr[1]}"; }`, "a\n|b\n"},
+	{`printf 'a,b,c' | { mapfile -t -d , arr; echo ${arr[@]}; }; printf 'x' | { mapfile; echo $MAPFILE; }`, "a b c\nx\n"},
+	{`printf '1\n2\n3\n4\n' | { mapfile -t -s 1 -n 2 arr; echo ${arr[@]}; cat; }`, "2 3\n4\n"},
+	{`printf '1\n2\n' | { mapfile -t -n 0 arr; echo ${arr[@]}; }`, "1 2\n"},
+	{`mapfile -n x arr; echo $?; mapfile -s; echo $?; mapfile a b; echo $?`, "mapfile: x: invalid line count\n2\nmapfile: -s: option requires an argument\n2\nmapfile: Only one array name may be specified, [a b]\n2\n"},
+
+	// return
+	{"f() { return 3; echo unreachable; }; f; echo $?; echo after", "3\nafter\n"},
+	{"f() { false; return; }; f; echo $?", "1\n"},
+	{"f() { return 2; }; g() { f; echo g $?; return 4; }; g; echo $?", "g 2\n4\n"},
+	{"f() { for i in 1 2 3; do echo $i; return 5; done; echo no; }; f; echo $?", "1\n5\n"},
+	{"return 3; echo $?", "return: can only be done from a func or sourced script\n1\n"},
+	{"f() { return 1 2; }; f; echo $?", "return: too many arguments\n2\n"},
+	{"f() { return x; echo no; }; f; echo $?", "return: x: numeric argument required\n2\n"},
+	{"echo 'echo in; return 6; echo no' >lib.sh; source lib.sh; echo $?; echo after", "in\n6\nafter\n"},
+	{"echo 'return 7' >lib.sh; f() { source lib.sh; echo f $?; }; f; echo $?", "f 7\n0\n"},
+
+	// call stack
+	{`f() { echo "${FUNCNAME[@]}"; }; g() { f; echo $FUNCNAME; }; g; echo "[$FUNCNAME]"`, "f g main\ng\n[]\n"},
+	{`f() { echo ${#FUNCNAME[@]} "${FUNCNAME[@]}"; (echo $FUNCNAME) | cat; }; f`, "2 f main\nf\n"},
+	{"f() {\n\tcaller\n\tcaller 0\n\tcaller 1\n\tcaller 2; echo $?\n}\ng() {\n\tf\n}\n\ng", "8 sh\n8 g sh\n11 main sh\n1\n"},
+	{"caller; echo $?; caller x; echo $?; caller 1 2; echo $?", "1\ncaller: x: invalid number\n2\nusage: caller [n]\n2\n"},
+
+	// IFS
+	{"IFS=,; set -- $(echo 'a,b,c'); echo $2", "b\n"},
+	{"x='a b,c'; set -- $x; echo $#; IFS=,; set -- $x; echo $#; IFS=; set -- $x; echo $#; unset IFS; set -- $x; echo $#", "2\n2\n1\n2\n"},
+	{"f() { local IFS=:; set -- $1; echo $#; }; f a:b:c; x=a:b; set -- $x; echo $#", "3\n1\n"},
+	{"IFS=:; echo 'x:y:z' | { read a b; echo \"$a|$b\"; }", "x|y:z\n"},
+	{"read a <<< '  a b  '; read <<< '  a b  '; echo \"[$a][$REPLY]\"", "[a b][  a b  ]\n"},
+	{"IFS=, read a b c <<< 'x,,y'; echo \"[$a][$b][$c]\"", "[x][][y]\n"},
+	{"IFS=' ,' read a b c d <<< ' x , , y '; echo \"[$a][$b][$c][$d]\"", "[x][][y][]\n"},
+	{"IFS=, read a b <<< 'x,y,'; echo \"[$a][$b]\"; IFS=, read a b <<< 'x,y,z,'; echo \"[$a][$b]\"", "[x][y]\n[x][y,z,]\n"},
+	{"IFS=, read a b <<< 'a\\,b,c'; echo \"[$a][$b]\"; IFS= read a b <<< ' a  b '; echo \"[$a][$b]\"", "[a,b][c]\n[ a  b ][]\n"},
+
+	// shopt
+	{"shopt; shopt -o errexit; echo $?", "dotglob\toff\t(\"on\" not supported)\nextglob\toff\nfailglob\toff\nglobstar\toff\nnocaseglob\toff\nnullglob\toff\nerrexit\toff\n1\n"},
+	{"shopt -s nullglob; echo x [nomatch]*; shopt nullglob; shopt -u nullglob; echo x [nomatch]*; shopt -q nullglob; echo $?", "x\nnullglob\ton\nx [nomatch]*\n1\n"},
+	{"mkdir -p a/b/c; >a/b/c/f.txt; >a/g.txt; echo a/**/*.txt; shopt -s globstar; echo a/**/*.txt; shopt -s", "a/**/*.txt\na/g.txt a/b/c/f.txt\nglobstar\ton\n"},
+	{"shopt -s nocaseglob extglob; >A.TXT; echo *.txt; (shopt -u extglob; shopt extglob); shopt extglob", "A.TXT\nextglob\toff\nextglob\ton\n"},
+	{">a.txt; echo *.none; shopt -s nullglob; echo *.none *.txt; for f in *.none; do echo in; done; echo $?", "*.none\na.txt\n0\n"},
+	{">a.txt; shopt -s failglob; echo *.none; echo $?; echo *.txt '*.none'; for f in *.none; do echo in; done; echo $?", "no match: *.none\n1\na.txt *.none\nno match: *.none\n1\n"},
+	{"shopt -s failglob nullglob; a=(*.none); echo $? ${#a[@]}; declare b=(x *.none); echo $? ${#b[@]}; echo ok", "no match: *.none\n1 0\nno match: *.none\n1 1\nok\n"},
+	{"shopt -s dotglob; echo $?; shopt -s bogus; echo $?; shopt errexit; echo $?; shopt -x", "shopt: dotglob: \"on\" not supported\n1\nshopt: invalid option name \"bogus\"\n1\nshopt: invalid option name \"errexit\"\n1\nshopt: invalid option \"-x\"\nexit status 2"},
+
+	// background subshells share variables and functions until either side changes them
+	{"x=1; f() { echo f; }; { x=2; f() { echo g; }; alias a=b; } & wait; echo $x; f; alias", "1\nf\n"},
+	{"x=1; f() { echo f; }; { echo $x; f; } & x=2; f() { echo g; }; unset x; wait; f", "1\nf\ng\n"},
+	{"f() { x=1; { echo $x; x=3; } & x=2; wait; echo $x; }; f", "1\n2\n"},
+	{"x=1; (y=2; { echo $x $y; } & y=3; wait; echo $y)", "1 2\n3\n"},
+}
+
+func TestBuiltinNamesSorted(t *testing.T) {
+	qt.Assert(t, qt.IsTrue(slices.IsSorted(builtinNames)))
+}
+
+func TestHandlerBuiltin(t *testing.T) {
+	t.Parallel()
+	wrapper := func(hc RunnerContext, args []string) error {
+		return hc.Builtin(hc.Context, append([]string{"echo", "wrapped"}, args...))
+	}
+	got := runScript(t, "echo() { :; }; wrapper foo; builtin echo bar", WithCommand("wrapper", wrapper))
+	qt.Assert(t, qt.Equals(got, "wrapped foo\nbar\n"))
+}
+
+func TestMaxFuncDepth(t *testing.T) {
+	t.Parallel()
+	got := runScript(t, "f() { f; }; f; echo unreachable")
+	qt.Assert(t, qt.Equals(got, "f: maximum function nesting level exceeded (1000)"))
+
+	got = runScript(t, "f() { (f); }; f", WithMaxFuncDepth(10))
+	qt.Assert(t, qt.Equals(got, "f: maximum function nesting level exceeded (10)"))
+
+	src := "f() { if [ $1 -gt 0 ]; then f $(($1 - 1)); else echo done; fi; }; f 20"
+	qt.Assert(t, qt.Equals(runScript(t, src, WithMaxFuncDepth(21)), "done\n"))
+	qt.Assert(t, qt.Equals(runScript(t, src, WithMaxFuncDepth(0)), "done\n"))
+}
+
+func TestMaxRecursionDepth(t *testing.T) {
+	t.Parallel()
+	got := runScript(t, "f() { f; }; f; echo unreachable", WithMaxRecursionDepth(50))
+	qt.Assert(t, qt.Equals(got, "f: maximum function nesting level exceeded (50)"))
+
+	// Sourced files count too, along with the functions they call.
+	src := "echo 'g() { . self.sh; }; g' >self.sh; . self.sh; echo unreachable"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	qt.Assert(t, qt.IsNil(err))
+	var out concBuffer
+	r := testRunner(t, &out, WithMaxFuncDepth(10))
+	err = r.Run(context.Background(), file)
+	qt.Assert(t, qt.ErrorIs(err, ErrRecursionLimit))
+	qt.Assert(t, qt.Equals(err.Error(), "self.sh: maximum function nesting level exceeded (10)"))
+	qt.Assert(t, qt.Equals(out.String(), ""))
+
+	// The default limit covers sourced files too.
+	r = testRunner(t, &out)
+	err = r.Run(context.Background(), file)
+	qt.Assert(t, qt.ErrorIs(err, ErrRecursionLimit))
+	qt.Assert(t, qt.Equals(err.Error(), "self.sh: maximum function nesting level exceeded (1000)"))
+
+	src = "f() { if [ $1 -gt 0 ]; then f $(($1 - 1)); else echo done; fi; }; f 20"
+	qt.Assert(t, qt.Equals(runScript(t, src, WithMaxRecursionDepth(21)), "done\n"))
+}
+
+func TestMaxProcs(t *testing.T) {
+	// Not parallel, so that the goroutine count only includes our own.
+	before := runtime.NumGoroutine()
+
+	got := runScript(t, "f() { f | f; }; f", WithMaxProcs(20))
+	qt.Assert(t, qt.Equals(got, ErrMaxProcs.Error()))
+
+	got = runScript(t, "echo $(echo $(echo a)) | (cat; (echo b) & wait)", WithMaxProcs(4))
+	qt.Assert(t, qt.Equals(got, "a\nb\n"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Each level waits for the next, so that the limit is surely hit
+	// before Run returns.
+	file, err := syntax.NewParser().Parse(strings.NewReader(":(){ :|:& wait; };:"), "")
+	qt.Assert(t, qt.IsNil(err))
+	r := testRunner(t, io.Discard, WithMaxProcs(20))
+	err = r.Run(ctx, file)
+	qt.Assert(t, qt.ErrorIs(err, ErrMaxProcs))
+	// All the background subshells should stop soon after the limit is hit.
+	for runtime.NumGoroutine() > before {
+		qt.Assert(t, qt.IsNil(ctx.Err()))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Later runs are not stopped by the limit hit in an earlier one.
+	var out concBuffer
+	r = testRunner(t, &out, WithMaxProcs(3))
+	for _, src := range []string{"(true)|(true)|(true)|(true)", "echo hi", "(echo a)|(cat)", "echo again"} {
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		err = r.Run(ctx, file)
+		if src == "(true)|(true)|(true)|(true)" {
+			qt.Assert(t, qt.ErrorIs(err, ErrMaxProcs))
+		} else {
+			qt.Assert(t, qt.IsNil(err), qt.Commentf("%q", src))
+		}
+	}
+	qt.Assert(t, qt.Equals(out.String(), "hi\na\nagain\n"))
+}
+
+func TestCatHdoc(t *testing.T) {
+	t.Parallel()
+	// "cat >file <<EOF" runs the registered cat like any other command.
+	var calls int
+	countCat := func(hc RunnerContext, args []string) error {
+		calls++
+		_, err := io.Copy(hc.Stdout, hc.Stdin)
+		return err
+	}
+	var out concBuffer
+	r := testRunner(t, &out, WithCommand("cat", countCat))
+	file, err := syntax.NewParser().Parse(strings.NewReader("dir=d\nmkdir $dir\ncat >$dir/f <<EOF\n$dir\nEOF\n"), "")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	qt.Assert(t, qt.Equals(out.String(), ""))
+	qt.Assert(t, qt.Equals(calls, 1))
+	data, err := r.FileSystem.ReadFile("d/f")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(string(data), "d\n"))
+}
+
+func TestParseAndRun(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	out, exit, err := ParseAndRun(ctx, "echo foo; echo bar >&2; (echo baz) &\nwait")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(exit, 0))
+	qt.Assert(t, qt.Equals(out, "foo\nbaz\n"))
+
+	out, exit, err = ParseAndRun(ctx, "echo foo; exit 3")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(exit, 3))
+	qt.Assert(t, qt.Equals(out, "foo\n"))
+
+	out, exit, err = ParseAndRun(ctx, "echo 'foo")
+	qt.Assert(t, qt.ErrorMatches(err, `1:6: reached EOF without closing quote '`))
+	qt.Assert(t, qt.Equals(exit, 2))
+	qt.Assert(t, qt.Equals(out, ""))
+
+	out, exit, err = ParseAndRun(ctx, "echo foo; f() { f; }; f", WithMaxFuncDepth(5))
+	qt.Assert(t, qt.ErrorMatches(err, `f: maximum function nesting level exceeded \(5\)`))
+	qt.Assert(t, qt.Equals(exit, 1))
+	qt.Assert(t, qt.Equals(out, "foo\n"))
+}
+
+func TestNoPathLookup(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "tool"), nil, 0o755)
+	qt.Assert(t, qt.IsNil(err))
+	src := "PATH=" + dir + "; type tool; command -v tool || echo none; tool"
+
+	got := runScript(t, src)
+	want := "tool is " + dir + "/tool\n" + dir + "/tool\nsh: tool: command not found\nexit status 127"
+	qt.Assert(t, qt.Equals(got, want))
+
+	// The executable on the host must not be found.
+	got = runScript(t, src, WithNoPathLookup())
+	want = "type: tool: not found\nnone\nsh: tool: command not found\nexit status 127"
+	qt.Assert(t, qt.Equals(got, want))
+}
+
+func TestWithDirExpand(t *testing.T) {
+	t.Parallel()
+	fsys := fs.NewMemFS()
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("home/user/sub", 0o755)))
+	env := WithEnv(expand.ListEnviron("HOME=/home/user", "SUB=sub"))
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"~", "/home/user"},
+		{"~/sub", "/home/user/sub"},
+		{"$HOME/sub", "/home/user/sub"},
+		{"${HOME}/$SUB", "/home/user/sub"},
+		{"/home/user/sub/..", "/home/user"},
+	} {
+		r, err := NewRunner(env, WithDir(fsys, tc.path))
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(r.Dir, tc.want))
+	}
+
+	_, err := NewRunner(env, WithDir(fsys, "$HOME/$UNDEFINED"))
+	qt.Assert(t, qt.ErrorMatches(err, "UNDEFINED: unbound variable"))
+
+	// Without an environment, "~" falls back to the default HOME.
+	r, err := NewRunner(WithDir(fsys, "~/home"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(r.Dir, "/home"))
+}
+
+func TestRunner(t *testing.T) {
+	t.Parallel()
+	for _, tc := range runTests {
+		t.Run("", func(t *testing.T) {
+			qt.Assert(t, qt.Equals(runScript(t, tc.src), tc.want))
+		})
+	}
+}
+
+// fakeClock is a [Clock] whose time only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	}
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.waiters = slices.DeleteFunc(c.waiters, func(w fakeWaiter) bool {
+		if w.at.After(c.now) {
+			return false
+		}
+		w.ch <- c.now
+		return true
+	})
+}
+
+// waitForWaiters blocks until someone is waiting on the clock.
+func (c *fakeClock) waitForWaiters(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.mu.Lock()
+		n := len(c.waiters)
+		c.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		qt.Assert(t, qt.IsTrue(time.Now().Before(deadline)))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCron(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var out concBuffer
+	r := testRunner(t, &out,
+		WithClock(clock),
+		WithCron("@every 1m", "tick"),
+		WithCron("*/5 * * * *", "echo five"),
+	)
+	file, err := syntax.NewParser().Parse(strings.NewReader("tick() { echo tick; }"), "")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := r.StartCron(ctx)
+	for range 10 {
+		clock.waitForWaiters(t)
+		clock.Advance(time.Minute)
+	}
+	clock.waitForWaiters(t)
+	cancel()
+	wait()
+
+	got := out.String()
+	qt.Assert(t, qt.Equals(strings.Count(got, "tick\n"), 10))
+	qt.Assert(t, qt.Equals(strings.Count(got, "five\n"), 2))
+}
+
+func TestCronSpec(t *testing.T) {
+	t.Parallel()
+	// A Monday.
+	start := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2024, 1, 1, 10, 31, 30, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"15,45 9-17/4 * * *", time.Date(2024, 1, 1, 13, 15, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 3", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		sched, err := parseCronSpec(test.spec)
+		qt.Assert(t, qt.IsNil(err), qt.Commentf("%q", test.spec))
+		qt.Assert(t, qt.Equals(sched.next(start), test.want), qt.Commentf("%q", test.spec))
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "@sometimes", "@every -1s", "5-1 * * * *"} {
+		_, err := parseCronSpec(spec)
+		qt.Assert(t, qt.IsNotNil(err), qt.Commentf("%q", spec))
+	}
+	_, err := NewRunner(WithCron("@daily", "echo ("))
+	qt.Assert(t, qt.IsNotNil(err))
+}
+
+func TestAt(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var out concBuffer
+	r := testRunner(t, &out, WithClock(clock))
+	run := func(ctx context.Context, src string) {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		if err := r.Run(ctx, file); err != nil {
+			fmt.Fprint(&out, err)
+		}
+	}
+
+	run(context.Background(), "at now + 2 minutes <<EOF\necho later\nEOF\njobs")
+	qt.Assert(t, qt.Equals(out.String(), ""+
+		"job 1 at Mon Jan  1 00:02:00 2024\n"+
+		"[1]  Running  at Mon Jan  1 00:02:00 2024: echo later\n"))
+	out.buf.Reset()
+
+	clock.waitForWaiters(t)
+	clock.Advance(time.Minute)
+	run(context.Background(), "jobs")
+	qt.Assert(t, qt.Equals(out.String(), "[1]  Running  at Mon Jan  1 00:02:00 2024: echo later\n"))
+	out.buf.Reset()
+
+	clock.Advance(time.Minute)
+	run(context.Background(), "wait $!; jobs; echo done &\nwait; jobs")
+	qt.Assert(t, qt.Equals(out.String(), ""+
+		"later\n"+
+		"[1]  Done     at Mon Jan  1 00:02:00 2024: echo later\n"+
+		"done\n"+
+		"[1]  Done     at Mon Jan  1 00:02:00 2024: echo later\n"+
+		"[2]  Done     echo done &\n"))
+	out.buf.Reset()
+
+	// Jobs which haven't run yet are stopped along with the shell's context.
+	ctx, cancel := context.WithCancel(context.Background())
+	run(ctx, "at 00:01 <<EOF\necho never\nEOF")
+	qt.Assert(t, qt.Equals(out.String(), "job 3 at Tue Jan  2 00:01:00 2024\n"))
+	out.buf.Reset()
+	cancel()
+	run(context.Background(), "wait g3; echo $?; at tomorrow; at now + 1 fortnight")
+	qt.Assert(t, qt.Equals(out.String(), "1\nat: garbled time \"tomorrow\"\nat: garbled time \"now + 1 fortnight\"\nexit status 1"))
+}
+
+func TestTempDir(t *testing.T) {
+	t.Parallel()
+	var out concBuffer
+	r := testRunner(t, &out, WithTempDir("/var/tmp"))
+	file, err := syntax.NewParser().Parse(strings.NewReader("echo $TMPDIR; cat <(echo in) > >(cat)"), "")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	qt.Assert(t, qt.Equals(out.String(), "/var/tmp\nin\n"))
+
+	// The directory is created as needed, and the temporary files are removed.
+	entries, err := r.FileSystem.ReadDir("/var/tmp")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(entries, 0))
+
+	_, err = NewRunner(WithTempDir("tmp"))
+	qt.Assert(t, qt.ErrorMatches(err, `temporary directory "tmp" is not an absolute path`))
+}
+
+func TestRandSource(t *testing.T) {
+	t.Parallel()
+	src := "echo $RANDOM $RANDOM; true <(echo); echo $RANDOM"
+	run := func(seed uint64) string {
+		return runScript(t, src, WithRandSource(rand.NewPCG(seed, 0)))
+	}
+	first := run(1)
+	qt.Assert(t, qt.Equals(run(1), first))
+	qt.Assert(t, qt.Not(qt.Equals(run(2), first)))
+
+	for _, field := range strings.Fields(first) {
+		n, err := strconv.Atoi(field)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsTrue(0 <= n && n < 32768))
+	}
+	// Each read gives a new value.
+	fields := strings.Fields(run(3))
+	qt.Assert(t, qt.Not(qt.IsTrue(fields[0] == fields[1] && fields[1] == fields[2])))
+}
+
+func TestSeconds(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var out concBuffer
+	r := testRunner(t, &out, WithClock(clock))
+	run := func(src string) {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	}
+
+	run("echo $SECONDS")
+	clock.Advance(5 * time.Second)
+	run("echo $SECONDS; SECONDS=100")
+	clock.Advance(2500 * time.Millisecond)
+	run("echo $SECONDS; (echo $SECONDS)")
+	qt.Assert(t, qt.Equals(out.String(), "0\n5\n102\n102\n"))
+}
+
+func TestCancel(t *testing.T) {
+	t.Parallel()
+	block := func(hc RunnerContext, args []string) error {
+		<-hc.Context.Done()
+		return hc.Context.Err()
+	}
+	var out concBuffer
+	r := testRunner(t, &out, WithCommand("block", block))
+	run := func(ctx context.Context, src string) error {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		return r.Run(ctx, file)
+	}
+
+	// A busy loop is stopped once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := run(ctx, "echo start; while true; do true; done; echo never")
+	qt.Assert(t, qt.ErrorIs(err, context.Canceled))
+	qt.Assert(t, qt.IsNil(run(context.Background(), "echo $?")))
+	qt.Assert(t, qt.Equals(out.String(), "start\n130\n"))
+	out.buf.Reset()
+
+	// As is a command waiting for the context to be done.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = run(ctx, "block; echo never")
+	qt.Assert(t, qt.ErrorIs(err, context.DeadlineExceeded))
+	qt.Assert(t, qt.IsNil(run(context.Background(), "echo $?")))
+	qt.Assert(t, qt.Equals(out.String(), "130\n"))
+}
+
+func TestCommandNames(t *testing.T) {
+	t.Parallel()
+	var out concBuffer
+	r := testRunner(t, &out, WithCommand("zzcmd", func(RunnerContext, []string) error { return nil }))
+	file, err := syntax.NewParser().Parse(strings.NewReader("zzfunc() { true; }; alias zzalias=echo; enable -n cd"), "")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+
+	names := r.CommandNames()
+	qt.Assert(t, qt.IsTrue(slices.IsSorted(names)))
+	for _, name := range []string{"echo", "zzalias", "zzcmd", "zzfunc"} {
+		qt.Assert(t, qt.IsTrue(slices.Contains(names, name)), qt.Commentf("%s", name))
+	}
+	qt.Assert(t, qt.IsFalse(slices.Contains(names, "cd")))
+}
+
+func TestPrompt(t *testing.T) {
+	t.Parallel()
+	r := testRunner(t, io.Discard, WithEnv(expand.ListEnviron("HOME=/home/me", "USER=me", "HOSTNAME=box.example.com")))
+	qt.Assert(t, qt.Equals(r.Prompt("PS1", "$ "), "$ "))
+
+	run := func(src string) {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	}
+	run(`PS1='\[\u@\h:\w\]\$ '; PS2='\s\\> $((1+2)) '`)
+	qt.Assert(t, qt.Equals(r.Prompt("PS1", "$ "), "me@box:/$ "))
+	qt.Assert(t, qt.Equals(r.Prompt("PS2", "> "), `vsh\> 3 `))
+
+	run(`mkdir -p /home/me/src; cd /home/me/src; PS1='\H \w \W\n$(echo x)\$ '`)
+	qt.Assert(t, qt.Equals(r.Prompt("PS1", "$ "), "box.example.com ~/src src\nx$ "))
+	run(`cd; USER=root`)
+	qt.Assert(t, qt.Equals(r.Prompt("PS1", "$ "), "box.example.com ~ ~\nx# "))
+}
+
+func TestTime(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tick := func(hc RunnerContext, args []string) error {
+		clock.Advance(61500 * time.Millisecond)
+		return ExitStatus(3)
+	}
+	// The times go to standard error, leaving the command's output alone.
+	for _, tc := range []struct {
+		src, wantOut, wantErr string
+	}{
+		{"time tick; echo $?", "3\n", "\nreal\t1m1.500s\nuser\t0m0.000s\nsys\t0m0.000s\n"},
+		{"time -p tick", "", "real 61.50\nuser 0.00\nsys 0.00\nexit status 3"},
+		{"TIMEFORMAT='%R %2lR %0U %S %P%% %x'; time tick", "", "61.500 1m1.50s 0 0.000 0.00% %x\nexit status 3"},
+		{"TIMEFORMAT=; time true", "", ""},
+		{"TIMEFORMAT=%R; time -p echo", "\n", "real 0.00\nuser 0.00\nsys 0.00\n"},
+	} {
+		var stdout, stderr concBuffer
+		r, err := NewRunner(WithStdIO(nil, &stdout, &stderr), WithClock(clock), WithCommand("tick", tick))
+		qt.Assert(t, qt.IsNil(err))
+		file, err := syntax.NewParser().Parse(strings.NewReader(tc.src), "")
+		qt.Assert(t, qt.IsNil(err))
+		if err := r.Run(context.Background(), file); err != nil {
+			fmt.Fprint(&stderr, err)
+		}
+		qt.Assert(t, qt.Equals(stdout.String(), tc.wantOut), qt.Commentf("%s", tc.src))
+		qt.Assert(t, qt.Equals(stderr.String(), tc.wantErr), qt.Commentf("%s", tc.src))
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	t.Parallel()
+	block := func(hc RunnerContext, args []string) error {
+		<-hc.Context.Done()
+		qt.Check(t, qt.Equals(context.Cause(hc.Context), ErrCommandTimeout))
+		return hc.Context.Err()
+	}
+	var out concBuffer
+	r := testRunner(t, &out, WithCommand("block", block), WithCommandTimeout(20*time.Millisecond))
+	run := func(src string) error {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		return r.Run(context.Background(), file)
+	}
+
+	// Each command gets its own timeout, including those in the background.
+	err := run("block; echo $?; block & block & wait $!; echo $?; eval 'while true; do true; done'; echo $?; echo fast")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(out.String(), "124\n124\n124\nfast\n"))
+
+	err = run("block")
+	qt.Assert(t, qt.ErrorIs(err, ErrCommandTimeout))
+	qt.Assert(t, qt.ErrorIs(err, context.DeadlineExceeded))
+}
+
+func TestPanicRecovery(t *testing.T) {
+	t.Parallel()
+	boom := func(hc RunnerContext, args []string) error {
+		panic("boom")
+	}
+	var gotName string
+	var gotValue any
+	var gotStack []byte
+	handler := func(name string, v any, stack []byte) {
+		gotName, gotValue, gotStack = name, v, stack
+	}
+	var out concBuffer
+	r := testRunner(t, &out, WithCommand("boom", boom), WithPanicHandler(handler))
+	file, err := syntax.NewParser().Parse(strings.NewReader("boom a; echo $?; (boom); echo after $?"), "")
+	qt.Assert(t, qt.IsNil(err))
+	err = r.Run(context.Background(), file)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(out.String(), "sh: boom: panic: boom\n2\nsh: boom: panic: boom\nafter 2\n"))
+	qt.Assert(t, qt.Equals(gotName, "boom"))
+	qt.Assert(t, qt.Equals(gotValue, any("boom")))
+	qt.Assert(t, qt.StringContains(string(gotStack), "TestPanicRecovery"))
+}
+
+func TestFileSystemAuditor(t *testing.T) {
+	t.Parallel()
+	var ops []string
+	auditor := func(op, path string) error {
+		ops = append(ops, op+" "+path)
+		if path == "/tmp/log" {
+			return nil
+		}
+		return fmt.Errorf("dry run")
+	}
+	fsys := fs.NewMemFS()
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("/tmp", 0o755)))
+	var out concBuffer
+	r := testRunner(t, &out, WithFileSystemAuditor(auditor), WithDir(fsys, "/"))
+	run := func(src string) error {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		return r.Run(context.Background(), file)
+	}
+
+	err := run("echo foo >out")
+	qt.Assert(t, qt.ErrorMatches(err, "write /out: dry run"))
+	_, err = fsys.Stat("/out")
+	qt.Assert(t, qt.ErrorIs(err, os.ErrNotExist))
+
+	qt.Assert(t, qt.IsNil(run("cd /tmp && echo bar >>log && cat <log")))
+	qt.Assert(t, qt.Equals(out.String(), "bar\n"))
+	qt.Assert(t, qt.DeepEquals(ops, []string{"write /out", "write /tmp/log"}))
+}
+
+func TestWithVar(t *testing.T) {
+	t.Parallel()
+	getenv := func(hc RunnerContext, args []string) error {
+		for _, name := range args {
+			vr := hc.Env.Get(name)
+			fmt.Fprintf(hc.Stdout, "%s=%q exported=%t\n", name, vr.String(), vr.Exported)
+		}
+		return nil
+	}
+	var out concBuffer
+	r := testRunner(t, &out,
+		WithCommand("getenv", getenv),
+		WithVar("NAME", "one"),
+		WithVars(map[string]string{"A": "a", "B": "b", "NAME": "two"}),
+		WithExportedVar("EXP", "exp"),
+	)
+	run := func(src string) {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	}
+
+	run("echo $NAME $A $B $EXP; getenv NAME EXP; NAME=changed")
+	qt.Assert(t, qt.Equals(out.String(), "two a b exp\nNAME=\"two\" exported=false\nEXP=\"exp\" exported=true\n"))
+
+	// The variables are set again after a reset.
+	r.Reset()
+	run("echo $NAME")
+	qt.Assert(t, qt.StringContains(out.String(), "exported=true\ntwo\n"))
+
+	_, err := NewRunner(WithVar("1x", ""))
+	qt.Assert(t, qt.ErrorMatches(err, `invalid variable name: "1x"`))
+}
+
+func TestPresetVarsAndFuncs(t *testing.T) {
+	t.Parallel()
+	var out concBuffer
+	r := testRunner(t, &out, WithVar("A", "option"))
+	r.Vars = map[string]expand.Variable{
+		"A": {Set: true, Kind: expand.String, Str: "overridden"},
+		"B": {Set: true, Kind: expand.String, Str: "b"},
+	}
+	file, err := syntax.NewParser().Parse(strings.NewReader("greet() { echo hello $1; }"), "")
+	qt.Assert(t, qt.IsNil(err))
+	r.Funcs = map[string]*syntax.Stmt{"greet": file.Stmts[0].Cmd.(*syntax.FuncDecl).Body}
+	run := func(src string) {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	}
+
+	// The first Run resets the runner, but keeps what was set up before it.
+	run("echo $A $B; greet world; B=changed; unset -f greet; other() { true; }")
+	qt.Assert(t, qt.Equals(out.String(), "overridden b\nhello world\n"))
+
+	r.Reset()
+	run("echo $A $B; greet again; type other || true")
+	qt.Assert(t, qt.Equals(out.String(), "overridden b\nhello world\noverridden b\nhello again\ntype: other: not found\n"))
+}
+
+func TestPreRunPostRun(t *testing.T) {
+	t.Parallel()
+	var log []string
+	preRun := func(hc RunnerContext, args []string) error {
+		log = append(log, "pre "+strings.Join(args, " "))
+		if args[0] == "denied" {
+			fmt.Fprintln(hc.Stderr, "not allowed:", args[0])
+			return ExitStatus(3)
+		}
+		if args[0] == "fatal" {
+			return fmt.Errorf("fatal from hook")
+		}
+		return nil
+	}
+	postRun := func(hc RunnerContext, args []string, exit int) {
+		log = append(log, fmt.Sprintf("post %s %d", args[0], exit))
+	}
+	var out concBuffer
+	r := testRunner(t, &out, WithPreRun(preRun), WithPostRun(postRun))
+	run := func(src string) error {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		return r.Run(context.Background(), file)
+	}
+
+	err := run(`f() { false; }; x=world; echo "hello $x"; f; denied; echo $?`)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(out.String(), "hello world\nnot allowed: denied\n3\n"))
+	qt.Assert(t, qt.DeepEquals(log, []string{
+		"pre echo hello world", "post echo 0",
+		"pre f", "pre false", "post false 1", "post f 1",
+		"pre denied",
+		"pre echo 3", "post echo 0",
+	}))
+
+	err = run("fatal; echo unreachable")
+	qt.Assert(t, qt.ErrorMatches(err, "fatal from hook"))
+}
+
+func TestMaxCommands(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"echo 1; echo 2; echo 3", "1\n2\n3\n"},
+		{"echo 1; echo 2; echo 3; echo 4", "1\n2\n3\nmaximum number of commands exceeded"},
+		{"while true; do true; done", "maximum number of commands exceeded"},
+		{"f() { echo f; f; }; f", "f\nmaximum number of commands exceeded"},
+		{"(while true; do true; done) & wait; echo unreachable", "maximum number of commands exceeded"},
+	}
+	for _, tc := range tests {
+		t.Run("", func(t *testing.T) {
+			got := runScript(t, tc.src, WithMaxCommands(3))
+			qt.Assert(t, qt.Equals(got, tc.want))
+		})
+	}
+}
+
+func TestMaxLoopIterations(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"for i in 1 2 3; do echo $i; done", "1\n2\n3\n"},
+		{"for i in 1 2 3 4; do echo $i; done", "1\n2\n3\nmaximum number of loop iterations exceeded"},
+		{"i=0; while ((1)); do ((i++)); done", "maximum number of loop iterations exceeded"},
+		{"i=0; until false; do ((i++)); done; echo $i", "maximum number of loop iterations exceeded"},
+		{"for ((;;)); do true; done", "maximum number of loop iterations exceeded"},
+		// Each loop has its own count.
+		{"for i in 1 2 3; do for j in a b c; do echo -n $j; done; done", "abcabcabc"},
+		{"for i in 1 2; do echo $i; done; for i in 3 4; do echo $i; done", "1\n2\n3\n4\n"},
+	}
+	for _, tc := range tests {
+		t.Run("", func(t *testing.T) {
+			got := runScript(t, tc.src, WithMaxLoopIterations(3))
+			qt.Assert(t, qt.Equals(got, tc.want))
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+	r := testRunner(t, io.Discard)
+	qt.Assert(t, qt.Equals(r.ExitCode(), 0))
+	for _, tc := range []struct {
+		src  string
+		want int
+	}{
+		{"true", 0},
+		{"false", 1},
+		{"(exit 42)", 42},
+		{"false; true", 0},
+		{"missing-command", 127},
+		{"exit 3", 3},
+	} {
+		file, err := syntax.NewParser().Parse(strings.NewReader(tc.src), "")
+		qt.Assert(t, qt.IsNil(err))
+		r.Run(context.Background(), file)
+		qt.Assert(t, qt.Equals(r.ExitCode(), tc.want), qt.Commentf("%s", tc.src))
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	t.Parallel()
+	fsys := fs.NewMemFS()
+	qt.Assert(t, qt.IsNil(fsys.MkdirAll("/tmp", 0o755)))
+	run := func(r *Runner, src string) {
+		t.Helper()
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	}
+	env := expand.ListEnviron("INHERITED=1", "DROPPED=1")
+	r1 := testRunner(t, io.Discard, WithDir(fsys, "/"), WithEnv(env))
+	run(r1, `cd /tmp; set -e -o pipefail -- a 'b c'; shopt -s nullglob; x=1; export y=2; readonly z=3; arr=(d e); unset DROPPED; greet() { echo "hi $1"; }`)
+	st := r1.ExportState()
+	qt.Assert(t, qt.Equals(st.Dir, "/tmp"))
+	qt.Assert(t, qt.DeepEquals(st.Params, []string{"a", "b c"}))
+	qt.Assert(t, qt.DeepEquals(st.Options, []string{"errexit", "nullglob", "pipefail"}))
+	qt.Assert(t, qt.Equals(st.Vars["y"].Exported, true))
+	_, ok := st.Vars["DROPPED"]
+	qt.Assert(t, qt.IsFalse(ok))
+
+	// The state can go through JSON, into another runner.
+	data, err := json.Marshal(st)
+	qt.Assert(t, qt.IsNil(err))
+	var st2 State
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &st2)))
+
+	var out concBuffer
+	r2 := testRunner(t, &out, WithDir(fsys, "/"), WithEnv(env))
+	qt.Assert(t, qt.IsNil(r2.ImportState(st2)))
+	run(r2, `echo $PWD $# "$2" $x $y $z ${arr[1]} $INHERITED "${DROPPED-unset}"; [[ -o errexit && -o pipefail && ! -o xtrace ]] && greet there; echo nomatch*; z=4 || true`)
+	qt.Assert(t, qt.Equals(out.String(), "/tmp 2 b c 1 2 3 e 1 unset\nhi there\n\nz: readonly variable\n"))
+
+	err = r2.ImportState(State{Options: []string{"bogus"}})
+	qt.Assert(t, qt.ErrorMatches(err, `invalid option: "bogus"`))
+}
+
+func TestStateJSON(t *testing.T) {
+	t.Parallel()
+	r := testRunner(t, io.Discard, WithEnv(expand.ListEnviron()))
+	file, err := syntax.NewParser().Parse(strings.NewReader(`set -u; s=str; export e=exp; a=(x "" z); declare -A m=([k]=v); declare -n ref=s; readonly s`), "")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.Run(context.Background(), file)))
+	st := r.ExportState()
+
+	data, err := json.Marshal(st)
+	qt.Assert(t, qt.IsNil(err))
+	for _, want := range []string{
+		`"options":["nounset"]`,
+		`"s":{"kind":"string","value":"str","readonly":true}`,
+		`"e":{"kind":"string","value":"exp","exported":true}`,
+		`"a":{"kind":"indexed","list":["x","","z"]}`,
+		`"m":{"kind":"associative","map":{"k":"v"}}`,
+		`"ref":{"kind":"nameref","value":"s"}`,
+	} {
+		qt.Assert(t, qt.StringContains(string(data), want))
+	}
+	var got State
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &got)))
+	qt.Assert(t, qt.DeepEquals(got, st))
+
+	err = json.Unmarshal([]byte(`{"vars":{"x":{"kind":"bogus"}}}`), &got)
+	qt.Assert(t, qt.ErrorMatches(err, `variable x: unknown kind "bogus"`))
+}
+
+func TestRunString(t *testing.T) {
+	t.Parallel()
+	var out concBuffer
+	r := testRunner(t, &out)
+	qt.Assert(t, qt.IsNil(r.RunString(context.Background(), "x=foo; echo $x")))
+	// The state carries over to the next call.
+	err := r.RunReader(context.Background(), strings.NewReader("echo $x bar; false"), "script.sh")
+	qt.Assert(t, qt.ErrorMatches(err, "exit status 1"))
+	qt.Assert(t, qt.Equals(out.String(), "foo\nfoo bar\n"))
+
+	err = r.RunReader(context.Background(), strings.NewReader("echo ("), "script.sh")
+	qt.Assert(t, qt.ErrorMatches(err, `script.sh:1:1: .*`))
+	qt.Assert(t, qt.Equals(out.String(), "foo\nfoo bar\n"))
+}
+
+func TestRunLine(t *testing.T) {
+	t.Parallel()
+	var out concBuffer
+	r := testRunner(t, &out)
+	ctx := context.Background()
+	lines := []struct {
+		line     string
+		complete bool
+		err      string
+	}{
+		{"x=foo", true, ""},
+		{"if true; then", false, ""},
+		{"  echo $x", false, ""},
+		{"fi", true, ""},
+		{"echo 'a", false, ""},
+		{"b'; false", true, "exit status 1"},
+		{"echo bar \\", false, ""},
+		{"baz", true, ""},
+		{"echo (", true, `1:1: .*`},
+		{"echo $x", true, ""},
+	}
+	for _, tc := range lines {
+		complete, err := r.RunLine(ctx, tc.line)
+		qt.Assert(t, qt.Equals(complete, tc.complete), qt.Commentf("%q", tc.line))
+		if tc.err != "" {
+			qt.Assert(t, qt.ErrorMatches(err, tc.err), qt.Commentf("%q", tc.line))
+		} else {
+			qt.Assert(t, qt.IsNil(err), qt.Commentf("%q", tc.line))
+		}
+	}
+	qt.Assert(t, qt.Equals(out.String(), "foo\na\nb\nbar baz\nfoo\n"))
+
+	// Reset discards any incomplete input.
+	complete, err := r.RunLine(ctx, "echo 'x")
+	qt.Assert(t, qt.IsFalse(complete))
+	qt.Assert(t, qt.IsNil(err))
+	r.Reset()
+	complete, err = r.RunLine(ctx, "echo y")
+	qt.Assert(t, qt.IsTrue(complete))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(out.String(), "foo\na\nb\nbar baz\nfoo\ny\n"))
+}
+
+func TestRunLineExitTrap(t *testing.T) {
+	t.Parallel()
+	var out concBuffer
+	r := testRunner(t, &out)
+	ctx := context.Background()
+	for _, line := range []string{"trap 'echo EXIT-TRAP' EXIT", "x=1", "false; echo $x", "echo two"} {
+		_, _ = r.RunLine(ctx, line)
+		qt.Assert(t, qt.IsFalse(r.Exited()), qt.Commentf("%q", line))
+	}
+	qt.Assert(t, qt.Equals(out.String(), "1\ntwo\n"))
+
+	complete, err := r.RunLine(ctx, "exit 3; echo unreachable")
+	qt.Assert(t, qt.IsTrue(complete))
+	qt.Assert(t, qt.ErrorMatches(err, "exit status 3"))
+	qt.Assert(t, qt.IsTrue(r.Exited()))
+	qt.Assert(t, qt.Equals(out.String(), "1\ntwo\nEXIT-TRAP\n"))
+}
+
+func TestHomeLookup(t *testing.T) {
+	t.Parallel()
+	lookup := WithHomeLookup(func(user string) (string, bool) {
+		return "/home/" + user, user == "alice"
+	})
+	got := runScript(t, "echo ~alice ~alice/x ~bob; x=~alice; echo $x", lookup)
+	qt.Assert(t, qt.Equals(got, "/home/alice /home/alice/x ~bob\n/home/alice\n"))
+}
+
+func TestNoClobber(t *testing.T) {
+	t.Parallel()
+	got := runScript(t, "echo a >f; echo b >|f; cat f; echo c >f", WithNoClobber())
+	qt.Assert(t, qt.Equals(got, "b\nf: cannot overwrite existing file\nexit status 1"))
+}
+
+func TestDebugLogger(t *testing.T) {
+	t.Parallel()
+	var logs concBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey || a.Key == slog.LevelKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	noop := func(hc RunnerContext, args []string) error { return nil }
+	got := runScript(t, "f() { noop x; }; f a b; echo hi >out; (true); true & wait; nosuch",
+		WithDebugLogger(logger), WithCommand("noop", noop))
+	qt.Assert(t, qt.Equals(got, "sh: nosuch: command not found\nexit status 127"))
+	lines := strings.Split(logs.String(), "\n")
+	qt.Assert(t, qt.DeepEquals(lines[:8], []string{
+		`msg=call kind=function name=f args="[a b]"`,
+		`msg=call kind=command name=noop args=[x]`,
+		`msg=redirect fd=1 op=> word=out`,
+		`msg=call kind=builtin name=echo args=[hi]`,
+		`msg=subshell background=false`,
+		`msg=call kind=builtin name=true args=[]`,
+		`msg=subshell background=true`,
+		`msg="background job started" job=1`,
+	}))
+	// The background job runs alongside "wait".
+	bg := lines[8:11]
+	slices.Sort(bg)
+	qt.Assert(t, qt.DeepEquals(bg, []string{
+		`msg="background job done" job=1 exit=0`,
+		`msg=call kind=builtin name=true args=[]`,
+		`msg=call kind=builtin name=wait args=[]`,
+	}))
+	qt.Assert(t, qt.DeepEquals(lines[11:], []string{`msg="command not found" name=nosuch disabled=false`, ""}))
+
+	// Without the option, or with the level too high, nothing is logged.
+	logs = concBuffer{}
+	quiet := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	runScript(t, "true; (true) & wait", WithDebugLogger(quiet))
+	qt.Assert(t, qt.Equals(logs.String(), ""))
+}
+
+// countRecorder is a [Recorder] which keeps what it's told.
+type countRecorder struct {
+	mu       sync.Mutex
+	commands []string
+	fileOps  map[string]int
+}
+
+func (c *countRecorder) CommandRun(name string, dur time.Duration, exit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands = append(c.commands, fmt.Sprintf("%s %s %d", name, dur, exit))
+}
+
+func (c *countRecorder) FileOp(op string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fileOps == nil {
+		c.fileOps = make(map[string]int)
+	}
+	c.fileOps[op]++
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tick := func(hc RunnerContext, args []string) error {
+		clock.Advance(2 * time.Second)
+		return nil
+	}
+	var rec countRecorder
+	got := runScript(t, "mkdir d; echo hi >d/f; read x <d/f; g() { tick; false; }; g; echo $x; nosuch",
+		WithMetrics(&rec), WithClock(clock), WithCommand("tick", tick))
+	qt.Assert(t, qt.Equals(got, "hi\nsh: nosuch: command not found\nexit status 127"))
+	qt.Assert(t, qt.DeepEquals(rec.commands, []string{
+		"mkdir 0s 0", "echo 0s 0", "read 0s 0", "tick 2s 0", "false 0s 1", "g 2s 1", "echo 0s 0", "nosuch 0s 127",
+	}))
+	qt.Assert(t, qt.DeepEquals(rec.fileOps, map[string]int{"mkdir": 1, "write": 1, "open": 1}))
+}
+
+func TestMergedOutput(t *testing.T) {
+	t.Parallel()
+	// A plain buffer, which would upset the race detector if the
+	// background commands wrote to it at the same time.
+	var out bytes.Buffer
+	r, err := NewRunner(WithMergedOutput(&out))
+	qt.Assert(t, qt.IsNil(err))
+	src := "for i in 1 2 3; do { echo out$i; echo err$i >&2; } & done; wait; echo a; echo b >&2; echo c >f"
+	qt.Assert(t, qt.IsNil(r.RunString(context.Background(), src)))
+
+	lines := strings.Split(out.String(), "\n")
+	qt.Assert(t, qt.DeepEquals(lines[6:], []string{"a", "b", ""}))
+	bg := lines[:6]
+	slices.Sort(bg)
+	qt.Assert(t, qt.DeepEquals(bg, []string{"err1", "err2", "err3", "out1", "out2", "out3"}))
+}
+
+func TestSafeWriter(t *testing.T) {
+	t.Parallel()
+	// Like yes, but each line is written a byte at a time, which would tear
+	// lines apart if the two background commands wrote them as they came.
+	yes := func(hc RunnerContext, args []string) error {
+		for range 200 {
+			for _, c := range []byte(args[0] + "\n") {
+				if _, err := hc.Stdout.Write([]byte{c}); err != nil {
+					return err
+				}
+				runtime.Gosched()
+			}
+		}
+		return nil
+	}
+	var out bytes.Buffer
+	r, err := NewRunner(WithStdIO(nil, SafeWriter(&out), nil), WithCommand("yes", yes))
+	qt.Assert(t, qt.IsNil(err))
+	src := "yes aaaa & yes bbbb & { yes cccc & yes dddd; wait; } & wait; printf end"
+	qt.Assert(t, qt.IsNil(r.RunString(context.Background(), src)))
+
+	counts := make(map[string]int)
+	for line := range strings.Lines(out.String()) {
+		counts[line]++
+	}
+	qt.Assert(t, qt.DeepEquals(counts, map[string]int{"aaaa\n": 200, "bbbb\n": 200, "cccc\n": 200, "dddd\n": 200, "end": 1}))
+}
+
+func TestWithShellOption(t *testing.T) {
+	t.Parallel()
+	opts := []runnerOption{
+		WithShellOption("beta", 'B'),
+		WithShellOption("fast", 0),
+		WithCommand("check", func(hc RunnerContext, args []string) error {
+			for _, name := range args {
+				fmt.Fprintln(hc.Stdout, name, hc.ShellOption(name))
+			}
+			return nil
+		}),
+	}
+	got := runScript(t, "check beta fast errexit nosuch; set -B -e -o fast; check beta fast errexit; (set +o fast; check fast); check fast; [[ -o fast ]] && echo set", opts...)
+	qt.Assert(t, qt.Equals(got, "beta false\nfast false\nerrexit false\nnosuch false\nbeta true\nfast true\nerrexit true\nfast false\nfast true\nset\n"))
+
+	got = runScript(t, "set -o fast; set +o", opts...)
+	qt.Assert(t, qt.StringContains(got, "set +o pipefail\nset +o vi\nset +o beta\nset -o fast\n"))
+
+	// Custom options are kept in the exported state.
+	var out concBuffer
+	r := testRunner(t, &out, opts...)
+	qt.Assert(t, qt.IsNil(r.RunString(context.Background(), "set -o beta")))
+	st := r.ExportState()
+	qt.Assert(t, qt.DeepEquals(st.Options, []string{"beta"}))
+	r.Reset()
+	qt.Assert(t, qt.IsNil(r.RunString(context.Background(), "check beta")))
+	qt.Assert(t, qt.IsNil(r.ImportState(st)))
+	qt.Assert(t, qt.IsNil(r.RunString(context.Background(), "check beta")))
+	qt.Assert(t, qt.Equals(out.String(), "beta false\nbeta true\n"))
+
+	for _, tc := range []struct {
+		name string
+		flag byte
+		want string
+	}{
+		{"bad name", 0, `invalid option name: "bad name"`},
+		{"errexit", 0, `option "errexit" already exists`},
+		{"extra", 'e', `option flag 'e' already exists`},
+		{"extra", '-', `invalid option flag: '-'`},
+	} {
+		_, err := NewRunner(WithShellOption(tc.name, tc.flag))
+		qt.Assert(t, qt.ErrorMatches(err, tc.want))
+	}
+}
+
+func TestArgv0(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	src := "echo $0; f() { echo $0; }; f; (echo $0)"
+
+	var out concBuffer
+	r := testRunner(t, &out)
+	qt.Assert(t, qt.IsNil(r.RunString(ctx, src)))
+	qt.Assert(t, qt.Equals(out.String(), "sh\nsh\nsh\n"))
+
+	out = concBuffer{}
+	r = testRunner(t, &out, WithArgv0("myscript"))
+	qt.Assert(t, qt.IsNil(r.RunString(ctx, src)))
+	qt.Assert(t, qt.Equals(out.String(), "myscript\nmyscript\nmyscript\n"))
+
+	// A named file always sets $0, and the default is back for the rest.
+	out = concBuffer{}
+	qt.Assert(t, qt.IsNil(r.RunReader(ctx, strings.NewReader(src), "dir/file.sh")))
+	qt.Assert(t, qt.IsNil(r.RunString(ctx, "echo $0")))
+	qt.Assert(t, qt.Equals(out.String(), "dir/file.sh\ndir/file.sh\ndir/file.sh\nmyscript\n"))
+}
+
+func TestCommandArgsKept(t *testing.T) {
+	t.Parallel()
+	// Commands may hold on to their arguments, even in the background,
+	// so the slices must not be reused for later commands.
+	var mu sync.Mutex
+	var kept [][]string
+	keep := func(hc RunnerContext, args []string) error {
+		mu.Lock()
+		kept = append(kept, args)
+		mu.Unlock()
+		return nil
+	}
+	got := runScript(t, "for i in 1 2; do keep $i x; keep lit; done; keep bg & wait; keep last", WithCommand("keep", keep))
+	qt.Assert(t, qt.Equals(got, ""))
+	qt.Assert(t, qt.DeepEquals(kept, [][]string{{"1", "x"}, {"lit"}, {"2", "x"}, {"lit"}, {"bg"}, {"last"}}))
+}
+
+// BenchmarkCommandLoop runs many simple commands, to measure the overhead of
+// running each of them.
+func BenchmarkCommandLoop(b *testing.B) {
+	file, err := syntax.NewParser().Parse(strings.NewReader("for ((i = 0; i < 10000; i++)); do true x y; done"), "")
+	qt.Assert(b, qt.IsNil(err))
+	r, err := NewRunner()
+	qt.Assert(b, qt.IsNil(err))
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset()
+		if err := r.Run(context.Background(), file); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRegexpCache(t *testing.T) {
+	t.Parallel()
+	r := testRunner(t, io.Discard)
+	rx1, err := r.compileRegexp("a+")
+	qt.Assert(t, qt.IsNil(err))
+	rx2, err := r.compileRegexp("a+")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(rx1, rx2))
+	_, err = r.compileRegexp("(")
+	qt.Assert(t, qt.IsNotNil(err))
+
+	// Shell patterns are kept apart from regular expressions.
+	rx3, err := r.compilePattern("a+", pattern.EntireString)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Not(qt.Equals(rx3, rx1)))
+	qt.Assert(t, qt.IsTrue(rx3.MatchString("a+")))
+
+	// Subshells and commands share the cache.
+	var fromCmd *regexp.Regexp
+	r.Commands["compile"] = func(hc RunnerContext, args []string) error {
+		fromCmd, err = hc.CompileRegexp(args[0])
+		return err
+	}
+	qt.Assert(t, qt.IsNil(r.RunString(context.Background(), "(compile 'a+')")))
+	qt.Assert(t, qt.Equals(fromCmd, rx1))
+
+	// The least recently used expressions are dropped first.
+	for i := range regexpCacheSize - 1 {
+		_, err := r.compileRegexp(strconv.Itoa(i))
+		qt.Assert(t, qt.IsNil(err))
+	}
+	rx2, _ = r.compileRegexp("a+")
+	qt.Assert(t, qt.Equals(rx2, rx1))
+	r.compileRegexp("new")
+	rx2, _ = r.compilePattern("a+", pattern.EntireString)
+	qt.Assert(t, qt.Not(qt.Equals(rx2, rx3)))
+	qt.Assert(t, qt.Equals(r.regexps.order.Len(), regexpCacheSize))
+}
+
+// BenchmarkPatternLoop matches the same patterns many times, like a script
+// filtering lines in a loop would.
+func BenchmarkPatternLoop(b *testing.B) {
+	src := `for ((i = 0; i < 1000; i++)); do [[ foo${i}bar =~ ^fo+[0-9]+bar$ ]]; case $i in *5 | @(1|2)*) ;; esac; x=${i/#1/one}; done`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	qt.Assert(b, qt.IsNil(err))
+	r, err := NewRunner()
+	qt.Assert(b, qt.IsNil(err))
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset()
+		if err := r.Run(context.Background(), file); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBackgroundLoop(b *testing.B) {
+	file, err := syntax.NewParser().Parse(strings.NewReader("for ((i = 0; i < 10000; i++)); do true & done; wait"), "")
+	qt.Assert(b, qt.IsNil(err))
+	r, err := NewRunner()
+	qt.Assert(b, qt.IsNil(err))
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset()
+		if err := r.Run(context.Background(), file); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package sshd serves shells over SSH, with a [vsh.Runner] for each session.
+//
+// A restricted SSH server, where each user gets a shell over their own
+// filesystem, can be set up like:
+//
+//	config := &ssh.ServerConfig{PasswordCallback: checkPassword}
+//	config.AddHostKey(hostKey)
+//	h := &sshd.Handler{
+//		NewRunner: func(ctx context.Context, conn ssh.ConnMetadata) (*vsh.Runner, error) {
+//			return vsh.NewRunner(vsh.WithDir(userFS(conn.User()), "/"))
+//		},
+//	}
+//	l, err := net.Listen("tcp", ":2222")
+//	...
+//	err = h.Serve(ctx, l, config)
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/term"
+	"golang.org/x/crypto/ssh"
+)
+
+// Handler serves SSH connections, running a shell for each session.
+//
+// A session with a PTY gets an interactive shell, as with [term.ServeConn],
+// which follows the changes of the size of the client's window. Otherwise,
+// the command given by the client is run, or the script read from its
+// standard input if there is none, like with "ssh host <script.sh". The exit
+// status of the shell is sent back to the client.
+type Handler struct {
+	// NewRunner returns the runner for a new session on conn, such as one
+	// with a FileSystem for the user. Its standard input and output are set
+	// by the handler, so they should not be set via [vsh.WithStdIO].
+	NewRunner func(ctx context.Context, conn ssh.ConnMetadata) (*vsh.Runner, error)
+}
+
+// Serve accepts connections on l, serving each of them in a new goroutine
+// with [Handler.ServeConn], until l fails to accept one.
+func (h *Handler) Serve(ctx context.Context, l net.Listener, config *ssh.ServerConfig) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			h.ServeConn(ctx, conn, config)
+			conn.Close()
+		}()
+	}
+}
+
+// ServeConn does the SSH handshake on conn and serves its sessions, until the
+// client disconnects or ctx is done. Other kinds of channels are rejected.
+func (h *Handler) ServeConn(ctx context.Context, conn net.Conn, config *ssh.ServerConfig) error {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return err
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		// Unblock the loop below once ctx is done.
+		<-ctx.Done()
+		sconn.Close()
+	}()
+	var wg sync.WaitGroup
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.serveSession(ctx, sconn, ch, chReqs)
+		}()
+	}
+	wg.Wait()
+	return sconn.Wait()
+}
+
+// ptyRequest is the payload of a "pty-req" request, as per RFC 4254.
+type ptyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// windowChange is the payload of a "window-change" request.
+type windowChange struct {
+	Columns, Rows uint32
+	Width, Height uint32
+}
+
+// session is an SSH session, running at most one shell.
+type session struct {
+	h    *Handler
+	conn ssh.ConnMetadata
+	ch   ssh.Channel
+
+	mu          sync.Mutex
+	pty         *ptyRequest
+	interactive *term.ConnSession // set while an interactive shell runs
+	started     bool
+}
+
+func (h *Handler) serveSession(ctx context.Context, conn ssh.ConnMetadata, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	// The session is over once the client closes the channel.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := &session{h: h, conn: conn, ch: ch}
+	done := make(chan struct{})
+	for {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				return
+			}
+			ok = s.handle(ctx, req, done)
+			if req.WantReply {
+				req.Reply(ok, nil)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// handle handles a request on the session, reporting whether it succeeded.
+// Once a shell started by the request is done, done is closed.
+func (s *session) handle(ctx context.Context, req *ssh.Request, done chan<- struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.Type {
+	case "pty-req":
+		var pty ptyRequest
+		if s.started || ssh.Unmarshal(req.Payload, &pty) != nil {
+			return false
+		}
+		s.pty = &pty
+		return true
+	case "window-change":
+		var wc windowChange
+		if s.pty == nil || ssh.Unmarshal(req.Payload, &wc) != nil {
+			return false
+		}
+		s.pty.Columns, s.pty.Rows = wc.Columns, wc.Rows
+		if s.interactive != nil {
+			s.interactive.SetSize(int(wc.Columns), int(wc.Rows))
+		}
+		return true
+	case "shell", "exec":
+		if s.started {
+			return false
+		}
+		var command string
+		if req.Type == "exec" {
+			var payload struct{ Command string }
+			if ssh.Unmarshal(req.Payload, &payload) != nil {
+				return false
+			}
+			command = payload.Command
+		}
+		r, err := s.h.NewRunner(ctx, s.conn)
+		if err != nil {
+			fmt.Fprintln(s.ch.Stderr(), err)
+			return false
+		}
+		s.started = true
+		go func() {
+			err := s.run(ctx, r, req.Type == "shell", command)
+			s.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{exitStatus(err)}))
+			if err != nil && !errors.As(err, new(vsh.ExitStatus)) {
+				fmt.Fprintln(s.ch.Stderr(), err)
+			}
+			close(done)
+		}()
+		return true
+	}
+	return false
+}
+
+// run runs the shell for the session: an interactive one if a PTY was
+// requested for it, or the command otherwise, or the script read from
+// standard input if the command is empty.
+func (s *session) run(ctx context.Context, r *vsh.Runner, shell bool, command string) error {
+	s.mu.Lock()
+	pty := s.pty
+	s.mu.Unlock()
+	if pty != nil && shell {
+		cs, err := term.NewConnSession(r, s.ch)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.interactive = cs
+		if s.pty.Columns > 0 {
+			cs.SetSize(int(s.pty.Columns), int(s.pty.Rows))
+		}
+		s.mu.Unlock()
+		return cs.Run(ctx)
+	}
+	var src io.Reader = strings.NewReader(command)
+	if shell {
+		// Read the whole script before the pipe for the standard input
+		// of its commands starts reading from the channel.
+		script, err := io.ReadAll(s.ch)
+		if err != nil {
+			return err
+		}
+		src = bytes.NewReader(script)
+	}
+	if err := vsh.WithStdIO(s.ch, s.ch, s.ch.Stderr())(r); err != nil {
+		return err
+	}
+	return r.RunReader(ctx, src, "")
+}
+
+// exitStatus returns the exit status for the error from running a shell.
+func exitStatus(err error) uint32 {
+	var es vsh.ExitStatus
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &es):
+		return uint32(es)
+	}
+	return 1
+}
@@ -0,0 +1,151 @@
+package sshd_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/builtin"
+	"github.com/wzshiming/vsh/fs"
+	"github.com/wzshiming/vsh/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// dial starts serving connections with h, and returns an SSH client for it.
+func dial(t *testing.T, h *sshd.Handler) *ssh.Client {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	qt.Assert(t, qt.IsNil(err))
+	signer, err := ssh.NewSignerFromKey(key)
+	qt.Assert(t, qt.IsNil(err))
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	// net.Pipe is not used, as both sides of the handshake write at once.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, qt.IsNil(err))
+	t.Cleanup(func() { l.Close() })
+	go h.Serve(context.Background(), l, config)
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	qt.Assert(t, qt.IsNil(err))
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newHandler() *sshd.Handler {
+	return &sshd.Handler{
+		NewRunner: func(ctx context.Context, conn ssh.ConnMetadata) (*vsh.Runner, error) {
+			// Each session gets its own filesystem.
+			return vsh.NewRunner(
+				vsh.WithDir(fs.NewMemFS(), "/"),
+				vsh.WithVar("USER", conn.User()),
+				vsh.WithCommand("cat", builtin.Cat),
+			)
+		},
+	}
+}
+
+func exitStatus(err error) int {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+	client := dial(t, newHandler())
+
+	sess, err := client.NewSession()
+	qt.Assert(t, qt.IsNil(err))
+	var stderr bytes.Buffer
+	sess.Stdin = strings.NewReader("from stdin\n")
+	sess.Stderr = &stderr
+	out, err := sess.Output(`echo hello $USER; read line; echo "$line"; echo oops >&2; exit 3`)
+	qt.Assert(t, qt.Equals(exitStatus(err), 3))
+	qt.Assert(t, qt.Equals(string(out), "hello user\nfrom stdin\n"))
+	qt.Assert(t, qt.Equals(stderr.String(), "oops\n"))
+
+	// Without a command nor a PTY, the script is read from standard input.
+	sess, err = client.NewSession()
+	qt.Assert(t, qt.IsNil(err))
+	sess.Stdin = strings.NewReader("echo one\necho two\n")
+	var stdout bytes.Buffer
+	sess.Stdout = &stdout
+	qt.Assert(t, qt.IsNil(sess.Shell()))
+	qt.Assert(t, qt.IsNil(sess.Wait()))
+	qt.Assert(t, qt.Equals(stdout.String(), "one\ntwo\n"))
+}
+
+// syncBuffer is a [bytes.Buffer] which can be written to while being read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestInteractive(t *testing.T) {
+	t.Parallel()
+	client := dial(t, newHandler())
+
+	sess, err := client.NewSession()
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{})))
+	stdin, err := sess.StdinPipe()
+	qt.Assert(t, qt.IsNil(err))
+	var out syncBuffer
+	sess.Stdout = &out
+	qt.Assert(t, qt.IsNil(sess.Shell()))
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("want output with %q, got %q", want, out.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("$ ")
+	qt.Assert(t, qt.IsNil(sess.WindowChange(24, 100)))
+	io.WriteString(stdin, "echo foo >f; cat f\r")
+	waitFor("echo foo >f; cat f\r\nfoo\r\n$ ")
+	io.WriteString(stdin, "exit 4\r")
+	qt.Assert(t, qt.Equals(exitStatus(sess.Wait()), 4))
+
+	// Each session gets a new runner.
+	sess, err = client.NewSession()
+	qt.Assert(t, qt.IsNil(err))
+	out2, err := sess.CombinedOutput("cat f")
+	qt.Assert(t, qt.Equals(exitStatus(err), 1))
+	qt.Assert(t, qt.StringContains(string(out2), "file does not exist"))
+}
@@ -0,0 +1,239 @@
+package vsh
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// State is a copy of the state of a shell session, as returned by
+// [Runner.ExportState]. It only holds plain values, so that it can be encoded
+// to resume a session later, or in another [Runner]. Its JSON encoding names
+// the kinds of the variables rather than using their numbers, so that it
+// doesn't depend on the version of the expand package.
+//
+// Nothing that only makes sense while the shell runs is part of the state,
+// such as open files and redirections, background commands, traps, aliases,
+// or the directory stack.
+type State struct {
+	// Dir is the current directory.
+	Dir string
+
+	// Params are the positional parameters, as in $@.
+	Params []string
+
+	// Options are the names of the shell options which are on, such as
+	// "errexit", including those set via "shopt", such as "globstar", sorted.
+	Options []string
+
+	// Vars are the variables which are set, including those inherited from
+	// the environment given via [WithEnv].
+	Vars map[string]expand.Variable
+
+	// Funcs holds the source of the body of each function.
+	Funcs map[string]string
+}
+
+// ExportState returns a copy of the state of the shell, such as after a Run
+// call, which can be restored with [Runner.ImportState]. Aliases, traps and
+// background commands are not part of it.
+func (r *Runner) ExportState() State {
+	if !r.didReset {
+		r.Reset()
+	}
+	st := State{
+		Dir:    r.Dir,
+		Params: slices.Clone(r.Params),
+		Vars:   make(map[string]expand.Variable),
+	}
+	for opt, status := range r.shellOpts() {
+		if *status {
+			st.Options = append(st.Options, opt.name)
+		}
+	}
+	for i, opt := range bashOptsTable {
+		if r.bashOpts[i] {
+			st.Options = append(st.Options, opt.name)
+		}
+	}
+	slices.Sort(st.Options)
+	// Each goes over parent environments first, so later values win.
+	r.writeEnv.Each(func(name string, vr expand.Variable) bool {
+		if vr.IsSet() {
+			st.Vars[name] = vr
+		} else {
+			delete(st.Vars, name)
+		}
+		return true
+	})
+	printer := syntax.NewPrinter()
+	if len(r.Funcs) > 0 {
+		st.Funcs = make(map[string]string, len(r.Funcs))
+	}
+	for name, body := range r.Funcs {
+		var sb strings.Builder
+		printer.Print(&sb, body)
+		st.Funcs[name] = sb.String()
+	}
+	return st
+}
+
+// ImportState resets the shell, like [Runner.Reset], and then restores the
+// state st returned by [Runner.ExportState]. Variables in the environment
+// given via [WithEnv] which aren't in st are unset.
+func (r *Runner) ImportState(st State) error {
+	funcs := make(map[string]*syntax.Stmt, len(st.Funcs))
+	parser := syntax.NewParser()
+	for _, name := range slices.Sorted(maps.Keys(st.Funcs)) {
+		file, err := parser.Parse(strings.NewReader(st.Funcs[name]), name)
+		if err != nil {
+			return err
+		}
+		if len(file.Stmts) != 1 {
+			return fmt.Errorf("function %s: body must be a single statement", name)
+		}
+		funcs[name] = file.Stmts[0]
+	}
+	var opts runnerOpts
+	var bashOpts [len(bashOptsTable)]bool
+	extra := make([]bool, len(r.extraOptsTable))
+	for _, name := range st.Options {
+		i, opt := r.optByName(name)
+		switch {
+		case opt == nil:
+			if i := bashOptIndex(name); i >= 0 {
+				bashOpts[i] = true
+				break
+			}
+			return fmt.Errorf("invalid option: %q", name)
+		case i < len(opts):
+			opts[i] = true
+		default:
+			extra[i-len(opts)] = true
+		}
+	}
+
+	r.Reset()
+	r.Dir = st.Dir
+	r.Params = slices.Clone(st.Params)
+	r.opts = opts
+	r.bashOpts = bashOpts
+	r.extraOpts = extra
+	r.Funcs = funcs
+	r.dirStack = append(r.dirStack[:0], r.Dir)
+
+	// Set the variables as they were, bypassing checks such as those for
+	// read-only variables.
+	env := &overlayEnviron{parent: r.Env, values: maps.Clone(st.Vars)}
+	if env.values == nil {
+		env.values = make(map[string]expand.Variable)
+	}
+	if r.Env != nil {
+		r.Env.Each(func(name string, vr expand.Variable) bool {
+			if _, ok := st.Vars[name]; !ok {
+				env.values[name] = expand.Variable{}
+			}
+			return true
+		})
+	}
+	r.writeEnv = env
+	clear(r.Vars)
+	maps.Insert(r.Vars, r.writeEnv.Each)
+	return nil
+}
+
+// stateJSON is the JSON encoding of a [State].
+type stateJSON struct {
+	Dir     string                  `json:"dir"`
+	Params  []string                `json:"params,omitempty"`
+	Options []string                `json:"options,omitempty"`
+	Vars    map[string]variableJSON `json:"vars,omitempty"`
+	Funcs   map[string]string       `json:"funcs,omitempty"`
+}
+
+// variableJSON is the JSON encoding of an [expand.Variable] which is set.
+type variableJSON struct {
+	Kind     string            `json:"kind"`
+	Value    string            `json:"value,omitempty"`
+	List     []string          `json:"list,omitempty"`
+	Map      map[string]string `json:"map,omitempty"`
+	Exported bool              `json:"exported,omitempty"`
+	ReadOnly bool              `json:"readonly,omitempty"`
+}
+
+var variableKinds = map[expand.ValueKind]string{
+	expand.String:      "string",
+	expand.NameRef:     "nameref",
+	expand.Indexed:     "indexed",
+	expand.Associative: "associative",
+}
+
+// MarshalJSON implements [json.Marshaler].
+func (st State) MarshalJSON() ([]byte, error) {
+	sj := stateJSON{
+		Dir:     st.Dir,
+		Params:  st.Params,
+		Options: st.Options,
+		Vars:    make(map[string]variableJSON, len(st.Vars)),
+		Funcs:   st.Funcs,
+	}
+	for name, vr := range st.Vars {
+		kind, ok := variableKinds[vr.Kind]
+		if !ok {
+			return nil, fmt.Errorf("variable %s: unsupported kind %d", name, vr.Kind)
+		}
+		sj.Vars[name] = variableJSON{
+			Kind:     kind,
+			Value:    vr.Str,
+			List:     vr.List,
+			Map:      vr.Map,
+			Exported: vr.Exported,
+			ReadOnly: vr.ReadOnly,
+		}
+	}
+	return json.Marshal(sj)
+}
+
+// UnmarshalJSON implements [json.Unmarshaler].
+func (st *State) UnmarshalJSON(data []byte) error {
+	var sj stateJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return err
+	}
+	*st = State{
+		Dir:     sj.Dir,
+		Params:  sj.Params,
+		Options: sj.Options,
+		Vars:    make(map[string]expand.Variable, len(sj.Vars)),
+		Funcs:   sj.Funcs,
+	}
+	for name, vj := range sj.Vars {
+		vr := expand.Variable{
+			Set:      true,
+			Exported: vj.Exported,
+			ReadOnly: vj.ReadOnly,
+		}
+		for kind, kindName := range variableKinds {
+			if kindName == vj.Kind {
+				vr.Kind = kind
+			}
+		}
+		switch vr.Kind {
+		case expand.String, expand.NameRef:
+			vr.Str = vj.Value
+		case expand.Indexed:
+			vr.List = vj.List
+		case expand.Associative:
+			vr.Map = vj.Map
+		default:
+			return fmt.Errorf("variable %s: unknown kind %q", name, vj.Kind)
+		}
+		st.Vars[name] = vr
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package vsh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// defaultTempDir is where temporary files go when TMPDIR is not set.
+const defaultTempDir = "/tmp"
+
+// WithTempDir sets the directory in which temporary files are created, such
+// as those backing process substitutions or made by a mktemp command. It is
+// exposed to scripts as TMPDIR, overriding any value from [WithEnv]. The
+// directory is created on the runner's filesystem when first needed.
+//
+// Without this option, TMPDIR from the environment is used if it is an
+// absolute path, falling back to /tmp.
+func WithTempDir(dir string) runnerOption {
+	return func(r *Runner) error {
+		dir, err := r.expandOptPath(dir)
+		if err != nil {
+			return err
+		}
+		if !path.IsAbs(dir) {
+			return fmt.Errorf("temporary directory %q is not an absolute path", dir)
+		}
+		r.tempDir = path.Clean(dir)
+		return nil
+	}
+}
+
+// getTempDir returns the directory for temporary files, per [WithTempDir].
+func (r *Runner) getTempDir() string {
+	if dir := r.envGet("TMPDIR"); path.IsAbs(dir) {
+		return dir
+	}
+	return defaultTempDir
+}
+
+// createTemp creates an empty file with a unique name starting with prefix in
+// the directory for temporary files, creating the directory if needed.
+func (r *Runner) createTemp(ctx context.Context, prefix string) (string, error) {
+	dir := r.getTempDir()
+	if err := r.FileSystem.MkdirAll(dir, 0o777); err != nil {
+		return "", err
+	}
+	for range 100 {
+		name := path.Join(dir, prefix+r.randomTempSuffix())
+		if _, err := r.FileSystem.Lstat(name); !errors.Is(err, iofs.ErrNotExist) {
+			continue
+		}
+		f, err := r.openFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return "", err
+		}
+		return name, f.Close()
+	}
+	return "", fmt.Errorf("could not create a temporary file in %s", dir)
+}
+
+func (r *Runner) randomTempSuffix() string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 10)
+	for i := range b {
+		b[i] = chars[r.rand.IntN(len(chars))]
+	}
+	return string(b)
+}
+
+// procSubstFile is a temporary file backing a process substitution.
+type procSubstFile struct {
+	path string
+	ps   *syntax.ProcSubst
+}
+
+// procSubst expands a process substitution to the path of a temporary file.
+//
+// As the filesystem has no named pipes, "<(cmd)" runs cmd to completion first,
+// and the file holds its output. ">(cmd)" gives an empty file for the command
+// to write to, and cmd reads it once the statement using it has finished; see
+// [Runner.endProcSubsts].
+func (r *Runner) procSubst(ctx context.Context, ps *syntax.ProcSubst) (string, error) {
+	name, err := r.createTemp(ctx, "vsh-procsubst-")
+	if err != nil {
+		return "", err
+	}
+	r.procSubstFiles = append(r.procSubstFiles, procSubstFile{path: name, ps: ps})
+	if ps.Op != syntax.CmdIn {
+		return name, nil
+	}
+	if !r.startProc() {
+		return "", ErrMaxProcs
+	}
+	defer r.procs.end()
+	f, err := r.openFile(ctx, name, os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r2 := r.subshell(false)
+	r2.stdout = f
+	r2.stmts(ctx, ps.Stmts)
+	return name, r2.fatalErr
+}
+
+// endProcSubsts runs the commands of any ">(cmd)" substitutions made since
+// the first n, with the files written to them as their standard input, and
+// removes the temporary files of all of them.
+func (r *Runner) endProcSubsts(ctx context.Context, n int) {
+	if len(r.procSubstFiles) <= n {
+		return
+	}
+	files := r.procSubstFiles[n:]
+	r.procSubstFiles = r.procSubstFiles[:n]
+	for _, psf := range files {
+		if psf.ps.Op == syntax.CmdOut {
+			r.procSubstOut(ctx, psf)
+		}
+		r.FileSystem.Remove(psf.path)
+	}
+}
+
+func (r *Runner) procSubstOut(ctx context.Context, psf procSubstFile) {
+	f, err := r.open(ctx, psf.path)
+	if err != nil {
+		r.errf("%v\n", err)
+		return
+	}
+	defer f.Close()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		r.setFatalErr(err)
+		return
+	}
+	defer pr.Close()
+	go func() {
+		io.Copy(pw, f)
+		pw.Close()
+	}()
+	r2 := r.subshell(false)
+	r2.stdin = pr
+	r2.stmts(ctx, psf.ps.Stmts)
+	if r2.fatalErr != nil {
+		r.setFatalErr(r2.fatalErr)
+	}
+}
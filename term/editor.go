@@ -0,0 +1,250 @@
+package term
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/wzshiming/vsh"
+	xterm "golang.org/x/term"
+)
+
+// ErrInterrupted is returned by [LineEditor.Read] when the user gives up on
+// the line being typed with Ctrl-C.
+var ErrInterrupted = errors.New("interrupted")
+
+// ctrlC is the byte sent by a terminal in raw mode for Ctrl-C.
+const ctrlC = 3
+
+// LineEditor reads lines from a terminal with a line editor, which supports
+// moving the cursor, recalling previous lines with the up and down arrows,
+// and completing words with Tab. It implements [io.Reader] so that it can be
+// read by the parser, and [io.Writer] so that output can be written without
+// messing up the line being edited.
+type LineEditor struct {
+	fd       int // of the local terminal, or -1
+	in       *ctrlCReader
+	out      io.Writer
+	term     *xterm.Terminal
+	history  xterm.History
+	complete Completer
+	prompt   string
+
+	// reading is set while a line is being read.
+	reading atomic.Bool
+
+	// buf holds the rest of the line being read by the parser.
+	buf []byte
+}
+
+// NewLineEditor returns a line editor which reads key presses from in, and
+// draws the line being edited on out. If history is nil, the lines are only
+// remembered in memory. If complete is nil, Tab is not special.
+//
+// If in is a local terminal, it is put in raw mode while each line is read,
+// so that commands see it as usual, and its size is used.
+func NewLineEditor(in io.Reader, out io.Writer, history xterm.History, complete Completer) *LineEditor {
+	e := &LineEditor{
+		fd:       -1,
+		in:       &ctrlCReader{r: in},
+		out:      out,
+		history:  history,
+		complete: complete,
+	}
+	if f, ok := in.(*os.File); ok && xterm.IsTerminal(int(f.Fd())) {
+		e.fd = int(f.Fd())
+	}
+	e.reset()
+	return e
+}
+
+// reset starts a new terminal, dropping the state of the line being edited.
+func (e *LineEditor) reset() {
+	e.term = xterm.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{e.in, e.out}, e.prompt)
+	if e.history != nil {
+		e.term.History = e.history
+	}
+	e.term.AutoCompleteCallback = e.autoComplete
+	if e.fd < 0 {
+		return
+	}
+	if width, height, err := xterm.GetSize(e.fd); err == nil && width > 0 {
+		e.term.SetSize(width, height)
+	}
+}
+
+// SetPrompt sets the prompt shown when the next line is read.
+func (e *LineEditor) SetPrompt(prompt string) {
+	e.prompt = prompt
+	e.term.SetPrompt(prompt)
+}
+
+// SetSize sets the size of the terminal, such as when a remote terminal
+// reports that it was resized.
+func (e *LineEditor) SetSize(width, height int) error {
+	return e.term.SetSize(width, height)
+}
+
+func (e *LineEditor) Read(p []byte) (int, error) {
+	if len(e.buf) == 0 {
+		line, err := e.readLine()
+		if err != nil {
+			return 0, err
+		}
+		e.buf = append([]byte(line), '\n')
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// Write writes to the terminal, with each newline as a carriage return and a
+// line feed, as a terminal in raw mode needs.
+func (e *LineEditor) Write(p []byte) (int, error) {
+	return e.term.Write(p)
+}
+
+func (e *LineEditor) readLine() (string, error) {
+	e.reading.Store(true)
+	defer e.reading.Store(false)
+	if e.fd >= 0 {
+		// The terminal is only in raw mode while a line is being edited,
+		// so that commands see it as usual, and Ctrl-C sends SIGINT to them.
+		state, err := xterm.MakeRaw(e.fd)
+		if err != nil {
+			return "", err
+		}
+		defer xterm.Restore(e.fd, state)
+	}
+	line, err := e.term.ReadLine()
+	if errors.Is(err, xterm.ErrPasteIndicator) {
+		err = nil
+	}
+	if err == io.EOF && e.in.interrupted {
+		e.in.interrupted = false
+		// The carriage return is needed while in raw mode.
+		fmt.Fprint(e.out, "^C\r\n")
+		e.reset()
+		return "", ErrInterrupted
+	}
+	return line, err
+}
+
+// A Completer returns the possible completions of a word, which is either a
+// command name or an argument.
+type Completer func(word string, command bool) []Completion
+
+// Completion is a possible completion of a word.
+type Completion struct {
+	// Text is inserted in place of the word.
+	Text string
+
+	// Name is shown in the list of completions, when there are many.
+	// It is usually shorter than Text, such as a file's base name.
+	Name string
+}
+
+// wordBreaks are the characters which separate the words being completed.
+const wordBreaks = " \t;&|()<>"
+
+// autoComplete completes the word before the cursor when Tab is pressed.
+// A single completion is inserted, followed by a space unless it's a
+// directory. Otherwise, their longest common prefix is inserted, or the
+// completions are listed if there is nothing to insert.
+func (e *LineEditor) autoComplete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || e.complete == nil {
+		return "", 0, false
+	}
+	start := strings.LastIndexAny(line[:pos], wordBreaks) + 1
+	word := line[start:pos]
+	before := strings.TrimRight(line[:start], " \t")
+	command := before == "" || strings.ContainsAny(before[len(before)-1:], ";&|(")
+	comps := e.complete(word, command)
+	if len(comps) == 0 {
+		return "", 0, false
+	}
+	insert := comps[0].Text
+	for _, c := range comps[1:] {
+		insert = insert[:commonPrefixLen(insert, c.Text)]
+	}
+	if len(comps) == 1 && !strings.HasSuffix(insert, "/") {
+		insert += " "
+	}
+	if insert == word {
+		names := make([]string, len(comps))
+		for i, c := range comps {
+			names[i] = c.Name
+		}
+		fmt.Fprintln(e.term, strings.Join(names, "  "))
+		return "", 0, false
+	}
+	return line[:start] + insert + line[pos:], start + len(insert), true
+}
+
+// RunnerCompleter completes the names of the commands the runner can run,
+// and the paths on its filesystem, relative to its current directory.
+func RunnerCompleter(r *vsh.Runner) Completer {
+	return func(word string, command bool) []Completion {
+		var comps []Completion
+		if command && !strings.Contains(word, "/") {
+			for _, name := range r.CommandNames() {
+				if strings.HasPrefix(name, word) {
+					comps = append(comps, Completion{Text: name, Name: name})
+				}
+			}
+			return comps
+		}
+		dir, base := path.Split(word)
+		full := dir
+		if !path.IsAbs(dir) {
+			full = path.Join(r.Dir, dir)
+		}
+		entries, err := r.FileSystem.ReadDir(full)
+		if err != nil {
+			return nil
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			// Like other shells, only list hidden files when asked for.
+			if !strings.HasPrefix(name, base) || (name[0] == '.' && !strings.HasPrefix(base, ".")) {
+				continue
+			}
+			if entry.IsDir() {
+				name += "/"
+			}
+			comps = append(comps, Completion{Text: dir + name, Name: name})
+		}
+		return comps
+	}
+}
+
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// ctrlCReader records whether a Ctrl-C key press was read, as the terminal
+// reports it in the same way as the end of the input.
+type ctrlCReader struct {
+	r           io.Reader
+	interrupted bool
+}
+
+func (r *ctrlCReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if bytes.IndexByte(p[:n], ctrlC) >= 0 {
+		r.interrupted = true
+	}
+	return n, err
+}
@@ -0,0 +1,64 @@
+package term
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/builtin"
+	"github.com/wzshiming/vsh/fs"
+	xterm "golang.org/x/term"
+)
+
+func TestComplete(t *testing.T) {
+	t.Parallel()
+	fsys := fs.NewMemFS()
+	for _, name := range []string{"dir/foo", "dir/bar1", "dir/bar2", "dir/.hidden"} {
+		qt.Assert(t, qt.IsNil(fsys.MkdirAll(path.Dir(name), 0o777)))
+		f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0o644)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(f.Close()))
+	}
+	runner, err := vsh.NewRunner(
+		vsh.WithDir(fsys, "/"),
+		vsh.WithCommand("mkdir", builtin.Mkdir),
+	)
+	qt.Assert(t, qt.IsNil(err))
+
+	tests := []struct {
+		line     string
+		want     string
+		wantList string
+	}{
+		{"ech", "echo ", ""},
+		{"x; mkd", "x; mkdir ", ""},
+		{"ls di", "ls dir/", ""},
+		{"ls dir/f", "ls dir/foo ", ""},
+		{"cat /dir/f", "cat /dir/foo ", ""},
+		{"cat <dir/b", "cat <dir/bar", ""},
+		{"cat dir/bar", "", "bar1  bar2\n"},
+		{"cat dir/", "", "bar1  bar2  foo\n"},
+		{"cat dir/.", "cat dir/.hidden ", ""},
+		{"nosuch/", "", ""},
+	}
+	for _, tc := range tests {
+		var out bytes.Buffer
+		e := &LineEditor{complete: RunnerCompleter(runner)}
+		e.term = xterm.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(""), &out}, "")
+		line, pos, ok := e.autoComplete(tc.line, len(tc.line), '\t')
+		qt.Assert(t, qt.Equals(ok, tc.want != ""), qt.Commentf("%q", tc.line))
+		if ok {
+			qt.Assert(t, qt.Equals(line, tc.want))
+			qt.Assert(t, qt.Equals(pos, len(tc.want)))
+		}
+		qt.Assert(t, qt.Equals(strings.ReplaceAll(out.String(), "\r\n", "\n"), tc.wantList))
+	}
+}
@@ -0,0 +1,230 @@
+// Package term runs interactive shell sessions, either on the terminal of the
+// process or over a connection such as a WebSocket or an SSH channel.
+package term
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wzshiming/vsh"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Session is an interactive shell session, which runs the statements read
+// from its input as they are entered.
+type Session struct {
+	Runner *vsh.Runner
+
+	// Input is where the statements are read from. If it is a [LineEditor],
+	// it shows the prompts itself; otherwise, they are written to Stdout.
+	// When a LineEditor is interrupted, the statement being typed is dropped.
+	Input io.Reader
+
+	// Stdout and Stderr are where the prompts and the errors which stop
+	// a statement are written to.
+	Stdout, Stderr io.Writer
+
+	// Interrupts stops the statements being run, if any, when a value is
+	// received from it; the session then goes back to the prompt. Interrupts
+	// received at the prompt are ignored.
+	Interrupts <-chan os.Signal
+}
+
+// Run runs the session until the end of its input, or until the shell exits.
+// The error is that of the last statement, as in [vsh.Runner.Run].
+func (s *Session) Run(ctx context.Context) error {
+	r := s.Runner
+	prompt := func(ps string) { fmt.Fprint(s.Stdout, ps) }
+	if editor, ok := s.Input.(*LineEditor); ok {
+		prompt = editor.SetPrompt
+	}
+	var runErr error
+	ps1 := func() {
+		// Unless PS1 is set, show the last exit status if it's not zero.
+		def := "$ "
+		var es vsh.ExitStatus
+		if errors.As(runErr, &es) {
+			def = fmt.Sprintf("[%d]$ ", es)
+		} else if runErr != nil {
+			def = "[1]$ "
+		}
+		prompt(r.Prompt("PS1", def))
+	}
+	parser := syntax.NewParser()
+	ps1()
+	fn := func(stmts []*syntax.Stmt) bool {
+		if parser.Incomplete() {
+			prompt(r.Prompt("PS2", "> "))
+			return true
+		}
+		// Interrupts at the prompt are ignored.
+		for len(s.Interrupts) > 0 {
+			<-s.Interrupts
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-s.Interrupts:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		for _, stmt := range stmts {
+			runErr = r.Run(ctx, stmt)
+			if r.Exited() {
+				return false
+			}
+
+			if ctx.Err() != nil {
+				fmt.Fprintln(s.Stdout)
+				runErr = vsh.ExitStatus(130)
+				break
+			}
+			if err := r.FatalErr(); err != nil {
+				// Give up on the rest of the line, but not on the shell.
+				fmt.Fprintln(s.Stderr, err)
+				break
+			}
+		}
+		ps1()
+		return true
+	}
+	in := &eofReader{r: s.Input}
+	for {
+		err := parser.Interactive(in, fn)
+		if errors.Is(err, ErrInterrupted) {
+			ps1()
+			continue
+		}
+		var perr syntax.ParseError
+		if errors.As(err, &perr) && !in.eof {
+			// Skip the line with the syntax error, and carry on.
+			fmt.Fprintln(s.Stderr, err)
+			runErr = vsh.ExitStatus(2)
+			ps1()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return runErr
+	}
+}
+
+// eofReader records whether the end of its input was reached.
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// ServeConn runs an interactive session over a connection to a terminal, such
+// as a WebSocket from a terminal in a browser. It is a shorthand for
+// [NewConnSession] followed by [ConnSession.Run].
+func ServeConn(ctx context.Context, r *vsh.Runner, rw io.ReadWriter) error {
+	s, err := NewConnSession(r, rw)
+	if err != nil {
+		return err
+	}
+	return s.Run(ctx)
+}
+
+// ConnSession is an interactive session over a connection to a terminal.
+type ConnSession struct {
+	session    Session
+	editor     *LineEditor
+	rw         io.ReadWriter
+	pr, pw     *os.File
+	interrupts chan os.Signal
+}
+
+// NewConnSession returns an interactive session over a connection to a
+// terminal, such as a WebSocket from a terminal in a browser, or an SSH
+// channel. The remote terminal is expected to send each key press as is, and
+// to leave the echoing and the line editing to the shell, like a local
+// terminal in raw mode does.
+//
+// It sets the standard input and output of r to the connection, so r must not
+// have been run yet. As commands such as "read" need an [os.File] to read
+// from, what is read from rw is copied into a pipe. Ctrl-C stops the command
+// being run, or drops the line being typed.
+func NewConnSession(r *vsh.Runner, rw io.ReadWriter) (*ConnSession, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	editor := NewLineEditor(pr, rw, nil, RunnerCompleter(r))
+	if err := vsh.WithStdIO(pr, editor, editor)(r); err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
+	s := &ConnSession{
+		editor:     editor,
+		rw:         rw,
+		pr:         pr,
+		pw:         pw,
+		interrupts: make(chan os.Signal, 1),
+	}
+	s.session = Session{
+		Runner:     r,
+		Input:      editor,
+		Stdout:     editor,
+		Stderr:     editor,
+		Interrupts: s.interrupts,
+	}
+	return s, nil
+}
+
+// SetSize sets the size of the remote terminal, such as when it was resized.
+// It can be called while the session runs.
+func (s *ConnSession) SetSize(width, height int) error {
+	return s.editor.SetSize(width, height)
+}
+
+// Run runs the session until the shell exits, or the connection reaches the
+// end of its input; closing the connection is left to the caller. The error
+// is that of the last statement, as in [Session.Run].
+func (s *ConnSession) Run(ctx context.Context) error {
+	defer s.pr.Close()
+	go s.copyInput()
+	return s.session.Run(ctx)
+}
+
+// copyInput copies what is read from the connection into the pipe which is
+// the standard input of the shell.
+func (s *ConnSession) copyInput() {
+	defer s.pw.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.rw.Read(buf)
+		p := buf[:n]
+		if !s.editor.reading.Load() && bytes.IndexByte(p, ctrlC) >= 0 {
+			// A command is running, so Ctrl-C interrupts it,
+			// rather than being left for the next prompt.
+			p = bytes.ReplaceAll(p, []byte{ctrlC}, nil)
+			select {
+			case s.interrupts <- os.Interrupt:
+			default:
+			}
+		}
+		if _, err := s.pw.Write(p); err != nil {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package term
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/wzshiming/vsh"
+	"github.com/wzshiming/vsh/builtin"
+	"github.com/wzshiming/vsh/fs"
+)
+
+// Each test has an even number of strings, which form input-output pairs for
+// the interactive shell. The input string is fed to the interactive shell, and
+// bytes are read from its output until the expected output string is matched or
+// an error is encountered.
+//
+// In other words, each first string is what the user types, and each following
+// string is what the shell will print back. Note that the first "$ " output is
+// implicit.
+
+var interactiveTests = []struct {
+	pairs   []string
+	wantErr string
+}{
+	{},
+	{
+		pairs: []string{
+			"\n",
+			"$ ",
+			"\n",
+			"$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo\n",
+			"foo\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo\n",
+			"foo\n$ ",
+			"echo bar\n",
+			"bar\n",
+		},
+	},
+	{
+		pairs: []string{
+			"if true\n",
+			"> ",
+			"then echo bar; fi\n",
+			"bar\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo 'foo\n",
+			"> ",
+			"bar'\n",
+			"foo\nbar\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo; echo bar\n",
+			"foo\nbar\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo; echo 'bar\n",
+			"> ",
+			"baz'\n",
+			"foo\nbar\nbaz\n",
+		},
+	},
+	{
+		pairs: []string{
+			"(\n",
+			"> ",
+			"echo foo)\n",
+			"foo\n",
+		},
+	},
+	{
+		pairs: []string{
+			"[[\n",
+			"> ",
+			"true ]]\n",
+			"$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo ||\n",
+			"> ",
+			"echo bar\n",
+			"foo\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo |\n",
+			"> ",
+			"read var; echo $var\n",
+			"foo\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo",
+			"",
+			" bar\n",
+			"foo bar\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo\\\n",
+			"> ",
+			" foo\n",
+			"foo\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo\\\n",
+			"> ",
+			"bar\n",
+			"foobar\n",
+		},
+	},
+	{
+		pairs: []string{
+			"echo 你好\n",
+			"你好\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo *; true\n",
+			"editor.go editor_test.go session.go session_test.go\n$ ",
+			"echo *\n",
+			"editor.go editor_test.go session.go session_test.go\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo; exit 0; echo bar\n",
+			"foo\n",
+			"echo baz\n",
+			"",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo; exit 1; echo bar\n",
+			"foo\n",
+			"echo baz\n",
+			"",
+		},
+		wantErr: "exit status 1",
+	},
+	{
+		pairs: []string{
+			"(\n",
+			"> ",
+		},
+		wantErr: "1:1: reached EOF without matching ( with )",
+	},
+	{
+		pairs: []string{
+			"PS1='$X\\$ '; PS2='... '; X=a\n",
+			"a$ ",
+			"if true\n",
+			"... ",
+			"then X=b; fi\n",
+			"b$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"false\n",
+			"[1]$ ",
+			"nosuch_cmd\n",
+			"sh: nosuch_cmd: command not found\n[127]$ ",
+			"true\n",
+			"$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo )\n",
+			"1:10: a command can only contain words and redirects; encountered )\n[2]$ ",
+			"echo bar\n",
+			"bar\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo >nosuch/f; echo bar\n",
+			"open nosuch/f: no such file or directory\n[1]$ ",
+			"echo baz\n",
+			"baz\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"gosh_alias arg || true\n",
+			"sh: gosh_alias: command not found\n$ ",
+			"alias gosh_alias=echo\n",
+			"$ ",
+			"gosh_alias arg || true\n",
+			"arg\n$ ",
+			"unalias gosh_alias\n",
+			"$ ",
+			"gosh_alias arg || true\n",
+			"sh: gosh_alias: command not found\n$ ",
+		},
+	},
+}
+
+func TestInteractive(t *testing.T) {
+	t.Parallel()
+	for _, tc := range interactiveTests {
+		t.Run("", func(t *testing.T) {
+			inReader, inWriter, err := os.Pipe()
+			qt.Assert(t, qt.IsNil(err))
+			outReader, outWriter, err := os.Pipe()
+			qt.Assert(t, qt.IsNil(err))
+			runner, err := vsh.NewRunner(
+				vsh.WithStdIO(inReader, outWriter, outWriter),
+				vsh.WithDir(fs.NewDiskFS("."), "/"),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			errc := make(chan error, 1)
+			go func() {
+				errc <- runInteractive(runner, nil, inReader, outWriter)
+				// Discard the rest of the input.
+				io.Copy(io.Discard, inReader)
+				inReader.Close()
+				outWriter.Close()
+			}()
+			err = readString(outReader, "$ ")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			line := 1
+			for len(tc.pairs) > 0 {
+				t.Logf("write %q", tc.pairs[0])
+				if _, err := io.WriteString(inWriter, tc.pairs[0]); err != nil {
+					t.Fatal(err)
+				}
+				t.Logf("read %q", tc.pairs[1])
+				if err := readString(outReader, tc.pairs[1]); err != nil {
+					t.Fatal(err)
+				}
+
+				line++
+				tc.pairs = tc.pairs[2:]
+			}
+
+			// Close the input pipe, so that the parser can stop.
+			inWriter.Close()
+
+			// Once the input pipe is closed, close the output pipe
+			// so that any remaining prompt writes get discarded.
+			outReader.Close()
+
+			err = <-errc
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tc.wantErr != "" && fmt.Sprint(err) != tc.wantErr {
+				t.Fatalf("want error %q, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestInteractiveExit(t *testing.T) {
+	inReader, inWriter, err := os.Pipe()
+	qt.Assert(t, qt.IsNil(err))
+	defer inReader.Close()
+	go func() {
+		io.WriteString(inWriter, "exit\n")
+		inWriter.Close()
+	}()
+	w := io.Discard
+	runner, _ := vsh.NewRunner(vsh.WithStdIO(inReader, w, w))
+	if err := runInteractive(runner, nil, inReader, w); err != nil {
+		t.Fatal("expected a nil error")
+	}
+}
+
+// runInteractive runs a session reading from in, and writing to out.
+func runInteractive(r *vsh.Runner, interrupts <-chan os.Signal, in io.Reader, out io.Writer) error {
+	s := &Session{Runner: r, Input: in, Stdout: out, Stderr: out, Interrupts: interrupts}
+	return s.Run(context.Background())
+}
+
+// readString will keep reading from a reader until all bytes from the supplied
+// string are read.
+func readString(r io.Reader, want string) error {
+	p := make([]byte, len(want))
+	_, err := io.ReadFull(r, p)
+	if err != nil {
+		return err
+	}
+	got := string(p)
+	if got != want {
+		return fmt.Errorf("ReadString: read %q, wanted %q", got, want)
+	}
+	return nil
+}
+
+func TestInteractiveInterrupt(t *testing.T) {
+	t.Parallel()
+	inReader, inWriter, err := os.Pipe()
+	qt.Assert(t, qt.IsNil(err))
+	outReader, outWriter, err := os.Pipe()
+	qt.Assert(t, qt.IsNil(err))
+	runner, err := vsh.NewRunner(
+		vsh.WithStdIO(inReader, outWriter, outWriter),
+		vsh.WithCommand("sleep", builtin.Sleep),
+	)
+	qt.Assert(t, qt.IsNil(err))
+	interrupts := make(chan os.Signal, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runInteractive(runner, interrupts, inReader, outWriter)
+		outWriter.Close()
+	}()
+	qt.Assert(t, qt.IsNil(readString(outReader, "$ ")))
+
+	// Interrupts at the prompt are ignored.
+	interrupts <- os.Interrupt
+	io.WriteString(inWriter, "echo started; sleep 1h; echo never\n")
+	qt.Assert(t, qt.IsNil(readString(outReader, "started\n")))
+
+	// An interrupt stops the command being run, and the shell carries on.
+	interrupts <- os.Interrupt
+	qt.Assert(t, qt.IsNil(readString(outReader, "\n[130]$ ")))
+	io.WriteString(inWriter, "echo after\n")
+	qt.Assert(t, qt.IsNil(readString(outReader, "after\n$ ")))
+
+	inWriter.Close()
+	qt.Assert(t, qt.IsNil(<-errc))
+}
+
+// syncBuffer is a [bytes.Buffer] which can be written to while being read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServeConn(t *testing.T) {
+	t.Parallel()
+	inReader, inWriter := io.Pipe()
+	var out syncBuffer
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{inReader, &out}
+	runner, err := vsh.NewRunner(vsh.WithCommand("sleep", builtin.Sleep))
+	qt.Assert(t, qt.IsNil(err))
+	errc := make(chan error, 1)
+	go func() { errc <- ServeConn(context.Background(), runner, conn) }()
+
+	// waitFor waits until the output so far ends with want, and clears it.
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.HasSuffix(out.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("want output ending with %q, got %q", want, out.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		out.mu.Lock()
+		out.buf.Reset()
+		out.mu.Unlock()
+	}
+	waitFor("$ ")
+
+	// What's typed is echoed, and output lines end with CRLF.
+	io.WriteString(inWriter, "echo foo; read x; echo got $x\r")
+	waitFor("echo foo; read x; echo got $x\r\nfoo\r\n")
+	io.WriteString(inWriter, "bar\n")
+	waitFor("got bar\r\n$ ")
+
+	// Ctrl-C stops the command being run.
+	io.WriteString(inWriter, "sleep 1h\r")
+	waitFor("sleep 1h\r\n")
+	io.WriteString(inWriter, "\x03")
+	waitFor("\r\n[130]$ ")
+
+	// At the prompt, it drops the line being typed.
+	io.WriteString(inWriter, "echo never\x03")
+	waitFor("^C\r\n[130]$ ")
+
+	io.WriteString(inWriter, "exit 3\r")
+	qt.Assert(t, qt.ErrorMatches(<-errc, "exit status 3"))
+}
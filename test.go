@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"regexp"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
@@ -47,7 +46,7 @@ func (r *Runner) shTest(ctx context.Context, expr syntax.TestExpr) string {
 func (r *Runner) binTest(ctx context.Context, op syntax.BinTestOperator, x, y string) bool {
 	switch op {
 	case syntax.TsReMatch:
-		re, err := regexp.Compile(y)
+		re, err := r.compileRegexp(y)
 		if err != nil {
 			r.exit = 2
 			return false
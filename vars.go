@@ -3,9 +3,10 @@ package vsh
 import (
 	"fmt"
 	"maps"
-	"os"
+	"math/rand/v2"
 	"slices"
 	"strconv"
+	"time"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
@@ -15,12 +16,23 @@ func newOverlayEnviron(parent expand.Environ, background bool) *overlayEnviron {
 	oenv := &overlayEnviron{}
 	if !background {
 		oenv.parent = parent
-	} else {
-		// We could do better here if the parent is also an overlayEnviron;
-		// measure with profiles or benchmarks before we choose to do so.
-		oenv.values = make(map[string]expand.Variable)
-		maps.Insert(oenv.values, parent.Each)
+		return oenv
+	}
+	// A background subshell runs concurrently with its parent, so it can't
+	// read the parent's overlay as it changes. When the overlay sits right on
+	// top of the environment given to the runner, which is never modified,
+	// share its values instead; whichever side modifies them first copies them.
+	if p, ok := parent.(*overlayEnviron); ok && !p.funcScope {
+		if _, nested := p.parent.(*overlayEnviron); !nested {
+			p.shared = true
+			oenv.parent = p.parent
+			oenv.values = p.values
+			oenv.shared = true
+			return oenv
+		}
 	}
+	oenv.values = make(map[string]expand.Variable)
+	maps.Insert(oenv.values, parent.Each)
 	return oenv
 }
 
@@ -35,6 +47,10 @@ type overlayEnviron struct {
 	// We need to know if the current scope is a function's scope, because
 	// functions can modify global variables. When true, [parent] must not be nil.
 	funcScope bool
+
+	// shared is true when [values] is also used by another overlay, such as
+	// that of a background subshell, so it must be copied before it's modified.
+	shared bool
 }
 
 func (o *overlayEnviron) Get(name string) expand.Variable {
@@ -58,6 +74,10 @@ func (o *overlayEnviron) Set(name string, vr expand.Variable) error {
 		prev = o.parent.Get(name)
 	}
 
+	if o.shared {
+		o.values = maps.Clone(o.values)
+		o.shared = false
+	}
 	if o.values == nil {
 		o.values = make(map[string]expand.Variable)
 	}
@@ -94,6 +114,15 @@ func (o *overlayEnviron) Each(f func(name string, vr expand.Variable) bool) {
 	}
 }
 
+// Like the PIDs of background shells, the PIDs of the shell itself are fake,
+// so that scripts don't see nor signal processes on the host. The shell is
+// "g0", as background shells count from "g1", and it has no parent shell.
+// Subshells share both, like in bash.
+const (
+	shellPID  = "g0"
+	shellPPID = "0"
+)
+
 func (r *Runner) lookupVar(name string) expand.Variable {
 	if name == "" {
 		panic("variable name must not be empty")
@@ -116,17 +145,39 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 		}
 	case "?":
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.lastExit)
+	case "_":
+		vr.Kind, vr.Str = expand.String, r.lastArg
 	case "$":
-		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getpid())
+		vr.Kind, vr.Str = expand.String, shellPID
 	case "PPID":
-		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getppid())
+		vr.Kind, vr.Str = expand.String, shellPPID
+	case "RANDOM":
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.rand.IntN(32768))
+	case "SECONDS":
+		secs := int(r.getClock().Now().Sub(r.secondsStart) / time.Second)
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(secs)
+	case "LINENO":
+		vr.Kind, vr.Str = expand.String, strconv.FormatUint(uint64(r.lineNo), 10)
 	case "DIRSTACK":
 		vr.Kind, vr.List = expand.Indexed, r.dirStack
+	case "FUNCNAME":
+		// Like in Bash, innermost first, with "main" for the script itself.
+		// It is unset outside of functions.
+		if len(r.callStack) > 0 {
+			list := make([]string, 0, len(r.callStack)+1)
+			for _, frame := range slices.Backward(r.callStack) {
+				list = append(list, frame.name)
+			}
+			vr.Kind, vr.List = expand.Indexed, append(list, "main")
+		}
 	case "0":
 		vr.Kind = expand.String
-		if r.filename != "" {
+		switch {
+		case r.filename != "":
 			vr.Str = r.filename
-		} else {
+		case r.argv0 != "":
+			vr.Str = r.argv0
+		default:
 			vr.Str = "sh"
 		}
 	case "1", "2", "3", "4", "5", "6", "7", "8", "9":
@@ -165,6 +216,20 @@ func (r *Runner) setVarString(name, value string) {
 }
 
 func (r *Runner) setVar(name string, vr expand.Variable) {
+	// Like in bash, assigning to these variables with computed values
+	// changes how they are computed, rather than storing the value.
+	switch name {
+	case "RANDOM":
+		seed, _ := strconv.ParseInt(vr.String(), 10, 64)
+		r.rand = newLockedRand(rand.NewPCG(uint64(seed), 0))
+		return
+	case "SECONDS":
+		secs, _ := strconv.Atoi(vr.String())
+		r.secondsStart = r.getClock().Now().Add(-time.Duration(secs) * time.Second)
+		return
+	case "LINENO":
+		return
+	}
 	if r.opts[optAllExport] {
 		vr.Exported = true
 	}
@@ -241,6 +306,7 @@ func (r *Runner) setVarWithIndex(prev expand.Variable, name string, index syntax
 }
 
 func (r *Runner) setFunc(name string, body *syntax.Stmt) {
+	r.ownMaps()
 	if r.Funcs == nil {
 		r.Funcs = make(map[string]*syntax.Stmt, 4)
 	}